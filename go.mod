@@ -1,3 +1,10 @@
 module github.com/sparques/minprox
 
-go 1.23.0
+go 1.24.0
+
+require golang.org/x/crypto v0.48.0
+
+require (
+	golang.org/x/net v0.49.0 // indirect
+	golang.org/x/text v0.34.0 // indirect
+)
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// abControl names the variant served by the usual backend.
+const abControl = "control"
+
+// abSplit sends a fixed share of reverse-proxied traffic to a second
+// backend. Clients are assigned by hashing their IP or a cookie, so each one
+// keeps seeing the same variant.
+type abSplit struct {
+	name    string
+	backend *url.URL
+	share   uint32 // in hundredths of a percent
+	cookie  string // hash this cookie instead of the client IP
+	header  string // response header naming the variant
+}
+
+// parseABSplit parses -ab-split "name=10%" for the -ab-backend URL. key is
+// "ip" or "cookie:NAME".
+func parseABSplit(split string, backend *url.URL, key, header string) (*abSplit, error) {
+	name, pct, ok := strings.Cut(split, "=")
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(pct, "%"), 64)
+	if !ok || name == "" || err != nil || percent < 0 || percent > 100 {
+		return nil, fmt.Errorf("-ab-split %q is not name=percent%%", split)
+	}
+	ab := &abSplit{name: name, backend: backend, share: uint32(percent * 100), header: header}
+	switch {
+	case key == "ip":
+	case strings.HasPrefix(key, "cookie:") && len(key) > len("cookie:"):
+		ab.cookie = strings.TrimPrefix(key, "cookie:")
+	default:
+		return nil, fmt.Errorf("-ab-key %q is not ip or cookie:NAME", key)
+	}
+	return ab, nil
+}
+
+// choose returns the variant for req and its backend, or nil to keep the
+// usual one. Requests without the cookie fall back to the client IP.
+func (ab *abSplit) choose(req *http.Request) (string, *url.URL) {
+	key, _ := remoteHost(req.RemoteAddr)
+	if ab.cookie != "" {
+		if c, err := req.Cookie(ab.cookie); err == nil {
+			key = c.Value
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	if h.Sum32()%10000 < ab.share {
+		return ab.name, ab.backend
+	}
+	return abControl, nil
+}
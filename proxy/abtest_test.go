@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestABSplit(t *testing.T) {
+	control, v2 := echoBackend(t, "control"), echoBackend(t, "v2")
+	p := newTestProxy(t, "-backend", control.URL, "-ab-backend", v2.URL, "-ab-split", "v2=10%")
+
+	// abRequest sends a request from client and returns the variant that
+	// answered it, checking the response header agrees.
+	abRequest := func(client string) string {
+		req := httptest.NewRequest("GET", "http://front.test/", nil)
+		req.RemoteAddr = client + ":4000"
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		served, _, _ := strings.Cut(rec.Body.String(), " ")
+		if got := rec.Header().Get("X-Backend-Variant"); got != served {
+			t.Errorf("%s: X-Backend-Variant %q, but %s answered", client, got, served)
+		}
+		return served
+	}
+	const clients = 2000
+	var inV2 int
+	for i := range clients {
+		client := fmt.Sprintf("10.0.%d.%d", i/250, i%250+1)
+		first := abRequest(client)
+		if first == "v2" {
+			inV2++
+		}
+		if again := abRequest(client); again != first {
+			t.Errorf("client %s served by %s, then %s", client, first, again)
+		}
+	}
+	if inV2 < clients*6/100 || inV2 > clients*14/100 {
+		t.Errorf("%d of %d clients got v2, want about 10%%", inV2, clients)
+	}
+}
+
+func TestABSplitByCookie(t *testing.T) {
+	control, v2 := echoBackend(t, "control"), echoBackend(t, "v2")
+	p := newTestProxy(t, "-backend", control.URL, "-ab-backend", v2.URL, "-ab-split", "v2=50%", "-ab-key", "cookie:uid", "-ab-header", "")
+
+	// The same cookie gets the same variant whatever address it comes from.
+	seen := map[string]bool{}
+	for i := range 20 {
+		var first string
+		for j := range 5 {
+			req := httptest.NewRequest("GET", "http://front.test/", nil)
+			req.RemoteAddr = fmt.Sprintf("192.0.2.%d:4000", j+1)
+			req.Header.Set("Cookie", fmt.Sprintf("uid=user%d", i))
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, req)
+			served, _, _ := strings.Cut(rec.Body.String(), " ")
+			if j == 0 {
+				first = served
+				seen[served] = true
+			} else if served != first {
+				t.Errorf("uid=user%d served by %s, then %s", i, first, served)
+			}
+			if rec.Header().Get("X-Backend-Variant") != "" {
+				t.Error("variant header set with -ab-header empty")
+			}
+		}
+	}
+	if !seen["control"] || !seen["v2"] {
+		t.Errorf("20 users at 50%% all got one variant: %v", seen)
+	}
+}
+
+func TestParseABSplit(t *testing.T) {
+	for _, tt := range []struct {
+		split, key string
+		share      uint32
+		cookie     string
+		ok         bool
+	}{
+		{"v2=10%", "ip", 1000, "", true},
+		{"v2=0.5", "cookie:uid", 50, "uid", true},
+		{"v2=100%", "ip", 10000, "", true},
+		{"v2=101%", "ip", 0, "", false},
+		{"=10%", "ip", 0, "", false},
+		{"v2", "ip", 0, "", false},
+		{"v2=ten", "ip", 0, "", false},
+		{"v2=10%", "cookie:", 0, "", false},
+		{"v2=10%", "header:X", 0, "", false},
+	} {
+		ab, err := parseABSplit(tt.split, nil, tt.key, "X-Backend-Variant")
+		if (err == nil) != tt.ok {
+			t.Errorf("parseABSplit(%q, %q): err = %v, want ok %v", tt.split, tt.key, err, tt.ok)
+			continue
+		}
+		if tt.ok && (ab.share != tt.share || ab.cookie != tt.cookie) {
+			t.Errorf("parseABSplit(%q, %q) = share %d cookie %q, want %d %q", tt.split, tt.key, ab.share, ab.cookie, tt.share, tt.cookie)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Formats of -access-log-format.
+const (
+	accessLogCommon   = "common"
+	accessLogCombined = "combined"
+	accessLogJSON     = "json"
+)
+
+// accessLog writes one line per completed request to -access-log, apart
+// from the diagnostic log, in a format log analyzers read. The file is
+// rotated once it reaches maxSize, keeping backups old files as path.1,
+// path.2 and so on, and reopened on SIGHUP for external rotation.
+type accessLog struct {
+	path    string
+	format  string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	w    io.Writer
+	f    *os.File
+	size int64
+}
+
+// accessEntry is what the access log records of one request. The byte
+// counts are updated by tunnels as they relay.
+type accessEntry struct {
+	start     time.Time
+	remote    string
+	user      string
+	method    string
+	target    string
+	proto     string
+	referer   string
+	userAgent string
+	status    int
+	dest      string
+
+	up, down atomic.Int64
+}
+
+// accessEntryKey is the context key of a request's accessEntry.
+type accessEntryKey struct{}
+
+// newAccessLog opens path, or standard output for "-", for the access log.
+func newAccessLog(path, format string, maxSize int64, backups int) (*accessLog, error) {
+	switch format {
+	case accessLogCommon, accessLogCombined, accessLogJSON:
+	default:
+		return nil, fmt.Errorf("-access-log-format %q is not common, combined or json", format)
+	}
+	l := &accessLog{path: path, format: format, maxSize: maxSize, backups: backups}
+	if path == "-" {
+		l.w = os.Stdout
+		return l, nil
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the log file for appending. l.mu must be held, or l not yet
+// shared.
+func (l *accessLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.w, l.size = f, f, fi.Size()
+	return nil
+}
+
+// reopen closes the log file and opens path afresh, so a file moved away
+// by logrotate is let go.
+func (l *accessLog) reopen() {
+	if l == nil || l.path == "-" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
+	}
+	if err := l.open(); err != nil {
+		slog.Error("reopening -access-log", "file", l.path, "error", err)
+		l.f, l.w = nil, io.Discard
+	}
+}
+
+// retune takes the rotation settings of fresh, built by a reload for the
+// same file, and closes it, so l stays the file's only writer.
+func (l *accessLog) retune(fresh *accessLog) {
+	fresh.close()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxSize, l.backups = fresh.maxSize, fresh.backups
+}
+
+// close closes the log file, for a log that is not written any more.
+func (l *accessLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
+		l.f, l.w = nil, io.Discard
+	}
+}
+
+// rotate shifts the old files up by one, dropping the oldest, and starts
+// a new file. l.mu must be held.
+func (l *accessLog) rotate() error {
+	l.f.Close()
+	if l.backups > 0 {
+		for i := l.backups - 1; i > 0; i-- {
+			os.Rename(l.path+"."+strconv.Itoa(i), l.path+"."+strconv.Itoa(i+1))
+		}
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Truncate(l.path, 0); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// begin starts the entry for req, recording it as it arrived, and returns
+// req carrying it.
+func (l *accessLog) begin(req *http.Request) (*accessEntry, *http.Request) {
+	e := &accessEntry{
+		start:     time.Now(),
+		remote:    req.RemoteAddr,
+		method:    req.Method,
+		target:    req.RequestURI,
+		proto:     req.Proto,
+		referer:   req.Referer(),
+		userAgent: req.UserAgent(),
+	}
+	if host, err := remoteHost(req.RemoteAddr); err == nil {
+		e.remote = host
+	}
+	if u, ok := interceptedUser(req); ok || e.target == "" {
+		// Requests inside intercepted tunnels were only given a path.
+		e.user = u
+		e.target = req.URL.String()
+	}
+	return e, req.WithContext(context.WithValue(req.Context(), accessEntryKey{}, e))
+}
+
+// accessEntryFrom returns req's access log entry, or nil if it is not
+// being logged.
+func accessEntryFrom(req *http.Request) *accessEntry {
+	e, _ := req.Context().Value(accessEntryKey{}).(*accessEntry)
+	return e
+}
+
+// setUser records who the client authenticated as.
+func (e *accessEntry) setUser(user string) {
+	if e != nil && user != "" {
+		e.user = user
+	}
+}
+
+// setStatus records the status of a response the ResponseWriter did not
+// see, such as a hijacked CONNECT's.
+func (e *accessEntry) setStatus(status int) {
+	if e != nil {
+		e.status = status
+	}
+}
+
+// write appends e to the log, rotating it first if it is full.
+func (l *accessLog) write(e *accessEntry) {
+	line := l.line(e)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil && l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			slog.Error("rotating -access-log", "file", l.path, "error", err)
+			if err := l.open(); err != nil {
+				l.f, l.w = nil, io.Discard
+			}
+		}
+	}
+	n, err := l.w.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		slog.Error("writing -access-log", "file", l.path, "error", err)
+	}
+}
+
+// line renders e as one line in the log's format. The common and
+// combined formats are the Apache ones; JSON adds the request body size,
+// duration and destination.
+func (l *accessLog) line(e *accessEntry) []byte {
+	if l.format == accessLogJSON {
+		line, _ := json.Marshal(struct {
+			Time       string  `json:"time"`
+			Remote     string  `json:"remote"`
+			User       string  `json:"user,omitempty"`
+			Method     string  `json:"method"`
+			URL        string  `json:"url"`
+			Proto      string  `json:"proto"`
+			Status     int     `json:"status"`
+			BytesIn    int64   `json:"bytes_in"`
+			BytesOut   int64   `json:"bytes_out"`
+			DurationMS float64 `json:"duration_ms"`
+			Dest       string  `json:"destination,omitempty"`
+			Referer    string  `json:"referer,omitempty"`
+			UserAgent  string  `json:"user_agent,omitempty"`
+		}{
+			Time:       e.start.Format(time.RFC3339Nano),
+			Remote:     e.remote,
+			User:       e.user,
+			Method:     e.method,
+			URL:        e.target,
+			Proto:      e.proto,
+			Status:     e.status,
+			BytesIn:    e.up.Load(),
+			BytesOut:   e.down.Load(),
+			DurationMS: float64(time.Since(e.start).Microseconds()) / 1000,
+			Dest:       e.dest,
+			Referer:    e.referer,
+			UserAgent:  e.userAgent,
+		})
+		return append(line, '\n')
+	}
+
+	var b bytes.Buffer
+	user := e.user
+	if user == "" {
+		user = "-"
+	}
+	size := "-"
+	if n := e.down.Load(); n > 0 {
+		size = strconv.FormatInt(n, 10)
+	}
+	fmt.Fprintf(&b, "%s - %s [%s] %s %d %s", e.remote, clfEscape(user), e.start.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.method+" "+e.target+" "+e.proto), e.status, size)
+	if l.format == accessLogCombined {
+		fmt.Fprintf(&b, " %s %s", clfQuote(e.referer), clfQuote(e.userAgent))
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// clfQuote quotes a header for the combined format, "-" standing for an
+// absent one.
+func clfQuote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+// clfEscape keeps a user name from breaking the line's fields apart.
+func clfEscape(s string) string {
+	q := strconv.Quote(s)
+	return strings.ReplaceAll(q[1:len(q)-1], " ", `\x20`)
+}
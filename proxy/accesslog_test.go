@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readLog returns the contents of path, failing the test if it can't.
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(wr, "hello")
+	})
+	for _, tt := range []struct {
+		format string
+		want   string
+	}{
+		{"common", `^192\.0\.2\.1 - - \[\d\d/\w{3}/\d{4}:\d\d:\d\d:\d\d [-+]\d{4}\] "GET http://front\.test/x\?q=1 HTTP/1\.1" 200 5\n$`},
+		{"combined", `^192\.0\.2\.1 - - \[[^]]+\] "GET http://front\.test/x\?q=1 HTTP/1\.1" 200 5 "http://ref\.test/" "agent/1\.0"\n$`},
+	} {
+		path := filepath.Join(t.TempDir(), "access.log")
+		p := newTestProxy(t, "-backend", b.URL, "-access-log", path, "-access-log-format", tt.format)
+		serve(p, "GET", "http://front.test/x?q=1", "Referer: http://ref.test/", "User-Agent: agent/1.0")
+		if got := readLog(t, path); !regexp.MustCompile(tt.want).MatchString(got) {
+			t.Errorf("%s line %q doesn't match %s", tt.format, got, tt.want)
+		}
+	}
+
+	if _, err := New(WithFlags("-access-log", filepath.Join(t.TempDir(), "log"), "-access-log-format", "apache")); err == nil {
+		t.Error("unknown -access-log-format accepted")
+	}
+}
+
+// accessJSON is the part of a JSON access log line the tests look at.
+type accessJSON struct {
+	Remote   string `json:"remote"`
+	User     string `json:"user"`
+	Method   string `json:"method"`
+	URL      string `json:"url"`
+	Status   int    `json:"status"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+	Dest     string `json:"destination"`
+}
+
+// jsonLines parses each line of a JSON access log.
+func jsonLines(t *testing.T, log string) []accessJSON {
+	t.Helper()
+	var entries []accessJSON
+	for _, line := range strings.Split(strings.TrimSpace(log), "\n") {
+		var e accessJSON
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(wr, "hello")
+	})
+	path := filepath.Join(t.TempDir(), "access.log")
+	p := newTestProxy(t, "-access-log", path, "-access-log-format", "json", "-auth-file", writeUserFile(t, "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="))
+	serveBody(p, "PUT", b.URL+"/up", strings.NewReader("0123456789"))
+	auth := "Proxy-Authorization: Basic YWxpY2U6c2VjcmV0"
+	serve(p, "GET", b.URL+"/down", auth)
+
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	echo := newEchoServer(t)
+	conn, br, _ := connect(t, srv.Listener.Addr().String(), echo, auth)
+	if !echoes(conn, br, "ping") {
+		t.Fatal("tunnel didn't carry data")
+	}
+	conn.Close()
+	waitFor(t, func() bool { return strings.Count(readLog(t, path), "\n") == 3 })
+
+	entries := jsonLines(t, readLog(t, path))
+	if e := entries[0]; e.Method != "PUT" || e.Status != http.StatusProxyAuthRequired || e.User != "" || e.Remote != "192.0.2.1" {
+		t.Errorf("unauthenticated PUT logged as %+v", e)
+	}
+	if e := entries[1]; e.Method != "GET" || e.URL != b.URL+"/down" || e.Status != http.StatusOK || e.User != "alice" || e.BytesOut != 5 {
+		t.Errorf("GET logged as %+v, want alice's 200 of 5 bytes", e)
+	}
+	if e := entries[2]; e.Method != "CONNECT" || e.Status != http.StatusOK || e.User != "alice" || e.BytesIn != 4 || e.BytesOut != 4 || e.Dest != echo {
+		t.Errorf("tunnel logged as %+v, want alice's 4 bytes each way to %s", e, echo)
+	}
+}
+
+func TestAccessLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := newAccessLog(path, accessLogCommon, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+	e := &accessEntry{start: time.Now(), remote: "192.0.2.1", method: "GET", target: "/" + strings.Repeat("x", 50), proto: "HTTP/1.1", status: 200}
+	lineLen := len(l.line(e))
+	for range 10 {
+		l.write(e)
+	}
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		if got := readLog(t, name); len(got) == 0 || len(got) > 200 || len(got)%lineLen != 0 {
+			t.Errorf("%s holds %d bytes, want whole lines up to 200", name, len(got))
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("more than -access-log-backups files kept")
+	}
+
+	// A file moved away is let go on reopen.
+	os.Rename(path, path+".moved")
+	l.reopen()
+	l.write(e)
+	if got := readLog(t, path); len(got) != lineLen {
+		t.Errorf("reopened log holds %q, want one line", got)
+	}
+}
+
+func TestCLFEscape(t *testing.T) {
+	for in, want := range map[string]string{
+		"alice":      "alice",
+		"a b":        `a\x20b`,
+		`say "hi"`:   `say\x20\"hi\"`,
+		"line\nfeed": `line\nfeed`,
+	} {
+		if got := clfEscape(in); got != want {
+			t.Errorf("clfEscape(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
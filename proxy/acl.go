@@ -0,0 +1,380 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// accessList restricts the destinations clients may reach, for plain
+// requests and CONNECT alike. Deny rules win; if there are allow rules, a
+// destination must also match one of them. A nil *accessList permits
+// everything.
+//
+// CIDR rules match host names by their resolved addresses: any address
+// in a denied range blocks the host, and an allow range only admits it if
+// all of its addresses are covered. The dial resolves the name again, so
+// the address it connects to is checked once more, and DNS changing its
+// answer in between can't get around a CIDR rule.
+type accessList struct {
+	mu          sync.RWMutex
+	allow, deny []aclRule
+	resolver    hostLookup
+	cidrs       bool // whether any rule needs host names resolved
+}
+
+// aclRule is one destination pattern: "*", an exact host, "*.example.com"
+// for the subdomains of example.com, or a CIDR prefix, optionally
+// followed by :PORT or :LOW-HIGH.
+type aclRule struct {
+	text     string
+	host     string
+	wildcard bool
+	prefix   netip.Prefix
+	any      bool
+	lo, hi   int // port range, 0 for any port
+}
+
+func parseACLRule(s string) (aclRule, error) {
+	r := aclRule{text: s}
+	pattern, ports := s, ""
+	if rest, ok := strings.CutPrefix(s, "["); ok {
+		// [IPv6 or IPv6/bits]:port
+		var found bool
+		if pattern, ports, found = strings.Cut(rest, "]"); !found {
+			return r, fmt.Errorf("ACL rule %q: missing ]", s)
+		}
+		if ports != "" {
+			if ports, found = strings.CutPrefix(ports, ":"); !found {
+				return r, fmt.Errorf("ACL rule %q: want [address]:port", s)
+			}
+		}
+	} else if strings.Count(s, ":") == 1 {
+		pattern, ports, _ = strings.Cut(s, ":")
+	}
+
+	if ports != "" {
+		low, high, isRange := strings.Cut(ports, "-")
+		var err error
+		if r.lo, err = strconv.Atoi(low); err == nil {
+			r.hi = r.lo
+			if isRange {
+				r.hi, err = strconv.Atoi(high)
+			}
+		}
+		if err != nil || r.lo < 1 || r.hi > 65535 || r.lo > r.hi {
+			return r, fmt.Errorf("ACL rule %q: bad port %q", s, ports)
+		}
+	}
+
+	switch {
+	case pattern == "*":
+		r.any = true
+	case strings.HasPrefix(pattern, "*."):
+		r.wildcard, r.host = true, normalizeHost(pattern[2:])
+		if r.host == "" || strings.ContainsAny(r.host, "*/ ") {
+			return r, fmt.Errorf("ACL rule %q: want host, *.domain, address or CIDR", s)
+		}
+	case strings.Contains(pattern, "/"):
+		prefix, err := netip.ParsePrefix(pattern)
+		if err != nil {
+			return r, fmt.Errorf("ACL rule %q: %w", s, err)
+		}
+		r.prefix = prefix.Masked()
+	default:
+		if ip, err := netip.ParseAddr(pattern); err == nil {
+			r.prefix = netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen())
+		} else if pattern == "" || strings.ContainsAny(pattern, "*/ ") {
+			return r, fmt.Errorf("ACL rule %q: want host, *.domain, address or CIDR", s)
+		} else {
+			r.host = normalizeHost(pattern)
+		}
+	}
+	return r, nil
+}
+
+// newAccessList builds the list from -acl-file, if given, and the
+// -acl-allow and -acl-deny rules.
+func newAccessList(path string, allow, deny []string, resolver hostLookup) (*accessList, error) {
+	a := &accessList{resolver: resolver}
+	if path != "" {
+		if err := a.load(path); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range allow {
+		if err := a.add("allow", s); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range deny {
+		if err := a.add("deny", s); err != nil {
+			return nil, err
+		}
+	}
+	if a.resolver == nil {
+		a.resolver = net.DefaultResolver
+	}
+	return a, nil
+}
+
+// load reads an ACL file: one "allow RULE" or "deny RULE" per line, with
+// # starting a comment.
+func (a *accessList) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: want allow RULE or deny RULE", path, n)
+		}
+		if err := a.add(strings.ToLower(fields[0]), fields[1]); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+	}
+	return sc.Err()
+}
+
+// add appends rule s to the allow or deny rules.
+func (a *accessList) add(action, s string) error {
+	r, err := parseACLRule(s)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch action {
+	case "allow":
+		a.allow = append(a.allow, r)
+	case "deny":
+		a.deny = append(a.deny, r)
+	default:
+		return fmt.Errorf("ACL action %q is not allow or deny", action)
+	}
+	a.cidrs = a.cidrs || r.prefix.IsValid()
+	return nil
+}
+
+// remove drops the allow or deny rule written as s, reporting whether
+// there was one.
+func (a *accessList) remove(action, s string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rules := &a.allow
+	if action == "deny" {
+		rules = &a.deny
+	} else if action != "allow" {
+		return false
+	}
+	i := slices.IndexFunc(*rules, func(r aclRule) bool { return r.text == s })
+	if i < 0 {
+		return false
+	}
+	*rules = slices.Concat((*rules)[:i], (*rules)[i+1:])
+	a.cidrs = false
+	for _, r := range slices.Concat(a.allow, a.deny) {
+		a.cidrs = a.cidrs || r.prefix.IsValid()
+	}
+	return true
+}
+
+// rules returns the allow and deny rules as written.
+func (a *accessList) rules() (allow, deny []string) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	allow, deny = []string{}, []string{}
+	for _, r := range a.allow {
+		allow = append(allow, r.text)
+	}
+	for _, r := range a.deny {
+		deny = append(deny, r.text)
+	}
+	return allow, deny
+}
+
+// checkACL applies the ACL and then the WithACL hook to target, the
+// host:port req is for.
+func (p *proxy) checkACL(req *http.Request, target string) (rule string, ok bool) {
+	if rule, ok := p.acl.check(req.Context(), target); !ok {
+		return rule, false
+	}
+	if p.aclHook != nil && !p.aclHook(req, target) {
+		return "WithACL", false
+	}
+	return "", true
+}
+
+// permitPort reports whether port is in the rule's range.
+func (r aclRule) permitPort(port int) bool {
+	return r.lo == 0 || (port >= r.lo && port <= r.hi)
+}
+
+// matchHost reports whether the rule covers host by name or, for an
+// address literal, by prefix.
+func (r aclRule) matchHost(host string, ip netip.Addr) bool {
+	switch {
+	case r.any:
+		return true
+	case r.prefix.IsValid():
+		return ip.IsValid() && r.prefix.Contains(ip)
+	case r.wildcard:
+		return strings.HasSuffix(host, "."+r.host)
+	}
+	return host == r.host
+}
+
+// check reports whether addr (host:port) may be reached, and if not, the
+// rule that refused it.
+func (a *accessList) check(ctx context.Context, addr string) (rule string, ok bool) {
+	if a == nil {
+		return "", true
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "invalid target", false
+	}
+	port, _ := strconv.Atoi(portStr)
+	host = normalizeHost(host)
+	// Rules removed at runtime are replaced, not edited in place, so the
+	// lookup below needn't hold the lock.
+	a.mu.RLock()
+	allow, deny, cidrs := a.allow, a.deny, a.cidrs
+	a.mu.RUnlock()
+	var ips []netip.Addr
+	literal, err := netip.ParseAddr(host)
+	if err == nil {
+		ips = []netip.Addr{literal.Unmap()}
+	} else if cidrs {
+		resolved, _ := a.resolver.LookupNetIP(ctx, "ip", host)
+		for _, ip := range resolved {
+			ips = append(ips, ip.Unmap())
+		}
+	}
+	return decideACL(allow, deny, host, port, ips)
+}
+
+// decideACL applies the rules to host, on port, at the addresses ips.
+func decideACL(allow, deny []aclRule, host string, port int, ips []netip.Addr) (rule string, ok bool) {
+	matches := func(r aclRule, ip netip.Addr) bool {
+		return r.permitPort(port) && r.matchHost(host, ip)
+	}
+	for _, r := range deny {
+		if matches(r, netip.Addr{}) {
+			return "deny " + r.text, false
+		}
+		for _, ip := range ips {
+			if matches(r, ip) {
+				return "deny " + r.text, false
+			}
+		}
+	}
+	if len(allow) == 0 {
+		return "", true
+	}
+	for _, r := range allow {
+		if matches(r, netip.Addr{}) {
+			return "", true
+		}
+	}
+	// Otherwise every address must fall in some allowed range.
+	for _, ip := range ips {
+		covered := false
+		for _, r := range allow {
+			if covered = matches(r, ip); covered {
+				break
+			}
+		}
+		if !covered {
+			return "not allowed", false
+		}
+	}
+	if len(ips) == 0 {
+		return "not allowed", false
+	}
+	return "", true
+}
+
+// checkAddr reports whether host, which was let through for port, may
+// be reached at ip, an address it resolved to.
+func (a *accessList) checkAddr(host string, port int, ip netip.Addr) (rule string, ok bool) {
+	if a == nil {
+		return "", true
+	}
+	a.mu.RLock()
+	allow, deny, cidrs := a.allow, a.deny, a.cidrs
+	a.mu.RUnlock()
+	if !cidrs {
+		return "", true
+	}
+	return decideACL(allow, deny, normalizeHost(host), port, []netip.Addr{ip.Unmap()})
+}
+
+// aclDialKey is the context key for the target a request passed the ACL
+// for.
+type aclDialKey struct{}
+
+// pin marks req so that the dial to target, which the ACL let through,
+// checks the address it connects to as well.
+func (a *accessList) pin(req *http.Request, target string) *http.Request {
+	if a == nil {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), aclDialKey{}, target))
+}
+
+// guard returns d, made to refuse connecting to an address of the host
+// in addr that the ACL denies, if ctx is for a request pinned to addr.
+func (a *accessList) guard(ctx context.Context, d *net.Dialer, addr string) *net.Dialer {
+	if target, _ := ctx.Value(aclDialKey{}).(string); a == nil || target != addr {
+		return d
+	}
+	host, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+	guarded := *d
+	guarded.Control = func(network, address string, c syscall.RawConn) error {
+		if ap, err := netip.ParseAddrPort(address); err == nil {
+			if rule, ok := a.checkAddr(host, port, ap.Addr()); !ok {
+				return fmt.Errorf("connecting to %s for %s: refused by ACL (%s)", address, host, rule)
+			}
+		}
+		if d.Control != nil {
+			return d.Control(network, address, c)
+		}
+		return nil
+	}
+	return &guarded
+}
+
+// aclTarget returns the host:port req is trying to reach.
+func (p *proxy) aclTarget(req *http.Request) string {
+	if req.Method == http.MethodConnect {
+		addr, _ := connectTarget(req, p.connectDefaultPort)
+		return addr
+	}
+	if req.URL.Host != "" {
+		return hostPort(req.URL)
+	}
+	u := &url.URL{Scheme: "http", Host: req.Host}
+	if req.TLS != nil {
+		u.Scheme = "https"
+	}
+	return hostPort(u)
+}
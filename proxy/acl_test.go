@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// staticLookup resolves host names from a fixed table.
+type staticLookup map[string][]string
+
+func (s staticLookup) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	for _, a := range s[host] {
+		addrs = append(addrs, netip.MustParseAddr(a))
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no such host")
+	}
+	return addrs, nil
+}
+
+func TestAccessList(t *testing.T) {
+	resolver := staticLookup{
+		"internal.test": {"10.1.1.1"},
+		"mixed.test":    {"10.1.1.1", "192.0.2.1"},
+		"sneaky.test":   {"10.6.6.1"},
+	}
+	a, err := newAccessList("", []string{"*.example.com:443", "10.0.0.0/8", "[2001:db8::/32]:443", "mail.test:587-588"}, []string{"bad.example.com", "10.6.6.0/24", "*:25"}, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		addr, rule string
+		ok         bool
+	}{
+		{"www.example.com:443", "", true},
+		{"WWW.Example.COM.:443", "", true},
+		{"www.example.com:80", "not allowed", false},
+		{"example.com:443", "not allowed", false},
+		{"bad.example.com:443", "deny bad.example.com", false},
+		{"10.1.2.3:80", "", true},
+		{"10.6.6.6:80", "deny 10.6.6.0/24", false},
+		{"10.1.2.3:25", "deny *:25", false},
+		{"internal.test:80", "", true},
+		{"mixed.test:80", "not allowed", false},
+		{"sneaky.test:80", "deny 10.6.6.0/24", false},
+		{"unresolvable.test:80", "not allowed", false},
+		{"[2001:db8::1]:443", "", true},
+		{"[2001:db8::1]:80", "not allowed", false},
+		{"[::ffff:10.1.2.3]:80", "", true},
+		{"mail.test:588", "", true},
+		{"mail.test:589", "not allowed", false},
+		{"no-port", "invalid target", false},
+	} {
+		rule, ok := a.check(context.Background(), tt.addr)
+		if ok != tt.ok || rule != tt.rule {
+			t.Errorf("check(%q) = %q, %v; want %q, %v", tt.addr, rule, ok, tt.rule, tt.ok)
+		}
+	}
+
+	var none *accessList
+	if _, ok := none.check(context.Background(), "anything.test:1"); !ok {
+		t.Error("nil ACL refused a destination")
+	}
+}
+
+func TestParseACLRule(t *testing.T) {
+	for _, bad := range []string{"", "host:0", "host:70000", "host:443-80", "host:x", "*.", "*.*.test", "a*b.test", "10.0.0.0/33", "[2001:db8::1", "[2001:db8::1]443"} {
+		if _, err := parseACLRule(bad); err == nil {
+			t.Errorf("parseACLRule(%q) accepted", bad)
+		}
+	}
+}
+
+func TestACLFile(t *testing.T) {
+	path := writeTempFile(t, "acl", `
+# internal services only
+allow *.corp.test
+Allow 192.0.2.0/24:443 # upper case action
+deny  secret.corp.test
+`)
+	a, err := newAccessList(path, nil, []string{"*:22"}, staticLookup{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allow, deny := a.rules()
+	if strings.Join(allow, " ") != "*.corp.test 192.0.2.0/24:443" || strings.Join(deny, " ") != "secret.corp.test *:22" {
+		t.Errorf("rules = %q, %q", allow, deny)
+	}
+	if !a.remove("deny", "secret.corp.test") || a.remove("deny", "secret.corp.test") || a.remove("block", "*:22") {
+		t.Error("remove doesn't drop exactly the rule named")
+	}
+	if _, ok := a.check(context.Background(), "secret.corp.test:80"); !ok {
+		t.Error("removed deny rule still applies")
+	}
+
+	for content, want := range map[string]string{
+		"allow":              ":1: want allow RULE or deny RULE",
+		"\npermit host.test": ":2: ACL action",
+		"deny host:99999":    ":1: ACL rule",
+	} {
+		if _, err := newAccessList(writeTempFile(t, "acl", content), nil, nil, nil); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("ACL file %q: err = %v, want %s", content, err, want)
+		}
+	}
+}
+
+func TestACLThroughProxy(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	logger, logs := newTestLogger()
+	p, err := New(WithFlags("-acl-allow", "127.0.0.1", "-acl-deny", "*.blocked.test"), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(p, "GET", b.URL+"/"); rec.Code != http.StatusOK || b.hits != 1 {
+		t.Errorf("allowed destination got %d", rec.Code)
+	}
+	for _, url := range []string{"http://ads.blocked.test/", "http://192.0.2.1/"} {
+		if rec := serve(p, "GET", url); rec.Code != http.StatusForbidden {
+			t.Errorf("GET %s got %d, want 403", url, rec.Code)
+		}
+	}
+	if b.hits != 1 {
+		t.Error("denied request reached a backend")
+	}
+	if !strings.Contains(logs.String(), "reason=acl") || !strings.Contains(logs.String(), `rule="deny *.blocked.test"`) {
+		t.Errorf("denial not audited:\n%s", logs)
+	}
+
+	srv := newProxyServer(t, "-acl-deny", "127.0.0.1")
+	if _, _, resp := connect(t, srv.Listener.Addr().String(), newEchoServer(t)); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("denied CONNECT got %s, want 403", resp.Status)
+	}
+}
+
+// newRebindingDNSServer answers the first A query with first and every
+// later one with then, like DNS rebinding a proxy between its ACL check
+// and its dial.
+func newRebindingDNSServer(t *testing.T, first, then netip.Addr) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		answered := false
+		buf := make([]byte, 512)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			msg := dnsAnswer(buf[:n], first)
+			if answered {
+				msg = dnsAnswer(buf[:n], then)
+			}
+			answered = answered || msg[7] == 1
+			pc.WriteTo(msg, from)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestACLChecksDialedAddress(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(b.URL, "http://"))
+	p := newTestProxy(t, "-acl-deny", "127.0.0.0/8", "-resolver", newRebindingDNSServer(t, netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("127.0.0.1")))
+	if rec := serve(p, "GET", "http://rebind.test:"+port+"/"); rec.Code != http.StatusBadGateway || b.hits != 0 {
+		t.Errorf("GET rebound to a denied address got %d with %d backend hits, want 502 and none", rec.Code, b.hits)
+	}
+
+	_, port, _ = net.SplitHostPort(newEchoServer(t))
+	srv := newProxyServer(t, "-acl-deny", "127.0.0.0/8", "-connect-retries", "0", "-resolver", newRebindingDNSServer(t, netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("127.0.0.1")))
+	if _, _, resp := connect(t, srv.Listener.Addr().String(), "rebind.test:"+port); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("CONNECT rebound to a denied address got %s, want 502", resp.Status)
+	}
+}
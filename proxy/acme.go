@@ -0,0 +1,29 @@
+//go:build acme
+
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeTLSConfig returns a TLS config that obtains and renews certificates
+// for domains automatically. Certificates and the account key are kept in
+// cacheDir. The handler returned answers HTTP-01 challenges, for serving on
+// -acme-http-addr; TLS-ALPN-01 is always handled on the TLS listener itself.
+func acmeTLSConfig(domains []string, cacheDir, email, directory string) (*tls.Config, http.Handler, error) {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}
+	if directory != "" {
+		m.Client = &acme.Client{DirectoryURL: directory}
+	}
+
+	return m.TLSConfig(), m.HTTPHandler(nil), nil
+}
@@ -0,0 +1,15 @@
+//go:build !acme
+
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestACMENotCompiledIn(t *testing.T) {
+	_, err := New(WithFlags("-acme-domains", "a.test", "-acme-cache-dir", t.TempDir()))
+	if err == nil || !strings.Contains(err.Error(), "-tags acme") {
+		t.Errorf("-acme-domains without -tags acme: err = %v, want a hint to rebuild", err)
+	}
+}
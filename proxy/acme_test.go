@@ -0,0 +1,44 @@
+//go:build acme
+
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestACMEListener(t *testing.T) {
+	l, err := newListener("minprox", []string{"-acme-domains", "a.test,B.test", "-acme-cache-dir", t.TempDir(), "-acme-http-addr", "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := l.server.TLSConfig
+	if cfg == nil || cfg.GetCertificate == nil || !slices.Contains(cfg.NextProtos, "acme-tls/1") {
+		t.Fatalf("listener TLS config doesn't get certificates from ACME: %+v", cfg)
+	}
+	// The host policy refuses other names before anything is asked of the
+	// ACME server.
+	if _, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "c.test"}); err == nil {
+		t.Error("got a certificate for a host outside -acme-domains")
+	}
+
+	if len(l.aux) != 1 {
+		t.Fatalf("%d helper servers, want the HTTP-01 one", len(l.aux))
+	}
+	challenge := l.aux[0].Handler
+	for _, tt := range []struct {
+		url    string
+		status int
+	}{
+		{"http://a.test/.well-known/acme-challenge/unknown", http.StatusNotFound},
+		{"http://b.test:80/page", http.StatusFound},
+		{"http://c.test/.well-known/acme-challenge/unknown", http.StatusNotFound},
+		{"http://c.test/page", http.StatusNotFound},
+	} {
+		if rec := serve(challenge, "GET", tt.url); rec.Code != tt.status {
+			t.Errorf("GET %s on -acme-http-addr got %d, want %d", tt.url, rec.Code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// adapter is a simplified ICAP-style content adaptation service. Bodies are
+// POSTed to it and it answers with a verdict:
+//
+//	204 No Content  approve the body unchanged
+//	200 OK          replace the body with the response body
+//	403 Forbidden   block the message
+//
+// Anything else is treated as an adapter failure.
+type adapter struct {
+	url    string
+	client *http.Client
+}
+
+func newAdapter(url string, timeout time.Duration) *adapter {
+	return &adapter{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+var errAdaptBlocked = errors.New("content blocked by adapter")
+
+// adapt passes body through the adapter and returns the body to forward
+// in its place, and whether it differs from the original. The original is
+// spooled to a temporary file, not memory, so large bodies stay cheap; the
+// returned body removes that file when closed. direction is "request" or
+// "response"; target is the URL the message is for.
+func (a *adapter) adapt(ctx context.Context, direction, target string, header http.Header, body io.ReadCloser) (io.ReadCloser, bool, error) {
+	spool, err := spoolBody(body)
+	if err != nil {
+		return nil, false, err
+	}
+
+	areq, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, io.NopCloser(spool.File))
+	if err != nil {
+		spool.Close()
+		return nil, false, err
+	}
+	areq.ContentLength = spool.size
+	areq.Header.Set("Content-Type", header.Get("Content-Type"))
+	areq.Header.Set("X-Adapt-Direction", direction)
+	areq.Header.Set("X-Adapt-URL", target)
+
+	resp, err := a.client.Do(areq)
+	if err != nil {
+		spool.Close()
+		return nil, false, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		resp.Body.Close()
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			spool.Close()
+			return nil, false, err
+		}
+		return spool, false, nil
+	case http.StatusOK:
+		spool.Close()
+		return resp.Body, true, nil
+	case http.StatusForbidden:
+		resp.Body.Close()
+		spool.Close()
+		return nil, false, errAdaptBlocked
+	}
+	resp.Body.Close()
+	spool.Close()
+	return nil, false, fmt.Errorf("adapter answered %s", resp.Status)
+}
+
+// spooledBody is a body saved to a temporary file, which is removed on
+// Close.
+type spooledBody struct {
+	*os.File
+	size int64
+}
+
+func spoolBody(body io.ReadCloser) (*spooledBody, error) {
+	defer body.Close()
+	f, err := os.CreateTemp("", "minprox-adapt-*")
+	if err != nil {
+		return nil, err
+	}
+	s := &spooledBody{File: f}
+	if s.size, err = io.Copy(f, body); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *spooledBody) Close() error {
+	err := s.File.Close()
+	os.Remove(s.Name())
+	return err
+}
+
+// adaptFailed answers a request whose content the adapter blocked (403)
+// or couldn't vet (502).
+func (p *proxy) adaptFailed(wr http.ResponseWriter, req *http.Request, log *slog.Logger, err error) {
+	if errors.Is(err, errAdaptBlocked) {
+		logBlocked(log, req, blockReasonAdapter, p.adapter.url)
+		http.Error(wr, "Forbidden", http.StatusForbidden)
+		return
+	}
+	log.Error("content adaptation failed", "error", err)
+	http.Error(wr, "Content adaptation failed", http.StatusBadGateway)
+}
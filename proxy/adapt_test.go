@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// verdictAdapter is a mock adaptation service blocking bodies containing
+// "virus", replacing those containing "secret" and failing on "crash".
+func verdictAdapter(t *testing.T) *countingBackend {
+	return newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		switch {
+		case strings.Contains(string(body), "virus"):
+			wr.WriteHeader(http.StatusForbidden)
+		case strings.Contains(string(body), "secret"):
+			io.WriteString(wr, strings.ReplaceAll(string(body), "secret", "[redacted]"))
+		case strings.Contains(string(body), "crash"):
+			wr.WriteHeader(http.StatusInternalServerError)
+		default:
+			wr.WriteHeader(http.StatusNoContent)
+		}
+	})
+}
+
+func TestAdaptRequestBodies(t *testing.T) {
+	a := verdictAdapter(t)
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		io.Copy(wr, req.Body)
+	})
+	p := newTestProxy(t, "-backend", b.URL, "-adapt-url", a.URL)
+	for _, tt := range []struct {
+		body   string
+		status int
+		echoed string
+	}{
+		{"hello", http.StatusOK, "hello"},
+		{"a secret plan", http.StatusOK, "a [redacted] plan"},
+		{"eicar virus", http.StatusForbidden, ""},
+		{"crash", http.StatusBadGateway, ""},
+	} {
+		hits := b.hits
+		rec := serveBody(p, "POST", "http://front.test/upload", strings.NewReader(tt.body))
+		if rec.Code != tt.status {
+			t.Errorf("POST %q got %d, want %d", tt.body, rec.Code, tt.status)
+		}
+		if tt.echoed != "" && rec.Body.String() != tt.echoed {
+			t.Errorf("POST %q: backend got %q, want %q", tt.body, rec.Body, tt.echoed)
+		}
+		if tt.status != http.StatusOK && b.hits != hits {
+			t.Errorf("POST %q reached the backend", tt.body)
+		}
+	}
+	if got := a.last.Header.Get("X-Adapt-URL"); !strings.HasSuffix(got, "/upload") {
+		t.Errorf("adapter told the target is %q", got)
+	}
+}
+
+func TestAdaptResponseBodies(t *testing.T) {
+	a := verdictAdapter(t)
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		io.WriteString(wr, strings.TrimPrefix(req.URL.Path, "/"))
+	})
+	p := newTestProxy(t, "-backend", b.URL, "-adapt-url", a.URL)
+	for _, tt := range []struct {
+		path, want string
+		status     int
+	}{
+		{"/clean", "clean", http.StatusOK},
+		{"/secret", "[redacted]", http.StatusOK},
+		{"/virus", "", http.StatusForbidden},
+	} {
+		rec := serve(p, "GET", "http://front.test"+tt.path)
+		if rec.Code != tt.status || tt.want != "" && rec.Body.String() != tt.want {
+			t.Errorf("GET %s got %d %q, want %d %q", tt.path, rec.Code, rec.Body, tt.status, tt.want)
+		}
+	}
+	if got := a.last.Header.Get("X-Adapt-Direction"); got != "response" {
+		t.Errorf("X-Adapt-Direction = %q, want response", got)
+	}
+}
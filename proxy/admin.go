@@ -0,0 +1,362 @@
+package proxy
+
+import (
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// adminAPI serves -admin-addr: JSON endpoints for looking into and
+// adjusting a running listener without restarting it.
+//
+//	GET    /connections   client connections and requests in flight
+//	GET    /tunnels       open tunnels
+//	GET    /config        the listener's options, credentials redacted
+//	GET    /log-level     the level logged
+//	PUT    /log-level     set it, from ?level= or the body: debug, info...
+//	POST   /cache/flush   empty the response caches
+//	GET    /acl           the ACL rules
+//	POST   /acl           add ?action=allow|deny&rule=RULE
+//	DELETE /acl           remove one, chosen the same way
+//	GET    /capture       whether -capture-file is capturing
+//	PUT    /capture       switch it, from ?enabled= or the body: true, false
+//
+// Only loopback clients are meant to reach it, and browsers are kept out:
+// requests must name a loopback Host, so DNS rebinding can't read it, and
+// must not carry an Origin. Those that change something must also send an
+// X-Minprox-Admin header, which a cross-site form can't.
+//
+// ACL changes and the capture switch last until the next reload or restart. It always serves the
+// listener's current proxy, so it keeps working across reloads.
+//
+// -config listeners sharing an -admin-addr share the API. The connections
+// listed are of them all, and ?listener=ADDR picks whose proxy the other
+// endpoints are about, the first listener's by default.
+type adminAPI struct {
+	servers []*http.Server
+	conns   *connTracker
+}
+
+// newAdminAPI returns the API for the proxy server serves, tracking the
+// server's connections.
+func newAdminAPI(server *http.Server) *adminAPI {
+	a := &adminAPI{conns: &connTracker{conns: make(map[net.Conn]*connInfo)}}
+	a.add(server)
+	return a
+}
+
+// add puts the proxy another server serves under the API too. Any
+// ConnState hook the server already has still runs, after the tracker's.
+func (a *adminAPI) add(server *http.Server) {
+	a.servers = append(a.servers, server)
+	if prev := server.ConnState; prev != nil {
+		server.ConnState = func(conn net.Conn, state http.ConnState) {
+			a.conns.track(conn, state)
+			prev(conn, state)
+		}
+		return
+	}
+	server.ConnState = a.conns.track
+}
+
+// loopbackAddr reports whether addr only takes local clients: a Unix
+// socket or a loopback host.
+func loopbackAddr(addr string) bool {
+	if strings.HasPrefix(addr, "unix:") {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	return err == nil && loopbackHost(host)
+}
+
+func (a *adminAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /connections", a.connections)
+	mux.HandleFunc("GET /tunnels", a.tunnels)
+	mux.HandleFunc("GET /config", a.config)
+	mux.HandleFunc("GET /log-level", a.logLevel)
+	mux.HandleFunc("PUT /log-level", a.setLogLevel)
+	mux.HandleFunc("POST /cache/flush", a.flushCache)
+	mux.HandleFunc("GET /acl", a.acl)
+	mux.HandleFunc("POST /acl", a.editACL)
+	mux.HandleFunc("DELETE /acl", a.editACL)
+	mux.HandleFunc("GET /capture", a.capture)
+	mux.HandleFunc("PUT /capture", a.setCapture)
+	return adminGuard(a.requireListener(mux))
+}
+
+// requireListener refuses requests naming a listener the API doesn't have.
+func (a *adminAPI) requireListener(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if a.server(req) == nil {
+			adminError(wr, http.StatusNotFound, "no listener "+strconv.Quote(req.URL.Query().Get("listener")))
+			return
+		}
+		h.ServeHTTP(wr, req)
+	})
+}
+
+// adminHeader must be sent with requests changing something.
+const adminHeader = "X-Minprox-Admin"
+
+// adminGuard refuses requests a web page could have made.
+func adminGuard(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		switch {
+		case !loopbackHost(req.Host):
+			adminError(wr, http.StatusMisdirectedRequest, "Host must be localhost or a loopback address")
+		case req.Header.Get("Origin") != "":
+			adminError(wr, http.StatusForbidden, "cross-origin requests are refused")
+		case req.Method != http.MethodGet && req.Method != http.MethodHead && req.Header.Get(adminHeader) == "":
+			adminError(wr, http.StatusForbidden, "changes need an "+adminHeader+" header")
+		default:
+			h.ServeHTTP(wr, req)
+		}
+	})
+}
+
+// loopbackHost reports whether host, a Host header, names localhost or a
+// loopback address.
+func loopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if normalizeHost(host) == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+// server returns the server req is about: the one listening on its
+// ?listener= address, or the first. It is nil if none listens there.
+func (a *adminAPI) server(req *http.Request) *http.Server {
+	addr := req.URL.Query().Get("listener")
+	if addr == "" {
+		return a.servers[0]
+	}
+	for _, s := range a.servers {
+		if s.Addr == addr {
+			return s
+		}
+	}
+	return nil
+}
+
+// proxy returns the proxy the server req is about currently serves.
+func (a *adminAPI) proxy(req *http.Request) *proxy {
+	s := a.server(req)
+	if h, ok := s.Handler.(*swappableHandler); ok {
+		return h.p.Load()
+	}
+	return s.Handler.(*proxy)
+}
+
+// writeAdminJSON answers with v as indented JSON.
+func writeAdminJSON(wr http.ResponseWriter, status int, v any) {
+	wr.Header().Set("Content-Type", "application/json")
+	wr.Header().Set("Cache-Control", "no-store")
+	wr.WriteHeader(status)
+	enc := json.NewEncoder(wr)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// adminError answers with a JSON error.
+func adminError(wr http.ResponseWriter, status int, msg string) {
+	writeAdminJSON(wr, status, map[string]string{"error": msg})
+}
+
+func (a *adminAPI) connections(wr http.ResponseWriter, req *http.Request) {
+	var active int64
+	if p := a.proxy(req); p.stats != nil {
+		active = p.stats.active.Load()
+	}
+	writeAdminJSON(wr, http.StatusOK, struct {
+		ActiveRequests int64      `json:"active_requests"`
+		Connections    []connInfo `json:"connections"`
+	}{active, a.conns.list()})
+}
+
+func (a *adminAPI) tunnels(wr http.ResponseWriter, req *http.Request) {
+	var tunnels []tunnelInfo
+	if p := a.proxy(req); p.tunnels != nil {
+		tunnels = p.tunnels.list()
+	}
+	writeAdminJSON(wr, http.StatusOK, tunnels)
+}
+
+func (a *adminAPI) config(wr http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(wr, http.StatusOK, a.proxy(req).settings)
+}
+
+func (a *adminAPI) logLevel(wr http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(wr, http.StatusOK, map[string]string{"level": logLevel.Level().String()})
+}
+
+func (a *adminAPI) setLogLevel(wr http.ResponseWriter, req *http.Request) {
+	text := req.URL.Query().Get("level")
+	if text == "" {
+		var body struct {
+			Level string `json:"level"`
+		}
+		json.NewDecoder(http.MaxBytesReader(wr, req.Body, 1024)).Decode(&body)
+		text = body.Level
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(text)); err != nil {
+		adminError(wr, http.StatusBadRequest, "want level debug, info, warn or error")
+		return
+	}
+	if old := logLevel.Level(); old != level {
+		logLevel.Set(level)
+		slog.Info("Changed log level", "from", old, "to", level)
+	}
+	a.logLevel(wr, req)
+}
+
+func (a *adminAPI) flushCache(wr http.ResponseWriter, req *http.Request) {
+	p := a.proxy(req)
+	flushed := map[string]int{"cache": p.cache.flush(), "stale": p.stale.flush()}
+	slog.Info("Flushed caches", "entries", flushed["cache"], "stale_entries", flushed["stale"])
+	writeAdminJSON(wr, http.StatusOK, flushed)
+}
+
+func (a *adminAPI) acl(wr http.ResponseWriter, req *http.Request) {
+	allow, deny := a.proxy(req).acl.rules()
+	writeAdminJSON(wr, http.StatusOK, map[string][]string{"allow": allow, "deny": deny})
+}
+
+func (a *adminAPI) editACL(wr http.ResponseWriter, req *http.Request) {
+	acl := a.proxy(req).acl
+	action, rule := req.FormValue("action"), req.FormValue("rule")
+	if req.Method == http.MethodDelete {
+		if !acl.remove(action, rule) {
+			adminError(wr, http.StatusNotFound, "no such ACL rule")
+			return
+		}
+		slog.Info("Removed ACL rule", "action", action, "rule", rule)
+	} else {
+		if err := acl.add(action, rule); err != nil {
+			adminError(wr, http.StatusBadRequest, err.Error())
+			return
+		}
+		slog.Info("Added ACL rule", "action", action, "rule", rule)
+	}
+	a.acl(wr, req)
+}
+
+func (a *adminAPI) capture(wr http.ResponseWriter, req *http.Request) {
+	c := a.proxy(req).capture
+	if c == nil {
+		adminError(wr, http.StatusNotFound, "no -capture-file")
+		return
+	}
+	writeAdminJSON(wr, http.StatusOK, map[string]any{"enabled": c.enabled.Load(), "file": c.out.path, "entries": c.out.count()})
+}
+
+func (a *adminAPI) setCapture(wr http.ResponseWriter, req *http.Request) {
+	c := a.proxy(req).capture
+	if c == nil {
+		adminError(wr, http.StatusNotFound, "no -capture-file")
+		return
+	}
+	text := req.URL.Query().Get("enabled")
+	if text == "" {
+		var body struct {
+			Enabled *bool `json:"enabled"`
+		}
+		json.NewDecoder(http.MaxBytesReader(wr, req.Body, 1024)).Decode(&body)
+		if body.Enabled != nil {
+			text = strconv.FormatBool(*body.Enabled)
+		}
+	}
+	enabled, err := strconv.ParseBool(text)
+	if err != nil {
+		adminError(wr, http.StatusBadRequest, "want enabled true or false")
+		return
+	}
+	if c.enabled.Swap(enabled) != enabled {
+		slog.Info("Switched traffic capture", "enabled", enabled, "file", c.out.path)
+	}
+	a.capture(wr, req)
+}
+
+// connTracker follows a server's client connections through its
+// ConnState hook. Hijacked ones leave it, becoming tunnels.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]*connInfo
+}
+
+// connInfo describes a client connection for the admin API.
+type connInfo struct {
+	Remote string    `json:"remote,omitempty"`
+	Local  string    `json:"local"`
+	State  string    `json:"state"`
+	Since  time.Time `json:"since"`
+}
+
+func (t *connTracker) track(conn net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch state {
+	case http.StateNew:
+		t.conns[conn] = &connInfo{Local: conn.LocalAddr().String(), State: state.String(), Since: time.Now()}
+	case http.StateHijacked, http.StateClosed:
+		delete(t.conns, conn)
+	default:
+		info, ok := t.conns[conn]
+		if !ok {
+			return
+		}
+		if info.Remote == "" {
+			// Not asked for when new: behind -proxy-protocol that
+			// would wait for the header on the accepting goroutine.
+			info.Remote = conn.RemoteAddr().String()
+		}
+		info.State = state.String()
+	}
+}
+
+// list returns the open connections, oldest first.
+func (t *connTracker) list() []connInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conns := make([]connInfo, 0, len(t.conns))
+	for _, info := range t.conns {
+		conns = append(conns, *info)
+	}
+	slices.SortFunc(conns, func(a, b connInfo) int { return a.Since.Compare(b.Since) })
+	return conns
+}
+
+// urlPassword matches the password of credentials in a URL.
+var urlPassword = regexp.MustCompile(`(://[^/@:\s]*):[^/@\s]*@`)
+
+// redactedFlags hold credentials themselves rather than naming a file.
+var redactedFlags = []string{"upstream-auth"}
+
+// flagSettings returns the value of every option in fs, for GET /config,
+// with credentials redacted.
+func flagSettings(fs *flag.FlagSet) map[string]string {
+	settings := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		v := urlPassword.ReplaceAllString(f.Value.String(), "$1:xxxxx@")
+		if slices.Contains(redactedFlags, f.Name) && v != "" {
+			v = "xxxxx"
+		}
+		settings[f.Name] = v
+	})
+	return settings
+}
@@ -0,0 +1,153 @@
+// Package proxy is minprox, the forward and reverse HTTP proxy, as a
+// library. New builds a Proxy configured with the same flags the minprox
+// command takes, plus options only a Go program can give: its own
+// transport or dialer, a logger, an extra ACL check and callbacks seeing
+// each request and response. A Proxy is an http.Handler, for serving
+// from a server of the program's own, or runs its listener itself.
+//
+//	p, err := proxy.New(
+//		proxy.WithFlags("-acl-deny", "*.internal"),
+//		proxy.OnRequest(func(req *http.Request) *http.Response {
+//			req.Header.Set("X-Via-Daemon", "1")
+//			return nil
+//		}),
+//	)
+//	...
+//	http.ListenAndServe("127.0.0.1:8080", p)
+//
+// Main is the minprox command itself.
+package proxy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+// Proxy is a configured minprox proxy.
+type Proxy struct {
+	l *listener
+}
+
+// Option configures a Proxy for New.
+type Option func(*options)
+
+type options struct {
+	args       []string
+	transport  http.RoundTripper
+	dialer     *net.Dialer
+	logger     *slog.Logger
+	acl        func(req *http.Request, target string) bool
+	onRequest  func(*http.Request) *http.Response
+	onResponse func(*http.Response)
+}
+
+// WithFlags configures the proxy with minprox command line flags, such as
+// "-acl-allow", "*.example.com". More than one WithFlags add up.
+func WithFlags(args ...string) Option {
+	return func(o *options) { o.args = append(o.args, args...) }
+}
+
+// WithTransport sends backend requests through rt instead of the
+// transport the flags configure. CONNECT tunnels still use the dialer.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(o *options) { o.transport = rt }
+}
+
+// WithDialer dials backends and tunnels with d. Its settings replace those
+// of -dial-timeout, -resolver and -tcp-fastopen.
+func WithDialer(d *net.Dialer) Option {
+	return func(o *options) { o.dialer = d }
+}
+
+// WithLogger logs each HTTP request and SOCKS5 connection to l. Messages
+// not about one go to slog's default logger, as in the command.
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) { o.logger = l }
+}
+
+// WithACL adds a check every destination must pass after the flags' ACL:
+// allow is called with the request, CONNECT included, and the host:port it
+// is for, and refuses it with 403 by returning false. For SOCKS5 clients
+// req is a CONNECT request standing for theirs.
+func WithACL(allow func(req *http.Request, target string) bool) Option {
+	return func(o *options) { o.acl = allow }
+}
+
+// OnRequest calls f with each plain HTTP request about to be sent to its
+// backend, once the proxy's own checks and rewriting are done. f may
+// change it, or answer it instead of the backend by returning a response,
+// whose body the proxy closes. CONNECT tunnels and SOCKS5 aren't seen.
+func OnRequest(f func(req *http.Request) *http.Response) Option {
+	return func(o *options) { o.onRequest = f }
+}
+
+// OnResponse calls f with each backend response before it is sent on. f
+// may change its status, headers and body; resp.Request is the request
+// sent to the backend.
+func OnResponse(f func(resp *http.Response)) Option {
+	return func(o *options) { o.onResponse = f }
+}
+
+// New returns a proxy configured by opts.
+func New(opts ...Option) (*Proxy, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	l, err := newListener("minprox", o.args)
+	if err != nil {
+		return nil, err
+	}
+	p := l.handler
+	p.stats = newServerStats()
+	p.tunnels = newTunnelSet()
+	if o.dialer != nil {
+		p.dialer = o.dialer
+	}
+	if o.transport != nil {
+		p.transport = o.transport
+		p.client = newBackendClient(o.transport, p.client.Timeout)
+	}
+	p.logger = o.logger
+	p.aclHook = o.acl
+	p.onRequest = o.onRequest
+	p.onResponse = o.onResponse
+	return &Proxy{l: l}, nil
+}
+
+// ServeHTTP proxies req.
+func (p *Proxy) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	p.l.handler.ServeHTTP(wr, req)
+}
+
+// Run serves the proxy on the addresses its flags give, -addr and the
+// like, SOCKS5 and admin servers included, until ctx is done. It then
+// shuts down as the command does, waiting up to -shutdown-timeout. Unlike
+// the command, it leaves telling systemd about the program to the program.
+func (p *Proxy) Run(ctx context.Context) error {
+	return run(ctx, []*listener{p.l}, p.l.shutdownTimeout, serveHooks{})
+}
+
+// serveHookResponse answers req with resp from the OnRequest callback.
+func (p *proxy) serveHookResponse(wr http.ResponseWriter, req *http.Request, resp *http.Response, log *slog.Logger) {
+	if resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	log.Info("Response", "status", resp.StatusCode, "from", "OnRequest")
+	copyHeader(wr.Header(), resp.Header)
+	wr.WriteHeader(resp.StatusCode)
+	if resp.Body != nil && bodyAllowed(req.Method, resp.StatusCode) {
+		io.Copy(wr, resp.Body)
+	}
+}
+
+// log returns the logger for a request or connection.
+func (p *proxy) log() *slog.Logger {
+	if p.logger != nil {
+		return p.logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// roundTripFunc is an http.RoundTripper made of a function.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestWithTransport(t *testing.T) {
+	var seen string
+	p, err := New(WithTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		seen = req.URL.String()
+		return &http.Response{StatusCode: http.StatusTeapot, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("from the transport")), Request: req}, nil
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := serve(p, "GET", "http://nowhere.test/x")
+	if rec.Code != http.StatusTeapot || rec.Body.String() != "from the transport" || seen != "http://nowhere.test/x" {
+		t.Errorf("got %d %q, transport saw %q", rec.Code, rec.Body, seen)
+	}
+}
+
+func TestWithDialer(t *testing.T) {
+	var dials atomic.Int64
+	d := &net.Dialer{Timeout: time.Second, Control: func(network, address string, c syscall.RawConn) error {
+		dials.Add(1)
+		return nil
+	}}
+	p, err := New(WithFlags("-connect-ports", "*"), WithDialer(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	conn, br, resp := connect(t, srv.Listener.Addr().String(), newEchoServer(t))
+	if resp.StatusCode != http.StatusOK || !echoes(conn, br, "ping") {
+		t.Fatalf("CONNECT got %s", resp.Status)
+	}
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	serve(p, "GET", b.URL+"/")
+	if n := dials.Load(); n != 2 {
+		t.Errorf("the dialer dialed %d times, want for the tunnel and the request", n)
+	}
+}
+
+func TestWithACL(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	echo := newEchoServer(t)
+	var asked []string
+	p, err := New(WithFlags("-acl-deny", "denied.test"), WithACL(func(req *http.Request, target string) bool {
+		asked = append(asked, req.Method+" "+target)
+		return target != echo
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(p, "GET", b.URL+"/"); rec.Code != http.StatusOK {
+		t.Errorf("allowed GET got %d", rec.Code)
+	}
+	if rec := serve(p, "GET", "http://denied.test/"); rec.Code != http.StatusForbidden {
+		t.Errorf("GET denied by -acl-deny got %d", rec.Code)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	if _, _, resp := connect(t, srv.Listener.Addr().String(), echo); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("CONNECT refused by the hook got %s, want 403", resp.Status)
+	}
+	// The hook isn't asked about what the flags' ACL already refused.
+	want := []string{"GET " + b.Listener.Addr().String(), "CONNECT " + echo}
+	if strings.Join(asked, ",") != strings.Join(want, ",") {
+		t.Errorf("hook asked about %q, want %q", asked, want)
+	}
+}
+
+func TestOnRequestOnResponse(t *testing.T) {
+	b := headerBackend(t, "X-Backend: 1")
+	p, err := New(
+		OnRequest(func(req *http.Request) *http.Response {
+			if req.URL.Path == "/answered" {
+				return &http.Response{StatusCode: http.StatusAccepted, Header: http.Header{"X-Hook": {"request"}}, Body: io.NopCloser(strings.NewReader("from the hook"))}
+			}
+			req.Header.Set("X-Added", "yes")
+			return nil
+		}),
+		OnResponse(func(resp *http.Response) {
+			resp.Header.Set("X-Seen", resp.Request.Header.Get("X-Added"))
+			resp.StatusCode = http.StatusCreated
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := serve(p, "GET", b.URL+"/passed")
+	if b.last.Header.Get("X-Added") != "yes" {
+		t.Error("OnRequest's change didn't reach the backend")
+	}
+	if rec.Code != http.StatusCreated || rec.Header().Get("X-Seen") != "yes" || rec.Header().Get("X-Backend") != "1" {
+		t.Errorf("got %d %v, want OnResponse's status and header on the backend's response", rec.Code, rec.Header())
+	}
+
+	hits := b.hits
+	rec = serve(p, "GET", b.URL+"/answered")
+	if rec.Code != http.StatusAccepted || rec.Body.String() != "from the hook" || rec.Header().Get("X-Hook") != "request" || b.hits != hits {
+		t.Errorf("OnRequest's answer came back as %d %q %v", rec.Code, rec.Body, rec.Header())
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	logger, logs := newTestLogger()
+	p, err := New(WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	serve(p, "GET", b.URL+"/logged")
+	if !strings.Contains(logs.String(), "/logged") {
+		t.Errorf("request not logged to the logger given:\n%s", logs)
+	}
+}
+
+func TestProxyRun(t *testing.T) {
+	addr := closedAddr(t)
+	p, err := New(WithFlags("-addr", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- p.Run(ctx) }()
+
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	waitFor(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+	if _, resp := keepAliveGet(t, addr, b.URL+"/"); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET through Run's listener got %s", resp.Status)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run = %v, want a clean shutdown", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return once ctx was done")
+	}
+}
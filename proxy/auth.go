@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// authRealm is the realm in Proxy-Authenticate challenges and the one
+// htdigest entries in -auth-file must be for.
+const authRealm = "minprox"
+
+// Schemes for -auth.
+const (
+	authBasic  = "basic"
+	authDigest = "digest"
+)
+
+// digestNonceLifetime is how long a Digest nonce is accepted. Clients
+// using an older one are told it is stale and retry without prompting.
+const digestNonceLifetime = 5 * time.Minute
+
+// proxyAuth checks client Proxy-Authorization against the -auth-file
+// users with the -auth schemes.
+//
+// Digest nonces are a timestamp signed with a key made at startup, so no
+// per-client state is kept. The flip side is that nonce counts aren't
+// tracked: a captured Digest response can be replayed until its nonce
+// expires, which is still far better than Basic's reusable password.
+type proxyAuth struct {
+	users         *userFile
+	basic, digest bool
+	nonceKey      []byte
+}
+
+func newProxyAuth(users *userFile, schemes []string) (*proxyAuth, error) {
+	a := &proxyAuth{users: users, nonceKey: make([]byte, 32)}
+	rand.Read(a.nonceKey)
+	for _, s := range schemes {
+		switch strings.ToLower(s) {
+		case authBasic:
+			a.basic = true
+		case authDigest:
+			a.digest = true
+		default:
+			return nil, fmt.Errorf("-auth scheme %q is not %s or %s", s, authBasic, authDigest)
+		}
+	}
+	if !a.basic && !a.digest {
+		a.basic = true
+	}
+	return a, nil
+}
+
+// authenticate returns the user req's Proxy-Authorization proves it is.
+// stale is set for Digest credentials that were fine but for an expired
+// nonce.
+func (a *proxyAuth) authenticate(req *http.Request) (user string, ok, stale bool) {
+	scheme, creds, _ := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	switch {
+	case a.basic && strings.EqualFold(scheme, "Basic"):
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(creds))
+		if err != nil {
+			return "", false, false
+		}
+		user, pass, _ := strings.Cut(string(decoded), ":")
+		return user, a.users.check(user, pass), false
+	case a.digest && strings.EqualFold(scheme, "Digest"):
+		return a.checkDigest(req, parseAuthParams(creds))
+	}
+	return "", false, false
+}
+
+// checkDigest verifies RFC 7616 Digest credentials, MD5 with qop=auth or
+// no qop.
+func (a *proxyAuth) checkDigest(req *http.Request, params map[string]string) (user string, ok, stale bool) {
+	user = params["username"]
+	// Clients differ on whether a proxied request's uri is the absolute
+	// URL it sent or just its path, so either will do.
+	uri := params["uri"]
+	if params["realm"] != authRealm || (uri != req.RequestURI && uri != req.URL.RequestURI()) {
+		return user, false, false
+	}
+	if alg := params["algorithm"]; alg != "" && !strings.EqualFold(alg, "MD5") {
+		return user, false, false
+	}
+	ha1, known := a.users.ha1(user)
+	if !known {
+		return user, false, false
+	}
+	fresh, valid := a.checkNonce(params["nonce"])
+	if !valid {
+		return user, false, false
+	}
+
+	ha2 := md5Hex(req.Method + ":" + uri)
+	var want string
+	switch params["qop"] {
+	case "auth":
+		want = md5Hex(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], "auth", ha2}, ":"))
+	case "":
+		want = md5Hex(ha1 + ":" + params["nonce"] + ":" + ha2)
+	default:
+		return user, false, false
+	}
+	if subtle.ConstantTimeCompare([]byte(want), []byte(strings.ToLower(params["response"]))) != 1 {
+		return user, false, false
+	}
+	if !fresh {
+		return user, false, true
+	}
+	return user, true, false
+}
+
+// newNonce returns a Digest nonce: the current time and its HMAC.
+func (a *proxyAuth) newNonce() string {
+	b := binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+	mac := hmac.New(sha256.New, a.nonceKey)
+	mac.Write(b)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(b))
+}
+
+// checkNonce reports whether nonce was made by newNonce, and whether it is
+// still within digestNonceLifetime.
+func (a *proxyAuth) checkNonce(nonce string) (fresh, valid bool) {
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != 8+sha256.Size {
+		return false, false
+	}
+	mac := hmac.New(sha256.New, a.nonceKey)
+	mac.Write(b[:8])
+	if !hmac.Equal(mac.Sum(nil), b[8:]) {
+		return false, false
+	}
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(b[:8])))
+	return time.Since(issued) < digestNonceLifetime, true
+}
+
+// challenge sets a Proxy-Authenticate header for each enabled scheme.
+func (a *proxyAuth) challenge(header http.Header, stale bool) {
+	if a.digest {
+		c := fmt.Sprintf(`Digest realm="%s", qop="auth", algorithm=MD5, nonce="%s"`, authRealm, a.newNonce())
+		if stale {
+			c += ", stale=true"
+		}
+		header.Add("Proxy-Authenticate", c)
+	}
+	if a.basic {
+		header.Add("Proxy-Authenticate", `Basic realm="`+authRealm+`"`)
+	}
+}
+
+// parseAuthParams parses the comma separated name=value pairs of a
+// Digest header. Values may be quoted strings with backslash escapes.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimLeft(s, " \t,") {
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		rest = strings.TrimLeft(rest, " \t")
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			value, s = b.String(), rest[min(i+1, len(rest)):]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[name] = value
+	}
+	return params
+}
+
+// requireAuth answers 407 and returns false if -auth-file is set and req
+// doesn't prove it is one of its users. Otherwise it returns the user, if
+// any, for the access log.
+func (p *proxy) requireAuth(wr http.ResponseWriter, req *http.Request) (user string, ok bool) {
+	if p.auth == nil {
+		return "", true
+	}
+	if user, ok := interceptedUser(req); ok {
+		// Authenticated when the tunnel was opened.
+		return user, true
+	}
+	user, ok, stale := p.auth.authenticate(req)
+	if ok {
+		return user, true
+	}
+	p.auth.challenge(wr.Header(), stale)
+	http.Error(wr, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+	return user, false
+}
@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeUserFile(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestUserFileCheck(t *testing.T) {
+	users, err := loadUserFile(writeUserFile(t,
+		"# comment",
+		"",
+		"plain:secret",
+		"apr:$apr1$r31....$gnsoqlxyxQQ0Ot5JCwiei.",
+		"sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+		"digest:minprox:"+digestHA1("digest", "secret"),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"plain", "apr", "sha", "digest"} {
+		if !users.check(user, "secret") {
+			t.Errorf("%s: right password refused", user)
+		}
+		if users.check(user, "wrong") {
+			t.Errorf("%s: wrong password accepted", user)
+		}
+	}
+	if users.check("nobody", "secret") {
+		t.Error("unknown user accepted")
+	}
+	if _, ok := users.ha1("apr"); ok {
+		t.Error("ha1 known for an apr1 hash")
+	}
+	if ha1, _ := users.ha1("plain"); ha1 != digestHA1("plain", "secret") {
+		t.Errorf("plain ha1 = %q", ha1)
+	}
+}
+
+func TestLoadUserFileRejects(t *testing.T) {
+	for name, line := range map[string]string{
+		"no colon":       "user",
+		"no user":        ":secret",
+		"unknown hash":   "user:$6$salt$hash",
+		"only a comment": "# nobody",
+	} {
+		if _, err := loadUserFile(writeUserFile(t, line)); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+}
+
+func TestParseAuthParams(t *testing.T) {
+	got := parseAuthParams(`username="Mufasa", realm="a, \"b\"", nc=00000001 ,qop=auth, uri="/dir/index.html"`)
+	want := map[string]string{"username": "Mufasa", "realm": `a, "b"`, "nc": "00000001", "qop": "auth", "uri": "/dir/index.html"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// digestChallenge returns the parameters of the Digest challenge in h.
+func digestChallenge(t *testing.T, h http.Header) map[string]string {
+	t.Helper()
+	for _, c := range h.Values("Proxy-Authenticate") {
+		if scheme, params, _ := strings.Cut(c, " "); scheme == "Digest" {
+			return parseAuthParams(params)
+		}
+	}
+	t.Fatalf("no Digest challenge in %q", h.Values("Proxy-Authenticate"))
+	return nil
+}
+
+// digestAuthorization answers challenge as user with pass for a request,
+// the way a client would.
+func digestAuthorization(challenge map[string]string, user, pass, method, uri string) string {
+	ha1 := digestHA1(user, pass)
+	ha2 := md5Hex(method + ":" + uri)
+	const nc, cnonce = "00000001", "0a4f113b"
+	response := md5Hex(strings.Join([]string{ha1, challenge["nonce"], nc, cnonce, "auth", ha2}, ":"))
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", qop=auth, nc=%s, cnonce="%s", response="%s", algorithm=MD5`,
+		user, challenge["realm"], challenge["nonce"], uri, nc, cnonce, response)
+}
+
+func TestProxyAuthDigest(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(wr, "in")
+	})
+	p := newTestProxy(t, "-auth-file", writeUserFile(t, "alice:secret"), "-auth", "digest")
+	url := b.URL + "/page?q=1"
+
+	rec := serve(p, "GET", url)
+	if rec.Code != http.StatusProxyAuthRequired {
+		t.Fatalf("unauthenticated request got %d, want 407", rec.Code)
+	}
+	if strings.Contains(strings.Join(rec.Header().Values("Proxy-Authenticate"), " "), "Basic") {
+		t.Error("Basic offered with -auth digest")
+	}
+	challenge := digestChallenge(t, rec.Header())
+	if challenge["realm"] != authRealm || challenge["qop"] != "auth" {
+		t.Errorf("challenge = %v", challenge)
+	}
+
+	for _, uri := range []string{url, "/page?q=1"} {
+		rec = serve(p, "GET", url, "Proxy-Authorization: "+digestAuthorization(challenge, "alice", "secret", "GET", uri))
+		if rec.Code != http.StatusOK || rec.Body.String() != "in" {
+			t.Errorf("uri %q: got %d %q, want the backend's 200", uri, rec.Code, rec.Body)
+		}
+	}
+	if h := b.last.Header.Get("Proxy-Authorization"); h != "" {
+		t.Errorf("Proxy-Authorization forwarded: %q", h)
+	}
+
+	for name, auth := range map[string]string{
+		"wrong password": digestAuthorization(challenge, "alice", "guess", "GET", url),
+		"unknown user":   digestAuthorization(challenge, "bob", "secret", "GET", url),
+		"other uri":      digestAuthorization(challenge, "alice", "secret", "GET", "/elsewhere"),
+		"other method":   digestAuthorization(challenge, "alice", "secret", "POST", url),
+		"forged nonce":   digestAuthorization(map[string]string{"realm": authRealm, "nonce": "bm9wZQ"}, "alice", "secret", "GET", url),
+		"basic":          "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret")),
+	} {
+		rec := serve(p, "GET", url, "Proxy-Authorization: "+auth)
+		if rec.Code != http.StatusProxyAuthRequired {
+			t.Errorf("%s: got %d, want 407", name, rec.Code)
+		}
+		if c := digestChallenge(t, rec.Header()); c["stale"] != "" {
+			t.Errorf("%s: challenge marked stale", name)
+		}
+	}
+}
+
+func TestProxyAuthDigestStaleNonce(t *testing.T) {
+	a, err := newProxyAuth(&userFile{users: map[string]userEntry{"alice": {kind: hashPlain, hash: "secret", ha1: digestHA1("alice", "secret")}}}, []string{"digest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A nonce signed with the right key but issued too long ago.
+	issued := binary.BigEndian.AppendUint64(nil, uint64(time.Now().Add(-digestNonceLifetime-time.Minute).UnixNano()))
+	mac := hmac.New(sha256.New, a.nonceKey)
+	mac.Write(issued)
+	stale := base64.RawURLEncoding.EncodeToString(mac.Sum(issued))
+
+	req, _ := http.NewRequest("GET", "http://x.test/", nil)
+	req.RequestURI = "http://x.test/"
+	req.Header.Set("Proxy-Authorization", digestAuthorization(map[string]string{"realm": authRealm, "nonce": stale}, "alice", "secret", "GET", "/"))
+	if _, ok, isStale := a.authenticate(req); ok || !isStale {
+		t.Errorf("expired nonce: ok %v, stale %v; want refused as stale", ok, isStale)
+	}
+
+	h := http.Header{}
+	a.challenge(h, true)
+	if c := digestChallenge(t, h); c["stale"] != "true" {
+		t.Errorf("challenge after a stale nonce = %v", c)
+	}
+}
+
+func TestProxyAuthBasic(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	p := newTestProxy(t, "-auth-file", writeUserFile(t, "alice:secret"))
+	basic := func(userpass string) string {
+		return "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(userpass))
+	}
+
+	rec := serve(p, "GET", b.URL)
+	if rec.Code != http.StatusProxyAuthRequired || rec.Header().Get("Proxy-Authenticate") != `Basic realm="minprox"` {
+		t.Errorf("unauthenticated: %d %q", rec.Code, rec.Header().Values("Proxy-Authenticate"))
+	}
+	if rec := serve(p, "GET", b.URL, basic("alice:secret")); rec.Code != http.StatusOK {
+		t.Errorf("right password got %d", rec.Code)
+	}
+	for _, auth := range []string{basic("alice:guess"), basic("alice"), "Proxy-Authorization: Basic !!!"} {
+		if rec := serve(p, "GET", b.URL, auth); rec.Code != http.StatusProxyAuthRequired {
+			t.Errorf("%q got %d, want 407", auth, rec.Code)
+		}
+	}
+	if b.hits != 1 {
+		t.Errorf("backend hit %d times, want 1", b.hits)
+	}
+}
+
+func TestNewProxyAuthSchemes(t *testing.T) {
+	users := &userFile{}
+	for _, tt := range []struct {
+		schemes       []string
+		basic, digest bool
+	}{
+		{nil, true, false},
+		{[]string{"Digest"}, false, true},
+		{[]string{"basic", "digest"}, true, true},
+	} {
+		a, err := newProxyAuth(users, tt.schemes)
+		if err != nil || a.basic != tt.basic || a.digest != tt.digest {
+			t.Errorf("%q: basic %v digest %v err %v", tt.schemes, a.basic, a.digest, err)
+		}
+	}
+	if _, err := newProxyAuth(users, []string{"ntlm"}); err == nil {
+		t.Error("ntlm accepted")
+	}
+}
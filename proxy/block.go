@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// targetHost returns the hostname the request is for, whether it arrived in
+// absolute form or origin form.
+func targetHost(req *http.Request) string {
+	if h := req.URL.Hostname(); h != "" {
+		return h
+	}
+	if h, _, err := net.SplitHostPort(req.Host); err == nil {
+		return h
+	}
+	return req.Host
+}
+
+// Block reasons recorded by logBlocked.
+const (
+	blockReasonDenyList = "denylist"
+	blockReasonFraming  = "framing"
+	blockReasonMethod   = "method"
+	blockReasonLoop     = "loop"
+	blockReasonAdapter  = "adapter"
+	blockReasonSNI      = "sni"
+	blockReasonBackend  = "backend"
+	blockReasonPort     = "port"
+	blockReasonLimits   = "limits"
+	blockReasonGeo      = "geo"
+	blockReasonACL      = "acl"
+	blockReasonRule     = "rule"
+	blockReasonRoute    = "route"
+)
+
+// logBlocked writes the audit record for a request refused by a filtering
+// rule. Every block path must go through here so security events can be
+// picked out of the log by the audit attribute alone.
+func logBlocked(log *slog.Logger, req *http.Request, reason, rule string) {
+	client, _ := remoteHost(req.RemoteAddr)
+	target := req.URL.Host
+	if target == "" {
+		target = req.Host
+	}
+	log.Warn("Blocked request",
+		"audit", true,
+		"reason", reason,
+		"rule", rule,
+		"client", client,
+		"target", target,
+	)
+}
+
+// Block response modes for -block-response-mode.
+const (
+	blockModeForbidden = "403"
+	blockModeNoContent = "204"
+	blockModeStub      = "stub"
+)
+
+// transparentGIF is the smallest valid 1x1 transparent GIF.
+var transparentGIF = []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\x00\x00\x00!\xf9\x04\x01\x00\x00\x00\x00,\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02D\x01\x00;")
+
+// serveBlocked answers a request for a blocked host according to
+// -block-response-mode. "204" answers with an empty response and "stub"
+// additionally serves a 1x1 image to requests that accept images, so
+// blocked ads don't break page layout. CONNECT requests always get 403
+// since there is nothing useful to put in a tunnel.
+func (p *proxy) serveBlocked(wr http.ResponseWriter, req *http.Request, log *slog.Logger, rule string) {
+	logBlocked(log, req, blockReasonDenyList, rule)
+
+	mode := p.blockMode
+	if req.Method == http.MethodConnect {
+		mode = blockModeForbidden
+	}
+
+	switch mode {
+	case blockModeStub:
+		if acceptsImage(req) {
+			wr.Header().Set("Content-Type", "image/gif")
+			wr.Header().Set("Cache-Control", "max-age=86400")
+			wr.Header().Set("Content-Length", fmt.Sprint(len(transparentGIF)))
+			wr.WriteHeader(http.StatusOK)
+			wr.Write(transparentGIF)
+			return
+		}
+		fallthrough
+	case blockModeNoContent:
+		wr.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(wr, "Forbidden", http.StatusForbidden)
+	}
+}
+
+// acceptsImage reports whether the Accept header asks specifically for an
+// image; browsers send "image/..." first for <img> loads.
+func acceptsImage(req *http.Request) bool {
+	for _, v := range strings.Split(req.Header.Get("Accept"), ",") {
+		mt, _, _ := strings.Cut(strings.TrimSpace(v), ";")
+		if strings.HasPrefix(mt, "image/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTempFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadDomainSet(t *testing.T) {
+	d, err := loadDomainSet(writeTempFile(t, "blocklist", `
+# hosts format and plain names both work
+0.0.0.0 ads.example.com tracker.example.net # trailing comment
+127.0.0.1 localhost
+Metrics.Example.ORG.
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]string{
+		"ads.example.com":       "ads.example.com",
+		"img.ads.example.com":   "ads.example.com",
+		"tracker.example.net.":  "tracker.example.net",
+		"metrics.example.org":   "metrics.example.org",
+		"example.com":           "",
+		"badads.example.com":    "",
+		"localhost":             "",
+		"tracker.example.net.x": "",
+	} {
+		if got, _ := d.match(host); got != want {
+			t.Errorf("match(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestBlockResponseModes(t *testing.T) {
+	list := writeTempFile(t, "blocklist", "ads.example.com\n")
+	for _, tt := range []struct {
+		mode, accept string
+		status       int
+		contentType  string
+	}{
+		{"403", "", http.StatusForbidden, "text/plain; charset=utf-8"},
+		{"204", "image/webp,*/*", http.StatusNoContent, ""},
+		{"stub", "image/avif,image/webp,*/*;q=0.8", http.StatusOK, "image/gif"},
+		{"stub", "text/html", http.StatusNoContent, ""},
+	} {
+		p := newTestProxy(t, "-blocklist", list, "-block-response-mode", tt.mode)
+		rec := serve(p, "GET", "http://cdn.ads.example.com/banner", "Accept: "+tt.accept)
+		if rec.Code != tt.status || rec.Header().Get("Content-Type") != tt.contentType {
+			t.Errorf("%s mode, Accept %q: got %d %q, want %d %q", tt.mode, tt.accept, rec.Code, rec.Header().Get("Content-Type"), tt.status, tt.contentType)
+		}
+		if tt.contentType == "image/gif" && rec.Body.String() != string(transparentGIF) {
+			t.Error("stub isn't the transparent GIF")
+		}
+	}
+}
+
+func TestBlockedConnect(t *testing.T) {
+	list := writeTempFile(t, "blocklist", "ads.example.com\n")
+	srv := newProxyServer(t, "-blocklist", list, "-block-response-mode", "stub")
+	if _, _, resp := connect(t, srv.Listener.Addr().String(), "ads.example.com:443"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("blocked CONNECT got %s, want 403 whatever the mode", resp.Status)
+	}
+}
+
+func TestBlockedRequestsAudited(t *testing.T) {
+	list := writeTempFile(t, "blocklist", "ads.example.com\n")
+	logger, logs := newTestLogger()
+	p, err := New(WithFlags("-blocklist", list), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "http://x.ads.example.com/", nil)
+	req.RemoteAddr = "192.0.2.9:4000"
+	p.ServeHTTP(httptest.NewRecorder(), req)
+	for _, want := range []string{`msg="Blocked request"`, "audit=true", "reason=denylist", "rule=ads.example.com", "client=192.0.2.9", "target=x.ads.example.com"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("audit record lacks %s:\n%s", want, logs)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// bodyLogger logs request and response bodies for a sampled fraction of
+// requests whose content type matches one of types.
+type bodyLogger struct {
+	sample  float64
+	types   []string
+	maxBody int
+	redact  map[string]bool
+	// redactRe catches redacted fields in JSON that didn't parse, usually
+	// because it was truncated.
+	redactRe *regexp.Regexp
+}
+
+func newBodyLogger(sample float64, types []string, maxBody int, redact []string) *bodyLogger {
+	b := &bodyLogger{
+		sample:  sample,
+		types:   types,
+		maxBody: maxBody,
+		redact:  make(map[string]bool),
+	}
+	if len(redact) > 0 {
+		quoted := make([]string, len(redact))
+		for i, f := range redact {
+			b.redact[f] = true
+			quoted[i] = regexp.QuoteMeta(f)
+		}
+		b.redactRe = regexp.MustCompile(`("(?:` + strings.Join(quoted, "|") + `)"\s*:\s*)("(?:[^"\\]|\\.)*"?|[^,}\]\s]*)`)
+	}
+	return b
+}
+
+// bodyCapture holds the bodies collected for one sampled request.
+type bodyCapture struct {
+	bl        *bodyLogger
+	req, resp *truncBuffer
+	reqType   string
+	respType  string
+}
+
+// start decides whether req is sampled and, if so, starts capturing its
+// body. It returns nil for requests that aren't logged.
+func (b *bodyLogger) start(req *http.Request) *bodyCapture {
+	if b == nil || rand.Float64() >= b.sample {
+		return nil
+	}
+	c := &bodyCapture{bl: b}
+	if ct := req.Header.Get("Content-Type"); req.Body != nil && req.Body != http.NoBody && b.matches(ct) {
+		c.req = &truncBuffer{max: b.maxBody}
+		c.reqType = ct
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(req.Body, c.req), req.Body}
+	}
+	return c
+}
+
+// wrapResponse starts capturing resp's body if its content type matches.
+func (c *bodyCapture) wrapResponse(resp *http.Response) {
+	if c == nil {
+		return
+	}
+	if ct := resp.Header.Get("Content-Type"); c.bl.matches(ct) {
+		c.resp = &truncBuffer{max: c.bl.maxBody}
+		c.respType = ct
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(resp.Body, c.resp), resp.Body}
+	}
+}
+
+// log writes whatever bodies were captured.
+func (c *bodyCapture) log(log *slog.Logger) {
+	if c == nil {
+		return
+	}
+	if c.req != nil {
+		log.Info("Request body", "body", c.bl.redactBody(c.req, c.reqType), "truncated", c.req.truncated)
+	}
+	if c.resp != nil {
+		log.Info("Response body", "body", c.bl.redactBody(c.resp, c.respType), "truncated", c.resp.truncated)
+	}
+}
+
+func (b *bodyLogger) matches(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range b.types {
+		if strings.HasPrefix(mt, strings.ToLower(t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactBody returns the captured body as a string with the configured JSON
+// fields replaced.
+func (b *bodyLogger) redactBody(buf *truncBuffer, contentType string) string {
+	if len(b.redact) == 0 || !strings.Contains(contentType, "json") {
+		return buf.String()
+	}
+	var v any
+	if !buf.truncated && json.Unmarshal(buf.Bytes(), &v) == nil {
+		if out, err := json.Marshal(b.redactValue(v)); err == nil {
+			return string(out)
+		}
+	}
+	return b.redactRe.ReplaceAllString(buf.String(), `$1"[REDACTED]"`)
+}
+
+func (b *bodyLogger) redactValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, vv := range v {
+			if b.redact[k] {
+				v[k] = "[REDACTED]"
+			} else {
+				v[k] = b.redactValue(vv)
+			}
+		}
+	case []any:
+		for i, vv := range v {
+			v[i] = b.redactValue(vv)
+		}
+	}
+	return v
+}
+
+// truncBuffer keeps the first max bytes written to it and notes whether
+// anything was dropped.
+type truncBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *truncBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); len(p) > room {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBodyLog(t *testing.T) {
+	var got string
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		got = string(body)
+		wr.Header().Set("Content-Type", "text/plain")
+		io.WriteString(wr, "reply text")
+	})
+	logger, logs := newTestLogger()
+	p, err := New(WithFlags("-backend", b.URL, "-body-log-sample", "1"), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "http://front.test/", strings.NewReader(`{"user":"ann","password":"hunter2"}`))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	p.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got != `{"user":"ann","password":"hunter2"}` {
+		t.Errorf("backend got %q, want the body unchanged", got)
+	}
+	out := logs.String()
+	if strings.Contains(out, "hunter2") {
+		t.Error("password logged")
+	}
+	for _, want := range []string{`"password\":\"[REDACTED]\"`, `"user\":\"ann\"`, `body="reply text"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log lacks %s:\n%s", want, out)
+		}
+	}
+}
+
+func TestBodyLogSkips(t *testing.T) {
+	bl := newBodyLogger(1, []string{"application/json"}, 100, nil)
+	req := httptest.NewRequest("POST", "http://x.test/", strings.NewReader("data"))
+	req.Header.Set("Content-Type", "image/png")
+	if c := bl.start(req); c == nil || c.req != nil {
+		t.Errorf("capturing a body of unlisted type: %+v", c)
+	}
+	if c := newBodyLogger(0, []string{"application/json"}, 100, nil).start(req); c != nil {
+		t.Error("request sampled with a sample of 0")
+	}
+	var none *bodyLogger
+	if none.start(req) != nil {
+		t.Error("nil body logger sampled a request")
+	}
+}
+
+func TestBodyLogRedactTruncated(t *testing.T) {
+	bl := newBodyLogger(1, []string{"application/json"}, 30, []string{"token"})
+	buf := &truncBuffer{max: bl.maxBody}
+	buf.Write([]byte(`{"id": 7, "token": "abcdef", "more": "data that won't fit"}`))
+	if !buf.truncated || buf.Len() != 30 {
+		t.Fatalf("buffer kept %d bytes, truncated %v", buf.Len(), buf.truncated)
+	}
+	if got := bl.redactBody(buf, "application/json"); strings.Contains(got, "abcdef") || !strings.Contains(got, `"token": "[REDACTED]"`) {
+		t.Errorf("redacted truncated body = %q", got)
+	}
+}
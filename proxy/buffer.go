@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// bufferResponse reads resp's body ahead, up to max bytes, so a backend
+// failing partway through is reported before anything reaches the client.
+// Bodies larger than max are streamed after the buffered part, as if
+// nothing had been read.
+func bufferResponse(resp *http.Response, max int64) error {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.LimitReader(resp.Body, max+1)); err != nil {
+		return err
+	}
+	var r io.Reader = &buf
+	if int64(buf.Len()) > max {
+		r = io.MultiReader(&buf, resp.Body)
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{r, resp.Body}
+	return nil
+}
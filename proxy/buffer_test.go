@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// truncatingBackend promises a 1000 byte body and dies after 10.
+func truncatingBackend(t *testing.T) *countingBackend {
+	return newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("Content-Length", "1000")
+		io.WriteString(wr, "0123456789")
+		wr.(http.Flusher).Flush()
+		conn, _, _ := http.NewResponseController(wr).Hijack()
+		conn.Close()
+	})
+}
+
+func TestBufferResponses(t *testing.T) {
+	b := truncatingBackend(t)
+	if rec := serve(newTestProxy(t, "-backend", b.URL), "GET", "http://front.test/"); rec.Code != http.StatusOK {
+		t.Errorf("streaming: got %d, want the 200 already sent before the failure", rec.Code)
+	}
+	if rec := serve(newTestProxy(t, "-backend", b.URL, "-buffer-responses", "4096"), "GET", "http://front.test/"); rec.Code != http.StatusBadGateway {
+		t.Errorf("buffered: got %d, want a clean 502", rec.Code)
+	}
+}
+
+func TestBufferResponsesOverCap(t *testing.T) {
+	body := strings.Repeat("x", 10000)
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		io.WriteString(wr, body)
+	})
+	p := newTestProxy(t, "-backend", b.URL, "-buffer-responses", "100")
+	if rec := serve(p, "GET", "http://front.test/"); rec.Code != http.StatusOK || rec.Body.String() != body {
+		t.Errorf("body over the cap: got %d with %d bytes, want all %d streamed", rec.Code, rec.Body.Len(), len(body))
+	}
+}
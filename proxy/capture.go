@@ -0,0 +1,339 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// trafficCapture records the requests the proxy forwards, and the
+// responses to them, for debugging: -capture-file. Only requests for
+// hosts, if set, are captured, and bodies are kept up to maxBody bytes,
+// none if 0. The admin API switches it on and off. A nil *trafficCapture
+// captures nothing.
+type trafficCapture struct {
+	hosts   *domainSet
+	maxBody int
+	enabled atomic.Bool
+	out     *captureFile
+}
+
+// captureFile is where captured exchanges go: a HAR 1.2 file, rewritten
+// so it stays a valid document after each entry, or, for any other file
+// name, one HAR entry as JSON per line.
+type captureFile struct {
+	path string
+	har  bool
+
+	mu      sync.Mutex
+	f       *os.File
+	end     int64 // where the HAR trailer starts
+	entries int
+}
+
+// harHeader and harTrailer surround the entries of a HAR file.
+const (
+	harHeader  = `{"log":{"version":"1.2","creator":{"name":"minprox","version":"1"},"entries":[`
+	harTrailer = "\n]}}\n"
+)
+
+// openCaptureFile opens path for -capture-file. A JSON lines file is
+// appended to. A HAR file, named *.har, is started afresh with its first
+// entry, so one opened again by a reload and then dropped is left alone.
+func openCaptureFile(path string) (*captureFile, error) {
+	c := &captureFile{path: path, har: strings.HasSuffix(strings.ToLower(path), ".har")}
+	flags := os.O_WRONLY | os.O_APPEND | os.O_CREATE
+	if c.har {
+		flags = os.O_RDWR | os.O_CREATE
+	}
+	f, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	c.f = f
+	return c, nil
+}
+
+// write adds e to the file.
+func (c *captureFile) write(e *harEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return nil
+	}
+	if !c.har {
+		_, err = c.f.Write(append(b, '\n'))
+	} else {
+		sep := ",\n"
+		if c.end == 0 {
+			if err := c.f.Truncate(0); err != nil {
+				return err
+			}
+			if _, err := c.f.WriteAt([]byte(harHeader), 0); err != nil {
+				return err
+			}
+			c.end, sep = int64(len(harHeader)), "\n"
+		}
+		entry := sep + string(b)
+		if _, err = c.f.WriteAt([]byte(entry+harTrailer), c.end); err == nil {
+			c.end += int64(len(entry))
+		}
+	}
+	if err == nil {
+		c.entries++
+	}
+	return err
+}
+
+// close closes the file, for a capture that is not written any more.
+func (c *captureFile) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f != nil {
+		c.f.Close()
+		c.f = nil
+	}
+}
+
+// count returns the number of entries written since the file was opened.
+func (c *captureFile) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries
+}
+
+// The parts of a HAR 1.2 entry minprox fills in.
+type (
+	harEntry struct {
+		StartedDateTime time.Time   `json:"startedDateTime"`
+		Time            float64     `json:"time"`
+		Request         harRequest  `json:"request"`
+		Response        harResponse `json:"response"`
+		Cache           struct{}    `json:"cache"`
+		Timings         harTimings  `json:"timings"`
+		Comment         string      `json:"comment,omitempty"`
+	}
+	harRequest struct {
+		Method      string         `json:"method"`
+		URL         string         `json:"url"`
+		HTTPVersion string         `json:"httpVersion"`
+		Cookies     []harNameValue `json:"cookies"`
+		Headers     []harNameValue `json:"headers"`
+		QueryString []harNameValue `json:"queryString"`
+		PostData    *harPostData   `json:"postData,omitempty"`
+		HeadersSize int            `json:"headersSize"`
+		BodySize    int64          `json:"bodySize"`
+	}
+	harResponse struct {
+		Status      int            `json:"status"`
+		StatusText  string         `json:"statusText"`
+		HTTPVersion string         `json:"httpVersion"`
+		Cookies     []harNameValue `json:"cookies"`
+		Headers     []harNameValue `json:"headers"`
+		Content     harContent     `json:"content"`
+		RedirectURL string         `json:"redirectURL"`
+		HeadersSize int            `json:"headersSize"`
+		BodySize    int64          `json:"bodySize"`
+	}
+	harNameValue struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	harPostData struct {
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text"`
+		Encoding string `json:"encoding,omitempty"`
+	}
+	harContent struct {
+		Size     int64  `json:"size"`
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text,omitempty"`
+		Encoding string `json:"encoding,omitempty"`
+	}
+	harTimings struct {
+		Send    float64 `json:"send"`
+		Wait    float64 `json:"wait"`
+		Receive float64 `json:"receive"`
+	}
+)
+
+// captureBuffer counts a body as it is read and keeps the first max bytes.
+type captureBuffer struct {
+	truncBuffer
+	n int64
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	b.n += int64(len(p))
+	return b.truncBuffer.Write(p)
+}
+
+// exchange is one request being captured.
+type exchange struct {
+	c         *trafficCapture
+	req       *http.Request
+	reqHeader http.Header
+	reqBody   *captureBuffer
+	respBody  *captureBuffer
+	start     time.Time
+	gotResp   time.Time
+}
+
+// start begins capturing req, asked for as host, if capture is on and the
+// host or its backend matches. It returns nil for requests that aren't
+// captured.
+func (c *trafficCapture) start(req *http.Request, host string) *exchange {
+	if c == nil || !c.enabled.Load() {
+		return nil
+	}
+	if c.hosts != nil {
+		if h, _ := remoteHost(host); !matchesHost(c.hosts, h) && !matchesHost(c.hosts, req.URL.Hostname()) {
+			return nil
+		}
+	}
+	x := &exchange{
+		c:         c,
+		req:       req,
+		reqHeader: req.Header.Clone(),
+		reqBody:   &captureBuffer{truncBuffer: truncBuffer{max: c.maxBody}},
+		respBody:  &captureBuffer{truncBuffer: truncBuffer{max: c.maxBody}},
+		start:     time.Now(),
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(req.Body, x.reqBody), req.Body}
+	}
+	return x
+}
+
+// wrapResponse tees resp's body into the capture.
+func (x *exchange) wrapResponse(resp *http.Response) {
+	if x == nil {
+		return
+	}
+	x.gotResp = time.Now()
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(resp.Body, x.respBody), resp.Body}
+}
+
+// finish writes the exchange out once the response has been sent, noting
+// if it was cut short by err.
+func (x *exchange) finish(resp *http.Response, err error, log *slog.Logger) {
+	if x == nil {
+		return
+	}
+	end := time.Now()
+	if x.gotResp.IsZero() {
+		x.gotResp = end
+	}
+	e := &harEntry{
+		StartedDateTime: x.start,
+		Time:            millis(end.Sub(x.start)),
+		Timings:         harTimings{Wait: millis(x.gotResp.Sub(x.start)), Receive: millis(end.Sub(x.gotResp))},
+	}
+	switch {
+	case err != nil:
+		e.Comment = "response incomplete: " + err.Error()
+	case x.c.maxBody > 0 && (x.reqBody.truncated || x.respBody.truncated):
+		e.Comment = "bodies cut at -capture-max-body"
+	}
+
+	req := x.req
+	e.Request = harRequest{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		HTTPVersion: req.Proto,
+		Cookies:     harCookies((&http.Request{Header: x.reqHeader}).Cookies()),
+		Headers:     harHeaders(x.reqHeader),
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    x.reqBody.n,
+	}
+	query := req.URL.Query()
+	for _, name := range slices.Sorted(maps.Keys(query)) {
+		for _, v := range query[name] {
+			e.Request.QueryString = append(e.Request.QueryString, harNameValue{name, v})
+		}
+	}
+	if x.reqBody.n > 0 {
+		text, enc := harText(x.reqBody)
+		e.Request.PostData = &harPostData{MimeType: x.reqHeader.Get("Content-Type"), Text: text, Encoding: enc}
+	}
+
+	e.Response = harResponse{
+		Status:      resp.StatusCode,
+		StatusText:  strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode))),
+		HTTPVersion: resp.Proto,
+		Cookies:     harCookies(resp.Cookies()),
+		Headers:     harHeaders(resp.Header),
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    x.respBody.n,
+	}
+	e.Response.Content = harContent{Size: x.respBody.n, MimeType: resp.Header.Get("Content-Type")}
+	e.Response.Content.Text, e.Response.Content.Encoding = harText(x.respBody)
+
+	if err := x.c.out.write(e); err != nil {
+		log.Error("writing -capture-file", "file", x.c.out.path, "error", err)
+	}
+}
+
+// harText returns what was kept of a body as HAR text: as it is if it is
+// UTF-8, else base64 encoded. If the body was cut at the size limit, only
+// the start is there.
+func harText(b *captureBuffer) (text, encoding string) {
+	if b.Len() == 0 {
+		return "", ""
+	}
+	if utf8.Valid(b.Bytes()) {
+		return b.String(), ""
+	}
+	return base64.StdEncoding.EncodeToString(b.Bytes()), "base64"
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for _, name := range slices.Sorted(maps.Keys(h)) {
+		for _, v := range h[name] {
+			headers = append(headers, harNameValue{name, v})
+		}
+	}
+	return headers
+}
+
+func harCookies(cookies []*http.Cookie) []harNameValue {
+	out := []harNameValue{}
+	for _, c := range cookies {
+		out = append(out, harNameValue{c.Name, c.Value})
+	}
+	return out
+}
+
+// matchesHost reports whether host is in hosts.
+func matchesHost(hosts *domainSet, host string) bool {
+	_, ok := hosts.match(host)
+	return ok
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
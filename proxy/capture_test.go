@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readHAR parses the HAR file at path, failing the test if it isn't one.
+func readHAR(t *testing.T, path string) []harEntry {
+	t.Helper()
+	var har struct {
+		Log struct {
+			Version string     `json:"version"`
+			Entries []harEntry `json:"entries"`
+		} `json:"log"`
+	}
+	if err := json.Unmarshal([]byte(readLog(t, path)), &har); err != nil {
+		t.Fatalf("%s isn't valid JSON: %v", path, err)
+	}
+	if har.Log.Version != "1.2" {
+		t.Errorf("HAR version %q, want 1.2", har.Log.Version)
+	}
+	return har.Log.Entries
+}
+
+func TestCaptureHAR(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		http.SetCookie(wr, &http.Cookie{Name: "session", Value: "abc"})
+		wr.Header().Set("Content-Type", "text/plain")
+		if req.URL.Path == "/binary" {
+			wr.Write([]byte{0xff, 0xfe, 0x00})
+			return
+		}
+		wr.Write([]byte("response body"))
+	})
+	path := filepath.Join(t.TempDir(), "capture.har")
+	p := newTestProxy(t, "-capture-file", path, "-capture-max-body", "8")
+
+	serve(p, "GET", b.URL+"/get?b=2&a=1", "Cookie: theme=dark")
+	if entries := readHAR(t, path); len(entries) != 1 {
+		t.Fatalf("%d entries after one request, want 1", len(entries))
+	}
+	req := httptest.NewRequest("POST", b.URL+"/post", strings.NewReader("0123456789"))
+	req.Header.Set("Content-Type", "text/plain")
+	p.ServeHTTP(httptest.NewRecorder(), req)
+	serve(p, "GET", b.URL+"/binary")
+
+	entries := readHAR(t, path)
+	if len(entries) != 3 {
+		t.Fatalf("%d entries, want 3", len(entries))
+	}
+	get := entries[0]
+	if get.Request.Method != "GET" || get.Request.URL != b.URL+"/get?b=2&a=1" || get.Response.Status != http.StatusOK || get.Response.StatusText != "OK" {
+		t.Errorf("GET captured as %s %s, %d %q", get.Request.Method, get.Request.URL, get.Response.Status, get.Response.StatusText)
+	}
+	if q := get.Request.QueryString; len(q) != 2 || q[0] != (harNameValue{"a", "1"}) || q[1] != (harNameValue{"b", "2"}) {
+		t.Errorf("query string captured as %v, want a=1 then b=2", q)
+	}
+	if c := get.Request.Cookies; len(c) != 1 || c[0] != (harNameValue{"theme", "dark"}) {
+		t.Errorf("request cookies captured as %v", c)
+	}
+	if c := get.Response.Cookies; len(c) != 1 || c[0] != (harNameValue{"session", "abc"}) {
+		t.Errorf("response cookies captured as %v", c)
+	}
+	if c := get.Response.Content; c.Size != 13 || c.Text != "response" || c.MimeType != "text/plain" || get.Comment == "" {
+		t.Errorf("response content captured as %+v with comment %q, want 13 bytes cut at 8", c, get.Comment)
+	}
+
+	post := entries[1]
+	if pd := post.Request.PostData; pd == nil || pd.Text != "01234567" || pd.MimeType != "text/plain" || post.Request.BodySize != 10 {
+		t.Errorf("POST body captured as %+v of %d bytes", pd, post.Request.BodySize)
+	}
+	if c := entries[2].Response.Content; c.Encoding != "base64" || c.Text != "//4A" {
+		t.Errorf("binary body captured as %q in %q, want base64", c.Text, c.Encoding)
+	}
+}
+
+func TestCaptureJSONLines(t *testing.T) {
+	b := echoBackend(t, "backend")
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	p := newTestProxy(t, "-capture-file", path, "-capture-hosts", "captured.test", "-backend", b.URL)
+	serve(p, "GET", "http://www.captured.test/in")
+	serve(p, "GET", "http://other.test/out")
+	serve(p, "GET", "http://captured.test/in-too")
+
+	lines := strings.Split(strings.TrimSpace(readLog(t, path)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d lines captured, want only the 2 for captured.test:\n%s", len(lines), strings.Join(lines, "\n"))
+	}
+	for i, want := range []string{"/in", "/in-too"} {
+		var e harEntry
+		if err := json.Unmarshal([]byte(lines[i]), &e); err != nil {
+			t.Fatal(err)
+		}
+		// Bodies aren't kept without -capture-max-body.
+		if !strings.HasSuffix(e.Request.URL, want) || e.Response.Content.Text != "" || e.Response.Content.Size == 0 {
+			t.Errorf("line %d captured %s with content %+v, want %s without its body", i+1, e.Request.URL, e.Response.Content, want)
+		}
+	}
+}
+
+func TestCaptureAdmin(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	l, err := newListener("minprox", []string{"-admin-addr", "127.0.0.1:0", "-capture-file", path, "-capture-off"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := l.aux[0].Handler
+	do := func(method, target, body string) map[string]any {
+		req := httptest.NewRequest(method, "http://localhost"+target, strings.NewReader(body))
+		req.Header.Set(adminHeader, "1")
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+		var v map[string]any
+		json.Unmarshal(rec.Body.Bytes(), &v)
+		return v
+	}
+
+	serve(l.handler, "GET", b.URL+"/")
+	if v := do("GET", "/capture", ""); v["enabled"] != false || v["entries"] != 0.0 || v["file"] != path {
+		t.Errorf("GET /capture with -capture-off = %v", v)
+	}
+	if v := do("PUT", "/capture?enabled=true", ""); v["enabled"] != true {
+		t.Errorf("PUT ?enabled=true = %v", v)
+	}
+	serve(l.handler, "GET", b.URL+"/")
+	if v := do("PUT", "/capture", `{"enabled": false}`); v["enabled"] != false || v["entries"] != 1.0 {
+		t.Errorf(`PUT {"enabled": false} = %v, want 1 entry captured`, v)
+	}
+	serve(l.handler, "GET", b.URL+"/")
+	if n := strings.Count(readLog(t, path), "\n"); n != 1 {
+		t.Errorf("%d requests captured, want only the one while enabled", n)
+	}
+	if v := do("PUT", "/capture?enabled=maybe", ""); v["error"] == nil {
+		t.Errorf("PUT ?enabled=maybe = %v, want an error", v)
+	}
+
+	l, err = newListener("minprox", []string{"-admin-addr", "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api = l.aux[0].Handler
+	if v := do("GET", "/capture", ""); v["error"] == nil {
+		t.Errorf("GET /capture without -capture-file = %v, want an error", v)
+	}
+}
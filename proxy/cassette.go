@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// interaction is one recorded request/response pair. A cassette file holds
+// one JSON encoded interaction per line.
+type interaction struct {
+	Request struct {
+		Method string      `json:"method"`
+		URL    string      `json:"url"`
+		Header http.Header `json:"header"`
+		Body   []byte      `json:"body,omitempty"`
+	} `json:"request"`
+	Response struct {
+		Status int         `json:"status"`
+		Header http.Header `json:"header"`
+		Body   []byte      `json:"body,omitempty"`
+	} `json:"response"`
+}
+
+// recorder appends completed interactions to a cassette file.
+type recorder struct {
+	path    string
+	mu      sync.Mutex
+	f       *os.File
+	enc     *json.Encoder
+	maxBody int
+}
+
+func newRecorder(path string, maxBody int) (*recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{path: path, f: f, enc: json.NewEncoder(f), maxBody: maxBody}, nil
+}
+
+// close closes the cassette file. Interactions finishing later aren't
+// recorded.
+func (r *recorder) close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+}
+
+// recording collects the bodies of a single in-flight interaction.
+type recording struct {
+	r         *recorder
+	req       *http.Request
+	reqBody   *cappedBuffer
+	respBody  *cappedBuffer
+	reqHeader http.Header
+}
+
+// start begins recording req, teeing its body as the backend reads it.
+func (r *recorder) start(req *http.Request) *recording {
+	if r == nil {
+		return nil
+	}
+	rec := &recording{
+		r:         r,
+		req:       req,
+		reqBody:   &cappedBuffer{max: r.maxBody},
+		respBody:  &cappedBuffer{max: r.maxBody},
+		reqHeader: req.Header.Clone(),
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(req.Body, rec.reqBody), req.Body}
+	}
+	return rec
+}
+
+// wrapResponse tees resp's body into the recording.
+func (rec *recording) wrapResponse(resp *http.Response) {
+	if rec == nil {
+		return
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(resp.Body, rec.respBody), resp.Body}
+}
+
+// finish writes the interaction to the cassette. Interactions whose bodies
+// exceeded the size limit are skipped, since they couldn't be replayed
+// faithfully.
+func (rec *recording) finish(resp *http.Response, log *slog.Logger) {
+	if rec == nil {
+		return
+	}
+	if rec.reqBody.overflow || rec.respBody.overflow {
+		log.Warn("not recording interaction", "reason", "body too large")
+		return
+	}
+
+	var it interaction
+	it.Request.Method = rec.req.Method
+	it.Request.URL = rec.req.URL.String()
+	it.Request.Header = rec.reqHeader
+	it.Request.Body = rec.reqBody.Bytes()
+	it.Response.Status = resp.StatusCode
+	it.Response.Header = resp.Header
+	it.Response.Body = rec.respBody.Bytes()
+
+	rec.r.mu.Lock()
+	defer rec.r.mu.Unlock()
+	if rec.r.f == nil {
+		log.Warn("not recording interaction", "reason", "cassette closed")
+		return
+	}
+	if err := rec.r.enc.Encode(&it); err != nil {
+		log.Error("recording interaction failed", "error", err)
+	}
+}
+
+// cassette serves recorded interactions instead of contacting backends.
+// Interactions are matched on method, URL and the configured headers;
+// repeated requests get successive recordings, the last one repeating.
+type cassette struct {
+	mu           sync.Mutex
+	matchHeaders []string
+	byKey        map[string][]*interaction
+}
+
+func loadCassette(path string, matchHeaders []string) (*cassette, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := &cassette{matchHeaders: matchHeaders, byKey: make(map[string][]*interaction)}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		it := new(interaction)
+		if err := json.Unmarshal(scanner.Bytes(), it); err != nil {
+			return nil, err
+		}
+		key := c.key(it.Request.Method, it.Request.URL, it.Request.Header)
+		c.byKey[key] = append(c.byKey[key], it)
+	}
+	return c, scanner.Err()
+}
+
+func (c *cassette) key(method, url string, header http.Header) string {
+	var b strings.Builder
+	b.WriteString(method)
+	b.WriteByte(' ')
+	b.WriteString(url)
+	for _, h := range c.matchHeaders {
+		b.WriteByte('\n')
+		b.WriteString(h)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(header.Values(h), ","))
+	}
+	return b.String()
+}
+
+// serve answers req from the cassette, or with 502 if nothing matches.
+func (c *cassette) serve(wr http.ResponseWriter, req *http.Request, log *slog.Logger) {
+	key := c.key(req.Method, req.URL.String(), req.Header)
+
+	c.mu.Lock()
+	var it *interaction
+	if list := c.byKey[key]; len(list) > 0 {
+		it = list[0]
+		if len(list) > 1 {
+			c.byKey[key] = list[1:]
+		}
+	}
+	c.mu.Unlock()
+
+	if it == nil {
+		log.Warn("no recorded interaction for request")
+		http.Error(wr, "No recorded response for this request", http.StatusBadGateway)
+		return
+	}
+
+	log.Info("Replaying response", "status", it.Response.Status)
+	copyHeader(wr.Header(), it.Response.Header)
+	wr.WriteHeader(it.Response.Status)
+	if bodyAllowed(req.Method, it.Response.Status) {
+		wr.Write(it.Response.Body)
+	}
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	n := 0
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		n++
+		wr.Header().Set("X-Seq", fmt.Sprint(n))
+		wr.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(wr, "response %d to %s", n, req.Header.Get("Accept-Language"))
+	})
+	cassette := filepath.Join(t.TempDir(), "cassette.jsonl")
+
+	rec := newTestProxy(t, "-record", cassette)
+	for _, lang := range []string{"en", "de", "fr"} {
+		serve(rec, "GET", b.URL+"/page", "Accept-Language: "+lang)
+	}
+	serve(rec, "GET", b.URL+"/other")
+	b.Close()
+
+	play := newTestProxy(t, "-replay", cassette, "-replay-match-headers", "Accept-Language")
+	for _, tt := range []struct {
+		path, lang string
+		status     int
+		body       string
+	}{
+		{"/page", "de", http.StatusCreated, "response 2 to de"},
+		{"/page", "en", http.StatusCreated, "response 1 to en"},
+		{"/page", "de", http.StatusCreated, "response 2 to de"},
+		{"/other", "", http.StatusCreated, "response 4 to "},
+		{"/page", "es", http.StatusBadGateway, ""},
+		{"/missing", "", http.StatusBadGateway, ""},
+	} {
+		got := serve(play, "GET", b.URL+tt.path, "Accept-Language: "+tt.lang)
+		if got.Code != tt.status || tt.body != "" && got.Body.String() != tt.body {
+			t.Errorf("replaying %s (%s): got %d %q, want %d %q", tt.path, tt.lang, got.Code, got.Body, tt.status, tt.body)
+		}
+	}
+}
+
+func TestReplaySuccessiveRecordings(t *testing.T) {
+	path := writeTempFile(t, "cassette.jsonl", strings.Join([]string{
+		`{"request":{"method":"GET","url":"http://x.test/"},"response":{"status":200,"body":"Zmlyc3Q="}}`,
+		``,
+		`{"request":{"method":"GET","url":"http://x.test/"},"response":{"status":200,"body":"c2Vjb25k"}}`,
+	}, "\n"))
+	p := newTestProxy(t, "-replay", path)
+	for _, want := range []string{"first", "second", "second"} {
+		if got := serve(p, "GET", "http://x.test/").Body.String(); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestRecordSkipsLargeBodies(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		wr.Write(bytes.Repeat([]byte("x"), 100))
+	})
+	cassette := filepath.Join(t.TempDir(), "cassette.jsonl")
+	p := newTestProxy(t, "-record", cassette, "-record-max-body", "50")
+	if rec := serve(p, "GET", b.URL+"/"); rec.Body.Len() != 100 {
+		t.Errorf("client got %d bytes, want all 100", rec.Body.Len())
+	}
+	if data, _ := os.ReadFile(cassette); len(data) != 0 {
+		t.Errorf("oversized interaction recorded: %s", data)
+	}
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// faultInjector adds artificial latency and errors to requests for
+// exercising client resilience. It does nothing unless -inject-delay or
+// -inject-error is given.
+type faultInjector struct {
+	delay     time.Duration
+	delayProb float64
+	errStatus int
+	errRate   float64
+	// hosts limits injection to matching targets; nil matches all.
+	hosts *domainSet
+}
+
+// apply injects any configured faults into req. It returns true if it
+// answered the request itself.
+func (f *faultInjector) apply(wr http.ResponseWriter, req *http.Request, log *slog.Logger) bool {
+	if f == nil {
+		return false
+	}
+	if f.hosts != nil {
+		if _, ok := f.hosts.match(targetHost(req)); !ok {
+			return false
+		}
+	}
+
+	if f.delay > 0 && rand.Float64() < f.delayProb {
+		log.Debug("injecting delay", "delay", f.delay)
+		select {
+		case <-time.After(f.delay):
+		case <-req.Context().Done():
+			return true
+		}
+	}
+
+	if f.errStatus != 0 && rand.Float64() < f.errRate {
+		log.Info("injecting error", "status", f.errStatus)
+		http.Error(wr, http.StatusText(f.errStatus), f.errStatus)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInjectError(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	p := newTestProxy(t, "-inject-error", "503", "-inject-error-rate", "1", "-inject-hosts", "flaky.test")
+	if rec := serve(p, "GET", "http://api.flaky.test/"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("matching host got %d, want 503", rec.Code)
+	}
+	if rec := serve(p, "GET", b.URL+"/"); rec.Code != http.StatusOK || b.hits != 1 {
+		t.Errorf("other host got %d with %d backend hits, want 200 from the backend", rec.Code, b.hits)
+	}
+
+	if _, err := New(WithFlags("-inject-error", "42")); err == nil {
+		t.Error("-inject-error 42 accepted")
+	}
+}
+
+func TestInjectDelay(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	p := newTestProxy(t, "-backend", b.URL, "-inject-delay", "50ms")
+	start := time.Now()
+	serve(p, "GET", "http://front.test/")
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("request took %v, want at least the 50ms delay", d)
+	}
+
+	// A client giving up ends the delay and the request.
+	p = newTestProxy(t, "-backend", b.URL, "-inject-delay", "1h")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequestWithContext(ctx, "GET", "http://front.test/", nil)
+	p.ServeHTTP(httptest.NewRecorder(), req)
+	if b.hits != 1 {
+		t.Errorf("backend hits = %d; the abandoned request reached it", b.hits)
+	}
+}
+
+func TestInjectNothingByChance(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	p := newTestProxy(t, "-backend", b.URL, "-inject-error", "500", "-inject-error-rate", "0")
+	for range 20 {
+		if rec := serve(p, "GET", "http://front.test/"); rec.Code != http.StatusOK {
+			t.Fatalf("got %d with a 0 error rate", rec.Code)
+		}
+	}
+}
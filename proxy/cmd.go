@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Main runs minprox as its command does, with the command line args
+// (without the program name), until it is interrupted or fails. Failures
+// are logged.
+func Main(args []string) {
+	logHandler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == "time" {
+				// a.Value = slog.StringValue(time.Now().Format(time.RFC3339))
+				a.Value = slog.TimeValue(time.Now())
+			}
+			return a
+		},
+	})
+
+	slog.SetDefault(slog.New(logHandler))
+
+	l, err := parseOptions(args)
+	if err != nil {
+		if err != flag.ErrHelp {
+			slog.Error("invalid configuration (quiting)", "error", err)
+		}
+		return
+	}
+
+	if l.syslog != "" {
+		h, err := newSyslogHandler(l.syslog)
+		if err != nil {
+			slog.Error("connecting to syslog (quiting)", "error", err)
+			return
+		}
+		slog.SetDefault(slog.New(h))
+	}
+
+	var listeners []*listener
+	if l.configFile != "" {
+		listeners, err = configListeners(l.configFile, args)
+		if err != nil {
+			slog.Error("invalid config file (quiting)", "error", err)
+			return
+		}
+		for _, l := range listeners {
+			l.server.Handler = newSwappableHandler(l.handler)
+		}
+	} else {
+		full, err := newListener("minprox", args)
+		if err != nil {
+			slog.Error("invalid configuration (quiting)", "error", err)
+			return
+		}
+		listeners = []*listener{full}
+	}
+
+	stats := newServerStats()
+	tunnels := newTunnelSet()
+	for _, l := range listeners {
+		l.handler.stats = stats
+		l.handler.tunnels = tunnels
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if l.maxRuntime > 0 {
+		// Ephemeral instances, e.g. in CI, go away even if whatever
+		// started them never does.
+		t := time.AfterFunc(l.maxRuntime, func() {
+			slog.Info("Reached -max-runtime, shutting down", "runtime", l.maxRuntime)
+			stop()
+		})
+		defer t.Stop()
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloaded := false
+			if l.configFile != "" {
+				// A reload reads every credential file afresh.
+				err := reloadConfig(ctx, l.configFile, args, listeners)
+				if err != nil {
+					slog.Error("reloading config, keeping the old one", "file", l.configFile, "error", err)
+				}
+				reloaded = err == nil
+			}
+			for _, l := range listeners {
+				if !reloaded {
+					l.handler.reloadSecrets()
+				}
+				l.handler.accessLog.reopen()
+			}
+		}
+	}()
+
+	err = run(ctx, listeners, l.shutdownTimeout, systemdHooks())
+	stats.log()
+	if err != nil {
+		slog.Error("ListenAndServe (quiting)", "error", err)
+		return
+	}
+	slog.Info("Stopped")
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMaxRuntime(t *testing.T) {
+	// Main logs to stdout and makes that the default logger.
+	stdout := os.Stdout
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = devnull
+	t.Cleanup(func() {
+		os.Stdout = stdout
+		devnull.Close()
+		slog.SetDefault(slog.New(slog.DiscardHandler))
+	})
+
+	sock := filepath.Join(t.TempDir(), "proxy")
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		Main([]string{"-addr", "unix:" + sock, "-max-runtime", "300ms"})
+		close(done)
+	}()
+	waitFor(t, func() bool {
+		_, err := unixGet(sock, "/")
+		return err == nil
+	})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("still running 5s into a 300ms -max-runtime")
+	}
+	if ran := time.Since(start); ran < 300*time.Millisecond {
+		t.Errorf("stopped after %v, before -max-runtime", ran)
+	}
+	if _, err := unixGet(sock, "/"); err == nil {
+		t.Error("still serving after Main returned")
+	}
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// coalescer merges concurrent identical GETs into one backend request.
+// The first request for a key goes to the backend; any that arrive while
+// it is in flight wait and get a copy of its response, which each then
+// runs through the rest of the pipeline as if it had fetched it.
+//
+// Only responses of known length up to maxBody, without Set-Cookie,
+// Cache-Control: private or a Vary on anything but Accept-Encoding, are
+// shared. For anything else, such as a streamed body, the waiting
+// requests are released to fetch their own.
+type coalescer struct {
+	maxBody int64
+
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// coalescedCall is one backend request in flight. resp and err are set
+// before done is closed; both nil means the response could not be shared.
+type coalescedCall struct {
+	done chan struct{}
+	resp *http.Response
+	body []byte
+	err  error
+}
+
+func newCoalescer(maxBody int64) *coalescer {
+	return &coalescer{maxBody: maxBody, calls: make(map[string]*coalescedCall)}
+}
+
+// key returns the key under which req may share a response, or "" if it
+// must not. Requests with credentials or cookies may get personal answers,
+// ranges and conditions change the body, and upgrades take the connection
+// over, so those always go to the backend. The Accept-Encoding is part of
+// the key so clients only get encodings they asked for, as is the Host
+// sent to the backend, as for the cache.
+func (c *coalescer) key(req *http.Request) string {
+	if c == nil || req.Method != http.MethodGet {
+		return ""
+	}
+	for _, h := range []string{"Authorization", "Cookie", "Range", "If-None-Match", "If-Modified-Since", "Upgrade"} {
+		if _, ok := req.Header[h]; ok {
+			return ""
+		}
+	}
+	return cacheKey(req) + "\x00" + strings.Join(req.Header.Values("Accept-Encoding"), ",")
+}
+
+// do sends req with client, or waits for an identical request already in
+// flight and returns a copy of its response.
+func (c *coalescer) do(client *http.Client, req *http.Request) (*http.Response, error) {
+	key := c.key(req)
+	if key == "" {
+		return client.Do(req)
+	}
+
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		switch {
+		case call.err != nil:
+			return nil, call.err
+		case call.resp != nil:
+			return call.response(req), nil
+		}
+		return client.Do(req)
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// An error caused by this client hanging up is not the backend's
+		// answer; the others try for themselves.
+		if req.Context().Err() == nil {
+			call.err = err
+		}
+		return nil, err
+	}
+	if !c.shareable(resp) {
+		return resp, nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	// Whatever happened, this request still reads the body it was sent,
+	// and the read error if there was one.
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	if err != nil {
+		return resp, nil
+	}
+
+	// The pipeline edits resp once it is returned, so the others copy
+	// from a snapshot.
+	shared := *resp
+	shared.Header = resp.Header.Clone()
+	shared.Trailer = nil
+	call.resp, call.body = &shared, body
+	return resp, nil
+}
+
+func (c *coalescer) shareable(resp *http.Response) bool {
+	if resp.ContentLength < 0 || resp.ContentLength > c.maxBody {
+		return false
+	}
+	if _, ok := resp.Header["Set-Cookie"]; ok {
+		return false
+	}
+	for _, v := range resp.Header.Values("Cache-Control") {
+		if strings.Contains(strings.ToLower(v), "private") {
+			return false
+		}
+	}
+	// Requests differing in the headers varied on were merged, and only
+	// Accept-Encoding is in the key.
+	return variesOnlyOnEncoding(resp.Header)
+}
+
+// variesOnlyOnEncoding reports whether the Vary header of a response names
+// no request header but Accept-Encoding.
+func variesOnlyOnEncoding(header http.Header) bool {
+	for _, v := range header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" && !strings.EqualFold(name, "Accept-Encoding") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// response returns a copy of the shared response for req.
+func (call *coalescedCall) response(req *http.Request) *http.Response {
+	resp := *call.resp
+	resp.Header = call.resp.Header.Clone()
+	resp.Body = io.NopCloser(bytes.NewReader(call.body))
+	resp.Request = req
+	return &resp
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// coalesceBackend holds every request until release is closed, and writes
+// header on each response.
+func coalesceBackend(t *testing.T, header http.Header) (srv *httptest.Server, hits *atomic.Int64, arrived chan struct{}, release chan struct{}) {
+	hits = new(atomic.Int64)
+	arrived, release = make(chan struct{}, 100), make(chan struct{})
+	srv = httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		n := hits.Add(1)
+		arrived <- struct{}{}
+		<-release
+		for name, values := range header {
+			wr.Header()[name] = values
+		}
+		fmt.Fprintf(wr, "response %d", n)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, hits, arrived, release
+}
+
+// coalesceConcurrently sends n copies of a GET for url, the first alone
+// until the backend has it, and returns the bodies.
+func coalesceConcurrently(t *testing.T, c *coalescer, url string, n int, arrived, release chan struct{}) []string {
+	t.Helper()
+	bodies := make([]string, n)
+	var wg sync.WaitGroup
+	get := func(i int) {
+		defer wg.Done()
+		req := httptest.NewRequest("GET", url, nil)
+		req.RequestURI = ""
+		resp, err := c.do(http.DefaultClient, req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		bodies[i] = string(body)
+	}
+	wg.Add(n)
+	go get(0)
+	<-arrived
+	for i := 1; i < n; i++ {
+		go get(i)
+	}
+	// Give the others time to find the call in flight.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	return bodies
+}
+
+func TestCoalescerShares(t *testing.T) {
+	srv, hits, arrived, release := coalesceBackend(t, http.Header{"Vary": {"Accept-Encoding"}})
+	bodies := coalesceConcurrently(t, newCoalescer(1<<20), srv.URL+"/same", 5, arrived, release)
+	if hits.Load() != 1 {
+		t.Errorf("backend hit %d times, want 1", hits.Load())
+	}
+	for i, body := range bodies {
+		if body != "response 1" {
+			t.Errorf("request %d got %q, want the shared response", i, body)
+		}
+	}
+}
+
+func TestCoalescerDoesNotShare(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		header  http.Header
+		maxBody int64
+	}{
+		{"Set-Cookie", http.Header{"Set-Cookie": {"id=1"}}, 1 << 20},
+		{"private", http.Header{"Cache-Control": {"max-age=5, Private"}}, 1 << 20},
+		{"Vary", http.Header{"Vary": {"Accept-Encoding, Accept-Language"}}, 1 << 20},
+		{"too big", nil, 4},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, hits, arrived, release := coalesceBackend(t, tt.header)
+			bodies := coalesceConcurrently(t, newCoalescer(tt.maxBody), srv.URL, 3, arrived, release)
+			if hits.Load() != 3 {
+				t.Errorf("backend hit %d times, want 3", hits.Load())
+			}
+			seen := map[string]bool{}
+			for _, body := range bodies {
+				seen[body] = true
+			}
+			if len(seen) != 3 {
+				t.Errorf("bodies %q, want each request's own", bodies)
+			}
+		})
+	}
+}
+
+func TestCoalescerKey(t *testing.T) {
+	c := newCoalescer(1 << 20)
+	base := httptest.NewRequest("GET", "http://a.test/x", nil)
+	key := c.key(base)
+	if key == "" {
+		t.Fatal("plain GET not coalesced")
+	}
+	for _, h := range []string{"Authorization", "Cookie", "Range", "If-None-Match", "If-Modified-Since", "Upgrade"} {
+		req := base.Clone(base.Context())
+		req.Header.Set(h, "x")
+		if c.key(req) != "" {
+			t.Errorf("request with %s coalesced", h)
+		}
+	}
+	if c.key(httptest.NewRequest("POST", "http://a.test/x", nil)) != "" {
+		t.Error("POST coalesced")
+	}
+
+	gzip := base.Clone(base.Context())
+	gzip.Header.Set("Accept-Encoding", "gzip")
+	otherHost := base.Clone(base.Context())
+	otherHost.Host = "b.test"
+	for name, req := range map[string]*http.Request{"Accept-Encoding": gzip, "Host": otherHost} {
+		if k := c.key(req); k == "" || k == key {
+			t.Errorf("request with another %s shares the key", name)
+		}
+	}
+
+	var none *coalescer
+	if none.key(base) != "" {
+		t.Error("nil coalescer returned a key")
+	}
+}
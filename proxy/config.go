@@ -0,0 +1,1035 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listener is one proxy handler and the server it is served by, built from
+// a set of command line style arguments.
+type listener struct {
+	handler *proxy
+	server  *http.Server
+	// aux are helper servers that run alongside server, such as the
+	// ACME HTTP-01 challenge listener.
+	aux []*http.Server
+	// socks, if set, serves SOCKS5 clients with the same handler.
+	socks *socksServer
+	// addrs are the addresses server listens on; its Addr is the first.
+	addrs []string
+	// proxyProto, if set, are the load balancers trusted to send PROXY
+	// protocol headers.
+	proxyProto []netip.Prefix
+	// connLimit, if set, caps each client's open connections for
+	// -max-conns-per-client.
+	connLimit *connLimiter
+
+	configFile      string
+	shutdownTimeout time.Duration
+	maxRuntime      time.Duration
+	bindRetry       time.Duration
+	reusePort       bool
+	syslog          string
+}
+
+// sharedServers are the -metrics-addr, -admin-addr and -acme-http-addr
+// servers of a set of listeners, one for each address however many of
+// them ask for it, so options given once on the command line for every
+// -config listener don't each start a server of their own.
+type sharedServers struct {
+	metrics map[string]*metrics
+	admin   map[string]*adminAPI
+	acme    map[string]challengeServer
+}
+
+func newSharedServers() *sharedServers {
+	return &sharedServers{
+		metrics: make(map[string]*metrics),
+		admin:   make(map[string]*adminAPI),
+		acme:    make(map[string]challengeServer),
+	}
+}
+
+// challengeServer answers the HTTP-01 challenges of every listener on one
+// -acme-http-addr, passing each request on to the ACME handler for its
+// Host's -acme-domains.
+type challengeServer map[string]http.Handler
+
+func (c challengeServer) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	h, ok := c[normalizeHost(host)]
+	if !ok {
+		http.NotFound(wr, req)
+		return
+	}
+	h.ServeHTTP(wr, req)
+}
+
+// newListener registers every option on a fresh flag set named name,
+// parses args and builds the proxy they describe.
+func newListener(name string, args []string) (*listener, error) {
+	return buildListener(name, args, newSharedServers())
+}
+
+// parseOptions parses args as newListener does, but only sets the options
+// of the listener that aren't about its proxy, such as -config and
+// -syslog, leaving its handler and servers unbuilt.
+func parseOptions(args []string) (*listener, error) {
+	return buildListener("minprox", args, nil)
+}
+
+// buildListener is newListener with the servers shared with other
+// listeners, or, if shared is nil, parseOptions.
+func buildListener(name string, args []string, shared *sharedServers) (*listener, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+
+	handler := &proxy{}
+
+	addr := &addrFlag{addrs: []string{"127.0.0.1:8080"}}
+	fs.Var(addr, "addr", "Address to listen on, host:port, unix:PATH for a Unix socket or systemd:[NAME] for a socket passed by systemd (repeat to listen on several).")
+	l := &listener{}
+	fs.StringVar(&l.configFile, "config", "", "JSON or TOML (.toml) config file describing one or more listeners, reloaded on SIGHUP.")
+	fs.DurationVar(&l.shutdownTimeout, "shutdown-timeout", 10*time.Second, "How long to wait for requests and tunnels to finish on SIGINT or SIGTERM before closing them.")
+	fs.DurationVar(&l.bindRetry, "bind-retry", 0, "If the listen address is in use, keep trying to bind it for this long.")
+	fs.BoolVar(&l.reusePort, "reuse-port", false, "Bind with SO_REUSEPORT, so a new instance can take over the address while this one drains.")
+	var maxConnsPerClient = fs.Int("max-conns-per-client", 0, "Maximum connections, tunnels included, each client IP may have open at once; more are refused with 429 (0 is unlimited).")
+	var proxyProtocol = fs.String("proxy-protocol", "", "Read PROXY protocol v1/v2 headers from load balancers at these IPs or CIDR prefixes, taking the client address from them (Unix socket peers are trusted too).")
+	fs.DurationVar(&l.maxRuntime, "max-runtime", 0, "Shut down gracefully after running this long, as if sent SIGTERM (0 runs until stopped).")
+	fs.StringVar(&l.syslog, "syslog", "", "Log to syslog instead of stdout: local, or udp://, tcp:// or unix:// address.")
+	var backends listFlag
+	fs.Var(&backends, "backend", "Run as a reverse proxy in front of this backend URL (repeat to balance over several).")
+	var backendFallback = fs.String("backend-fallback", "", "Other host[:port] endpoints of -backend, dialled in order when it refuses or fails.")
+	var lbStrategy = fs.String("lb-strategy", lbRoundRobin, "How requests are spread over repeated -backend URLs: round-robin or least-latency.")
+	var routes listFlag
+	fs.Var(&routes, "route", "Reverse-proxy requests by host, path prefix or both to a backend URL: /prefix=URL, host=URL or host/prefix=URL, host may be *.domain (repeatable).")
+	fs.BoolVar(&handler.forwardUnmatched, "forward-unmatched", false, "With -route and no -backend, forward proxy requests that match no route instead of answering 404.")
+	var abBackend = fs.String("ab-backend", "", "In reverse-proxy mode, send the -ab-split share of clients to this backend URL.")
+	var abSplitFlag = fs.String("ab-split", "", "Variant name and share of clients for -ab-backend, e.g. v2=10%.")
+	var abKey = fs.String("ab-key", "ip", "What assigns clients to a variant: ip or cookie:NAME.")
+	var abHeader = fs.String("ab-header", "X-Backend-Variant", "Response header naming the variant that served the request (empty disables).")
+	var timeoutHeaderMax = fs.Duration("timeout-header-max", 0, "Honour X-Proxy-Timeout from -timeout-header-from clients, capped at this (0 disables).")
+	var timeoutHeaderFrom = fs.String("timeout-header-from", "", "Client IPs or CIDR prefixes trusted to send X-Proxy-Timeout.")
+	fs.StringVar(&handler.backendHeader, "backend-header", "", "Let trusted callers pick the backend with this request header, e.g. X-Proxy-Backend.")
+	var backendAllow = fs.String("backend-allow", "", "Backend URLs -backend-header may name; others get 403.")
+	fs.StringVar(&handler.stripPrefix, "strip-prefix", "", "In reverse-proxy mode, remove this prefix from request paths.")
+	fs.StringVar(&handler.addPrefix, "add-prefix", "", "In reverse-proxy mode, prepend this prefix to request paths.")
+	var blocklistFile = fs.String("blocklist", "", "File of domains to block (plain list or hosts format).")
+	var rulesFile = fs.String("rules", "", "File of URL rules editing headers, rewriting, redirecting and blocking requests, one \"PATTERN ACTION ARGUMENTS\" per line.")
+	var aclFile = fs.String("acl-file", "", "File of destination rules, one \"allow RULE\" or \"deny RULE\" per line; RULE is *, host, *.domain, address or CIDR, optionally :PORT or :LOW-HIGH.")
+	var aclAllow = fs.String("acl-allow", "", "Destination rules to allow, as in -acl-file; when any are set, other destinations get 403.")
+	var aclDeny = fs.String("acl-deny", "", "Destination rules to refuse with 403, as in -acl-file. Deny rules win over allow rules.")
+	fs.StringVar(&handler.blockMode, "block-response-mode", blockModeForbidden, "Response for blocked requests: 403, 204, or stub (1x1 image for image requests, else 204).")
+	fs.DurationVar(&handler.retryAfterBase, "retry-after", 5*time.Second, "Minimum Retry-After sent with 429 and 503 responses.")
+	fs.Float64Var(&handler.retryAfterJitter, "retry-after-jitter", 0.2, "Random fraction added to Retry-After so clients don't retry in step.")
+	fs.BoolVar(&handler.verboseErrors, "verbose-errors", false, "Describe failed backend requests in 502 and 504 bodies as JSON (error category and target host).")
+	fs.BoolVar(&handler.honorMethodOverride, "honor-method-override", false, "Forward POSTs with X-HTTP-Method-Override as the method it names, without the header.")
+	var pac = fs.Bool("pac", false, "Serve a proxy auto-config file for this listener at "+pacPath+".")
+	var pacProxy = fs.String("pac-proxy", "", "Proxy host:port the PAC file names (default the address it was fetched from).")
+	var pacDirect = fs.String("pac-direct", "", "Destinations the PAC file sends direct, as ACL patterns without ports: host, *.domain or CIDR.")
+	var wpad = fs.Bool("wpad", false, "Also serve the PAC file at "+wpadPath+" for WPAD discovery (implies -pac).")
+	fs.StringVar(&handler.echoPath, "echo-path", "", "Answer requests for this path locally with the request as the proxy would forward it, as JSON.")
+	var geoDB = fs.String("geoip-db", "", "MaxMind country or city database; adds X-Client-Country to forwarded requests.")
+	var geoAllow = fs.String("geoip-allow", "", "Only serve clients from these ISO country codes (needs -geoip-db).")
+	var geoDeny = fs.String("geoip-deny", "", "Refuse clients from these ISO country codes with 403 (needs -geoip-db).")
+	var quotaBytes = fs.Int64("quota-bytes", 0, "Maximum bytes each client IP may transfer per -quota-window (0 is unlimited).")
+	var quotaWindow = fs.Duration("quota-window", time.Hour, "Window for -quota-bytes.")
+	var injectDelay = fs.Duration("inject-delay", 0, "Chaos testing: delay requests by this long.")
+	var injectDelayProb = fs.Float64("inject-delay-prob", 1, "Fraction (0-1) of requests delayed by -inject-delay.")
+	var injectError = fs.Int("inject-error", 0, "Chaos testing: answer requests with this HTTP status.")
+	var injectErrorRate = fs.Float64("inject-error-rate", 0.1, "Fraction (0-1) of requests answered with -inject-error.")
+	var injectHosts = fs.String("inject-hosts", "", "Only inject faults for these domains (default all).")
+	fs.BoolVar(&handler.preserveHost, "preserve-host", false, "Forward the client's Host header rather than the backend's host.")
+	fs.BoolVar(&handler.serveStale, "serve-stale", false, "Serve the last good response when the backend is unreachable.")
+	fs.StringVar(&handler.cacheStatusHeader, "cache-status-header", "X-Cache", "Response header reporting the cache outcome (empty disables).")
+	var staleEntries = fs.Int("stale-entries", 1000, "Maximum number of responses kept for -serve-stale.")
+	var staleMaxBody = fs.Int("stale-max-body", 1<<20, "Maximum body size in bytes kept for -serve-stale.")
+	var cacheSize = fs.Int64("cache-size", 0, "Cache responses per RFC 7234 in up to this many bytes, evicting the least recently used (0 disables).")
+	var cacheDir = fs.String("cache-dir", "", "Keep -cache-size bodies in this directory instead of memory, so they survive restarts.")
+	var cacheMaxObject = fs.Int64("cache-max-object", 64<<20, "Largest response body in bytes stored by -cache-size.")
+	var coalesce = fs.Bool("coalesce", false, "Let concurrent identical GETs share one backend request and its response.")
+	var coalesceMaxBody = fs.Int64("coalesce-max-body", 1<<20, "Largest response body in bytes shared by -coalesce.")
+	fs.BoolVar(&handler.noConnect, "no-connect", false, "Refuse CONNECT requests (plain HTTP forwarding only).")
+	fs.DurationVar(&handler.tunnelIdleTimeout, "tunnel-idle-timeout", 0, "Close CONNECT tunnels idle for this long (0 disables).")
+	fs.DurationVar(&handler.tunnelMaxDuration, "tunnel-max-duration", 0, "Close CONNECT tunnels this long after they open, busy or not (0 disables).")
+	fs.DurationVar(&handler.tunnelLinger, "tunnel-linger", 30*time.Second, "Once one side of a tunnel is done, close it if the other hasn't finished within this long (0 waits).")
+	fs.BoolVar(&handler.tunnelSockOpts.noDelay, "tunnel-nodelay", true, "Set TCP_NODELAY on tunnel sockets so small interactive writes aren't batched.")
+	fs.IntVar(&handler.tunnelSockOpts.readBuffer, "tunnel-read-buffer", 0, "Socket receive buffer size for tunnels, in bytes (0 is the OS default).")
+	fs.IntVar(&handler.tunnelSockOpts.writeBuffer, "tunnel-write-buffer", 0, "Socket send buffer size for tunnels, in bytes (0 is the OS default).")
+	var globalRate = fs.Float64("global-rate", 0, "Maximum outbound requests and tunnels per second across all clients (0 is unlimited).")
+	var globalBurst = fs.Int("global-burst", 0, "Requests -global-rate lets through at once after a quiet spell (default one second's worth).")
+	var rateLimits, bandwidthLimits listFlag
+	fs.Var(&rateLimits, "rate-limit", "Requests and tunnels per second allowed per KEY (ip, user or host), as KEY=RATE or KEY=RATE/BURST; more get 429. Repeatable.")
+	fs.Var(&bandwidthLimits, "bandwidth-limit", "Bytes per second per KEY (ip, user or host) for bodies and tunnels, as KEY=RATE or KEY=RATE/BURST. Repeatable.")
+	fs.DurationVar(&handler.globalRateWait, "global-rate-wait", time.Second, "How long a request over -global-rate waits for its turn before getting 503.")
+	fs.IntVar(&handler.maxTunnels, "max-tunnels", 0, "Maximum concurrent CONNECT tunnels; more get 503 (0 is unlimited).")
+	fs.IntVar(&handler.connectRetries, "connect-retries", 2, "Retries for transient CONNECT dial failures.")
+	fs.DurationVar(&handler.connectRetryBackoff, "connect-retry-backoff", 100*time.Millisecond, "Initial backoff between CONNECT dial retries.")
+	var requestRetries = fs.Int("request-retries", 0, "Retries for idempotent backend requests without a body that fail to connect, are reset, or get a -request-retry-statuses answer.")
+	var requestRetryBackoff = fs.Duration("request-retry-backoff", 100*time.Millisecond, "Initial backoff between -request-retries, doubling each time.")
+	var requestRetryStatuses = fs.String("request-retry-statuses", "502,503,504", "Backend response statuses that -request-retries retries.")
+	var requestRetryBudget = fs.Duration("request-retry-budget", 10*time.Second, "Don't start a retry that would end more than this long after the request's first attempt (0 is unlimited).")
+	fs.BoolVar(&handler.logSNI, "log-sni", false, "Log the TLS server name (SNI) clients send through CONNECT tunnels.")
+	var connectPorts = fs.String("connect-ports", "80,443", "Only allow CONNECT to these ports and LOW-HIGH ranges, e.g. 443,8000-8999, or to any port with *.")
+	fs.StringVar(&handler.connectDefaultPort, "connect-default-port", defaultConnectPort, "Port dialled for CONNECT targets that don't give one.")
+	fs.Int64Var(&handler.bufferResponses, "buffer-responses", 0, "Buffer up to this many bytes of each response before sending it, so backend failures give 502 (0 streams).")
+	fs.BoolVar(&handler.forceIdentity, "force-identity-encoding", false, "Send Accept-Encoding: identity to backends so responses arrive uncompressed.")
+	fs.Int64Var(&handler.decompressionLimits.maxBytes, "max-decompressed-bytes", 1<<30, "Abort responses decompressed past this many bytes (0 is unlimited).")
+	fs.Float64Var(&handler.decompressionLimits.maxRatio, "max-decompression-ratio", 1000, "Abort responses inflating more than this many times their compressed size past 1MB (0 is unlimited).")
+	var requestHeaderAllow = fs.String("request-header-allowlist", "", "Forward only these request headers to backends (body framing headers and Content-Type always pass).")
+	var responseHeaderAllow = fs.String("response-header-allowlist", "", "Return only these response headers to clients (body framing headers and Content-Type always pass).")
+	fs.BoolVar(&handler.stripAltSvc, "strip-alt-svc", false, "Strip Alt-Svc headers from backend responses.")
+	fs.StringVar(&handler.serverHeader, "server-header", "", "Replace the Server header on responses with this value (\"-\" removes it, empty passes it through).")
+	var stripResponseHeaders = fs.String("strip-response-headers", "", "Remove these headers from backend responses, e.g. X-Powered-By,X-AspNet-Version.")
+	var securityHeaders = fs.Bool("security-headers", false, "In reverse-proxy mode, add HSTS, nosniff, framing and CSP headers to responses that lack them.")
+	var hsts = fs.String("hsts", "max-age=31536000; includeSubDomains", "Strict-Transport-Security value for -security-headers (empty omits it).")
+	var frameOptions = fs.String("frame-options", "DENY", "X-Frame-Options value for -security-headers (empty omits it).")
+	var csp = fs.String("csp", "", "Content-Security-Policy value for -security-headers (empty omits it).")
+	var securityOverride = fs.Bool("security-headers-override", false, "Replace security headers the backend already set.")
+	var adaptURL = fs.String("adapt-url", "", "POST request and response bodies to this content adaptation service for approval.")
+	var adaptTimeout = fs.Duration("adapt-timeout", 30*time.Second, "Timeout for content adaptation requests.")
+	var transform = fs.String("transform", "", "Rewrite response bodies with this command (body on stdin, result on stdout) or template:FILE Go template.")
+	var transformTypes = fs.String("transform-types", "text/html", "Content type prefixes rewritten by -transform.")
+	var transformMaxBody = fs.Int64("transform-max-body", 1<<20, "Larger response bodies bypass -transform.")
+	var transformTimeout = fs.Duration("transform-timeout", 10*time.Second, "Timeout for each -transform command run.")
+	var mirrorTo = fs.String("mirror-to", "", "Mirror a copy of each proxied request to this base URL.")
+	var mirrorTimeout = fs.Duration("mirror-timeout", 10*time.Second, "Timeout for mirrored requests.")
+	var mirrorMaxBody = fs.Int64("mirror-max-body", 1<<20, "Requests with larger bodies are not mirrored.")
+	fs.StringVar(&handler.via, "via", defaultVia(), "Pseudonym added to Via headers and used for loop detection (empty disables).")
+	fs.IntVar(&handler.maxForwardHops, "max-forward-hops", 0, "Maximum X-Forwarded-For entries accepted from clients (0 is unlimited).")
+	fs.BoolVar(&handler.stripReferer, "strip-referer", false, "Remove the Referer header from forwarded requests.")
+	fs.StringVar(&handler.refererPolicy, "referer-policy", "", "Set to origin to cut forwarded Referer headers down to scheme and host.")
+	fs.BoolVar(&handler.noXFF, "no-xff", false, "Don't add X-Forwarded-For, and strip forwarding headers clients send, hiding them from backends.")
+	var trustedProxies = fs.String("trusted-proxies", "", "Client IPs or CIDR prefixes whose X-Forwarded-*, Forwarded and X-Real-Ip headers are passed on; other clients' are handled per -forwarded-untrusted.")
+	var forwardedUntrusted = fs.String("forwarded-untrusted", forwardedReplace, "With -trusted-proxies, what becomes of other clients' forwarding headers: replace (with the client's address) or strip (add none).")
+	var forwardedHeader = fs.Bool("forwarded-header", false, "Add an RFC 7239 Forwarded header (for, proto, host) alongside X-Forwarded-For.")
+	var forwardedProtoHost = fs.Bool("forwarded-proto-host", false, "Set X-Forwarded-Proto and X-Forwarded-Host on forward proxy requests too, not just reverse-proxied ones.")
+	var forwardHopsAction = fs.String("forward-hops-action", "reject", "What to do past -max-forward-hops: reject (502) or truncate.")
+	var dedupe = fs.Bool("dedupe-headers", false, "Forward only the first value of duplicated single-value headers.")
+	var dedupeList = fs.String("dedupe-header-list", "Content-Type,Content-Length,Host", "Headers affected by -dedupe-headers.")
+	var debugSampleRate = fs.Float64("debug-sample", 0, "Fraction (0-1) of requests given body capture and backend timing traces.")
+	var bodyLogSample = fs.Float64("body-log-sample", 0, "Fraction (0-1) of requests whose bodies are logged.")
+	var bodyLogTypes = fs.String("body-log-types", "application/json,application/x-www-form-urlencoded,text/", "Content type prefixes eligible for body logging.")
+	var bodyLogMax = fs.Int("body-log-max", 4096, "Truncate logged bodies to this many bytes.")
+	var bodyLogRedact = fs.String("body-log-redact", "password,token,secret", "JSON fields redacted from logged bodies.")
+	var recordFile = fs.String("record", "", "Record request/response pairs to this cassette file.")
+	var recordMaxBody = fs.Int("record-max-body", 10<<20, "Interactions with larger bodies are not recorded.")
+	var captureFile = fs.String("capture-file", "", "Capture forwarded requests and responses to this file: HAR if named *.har, else one HAR entry per line.")
+	var captureHosts = fs.String("capture-hosts", "", "Capture only requests for these domains and their subdomains.")
+	var captureMaxBody = fs.Int("capture-max-body", 0, "Keep captured bodies up to this many bytes (0 keeps none).")
+	var captureOff = fs.Bool("capture-off", false, "Start with -capture-file switched off, for the admin API to turn on.")
+	var replayFile = fs.String("replay", "", "Serve requests from this cassette file instead of contacting backends.")
+	var replayHeaders = fs.String("replay-match-headers", "", "Request headers that must also match when replaying.")
+	var otlpEndpoint = fs.String("otlp-endpoint", "", "Export traces to this OTLP/HTTP collector URL.")
+	fs.IntVar(&handler.maxRequestHeaders, "max-request-headers", 0, "Reject requests with more header lines than this with 400 (0 is unlimited).")
+	fs.IntVar(&handler.maxCookies, "max-cookies", 0, "Reject requests carrying more cookies than this with 400 (0 is unlimited).")
+	fs.Int64Var(&handler.maxBodyBytes, "max-body-bytes", 0, "Answer requests with bodies larger than this with 413 (0 is unlimited).")
+	var maxHeaderBytes = fs.Int("max-header-bytes", http.DefaultMaxHeaderBytes, "Maximum size of client request headers; larger requests get 431.")
+	var accessLogPath = fs.String("access-log", "", "Write an access log line per request to this file (\"-\" for stdout).")
+	var accessLogFormat = fs.String("access-log-format", accessLogCombined, "Access log format: common, combined, or json (adds request bytes, duration and destination).")
+	var accessLogMaxSize = fs.Int64("access-log-max-size", 0, "Rotate -access-log once it reaches this many bytes (0 leaves rotation to SIGHUP).")
+	var accessLogBackups = fs.Int("access-log-backups", 5, "Rotated -access-log files kept, as FILE.1 to FILE.N.")
+	var adminAddr = fs.String("admin-addr", "", "Serve the admin API (connections, tunnels, config, log level, cache flush, ACL edits) at this loopback host:port or unix:PATH.")
+	var metricsAddr = fs.String("metrics-addr", "", "Serve Prometheus metrics on /metrics at this address.")
+	var metricsHosts = fs.String("metrics-hosts", "", "Target hosts that always get their own metrics label.")
+	var metricsMaxHosts = fs.Int("metrics-max-hosts", 0, "Label metrics by target host for up to this many other hosts, the first seen rather than the busiest; later ones are \"other\" until restart, so list busy hosts in -metrics-hosts.")
+	var h2c = fs.Bool("h2c", false, "Accept cleartext HTTP/2 (h2c) from clients and forward gRPC to backends over HTTP/2.")
+	var tlsCert = fs.String("tls-cert", "", "Serve the proxy over TLS with this PEM certificate (with -tls-key), re-read on SIGHUP.")
+	var tlsKey = fs.String("tls-key", "", "PEM private key for -tls-cert.")
+	var tlsALPN = fs.String("tls-alpn", "h2,http/1.1", "Protocols offered to -tls-cert clients by ALPN: h2, http/1.1 or both.")
+	var tlsClientCA = fs.String("tls-client-ca", "", "With -tls-cert, require client certificates signed by a CA in this PEM file.")
+	var mitmCACert = fs.String("mitm-ca-cert", "", "Intercept CONNECT tunnels with host certificates signed by this CA (PEM, created along with -mitm-ca-key if both are missing).")
+	var mitmCAKey = fs.String("mitm-ca-key", "", "Private key of the -mitm-ca-cert CA.")
+	var mitmHosts = fs.String("mitm-hosts", "", "Only intercept tunnels to these domains (default all).")
+	var acmeDomains = fs.String("acme-domains", "", "Serve the proxy over TLS with certificates for these domains from ACME (needs -tags acme).")
+	var acmeCacheDir = fs.String("acme-cache-dir", "acme-cache", "Directory for ACME account keys and certificates.")
+	var acmeEmail = fs.String("acme-email", "", "Contact email for the ACME account.")
+	var acmeDirectory = fs.String("acme-directory", "", "ACME directory URL (default Let's Encrypt production).")
+	var acmeHTTPAddr = fs.String("acme-http-addr", ":80", "Address answering ACME HTTP-01 challenges (empty disables).")
+	var dnsNegTTL = fs.Duration("dns-neg-ttl", 0, "Fail requests for host names found not to exist within this long without looking them up again (0 disables).")
+	var resolver = fs.String("resolver", "", "Resolve target hosts using this DNS server (host[:port]), or DNS-over-HTTPS server (https:// URL), instead of the system resolver.")
+	var hostsFile = fs.String("hosts-file", "", "Resolve target hosts listed in this hosts-style file (ADDRESS NAME..., *.domain allowed) to the addresses given.")
+	var dnsCacheTTL = fs.Duration("dns-cache-ttl", 0, "Reuse the addresses a target host resolved to for this long (0 disables).")
+	var socksAddr = fs.String("socks-addr", "", "Also serve SOCKS5 clients (TCP connect and UDP associate) on this address, with the same ACL, auth and filters.")
+	var upstream = fs.String("upstream", "", "Send all traffic through this parent proxy URL, http:// or socks5://; list several to fail over to the next while one is unreachable.")
+	var upstreamRoutes listFlag
+	fs.Var(&upstreamRoutes, "upstream-route", "Route destinations matching an ACL-style pattern through another parent proxy, directly or nowhere: PATTERN=URL, PATTERN=direct or PATTERN=block (repeatable, first match wins).")
+	var routeFile = fs.String("route-file", "", "File of routes tried after the -upstream-route ones, one \"PATTERN URL|direct|block\" per line.")
+	var upstreamAuth = fs.String("upstream-auth", "", "Credentials (user:password) for the -upstream proxy.")
+	var upstreamAuthFile = fs.String("upstream-auth-file", "", "Read -upstream-auth credentials from this file, re-read on SIGHUP.")
+	var authFile = fs.String("auth-file", "", "Require clients to authenticate as a user in this htpasswd-style file, re-read on SIGHUP.")
+	var authSchemes = fs.String("auth", "", "Authentication schemes offered for -auth-file: basic, digest or both (default basic).")
+	var tcpFastOpen = fs.Bool("tcp-fastopen", false, "Enable TCP Fast Open on outbound connections where supported.")
+	var dialTimeout = fs.Duration("dial-timeout", 30*time.Second, "Give up connecting to a backend or CONNECT target after this long.")
+	var tlsHandshakeTimeout = fs.Duration("tls-handshake-timeout", 10*time.Second, "Give up on a backend TLS handshake after this long (0 waits forever).")
+	var responseHeaderTimeout = fs.Duration("response-header-timeout", 0, "Answer 504 if a backend sends no response headers this long after the request (0 waits forever).")
+	var requestTimeout = fs.Duration("request-timeout", 0, "Abort backend requests not finished, response body included, after this long (0 is unlimited).")
+	var maxIdleConnsPerHost = fs.Int("max-idle-conns-per-host", 16, "Maximum idle backend connections kept per host for reuse.")
+	var idleConnTimeout = fs.Duration("idle-conn-timeout", 90*time.Second, "Close idle backend connections after this long (0 keeps them forever).")
+	var maxIdleConns = fs.Int("max-idle-conns", 100, "Maximum idle backend connections across all hosts (0 is unlimited).")
+	var maxConnsPerHost = fs.Int("max-conns-per-host", 0, "Maximum backend connections per host (0 is unlimited).")
+	var tlsSessionCache = fs.Int("tls-session-cache", 256, "Backend TLS sessions kept for resumption (0 disables).")
+	var tlsVerify listFlag
+	fs.Var(&tlsVerify, "tls-verify", "Per-host backend TLS verification: host=strict|skip|ca:/path/to/ca.pem (repeatable, covers subdomains).")
+	var connMaxLifetime = fs.Duration("conn-max-lifetime", 0, "Close backend connections older than this once idle, forcing a fresh dial (0 keeps them).")
+	var disableKeepAlives = fs.Bool("disable-keepalives", false, "Use a fresh backend connection for every request.")
+	var warmupConns = fs.Int("warmup-conns", 0, "Keep this many connections to each backend open, dialled at startup.")
+	var warmupInterval = fs.Duration("warmup-interval", 30*time.Second, "How often -warmup-conns tops up the backend connections.")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if shared == nil {
+		return l, nil
+	}
+
+	handler.dialer = newDialer()
+	handler.dialer.Timeout = *dialTimeout
+	if *dnsNegTTL > 0 {
+		handler.negDNS = newNegativeDNSCache(*dnsNegTTL)
+	}
+	if *resolver != "" {
+		handler.dialer.Resolver = newResolver(*resolver)
+	}
+	if *hostsFile != "" || *dnsCacheTTL > 0 {
+		handler.dns = newDNSLayer(handler.lookup(), *dnsCacheTTL)
+		if *hostsFile != "" {
+			if err := handler.dns.loadHosts(*hostsFile); err != nil {
+				return nil, fmt.Errorf("loading -hosts-file: %w", err)
+			}
+		}
+	}
+	if *maxConnsPerClient > 0 {
+		l.connLimit = newConnLimiter(*maxConnsPerClient, handler.retryAfter)
+	}
+	if *proxyProtocol != "" {
+		trusted, err := parsePrefixes(splitList(*proxyProtocol))
+		if err != nil {
+			return nil, fmt.Errorf("-proxy-protocol: %w", err)
+		}
+		l.proxyProto = trusted
+	}
+	if l.reusePort {
+		if _, ok := reusePortControl(); !ok {
+			slog.Warn("SO_REUSEPORT is not supported on this platform, ignoring -reuse-port")
+			l.reusePort = false
+		}
+	}
+	if *tcpFastOpen {
+		if control, ok := tcpFastOpenControl(); ok {
+			handler.dialer.Control = control
+		} else {
+			slog.Warn("TCP Fast Open is not supported on this platform, ignoring -tcp-fastopen")
+		}
+	}
+	if *upstream != "" {
+		var urls []*url.URL
+		for _, s := range splitList(*upstream) {
+			u, err := parseUpstreamURL("upstream", s)
+			if err != nil {
+				return nil, err
+			}
+			if *upstreamAuth != "" {
+				user, pass, _ := strings.Cut(*upstreamAuth, ":")
+				u.User = url.UserPassword(user, pass)
+			}
+			urls = append(urls, u)
+		}
+		if len(urls) == 0 {
+			return nil, fmt.Errorf("invalid -upstream %q", *upstream)
+		}
+		handler.upstream = urls[0]
+		if len(urls) > 1 {
+			handler.upstreamFailover = newUpstreamFailover(urls)
+		}
+		if *upstreamAuthFile != "" {
+			c, err := loadCredentialFile(*upstreamAuthFile)
+			if err != nil {
+				return nil, fmt.Errorf("loading -upstream-auth-file: %w", err)
+			}
+			handler.upstreamAuthFile = c
+		}
+	}
+	for _, s := range upstreamRoutes {
+		route, err := parseUpstreamRoute(s)
+		if err != nil {
+			return nil, err
+		}
+		handler.upstreamRoutes = append(handler.upstreamRoutes, route)
+	}
+	if *routeFile != "" {
+		routes, err := loadRouteFile(*routeFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading -route-file: %w", err)
+		}
+		handler.upstreamRoutes = append(handler.upstreamRoutes, routes...)
+	}
+	if *authFile != "" {
+		users, err := loadUserFile(*authFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading -auth-file: %w", err)
+		}
+		handler.auth, err = newProxyAuth(users, splitList(*authSchemes))
+		if err != nil {
+			return nil, err
+		}
+	} else if *authSchemes != "" {
+		return nil, fmt.Errorf("-auth needs -auth-file")
+	}
+
+	transport := handler.newTransport()
+	if handler.upstream != nil || handler.upstreamRoutes != nil {
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			return handler.upstreamFor(hostPort(req.URL)), nil
+		}
+	}
+	transport.TLSHandshakeTimeout = *tlsHandshakeTimeout
+	transport.ResponseHeaderTimeout = *responseHeaderTimeout
+	transport.IdleConnTimeout = *idleConnTimeout
+	transport.MaxIdleConns = *maxIdleConns
+	transport.MaxIdleConnsPerHost = *maxIdleConnsPerHost
+	transport.MaxConnsPerHost = *maxConnsPerHost
+	transport.DisableKeepAlives = *disableKeepAlives
+	if *connMaxLifetime > 0 {
+		transport.DialContext = agedDialer(transport.DialContext, *connMaxLifetime)
+	}
+	if *tlsSessionCache > 0 {
+		// Lets repeat connections to a TLS backend resume the session
+		// instead of doing a full handshake.
+		transport.TLSClientConfig = &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(*tlsSessionCache)}
+	}
+	handler.transport = transport
+	if *h2c {
+		handler.grpcTransport = grpcTransport(transport)
+	}
+	if len(tlsVerify) > 0 {
+		rules, err := parseTLSVerify(tlsVerify)
+		if err != nil {
+			return nil, err
+		}
+		handler.transport = newTLSVerifyTransport(transport, rules)
+		if *h2c {
+			handler.grpcTransport = newTLSVerifyTransport(grpcTransport(transport), rules)
+		}
+	}
+	if *connMaxLifetime > 0 {
+		handler.transport = &lifetimeTransport{base: handler.transport}
+		if handler.grpcTransport != nil {
+			handler.grpcTransport = &lifetimeTransport{base: handler.grpcTransport}
+		}
+	}
+	if *requestRetries > 0 {
+		statuses, err := parseRetryStatuses(*requestRetryStatuses)
+		if err != nil {
+			return nil, err
+		}
+		handler.retry = &retryPolicy{retries: *requestRetries, backoff: *requestRetryBackoff, statuses: statuses, budget: *requestRetryBudget}
+	}
+	handler.client = newBackendClient(handler.transport, *requestTimeout)
+	if handler.grpcTransport != nil {
+		handler.grpcClient = newBackendClient(handler.grpcTransport, *requestTimeout)
+	}
+
+	var pool []*url.URL
+	for _, b := range backends {
+		u, err := parseFlagURL("backend", b)
+		if err != nil {
+			return nil, err
+		}
+		pool = append(pool, u)
+	}
+	if len(pool) > 0 {
+		handler.backend = pool[0]
+	}
+	if *backendFallback != "" {
+		if handler.backend == nil {
+			return nil, fmt.Errorf("-backend-fallback needs -backend")
+		}
+		handler.fallback = newDialFallback(handler.backend, splitList(*backendFallback))
+	}
+	if len(pool) > 1 {
+		var err error
+		handler.pool, err = newBackendPool(*lbStrategy, pool)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, r := range routes {
+		rt, err := parseRoute(r)
+		if err != nil {
+			return nil, err
+		}
+		handler.routes = append(handler.routes, rt)
+	}
+	sortRoutes(handler.routes)
+	if handler.forwardUnmatched && (len(handler.routes) == 0 || handler.backend != nil) {
+		return nil, fmt.Errorf("-forward-unmatched needs -route without -backend")
+	}
+
+	if *abBackend != "" {
+		u, err := parseFlagURL("ab-backend", *abBackend)
+		if err != nil {
+			return nil, err
+		}
+		if !handler.reverseMode() {
+			return nil, fmt.Errorf("-ab-backend needs -backend or -route")
+		}
+		handler.abSplit, err = parseABSplit(*abSplitFlag, u, *abKey, *abHeader)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if *timeoutHeaderMax > 0 {
+		trusted, err := parsePrefixes(splitList(*timeoutHeaderFrom))
+		if err != nil {
+			return nil, fmt.Errorf("-timeout-header-from: %w", err)
+		}
+		if len(trusted) == 0 {
+			return nil, fmt.Errorf("-timeout-header-max needs -timeout-header-from")
+		}
+		handler.timeoutOverride = &timeoutOverride{max: *timeoutHeaderMax, trusted: trusted}
+	}
+
+	if handler.backendHeader != "" {
+		handler.allowedBackends = make(map[string]*url.URL)
+		for _, v := range splitList(*backendAllow) {
+			u, err := parseFlagURL("backend-allow", v)
+			if err != nil {
+				return nil, err
+			}
+			handler.allowedBackends[backendKey(u)] = u
+		}
+	}
+
+	if *securityHeaders {
+		if handler.reverseMode() {
+			handler.securityHeaders = newSecurityHeaders(*hsts, *frameOptions, *csp, *securityOverride)
+		} else {
+			slog.Warn("-security-headers needs -backend or -route, ignoring it")
+		}
+	}
+
+	if *warmupConns > 0 {
+		handler.warmer = handler.newWarmer(*warmupConns, *warmupInterval)
+		if handler.warmer == nil {
+			slog.Warn("-warmup-conns needs -backend or -route, ignoring it")
+		} else {
+			// Idle connections beyond this are closed, and must be
+			// revisited before the transport expires them.
+			transport.MaxIdleConnsPerHost = max(transport.MaxIdleConnsPerHost, *warmupConns)
+			if *idleConnTimeout > 0 && handler.warmer.interval >= *idleConnTimeout {
+				handler.warmer.interval = *idleConnTimeout / 2
+			}
+		}
+	}
+
+	if *rulesFile != "" {
+		rs, err := loadRules(*rulesFile)
+		if err != nil {
+			return nil, fmt.Errorf("-rules: %w", err)
+		}
+		handler.rules = rs
+		slog.Info("Loaded rules", "file", *rulesFile, "rules", len(rs.rules))
+	}
+
+	if *blocklistFile != "" {
+		bl, err := loadDomainSet(*blocklistFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading blocklist: %w", err)
+		}
+		handler.blocklist = bl
+		slog.Info("Loaded blocklist", "file", *blocklistFile, "domains", len(bl.hosts))
+	}
+
+	if *aclFile != "" || *aclAllow != "" || *aclDeny != "" {
+		acl, err := newAccessList(*aclFile, splitList(*aclAllow), splitList(*aclDeny), handler.lookup())
+		if err != nil {
+			return nil, fmt.Errorf("loading ACL: %w", err)
+		}
+		handler.acl = acl
+		slog.Info("Loaded ACL", "allow", len(acl.allow), "deny", len(acl.deny))
+	} else if *adminAddr != "" {
+		// An empty list, permitting everything, for the admin API to add
+		// rules to.
+		handler.acl, _ = newAccessList("", nil, nil, handler.lookup())
+	}
+
+	if *geoDB != "" {
+		geo, err := newGeoFilter(*geoDB, splitList(*geoAllow), splitList(*geoDeny))
+		if err != nil {
+			return nil, fmt.Errorf("loading GeoIP database: %w", err)
+		}
+		handler.geo = geo
+		slog.Info("Loaded GeoIP database", "file", *geoDB)
+	} else if *geoAllow != "" || *geoDeny != "" {
+		return nil, fmt.Errorf("-geoip-allow and -geoip-deny need -geoip-db")
+	}
+
+	if err := validRefererPolicy(handler.refererPolicy); err != nil {
+		return nil, err
+	}
+
+	switch handler.blockMode {
+	case blockModeForbidden, blockModeNoContent, blockModeStub:
+	default:
+		return nil, fmt.Errorf("invalid -block-response-mode %q", handler.blockMode)
+	}
+
+	if *quotaBytes > 0 {
+		handler.quota = newQuotaTracker(*quotaBytes, *quotaWindow)
+	}
+
+	if *injectDelay > 0 || *injectError != 0 {
+		if *injectError != 0 && (*injectError < 100 || *injectError > 999) {
+			return nil, fmt.Errorf("invalid -inject-error status %d", *injectError)
+		}
+		handler.faults = &faultInjector{
+			delay:     *injectDelay,
+			delayProb: *injectDelayProb,
+			errStatus: *injectError,
+			errRate:   *injectErrorRate,
+		}
+		if *injectHosts != "" {
+			handler.faults.hosts = newDomainSet(splitList(*injectHosts))
+		}
+		slog.Warn("Fault injection enabled", "delay", *injectDelay, "error", *injectError)
+	}
+
+	if handler.serveStale {
+		handler.stale = newStaleCache(*staleEntries, *staleMaxBody)
+	}
+	if *cacheSize > 0 {
+		c, err := newHTTPCache(*cacheSize, *cacheMaxObject, *cacheDir)
+		if err != nil {
+			return nil, fmt.Errorf("opening -cache-dir: %w", err)
+		}
+		handler.cache = c
+	} else if *cacheDir != "" {
+		return nil, fmt.Errorf("-cache-dir needs -cache-size")
+	}
+
+	for _, rule := range rateLimits {
+		kl, err := parseKeyedLimiter(rule)
+		if err != nil {
+			return nil, fmt.Errorf("-rate-limit %w", err)
+		}
+		handler.rateLimits = append(handler.rateLimits, kl)
+	}
+	for _, rule := range bandwidthLimits {
+		kl, err := parseKeyedLimiter(rule)
+		if err != nil {
+			return nil, fmt.Errorf("-bandwidth-limit %w", err)
+		}
+		handler.bandwidthLimits = append(handler.bandwidthLimits, kl)
+	}
+
+	if *globalRate > 0 {
+		burst := *globalBurst
+		if burst <= 0 {
+			burst = int(math.Ceil(*globalRate))
+		}
+		handler.globalRate = newTokenBucket(*globalRate, burst)
+	}
+
+	if *coalesce {
+		handler.coalescer = newCoalescer(*coalesceMaxBody)
+	}
+
+	switch *forwardHopsAction {
+	case "reject":
+	case "truncate":
+		handler.truncateForwardHops = true
+	default:
+		return nil, fmt.Errorf("invalid -forward-hops-action %q", *forwardHopsAction)
+	}
+
+	if *trustedProxies != "" || *forwardedHeader || *forwardedProtoHost {
+		trusted, err := parsePrefixes(splitList(*trustedProxies))
+		if err != nil {
+			return nil, fmt.Errorf("-trusted-proxies: %w", err)
+		}
+		switch *forwardedUntrusted {
+		case forwardedReplace, forwardedStrip:
+		default:
+			return nil, fmt.Errorf("invalid -forwarded-untrusted %q: want replace or strip", *forwardedUntrusted)
+		}
+		handler.forwarded = &forwardedPolicy{trusted: trusted, untrusted: *forwardedUntrusted, rfc7239: *forwardedHeader, protoHost: *forwardedProtoHost}
+	}
+
+	if *pac || *wpad {
+		direct, err := parsePACDirect(splitList(*pacDirect))
+		if err != nil {
+			return nil, err
+		}
+		handler.pac = &pacConfig{proxy: *pacProxy, direct: direct, wpad: *wpad}
+	}
+
+	if *connectPorts != "*" {
+		set, err := parsePortSet(splitList(*connectPorts))
+		if err != nil {
+			return nil, fmt.Errorf("-connect-ports: %w", err)
+		}
+		handler.connectPorts = set
+	}
+	handler.stripResponseHeaders = splitList(*stripResponseHeaders)
+	handler.requestHeaderAllow = headerAllowlist(splitList(*requestHeaderAllow))
+	handler.responseHeaderAllow = headerAllowlist(splitList(*responseHeaderAllow))
+	if *dedupe {
+		handler.dedupeHeaders = splitList(*dedupeList)
+	}
+
+	if *debugSampleRate > 0 {
+		handler.debugSample = &debugSampler{
+			rate:    *debugSampleRate,
+			bodyLog: newBodyLogger(1, splitList(*bodyLogTypes), *bodyLogMax, splitList(*bodyLogRedact)),
+		}
+	}
+	if *bodyLogSample > 0 {
+		handler.bodyLog = newBodyLogger(*bodyLogSample, splitList(*bodyLogTypes), *bodyLogMax, splitList(*bodyLogRedact))
+	}
+
+	if *recordFile != "" {
+		rec, err := newRecorder(*recordFile, *recordMaxBody)
+		if err != nil {
+			return nil, fmt.Errorf("opening record cassette: %w", err)
+		}
+		handler.recorder = rec
+	}
+
+	if *captureFile != "" {
+		out, err := openCaptureFile(*captureFile)
+		if err != nil {
+			return nil, fmt.Errorf("opening -capture-file: %w", err)
+		}
+		handler.capture = &trafficCapture{maxBody: *captureMaxBody, out: out}
+		if hosts := splitList(*captureHosts); len(hosts) > 0 {
+			handler.capture.hosts = newDomainSet(hosts)
+		}
+		handler.capture.enabled.Store(!*captureOff)
+	}
+
+	if *replayFile != "" {
+		c, err := loadCassette(*replayFile, splitList(*replayHeaders))
+		if err != nil {
+			return nil, fmt.Errorf("loading replay cassette: %w", err)
+		}
+		handler.replay = c
+	}
+
+	if *otlpEndpoint != "" {
+		u, err := parseFlagURL("otlp-endpoint", *otlpEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		handler.tracer = newTracer(u, "minprox")
+	}
+
+	if *adaptURL != "" {
+		handler.adapter = newAdapter(*adaptURL, *adaptTimeout)
+	}
+
+	if *transform != "" {
+		t, err := newTransformer(*transform, splitList(*transformTypes), *transformMaxBody, *transformTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("-transform: %w", err)
+		}
+		handler.transformer = t
+	}
+
+	if *mirrorTo != "" {
+		target, err := parseFlagURL("mirror-to", *mirrorTo)
+		if err != nil {
+			return nil, err
+		}
+		handler.mirror = newMirror(target, *mirrorTimeout, *mirrorMaxBody)
+	}
+
+	if *accessLogPath != "" {
+		al, err := newAccessLog(*accessLogPath, *accessLogFormat, *accessLogMaxSize, *accessLogBackups)
+		if err != nil {
+			return nil, fmt.Errorf("opening -access-log: %w", err)
+		}
+		handler.accessLog = al
+	}
+
+	if *metricsAddr != "" {
+		m, ok := shared.metrics[*metricsAddr]
+		if !ok {
+			m = newMetrics(newHostLabeler(splitList(*metricsHosts), *metricsMaxHosts))
+			shared.metrics[*metricsAddr] = m
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", m)
+			l.aux = append(l.aux, &http.Server{Addr: *metricsAddr, Handler: mux, ErrorLog: serverErrorLog()})
+		}
+		handler.metrics = m
+	}
+
+	if len(addr.addrs) == 0 {
+		return nil, fmt.Errorf("-addr is empty")
+	}
+	l.addrs = addr.addrs
+	server := &http.Server{
+		Addr:    addr.addrs[0],
+		Handler: handler,
+		// Let the proxy answer "OPTIONS *" itself.
+		DisableGeneralOptionsHandler: true,
+		// net/http answers oversized header blocks with 431 Request
+		// Header Fields Too Large (allowing 4KB of slack) and closes.
+		MaxHeaderBytes: *maxHeaderBytes,
+		ErrorLog:       serverErrorLog(),
+	}
+	if *h2c {
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	switch {
+	case *tlsCert != "" && *acmeDomains != "":
+		return nil, fmt.Errorf("-tls-cert and -acme-domains can't be used together")
+	case (*tlsCert == "") != (*tlsKey == ""):
+		return nil, fmt.Errorf("-tls-cert and -tls-key must be given together")
+	case *tlsClientCA != "" && *tlsCert == "":
+		return nil, fmt.Errorf("-tls-client-ca needs -tls-cert")
+	}
+	if *tlsCert != "" {
+		cert, err := loadCertFile(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading -tls-cert: %w", err)
+		}
+		alpn := splitList(*tlsALPN)
+		tlsConfig, err := serverTLSConfig(cert, alpn, *tlsClientCA)
+		if err != nil {
+			return nil, err
+		}
+		if server.Protocols == nil {
+			server.Protocols = new(http.Protocols)
+			server.Protocols.SetHTTP1(true)
+		}
+		server.Protocols.SetHTTP2(slices.Contains(alpn, "h2"))
+		server.TLSConfig = tlsConfig
+		handler.metrics.countTLS(tlsConfig)
+		handler.serverCert = cert
+	}
+
+	switch {
+	case (*mitmCACert == "") != (*mitmCAKey == ""):
+		return nil, fmt.Errorf("-mitm-ca-cert and -mitm-ca-key must be given together")
+	case *mitmCACert != "":
+		in, err := newInterceptor(*mitmCACert, *mitmCAKey, splitList(*mitmHosts))
+		if err != nil {
+			return nil, fmt.Errorf("loading -mitm-ca-cert: %w", err)
+		}
+		handler.mitm = in
+	case *mitmHosts != "":
+		return nil, fmt.Errorf("-mitm-hosts needs -mitm-ca-cert")
+	}
+
+	if *acmeDomains != "" {
+		domains := splitList(*acmeDomains)
+		tlsConfig, challenge, err := acmeTLSConfig(domains, *acmeCacheDir, *acmeEmail, *acmeDirectory)
+		if err != nil {
+			return nil, fmt.Errorf("setting up ACME: %w", err)
+		}
+		server.TLSConfig = tlsConfig
+		handler.metrics.countTLS(tlsConfig)
+		if *acmeHTTPAddr != "" {
+			c, ok := shared.acme[*acmeHTTPAddr]
+			if !ok {
+				c = make(challengeServer)
+				shared.acme[*acmeHTTPAddr] = c
+				l.aux = append(l.aux, &http.Server{Addr: *acmeHTTPAddr, Handler: c, ErrorLog: serverErrorLog()})
+			}
+			for _, d := range domains {
+				c[normalizeHost(d)] = challenge
+			}
+		}
+	}
+
+	if *adminAddr != "" {
+		if !loopbackAddr(*adminAddr) {
+			return nil, fmt.Errorf("-admin-addr %q is not a loopback address or unix: socket", *adminAddr)
+		}
+		handler.settings = flagSettings(fs)
+		if a, ok := shared.admin[*adminAddr]; ok {
+			a.add(server)
+		} else {
+			a = newAdminAPI(server)
+			shared.admin[*adminAddr] = a
+			l.aux = append(l.aux, &http.Server{Addr: *adminAddr, Handler: a.handler(), ErrorLog: serverErrorLog()})
+		}
+	}
+
+	if *socksAddr != "" {
+		l.socks = newSOCKSServer(*socksAddr, handler)
+		l.socks.reusePort = l.reusePort
+		l.socks.proxyProto = l.proxyProto
+		l.socks.connLimit = l.connLimit
+	}
+
+	l.handler, l.server = handler, server
+	return l, nil
+}
+
+// parseFlagURL parses the value of a URL flag, requiring a host.
+func parseFlagURL(name, value string) (*url.URL, error) {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid -%s URL %q", name, value)
+	}
+	return u, nil
+}
+
+// config is the -config file. Each listener runs its own proxy, configured
+// by the command line options followed by its own.
+type config struct {
+	Listeners []listenerSpec `json:"listeners"`
+}
+
+// listenerSpec describes one listener. Options are keyed by flag name
+// without the dash; a list value repeats the flag.
+//
+//	{"addr": ":8081", "mode": "reverse", "options": {"route": ["/api=http://api:8000"]}}
+type listenerSpec struct {
+	Addr    string         `json:"addr"`
+	Mode    string         `json:"mode"`
+	Options map[string]any `json:"options"`
+}
+
+// Listener modes.
+const (
+	modeForward = "forward"
+	modeReverse = "reverse"
+	modeBoth    = "both" // -route with -forward-unmatched
+)
+
+// loadConfig reads a -config file, TOML if its name ends in .toml and
+// JSON otherwise.
+func loadConfig(path string) (*config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cfg *config
+	if strings.HasSuffix(path, ".toml") {
+		cfg, err = parseTOMLConfig(f)
+	} else {
+		dec := json.NewDecoder(f)
+		dec.UseNumber()
+		dec.DisallowUnknownFields()
+		cfg = new(config)
+		err = dec.Decode(cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if len(cfg.Listeners) == 0 {
+		return nil, fmt.Errorf("%s: no listeners", path)
+	}
+	return cfg, nil
+}
+
+// args turns the spec into flag arguments, in a stable order.
+func (spec listenerSpec) args() ([]string, error) {
+	var args []string
+	if spec.Addr != "" {
+		args = append(args, "-addr=", "-addr="+spec.Addr)
+	}
+	names := make([]string, 0, len(spec.Options))
+	for name := range spec.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values, ok := spec.Options[name].([]any)
+		if !ok {
+			values = []any{spec.Options[name]}
+		}
+		for _, v := range values {
+			switch v := v.(type) {
+			case string:
+				args = append(args, "-"+name+"="+v)
+			case json.Number:
+				args = append(args, "-"+name+"="+v.String())
+			case bool:
+				args = append(args, "-"+name+"="+strconv.FormatBool(v))
+			default:
+				return nil, fmt.Errorf("option %q: unsupported value %v", name, v)
+			}
+		}
+	}
+	return args, nil
+}
+
+// configListeners builds every listener in the config file. base holds the
+// command line options, which each listener's own options are applied on
+// top of. Listeners asking for metrics, admin or ACME challenge servers on
+// the same address share one.
+func configListeners(path string, base []string) ([]*listener, error) {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	shared := newSharedServers()
+
+	var listeners []*listener
+	// A reload that fails leaves no files open or sweepers running.
+	fail := func(err error) ([]*listener, error) {
+		for _, l := range listeners {
+			l.handler.release()
+		}
+		return nil, err
+	}
+	for i, spec := range cfg.Listeners {
+		name := fmt.Sprintf("listener %d", i)
+		if spec.Addr != "" {
+			name = "listener " + spec.Addr
+		}
+		args, err := spec.args()
+		if err != nil {
+			return fail(fmt.Errorf("%s: %w", name, err))
+		}
+		if spec.Mode == modeBoth {
+			args = append(args, "-forward-unmatched")
+		}
+		l, err := buildListener(name, append(append([]string{}, base...), args...), shared)
+		if err != nil {
+			return fail(fmt.Errorf("%s: %w", name, err))
+		}
+		listeners = append(listeners, l)
+		switch spec.Mode {
+		case "", modeForward:
+			if l.handler.reverseMode() {
+				return fail(fmt.Errorf("%s: forward mode cannot use -backend or -route", name))
+			}
+		case modeReverse:
+			if !l.handler.reverseMode() {
+				return fail(fmt.Errorf("%s: reverse mode needs -backend or -route", name))
+			}
+		case modeBoth:
+		default:
+			return fail(fmt.Errorf("%s: unknown mode %q", name, spec.Mode))
+		}
+	}
+
+	return listeners, nil
+}
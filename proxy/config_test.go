@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigListeners(t *testing.T) {
+	b := echoBackend(t, "b")
+	path := writeTempFile(t, "config.json", `{"listeners": [
+		{"addr": "127.0.0.1:0", "mode": "forward"},
+		{"addr": "127.0.0.1:0", "mode": "reverse", "options": {"backend": "`+b.URL+`", "via": "rev"}}
+	]}`)
+	listeners, err := configListeners(path, []string{"-via", "base", "-metrics-addr", "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 2 {
+		t.Fatalf("got %d listeners, want 2", len(listeners))
+	}
+	fwd, rev := listeners[0].handler, listeners[1].handler
+
+	if rec := serve(fwd, "GET", b.URL+"/x"); rec.Code != http.StatusOK || b.last.Header.Get("Via") != "1.1 base" {
+		t.Errorf("forward listener got %d, Via %q", rec.Code, b.last.Header.Get("Via"))
+	}
+	rec := serve(rev, "GET", "http://front.test/y")
+	if want := "b " + b.Listener.Addr().String() + " /y"; rec.Body.String() != want || b.last.Header.Get("Via") != "1.1 rev" {
+		t.Errorf("reverse listener got %q, Via %q; want %q via its own pseudonym", rec.Body, b.last.Header.Get("Via"), want)
+	}
+	if fwd.metrics == nil || fwd.metrics != rev.metrics {
+		t.Error("listeners on one -metrics-addr don't share its server")
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	b := echoBackend(t, "b")
+	dir := t.TempDir()
+	config := func(options string) string {
+		return `{"listeners": [{"addr": "127.0.0.1:0", "options": {"serve-stale": true, ` + options + `}}]}`
+	}
+	path := writeTempFile(t, "config.json", config(`"access-log": "`+filepath.Join(dir, "a.log")+`", "capture-file": "`+filepath.Join(dir, "capture.jsonl")+`"`))
+	listeners, err := configListeners(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listeners[0].handler.release() })
+	first := listeners[0].handler
+	listeners[0].server.Handler = newSwappableHandler(first)
+	serve(listeners[0].server.Handler, "GET", b.URL+"/x")
+
+	// Another access log and no capture: the old files are closed, and
+	// the stale copies stay.
+	if err := os.WriteFile(path, []byte(config(`"access-log": "`+filepath.Join(dir, "b.log")+`"`)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(context.Background(), path, nil, listeners); err != nil {
+		t.Fatal(err)
+	}
+	second := listeners[0].handler
+	if first.accessLog.f != nil || first.capture.out.f != nil {
+		t.Error("access log or capture file left open after the reload dropped it")
+	}
+	if second.stale != first.stale || second.stale.get(staleKey(httptest.NewRequest("GET", b.URL+"/x", nil))) == nil {
+		t.Error("-serve-stale responses dropped by the reload")
+	}
+
+	// The same access log again: one writer, still open.
+	if err := reloadConfig(context.Background(), path, nil, listeners); err != nil {
+		t.Fatal(err)
+	}
+	if third := listeners[0].handler; third.accessLog != second.accessLog || third.accessLog.f == nil {
+		t.Error("unchanged access log not kept across the reload")
+	}
+}
+
+func TestConfigListenerModes(t *testing.T) {
+	for _, tt := range []struct {
+		spec, err string
+	}{
+		{`{"mode": "forward", "options": {"backend": "http://b.test"}}`, "forward mode cannot use"},
+		{`{"mode": "reverse"}`, "reverse mode needs"},
+		{`{"mode": "sideways"}`, "unknown mode"},
+		{`{"options": {"max-body-bytes": [1.5]}}`, "max-body-bytes"},
+		{`{"mode": "both", "options": {"route": ["/api=http://api.test"]}}`, ""},
+	} {
+		_, err := configListeners(writeTempFile(t, "config.json", `{"listeners": [`+tt.spec+`]}`), nil)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: err = %v, want %q", tt.spec, err, tt.err)
+		}
+	}
+	if _, err := configListeners(writeTempFile(t, "config.json", `{"listeners": []}`), nil); err == nil {
+		t.Error("config without listeners accepted")
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	l, err := newListener("minprox", []string{"-backend", b.URL, "-max-header-bytes", "1024"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(nil)
+	srv.Config = l.server
+	srv.Start()
+	defer srv.Close()
+
+	// net/http allows 4KB over the limit before giving up.
+	for _, tt := range []struct {
+		size, status int
+	}{
+		{512, http.StatusOK},
+		{8 << 10, http.StatusRequestHeaderFieldsTooLarge},
+	} {
+		resp := rawRequest(t, srv.Listener.Addr().String(), "GET / HTTP/1.1\r\nHost: front.test\r\nX-Big: "+strings.Repeat("x", tt.size)+"\r\n\r\n")
+		if resp.StatusCode != tt.status {
+			t.Errorf("%d byte header got %s, want %d", tt.size, resp.Status, tt.status)
+		}
+	}
+	if b.hits != 1 {
+		t.Errorf("backend hit %d times, want only by the small request", b.hits)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, tt := range []struct {
+		config, err string
+	}{
+		{`{"listeners": []}`, "no listeners"},
+		{`{"listeners": [{"addr": ":1", "port": 2}]}`, "unknown field"},
+		{`{"listeners": [`, "parsing"},
+	} {
+		_, err := loadConfig(writeTempFile(t, "config.json", tt.config))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: err = %v, want %q", tt.config, err, tt.err)
+		}
+	}
+
+	spec := listenerSpec{Options: map[string]any{"max-body-bytes": []any{[]any{1.5}}}}
+	if _, err := spec.args(); err == nil || !strings.Contains(err.Error(), "max-body-bytes") {
+		t.Errorf("unsupported option value: err = %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// debugSampler sends a fraction of requests down an instrumented path:
+// their bodies are captured whatever -body-log-sample says, and the phases
+// of the backend exchange are timed and logged.
+type debugSampler struct {
+	rate    float64
+	bodyLog *bodyLogger
+}
+
+// sampled reports whether this request takes the instrumented path.
+func (d *debugSampler) sampled() bool {
+	return d != nil && rand.Float64() < d.rate
+}
+
+// requestTiming records when each phase of a backend request happened.
+type requestTiming struct {
+	mu                        sync.Mutex
+	start                     time.Time
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	gotConn, firstByte        time.Time
+	reused                    bool
+}
+
+// traceTiming returns req with a trace recording its timings.
+func traceTiming(req *http.Request) (*http.Request, *requestTiming) {
+	t := &requestTiming{start: time.Now()}
+	now := func(at *time.Time) {
+		t.mu.Lock()
+		*at = time.Now()
+		t.mu.Unlock()
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { now(&t.dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { now(&t.dnsDone) },
+		ConnectStart:      func(string, string) { now(&t.connectStart) },
+		ConnectDone:       func(string, string, error) { now(&t.connectDone) },
+		TLSHandshakeStart: func() { now(&t.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { now(&t.tlsDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			now(&t.gotConn)
+			t.mu.Lock()
+			t.reused = info.Reused
+			t.mu.Unlock()
+		},
+		GotFirstResponseByte: func() { now(&t.firstByte) },
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), t
+}
+
+// log writes the timings. Phases that didn't happen, such as DNS on a
+// reused connection, are left out.
+func (t *requestTiming) log(log *slog.Logger) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	attrs := []any{"total", time.Since(t.start), "reused", t.reused}
+	phase := func(name string, from, to time.Time) {
+		if !from.IsZero() && !to.IsZero() {
+			attrs = append(attrs, name, to.Sub(from))
+		}
+	}
+	phase("dns", t.dnsStart, t.dnsDone)
+	phase("connect", t.connectStart, t.connectDone)
+	phase("tls", t.tlsStart, t.tlsDone)
+	phase("conn_wait", t.start, t.gotConn)
+	phase("ttfb", t.start, t.firstByte)
+	log.Info("Debug timings", attrs...)
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDebugSample(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("Content-Type", "text/plain")
+		io.WriteString(wr, "reply text")
+	})
+	for _, tt := range []struct {
+		rate     string
+		min, max int
+	}{
+		{"1", 200, 200},
+		{"0.25", 30, 70},
+	} {
+		logger, logs := newTestLogger()
+		p, err := New(WithFlags("-backend", b.URL, "-debug-sample", tt.rate), WithLogger(logger))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range 200 {
+			serve(p, "GET", "http://front.test/")
+		}
+		out := logs.String()
+		timings := strings.Count(out, `msg="Debug timings"`)
+		if timings < tt.min || timings > tt.max {
+			t.Errorf("-debug-sample %s: %d of 200 requests traced, want %d to %d", tt.rate, timings, tt.min, tt.max)
+		}
+		// Each sampled request also has its response body captured.
+		if bodies := strings.Count(out, `body="reply text"`); bodies != timings {
+			t.Errorf("-debug-sample %s: %d bodies captured for %d traced requests", tt.rate, bodies, timings)
+		}
+		for _, want := range []string{"debug_sample=true", "ttfb=", "conn_wait="} {
+			if !strings.Contains(out, want) {
+				t.Errorf("-debug-sample %s: log lacks %s", tt.rate, want)
+			}
+		}
+	}
+
+	logger, logs := newTestLogger()
+	p, err := New(WithFlags("-backend", b.URL), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(p, "GET", "http://front.test/")
+	if strings.Contains(logs.String(), "Debug timings") || strings.Contains(logs.String(), "reply text") {
+		t.Errorf("request instrumented without -debug-sample:\n%s", logs)
+	}
+}
@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// newResolver returns a resolver that sends every DNS query to server
+// (host:port, port defaulting to 53) instead of the servers in
+// /etc/resolv.conf, or to a DNS-over-HTTPS server if server is an https://
+// URL.
+func newResolver(server string) *net.Resolver {
+	if strings.HasPrefix(server, "https://") {
+		return newDoHResolver(server)
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// dial opens outbound connections for both CONNECT tunnels and proxied
+// requests, so settings on p.dialer apply to all target traffic. Dials to
+// the -backend address that fail move on to each -backend-fallback in turn.
+func (p *proxy) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := p.dialAddr(ctx, network, addr)
+	if ctx.Err() == nil {
+		p.upstreamFailover.observe(addr, err)
+	}
+	if err == nil || p.fallback == nil || addr != p.fallback.primary {
+		return conn, err
+	}
+	errs := []error{err}
+	for _, fb := range p.fallback.addrs {
+		if ctx.Err() != nil {
+			break
+		}
+		slog.Warn("backend dial failed, trying fallback", "addr", addr, "fallback", fb, "error", err)
+		conn, err = p.dialAddr(ctx, network, fb)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		addr = fb
+	}
+	return nil, errors.Join(errs...)
+}
+
+// dialAddr dials addr, failing at once for hosts in the negative DNS
+// cache. With a DNS layer, host names are resolved through it. A target
+// the ACL was checked for is only connected to at an address it permits.
+func (p *proxy) dialAddr(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(addr)
+	if err := p.negDNS.get(host); err != nil {
+		slog.Debug("host failed to resolve recently, not retrying yet", "host", host)
+		return nil, err
+	}
+	d := p.dialer
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	d = p.acl.guard(ctx, d, addr)
+	var conn net.Conn
+	var err error
+	if p.dns != nil {
+		conn, err = p.dns.dialResolved(ctx, d, network, addr)
+	} else {
+		conn, err = d.DialContext(ctx, network, addr)
+	}
+	p.negDNS.observe(host, err)
+	if err != nil && ctx.Err() == nil {
+		p.metrics.dialFailed(err)
+	}
+	return conn, err
+}
+
+// lookup returns what resolves target host names outside of dials, for
+// ACLs and SOCKS UDP: the DNS layer, else the dialer's resolver.
+func (p *proxy) lookup() hostLookup {
+	switch {
+	case p.dns != nil:
+		return p.dns
+	case p.dialer != nil && p.dialer.Resolver != nil:
+		return p.dialer.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// dialFallback lists other endpoints of the backend at primary, tried in
+// order when it can't be reached. Only the address dialled changes: TLS
+// is still verified against the -backend host name.
+type dialFallback struct {
+	primary string
+	addrs   []string
+}
+
+// newDialFallback builds the fallbacks for backend from -backend-fallback
+// entries, which default to the backend's port.
+func newDialFallback(backend *url.URL, list []string) *dialFallback {
+	primary := hostPort(backend)
+	_, port, _ := net.SplitHostPort(primary)
+	fb := &dialFallback{primary: primary}
+	for _, a := range list {
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			a = net.JoinHostPort(strings.Trim(a, "[]"), port)
+		}
+		fb.addrs = append(fb.addrs, a)
+	}
+	return fb
+}
+
+// newTransport returns a copy of http.DefaultTransport that dials through p.
+// Its defaults already stream request bodies: ExpectContinueTimeout only
+// delays a body while a backend decides on "Expect: 100-continue", and
+// DisableCompression concerns responses, not uploads.
+func (p *proxy) newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = p.dial
+	return t
+}
+
+// newBackendClient returns the client backend requests are sent with.
+// Redirects go back to the client rather than being followed, and
+// timeout, if set, bounds each request, response body included.
+func newBackendClient(rt http.RoundTripper, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: rt,
+		Timeout:   timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// newDialer returns a dialer with the same defaults as http.DefaultTransport.
+func newDialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+}
+
+// dialErrorKind classifies a dial error for logging: "dns", "refused",
+// "timeout" or "other".
+func dialErrorKind(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case fdExhausted(err):
+		return "fd-limit"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, syscall.ETIMEDOUT):
+		return "timeout"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return "other"
+}
+
+// fdExhausted reports whether err means the process or system is out of
+// file descriptors. It is distinct from other dial failures: the target is
+// fine, the proxy is overloaded.
+func fdExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// logFDExhausted logs running out of file descriptors loudly enough for
+// operators to notice they need to raise the limit.
+func logFDExhausted(log *slog.Logger, err error) {
+	log.Error("out of file descriptors, raise the open files limit (ulimit -n)", "error", err)
+}
+
+// transientDialError reports whether a failed dial is worth retrying.
+// Hosts that don't resolve won't start resolving a few milliseconds later.
+func transientDialError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+	switch dialErrorKind(err) {
+	case "refused", "timeout":
+		return true
+	}
+	return false
+}
+
+// dialRetry dials addr, retrying transient failures up to retries times
+// with a doubling backoff. Each failed attempt is logged.
+func (p *proxy) dialRetry(ctx context.Context, network, addr string, retries int, backoff time.Duration, log *slog.Logger) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		conn, err := p.dial(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		log.Warn("dial failed", "host", addr, "attempt", attempt+1, "kind", dialErrorKind(err), "error", err)
+		if attempt >= retries || !transientDialError(err) {
+			return nil, err
+		}
+		select {
+		case <-time.After(backoff << attempt):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
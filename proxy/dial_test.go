@@ -0,0 +1,326 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// dnsAnswer answers a DNS query: an A record for addr if it asks for one,
+// else no records.
+func dnsAnswer(query []byte, addr netip.Addr) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5 // the root label, type and class
+	if end > len(query) {
+		return nil
+	}
+	question := query[12:end]
+	qtype := binary.BigEndian.Uint16(question[len(question)-4:])
+
+	msg := append([]byte{}, query[:2]...)
+	msg = append(msg, 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0)
+	msg = append(msg, question...)
+	if qtype == 1 && addr.Is4() {
+		msg[7] = 1
+		ip := addr.As4()
+		msg = append(msg, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		msg = append(msg, ip[:]...)
+	}
+	return msg
+}
+
+// newDNSServer serves dnsAnswer over UDP, counting the queries, and
+// returns its address.
+func newDNSServer(t *testing.T, addr netip.Addr) (string, *atomic.Int64) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	queries := new(atomic.Int64)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+			pc.WriteTo(dnsAnswer(buf[:n], addr), from)
+		}
+	}()
+	return pc.LocalAddr().String(), queries
+}
+
+func TestResolver(t *testing.T) {
+	server, queries := newDNSServer(t, netip.MustParseAddr("192.0.2.10"))
+	addrs, err := newResolver(server).LookupNetIP(context.Background(), "ip4", "anything.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != netip.MustParseAddr("192.0.2.10") {
+		t.Errorf("resolved to %v, want 192.0.2.10", addrs)
+	}
+	if queries.Load() == 0 {
+		t.Error("the -resolver server wasn't asked")
+	}
+}
+
+func TestResolverThroughProxy(t *testing.T) {
+	server, _ := newDNSServer(t, netip.MustParseAddr("127.0.0.1"))
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(wr, "found")
+	})
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(b.URL, "http://"))
+	p := newTestProxy(t, "-resolver", server)
+
+	rec := serve(p, "GET", "http://only-in-test-dns.test:"+port+"/")
+	if rec.Code != http.StatusOK || rec.Body.String() != "found" {
+		t.Errorf("got %d %q, want the backend the test DNS server points at", rec.Code, rec.Body)
+	}
+}
+
+func TestDialErrorKind(t *testing.T) {
+	for _, tt := range []struct {
+		err       error
+		kind      string
+		transient bool
+	}{
+		{&net.DNSError{Err: "no such host", IsNotFound: true}, "dns", false},
+		{&net.DNSError{Err: "timeout", IsTimeout: true}, "dns", true},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, "refused", true},
+		{fmt.Errorf("dial: %w", context.DeadlineExceeded), "timeout", true},
+		{&net.OpError{Op: "dial", Err: syscall.EMFILE}, "fd-limit", false},
+		{errors.New("something else"), "other", false},
+	} {
+		if got := dialErrorKind(tt.err); got != tt.kind {
+			t.Errorf("dialErrorKind(%v) = %q, want %q", tt.err, got, tt.kind)
+		}
+		if got := transientDialError(tt.err); got != tt.transient {
+			t.Errorf("transientDialError(%v) = %v, want %v", tt.err, got, tt.transient)
+		}
+	}
+}
+
+// TestConnectRetriesRefusedDial opens a CONNECT to a port nothing listens
+// on until after the first attempt.
+func TestConnectRetriesRefusedDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := ln.Addr().String()
+	ln.Close()
+
+	srv := newProxyServer(t, "-connect-retries", "3", "-connect-retry-backoff", "100ms")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ln, err := net.Listen("tcp", target)
+		if err != nil {
+			return
+		}
+		defer ln.Close()
+		if c, err := ln.Accept(); err == nil {
+			c.Write([]byte("up"))
+			c.Close()
+		}
+	}()
+	conn, br, resp := connect(t, srv.Listener.Addr().String(), target)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT got %s, want 200 after a retry", resp.Status)
+	}
+	if got, _ := io.ReadAll(br); string(got) != "up" {
+		t.Errorf("tunnel read %q", got)
+	}
+	conn.Close()
+}
+
+func TestConnectDoesNotRetryWhenDisabled(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := ln.Addr().String()
+	ln.Close()
+
+	srv := newProxyServer(t, "-connect-retries", "0")
+	if _, _, resp := connect(t, srv.Listener.Addr().String(), target); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("CONNECT to a closed port got %s, want 502", resp.Status)
+	}
+}
+
+// exhaustFDs makes every dial p makes fail as if the process were out of
+// file descriptors.
+func exhaustFDs(p *Proxy) {
+	p.l.handler.dialer.Control = func(network, address string, c syscall.RawConn) error {
+		return syscall.EMFILE
+	}
+}
+
+func TestFDExhausted(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	p := newTestProxy(t, "-backend", b.URL)
+	exhaustFDs(p)
+	rec := serve(p, "GET", "http://front.test/")
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("request got %d with Retry-After %q, want 503 with one", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	p = newTestProxy(t)
+	exhaustFDs(p)
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	if _, _, resp := connect(t, srv.Listener.Addr().String(), b.Listener.Addr().String()); resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("CONNECT got %s with Retry-After %q, want 503 with one", resp.Status, resp.Header.Get("Retry-After"))
+	}
+
+	if !fdExhausted(fmt.Errorf("dial: %w", syscall.ENFILE)) || fdExhausted(syscall.ECONNREFUSED) {
+		t.Error("fdExhausted doesn't tell EMFILE and ENFILE from other errors")
+	}
+}
+
+// connCountingBackend counts the connections made to it.
+func connCountingBackend(t *testing.T) (*httptest.Server, *atomic.Int64) {
+	conns := new(atomic.Int64)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv, conns
+}
+
+func TestBackendKeepAlives(t *testing.T) {
+	for _, tt := range []struct {
+		args  []string
+		pause time.Duration
+		conns int64
+	}{
+		{nil, 0, 1},
+		{[]string{"-disable-keepalives"}, 0, 3},
+		{[]string{"-idle-conn-timeout", "20ms"}, 100 * time.Millisecond, 3},
+	} {
+		srv, conns := connCountingBackend(t)
+		p := newTestProxy(t, append([]string{"-backend", srv.URL}, tt.args...)...)
+		for range 3 {
+			serve(p, "GET", "http://front.test/")
+			time.Sleep(tt.pause)
+		}
+		if got := conns.Load(); got != tt.conns {
+			t.Errorf("%q: %d backend connections for 3 requests, want %d", tt.args, got, tt.conns)
+		}
+	}
+}
+
+// closedAddr returns a local address nothing listens on.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	return ln.Addr().String()
+}
+
+func TestBackendFallback(t *testing.T) {
+	live := echoBackend(t, "live")
+	primary := closedAddr(t)
+	p := newTestProxy(t, "-backend", "http://"+primary, "-backend-fallback", closedAddr(t)+","+strings.TrimPrefix(live.URL, "http://"))
+	rec := serve(p, "GET", "http://front.test/x")
+	if rec.Code != http.StatusOK || rec.Body.String() != "live "+primary+" /x" {
+		t.Errorf("got %d %q, want the live fallback, sent the -backend Host", rec.Code, rec.Body)
+	}
+
+	p = newTestProxy(t, "-backend", "http://"+primary, "-backend-fallback", closedAddr(t), "-connect-retries", "0")
+	if rec := serve(p, "GET", "http://front.test/"); rec.Code != http.StatusBadGateway {
+		t.Errorf("every endpoint refusing got %d, want 502", rec.Code)
+	}
+
+	if _, err := New(WithFlags("-backend-fallback", "10.0.0.1")); err == nil {
+		t.Error("-backend-fallback accepted without -backend")
+	}
+}
+
+func TestNewDialFallback(t *testing.T) {
+	backend, _ := url.Parse("https://app.test")
+	fb := newDialFallback(backend, []string{"10.0.0.1", "10.0.0.2:8443", "[2001:db8::1]", "2001:db8::2"})
+	want := []string{"10.0.0.1:443", "10.0.0.2:8443", "[2001:db8::1]:443", "[2001:db8::2]:443"}
+	if fb.primary != "app.test:443" || strings.Join(fb.addrs, " ") != strings.Join(want, " ") {
+		t.Errorf("fallback %s -> %q, want app.test:443 -> %q", fb.primary, fb.addrs, want)
+	}
+}
+
+func TestBackendClientTimeouts(t *testing.T) {
+	stalled := make(chan struct{})
+	t.Cleanup(func() { close(stalled) })
+	b := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/moved" {
+			http.Redirect(wr, req, "/elsewhere", http.StatusFound)
+			return
+		}
+		io.WriteString(wr, "start")
+		http.NewResponseController(wr).Flush()
+		select {
+		case <-stalled:
+		case <-req.Context().Done():
+		}
+	}))
+	defer b.Close()
+
+	p := newTestProxy(t, "-backend", b.URL, "-request-timeout", "100ms", "-dial-timeout", "2s")
+	start := time.Now()
+	rec := serve(p, "GET", "http://front.test/stall")
+	if elapsed := time.Since(start); elapsed > 2*time.Second || rec.Body.String() != "start" {
+		t.Errorf("stalled body got %q after %v, want the start cut off at -request-timeout", rec.Body, elapsed)
+	}
+	if rec := serve(p, "GET", "http://front.test/moved"); rec.Code != http.StatusFound || rec.Header().Get("Location") != "/elsewhere" {
+		t.Errorf("redirect got %d to %q, want the 302 passed back", rec.Code, rec.Header().Get("Location"))
+	}
+	if got := p.l.handler.dialer.Timeout; got != 2*time.Second {
+		t.Errorf("dial timeout %v, want -dial-timeout's 2s", got)
+	}
+
+	// A backend that accepts but never answers the TLS handshake.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close() // once the listener is closed
+		}
+	}()
+	p = newTestProxy(t, "-backend", "https://"+ln.Addr().String(), "-tls-handshake-timeout", "100ms", "-connect-retries", "0")
+	start = time.Now()
+	if rec := serve(p, "GET", "http://front.test/"); rec.Code < 500 || time.Since(start) > 2*time.Second {
+		t.Errorf("silent TLS backend got %d after %v, want an error at -tls-handshake-timeout", rec.Code, time.Since(start))
+	}
+}
@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDNSCacheEntries bounds the -dns-cache-ttl cache. When it is full of
+// unexpired entries new answers simply aren't cached.
+const maxDNSCacheEntries = 10000
+
+// hostLookup resolves host names to addresses. *net.Resolver is one.
+type hostLookup interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// dnsLayer resolves the host names the proxy dials: -hosts-file entries
+// first, then answers cached for -dns-cache-ttl, then the resolver
+// (-resolver, or the system's). Failures are left to the negative cache.
+type dnsLayer struct {
+	hosts    map[string][]netip.Addr // exact names, and ".domain" for *.domain
+	resolver hostLookup
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	cache map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+func newDNSLayer(resolver hostLookup, ttl time.Duration) *dnsLayer {
+	return &dnsLayer{resolver: resolver, ttl: ttl, hosts: make(map[string][]netip.Addr), cache: make(map[string]dnsEntry)}
+}
+
+// loadHosts reads a hosts file: an address followed by the names it
+// stands for, one entry per line, # starting a comment. A name of the
+// form *.example.com covers the subdomains of example.com. A name listed
+// more than once gets every address given for it.
+func (d *dnsLayer) loadHosts(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		ip, err := netip.ParseAddr(fields[0])
+		if err != nil || len(fields) < 2 {
+			return fmt.Errorf("%s:%d: want ADDRESS NAME...", path, n)
+		}
+		for _, name := range fields[1:] {
+			name = normalizeHost(strings.TrimPrefix(name, "*"))
+			d.hosts[name] = append(d.hosts[name], ip.Unmap())
+		}
+	}
+	return sc.Err()
+}
+
+// override returns the -hosts-file addresses for host: its own entry, else
+// that of the closest *.domain covering it.
+func (d *dnsLayer) override(host string) []netip.Addr {
+	if addrs, ok := d.hosts[host]; ok {
+		return addrs
+	}
+	for i := strings.IndexByte(host, '.'); i >= 0; i = strings.IndexByte(host, '.') {
+		if addrs, ok := d.hosts[host[i:]]; ok {
+			return addrs
+		}
+		host = host[i+1:]
+	}
+	return nil
+}
+
+// LookupNetIP resolves host for network ("ip", "ip4" or "ip6").
+func (d *dnsLayer) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	host = normalizeHost(host)
+	if addrs := filterFamily(d.override(host), network); len(addrs) > 0 {
+		return addrs, nil
+	}
+	if d.ttl <= 0 {
+		return d.resolver.LookupNetIP(ctx, network, host)
+	}
+
+	key := network + "\x00" + host
+	now := time.Now()
+	d.mu.Lock()
+	e, ok := d.cache[key]
+	d.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.addrs, nil
+	}
+	addrs, err := d.resolver.LookupNetIP(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.cache) >= maxDNSCacheEntries {
+		for k, e := range d.cache {
+			if now.After(e.expires) {
+				delete(d.cache, k)
+			}
+		}
+	}
+	if len(d.cache) < maxDNSCacheEntries {
+		d.cache[key] = dnsEntry{addrs: addrs, expires: now.Add(d.ttl)}
+	}
+	return addrs, nil
+}
+
+// filterFamily returns the addresses in addrs that network can reach.
+func filterFamily(addrs []netip.Addr, network string) []netip.Addr {
+	if network == "ip" {
+		return addrs
+	}
+	var out []netip.Addr
+	for _, a := range addrs {
+		if a.Is4() == (network == "ip4") {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// dialResolved dials addr's host at each address d gives for it in turn,
+// until one answers.
+func (d *dnsLayer) dialResolved(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	family := "ip"
+	switch network {
+	case "tcp4", "udp4":
+		family = "ip4"
+	case "tcp6", "udp6":
+		family = "ip6"
+	}
+	addrs, err := d.LookupNetIP(ctx, family, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	for _, a := range addrs {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(a.String(), port))
+		if err == nil || ctx.Err() != nil {
+			return conn, err
+		}
+	}
+	return nil, err
+}
+
+// dnsMessageType is the media type of DNS-over-HTTPS bodies.
+const dnsMessageType = "application/dns-message"
+
+// newDoHResolver returns a resolver that sends its queries to the
+// DNS-over-HTTPS server at endpoint (RFC 8484), so lookups neither reach
+// nor can be seen by the local network's DNS servers. The server's own
+// name is still looked up with the system resolver.
+func newDoHResolver(endpoint string) *net.Resolver {
+	client := &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return &dohConn{ctx: ctx, client: client, endpoint: endpoint}, nil
+		},
+	}
+}
+
+// dohConn carries one DNS exchange for the resolver. The resolver frames
+// messages as over TCP, with a two byte length; each complete query
+// written is POSTed to the endpoint, and the answer is read back in the
+// same framing.
+type dohConn struct {
+	ctx      context.Context
+	client   *http.Client
+	endpoint string
+
+	query  []byte
+	answer []byte
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.query = append(c.query, b...)
+	if len(c.query) < 2 || len(c.query) < 2+int(binary.BigEndian.Uint16(c.query)) {
+		return len(b), nil
+	}
+	answer, err := c.exchange(c.query[2:])
+	c.query = c.query[:0]
+	if err != nil {
+		return 0, err
+	}
+	c.answer = binary.BigEndian.AppendUint16(c.answer, uint16(len(answer)))
+	c.answer = append(c.answer, answer...)
+	return len(b), nil
+}
+
+func (c *dohConn) exchange(query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodPost, c.endpoint, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS-over-HTTPS server answered %s", resp.Status)
+	}
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt != dnsMessageType {
+		return nil, fmt.Errorf("DNS-over-HTTPS server sent %q, not %s", mt, dnsMessageType)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if len(c.answer) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, c.answer)
+	c.answer = c.answer[n:]
+	return n, nil
+}
+
+func (c *dohConn) Close() error                     { return nil }
+func (c *dohConn) LocalAddr() net.Addr              { return dohAddr(c.endpoint) }
+func (c *dohConn) RemoteAddr() net.Addr             { return dohAddr(c.endpoint) }
+func (c *dohConn) SetDeadline(time.Time) error      { return nil }
+func (c *dohConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(time.Time) error { return nil }
+
+// dohAddr is the address a dohConn reports: its endpoint.
+type dohAddr string
+
+func (a dohAddr) Network() string { return "https" }
+func (a dohAddr) String() string  { return string(a) }
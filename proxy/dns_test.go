@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeLookup answers every name with addrs, or fails with err, counting
+// the lookups.
+type fakeLookup struct {
+	addrs []netip.Addr
+	err   error
+	calls int
+}
+
+func (f *fakeLookup) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	f.calls++
+	return filterFamily(f.addrs, network), f.err
+}
+
+func TestHostsFile(t *testing.T) {
+	fake := &fakeLookup{addrs: []netip.Addr{netip.MustParseAddr("198.51.100.1")}}
+	d := newDNSLayer(fake, 0)
+	if err := d.loadHosts(writeTempFile(t, "hosts", strings.Join([]string{
+		"# overrides",
+		"192.0.2.1 exact.test Alias.test",
+		"192.0.2.2 *.wild.test  # and its subdomains",
+		"::ffff:192.0.2.3 deeper.wild.test",
+		"2001:db8::4 deeper.wild.test",
+		"",
+	}, "\n"))); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		network, host string
+		want          string
+	}{
+		{"ip", "exact.test", "[192.0.2.1]"},
+		{"ip", "alias.test.", "[192.0.2.1]"},
+		{"ip", "a.wild.test", "[192.0.2.2]"},
+		{"ip", "a.b.wild.test", "[192.0.2.2]"},
+		{"ip", "deeper.wild.test", "[192.0.2.3 2001:db8::4]"},
+		{"ip6", "deeper.wild.test", "[2001:db8::4]"},
+		{"ip", "wild.test", "[198.51.100.1]"},
+		{"ip6", "exact.test", "[]"},
+	} {
+		addrs, err := d.LookupNetIP(context.Background(), tt.network, tt.host)
+		if got := fmt.Sprint(addrs); err != nil || got != tt.want {
+			t.Errorf("%s %s resolved to %s, %v; want %s", tt.network, tt.host, got, err, tt.want)
+		}
+	}
+	if fake.calls != 2 {
+		t.Errorf("resolver asked %d times, want only for wild.test and exact.test over IPv6", fake.calls)
+	}
+
+	for _, content := range []string{"exact.test 192.0.2.1\n", "192.0.2.1\n"} {
+		if err := newDNSLayer(fake, 0).loadHosts(writeTempFile(t, "hosts", "192.0.2.9 ok.test\n"+content)); err == nil || !strings.Contains(err.Error(), ":2:") {
+			t.Errorf("hosts line %q got %v, want an error on line 2", content, err)
+		}
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	fake := &fakeLookup{addrs: []netip.Addr{netip.MustParseAddr("192.0.2.1")}}
+	d := newDNSLayer(fake, 50*time.Millisecond)
+	lookup := func(network string) {
+		if _, err := d.LookupNetIP(context.Background(), network, "cached.test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lookup("ip")
+	lookup("ip")
+	if fake.calls != 1 {
+		t.Errorf("resolver asked %d times within the TTL, want 1", fake.calls)
+	}
+	lookup("ip4")
+	if fake.calls != 2 {
+		t.Error("an ip answer was reused for ip4")
+	}
+	time.Sleep(60 * time.Millisecond)
+	lookup("ip")
+	if fake.calls != 3 {
+		t.Error("an expired answer was reused")
+	}
+
+	// Failures aren't cached here; -dns-neg-ttl handles those.
+	fake.err = errors.New("lookup failed")
+	d.LookupNetIP(context.Background(), "ip", "failing.test")
+	d.LookupNetIP(context.Background(), "ip", "failing.test")
+	if fake.calls != 5 {
+		t.Errorf("resolver asked %d times in all, want a failure asked again", fake.calls)
+	}
+}
+
+func TestDialResolved(t *testing.T) {
+	b := echoBackend(t, "backend")
+	_, port, _ := net.SplitHostPort(b.Listener.Addr().String())
+	// The first address refuses, the second answers.
+	d := newDNSLayer(&fakeLookup{}, 0)
+	d.hosts["multi.test"] = []netip.Addr{netip.MustParseAddr("127.0.0.2"), netip.MustParseAddr("127.0.0.1")}
+	conn, err := d.dialResolved(context.Background(), &net.Dialer{Timeout: time.Second}, "tcp", net.JoinHostPort("multi.test", port))
+	if err != nil {
+		t.Fatalf("dialing past a refusing address: %v", err)
+	}
+	conn.Close()
+
+	var dnsErr *net.DNSError
+	if _, err := d.dialResolved(context.Background(), &net.Dialer{}, "tcp", "missing.test:80"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("name without addresses got %v, want a not found DNSError", err)
+	}
+}
+
+func TestHostsFileThroughProxy(t *testing.T) {
+	b := echoBackend(t, "backend")
+	_, port, _ := net.SplitHostPort(b.Listener.Addr().String())
+	p := newTestProxy(t, "-hosts-file", writeTempFile(t, "hosts", "127.0.0.1 *.internal.test\n"))
+	rec := serve(p, "GET", "http://app.internal.test:"+port+"/x")
+	if want := "backend app.internal.test:" + port + " /x"; rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("got %d %q, want %q", rec.Code, rec.Body, want)
+	}
+
+	if _, err := New(WithFlags("-hosts-file", writeTempFile(t, "hosts", "not-an-address name.test\n"))); err == nil {
+		t.Error("bad -hosts-file accepted")
+	}
+}
+
+func TestDoHResolver(t *testing.T) {
+	doh := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != dnsMessageType {
+			http.Error(wr, "want a POSTed DNS message", http.StatusUnsupportedMediaType)
+			return
+		}
+		query, _ := io.ReadAll(req.Body)
+		if req.URL.Query().Has("wrong-type") {
+			wr.Header().Set("Content-Type", "text/plain")
+		} else {
+			wr.Header().Set("Content-Type", dnsMessageType)
+		}
+		wr.Write(dnsAnswer(query, netip.MustParseAddr("192.0.2.10")))
+	}))
+	defer doh.Close()
+
+	addrs, err := newDoHResolver(doh.URL+"/dns-query").LookupNetIP(context.Background(), "ip4", "anything.test")
+	if err != nil || len(addrs) != 1 || addrs[0] != netip.MustParseAddr("192.0.2.10") {
+		t.Errorf("resolved to %v, %v; want 192.0.2.10", addrs, err)
+	}
+	if addrs, err := newDoHResolver(doh.URL+"/dns-query?wrong-type").LookupNetIP(context.Background(), "ip4", "anything.test"); err == nil {
+		t.Errorf("answer sent as text/plain taken as %v", addrs)
+	}
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// maxNegativeDNSEntries bounds the negative DNS cache. When it is full of
+// unexpired entries new failures simply aren't cached.
+const maxNegativeDNSEntries = 10000
+
+// negativeDNSCache remembers host names that failed to resolve, so a
+// client retrying a mistyped domain in a loop fails fast instead of sending
+// a DNS query each time. Only names that don't exist are cached; after a
+// timeout, SERVFAIL or other failure the next try may well succeed.
+type negativeDNSCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]negativeDNSEntry
+}
+
+type negativeDNSEntry struct {
+	err     error
+	expires time.Time
+}
+
+func newNegativeDNSCache(ttl time.Duration) *negativeDNSCache {
+	return &negativeDNSCache{ttl: ttl, entries: make(map[string]negativeDNSEntry)}
+}
+
+// get returns the cached lookup failure for host, or nil.
+func (c *negativeDNSCache) get(host string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[host]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, host)
+		return nil
+	}
+	return e.err
+}
+
+// observe caches err for host if the name doesn't exist. Other lookup
+// failures, such as a SERVFAIL or an unreachable resolver, may clear up
+// on the next try.
+func (c *negativeDNSCache) observe(host string, err error) {
+	var dnsErr *net.DNSError
+	if c == nil || !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		return
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= maxNegativeDNSEntries {
+		for h, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, h)
+			}
+		}
+		if len(c.entries) >= maxNegativeDNSEntries {
+			return
+		}
+	}
+	c.entries[host] = negativeDNSEntry{err: err, expires: now.Add(c.ttl)}
+}
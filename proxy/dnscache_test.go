@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNegativeDNSCacheObserve(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		host   string
+		err    error
+		cached bool
+	}{
+		{"no such host", "typo.example", &net.DNSError{Err: "no such host", Name: "typo.example", IsNotFound: true}, true},
+		{"wrapped", "typo.example", fmt.Errorf("dial: %w", &net.DNSError{Err: "no such host", IsNotFound: true}), true},
+		{"servfail", "broken.example", &net.DNSError{Err: "server misbehaving", Name: "broken.example"}, false},
+		{"timeout", "slow.example", &net.DNSError{Err: "i/o timeout", IsTimeout: true}, false},
+		{"temporary", "flaky.example", &net.DNSError{Err: "try again", IsTemporary: true}, false},
+		{"not DNS", "refused.example", errors.New("connection refused"), false},
+		{"IP literal", "192.0.2.1", &net.DNSError{Err: "no such host", IsNotFound: true}, false},
+	} {
+		c := newNegativeDNSCache(time.Minute)
+		c.observe(tt.host, tt.err)
+		if got := c.get(tt.host) != nil; got != tt.cached {
+			t.Errorf("%s: cached = %v, want %v", tt.name, got, tt.cached)
+		}
+	}
+}
+
+func TestNegativeDNSCacheExpires(t *testing.T) {
+	c := newNegativeDNSCache(time.Millisecond)
+	c.observe("typo.example", &net.DNSError{Err: "no such host", IsNotFound: true})
+	time.Sleep(5 * time.Millisecond)
+	if err := c.get("typo.example"); err != nil {
+		t.Errorf("expired entry still returned: %v", err)
+	}
+
+	var none *negativeDNSCache
+	none.observe("typo.example", &net.DNSError{IsNotFound: true})
+	if none.get("typo.example") != nil {
+		t.Error("nil cache returned an entry")
+	}
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+)
+
+// domainSet is a set of domains used for host matching. A domain also
+// matches all of its subdomains.
+type domainSet struct {
+	hosts map[string]bool
+}
+
+func newDomainSet(names []string) *domainSet {
+	d := &domainSet{hosts: make(map[string]bool)}
+	for _, h := range names {
+		d.hosts[normalizeHost(h)] = true
+	}
+	return d
+}
+
+// loadDomainSet reads a domain list file. It accepts both one domain per
+// line and hosts-file format ("0.0.0.0 ads.example.com"); # starts a
+// comment.
+func loadDomainSet(path string) (*domainSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	d := &domainSet{hosts: make(map[string]bool)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if net.ParseIP(fields[0]) != nil && len(fields) > 1 {
+			fields = fields[1:]
+		}
+		for _, h := range fields {
+			h = normalizeHost(h)
+			if h == "localhost" || h == "" {
+				continue
+			}
+			d.hosts[h] = true
+		}
+	}
+	return d, scanner.Err()
+}
+
+// match returns the entry matching host, if any.
+func (d *domainSet) match(host string) (string, bool) {
+	if d == nil {
+		return "", false
+	}
+	host = normalizeHost(host)
+	for host != "" {
+		if d.hosts[host] {
+			return host, true
+		}
+		_, host, _ = strings.Cut(host, ".")
+	}
+	return "", false
+}
+
+func normalizeHost(h string) string {
+	return strings.TrimSuffix(strings.ToLower(h), ".")
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// tunnelSet tracks the client connections of open tunnels. They are
+// hijacked from the server, so http.Server.Shutdown neither waits for nor
+// closes them; shutdown drains them here instead. A nil *tunnelSet
+// tracks nothing.
+type tunnelSet struct {
+	mu     sync.Mutex
+	conns  map[net.Conn]tunnelInfo
+	active sync.WaitGroup
+}
+
+// tunnelInfo describes an open tunnel for the admin API.
+type tunnelInfo struct {
+	Client string    `json:"client"`
+	Target string    `json:"target"`
+	Since  time.Time `json:"since"`
+}
+
+func newTunnelSet() *tunnelSet {
+	return &tunnelSet{conns: make(map[net.Conn]tunnelInfo)}
+}
+
+// add tracks conn, the client side of the tunnel req opened, until the
+// returned func is called.
+func (t *tunnelSet) add(conn net.Conn, req *http.Request) func() {
+	if t == nil {
+		return func() {}
+	}
+	t.mu.Lock()
+	t.conns[conn] = tunnelInfo{Client: req.RemoteAddr, Target: req.Host, Since: time.Now()}
+	t.active.Add(1)
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		delete(t.conns, conn)
+		t.mu.Unlock()
+		t.active.Done()
+	}
+}
+
+// count returns how many tunnels are open.
+func (t *tunnelSet) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// list returns the open tunnels, oldest first.
+func (t *tunnelSet) list() []tunnelInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tunnels := make([]tunnelInfo, 0, len(t.conns))
+	for _, info := range t.conns {
+		tunnels = append(tunnels, info)
+	}
+	slices.SortFunc(tunnels, func(a, b tunnelInfo) int { return a.Since.Compare(b.Since) })
+	return tunnels
+}
+
+// drain waits for the open tunnels to finish. If ctx is done first, it
+// closes the rest and returns ctx's error.
+func (t *tunnelSet) drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		t.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		t.mu.Lock()
+		for conn := range t.conns {
+			conn.Close()
+		}
+		t.mu.Unlock()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// startRun serves the listener args configure with run, tracking tunnels
+// as Main does and shutting down within timeout. It returns the
+// listener's address, the function that starts the shutdown and the
+// channel run's result arrives on.
+func startRun(t *testing.T, timeout time.Duration, args ...string) (string, context.CancelFunc, chan error) {
+	t.Helper()
+	addr := closedAddr(t)
+	l, err := newListener("minprox", append([]string{"-addr", addr, "-connect-ports", "*"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.handler.tunnels = newTunnelSet()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	ready := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, []*listener{l}, timeout, serveHooks{ready: func(context.Context) { close(ready) }})
+	}()
+	select {
+	case <-ready:
+	case err := <-done:
+		t.Fatalf("run returned before serving: %v", err)
+	}
+	return addr, cancel, done
+}
+
+func TestShutdownDrainsTunnels(t *testing.T) {
+	addr, cancel, done := startRun(t, 5*time.Second)
+	conn, br, resp := connect(t, addr, newEchoServer(t))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT got %s", resp.Status)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		t.Fatalf("run returned with a tunnel open: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if !echoes(conn, br, "still here") {
+		t.Error("tunnel stopped carrying data while draining")
+	}
+	if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Error("new connection accepted while draining")
+	}
+	conn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("run = %v, want a clean shutdown", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run didn't return once the tunnel closed")
+	}
+}
+
+func TestShutdownTimeoutClosesTunnels(t *testing.T) {
+	addr, cancel, done := startRun(t, 300*time.Millisecond)
+	conn, br, _ := connect(t, addr, newEchoServer(t))
+	start := time.Now()
+	cancel()
+	if !closedWithin(br, conn, 5*time.Second) {
+		t.Error("tunnel left open past the shutdown timeout")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run didn't return")
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("tunnel closed after %v, before the 300ms timeout", elapsed)
+	}
+}
+
+func TestShutdownFinishesRequests(t *testing.T) {
+	started := make(chan struct{})
+	b := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		wr.Write([]byte("finished"))
+	}))
+	defer b.Close()
+	addr, cancel, done := startRun(t, 5*time.Second)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: addr})}}
+	got := make(chan string, 1)
+	go func() {
+		resp, err := client.Get(b.URL)
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		got <- string(body)
+	}()
+	<-started
+	cancel()
+	if body := <-got; body != "finished" {
+		t.Errorf("request in flight at shutdown got %q", body)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("run = %v", err)
+	}
+}
+
+func TestTunnelSetDrain(t *testing.T) {
+	s := newTunnelSet()
+	client, server := net.Pipe()
+	defer server.Close()
+	remove := s.add(client, &http.Request{RemoteAddr: "192.0.2.1:4000", Host: "example.com:443"})
+	if got := s.list(); len(got) != 1 || got[0].Client != "192.0.2.1:4000" || got[0].Target != "example.com:443" {
+		t.Errorf("list = %+v", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("drain with a tunnel open = %v, want the deadline", err)
+	}
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Error("tunnel left open after the drain timed out")
+	}
+	remove()
+	if err := s.drain(context.Background()); err != nil || s.count() != 0 {
+		t.Errorf("drain with none open = %v, %d left", err, s.count())
+	}
+	var none *tunnelSet
+	none.add(client, &http.Request{})()
+}
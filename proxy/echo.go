@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// isEchoRequest reports whether req is for the -echo-path debug endpoint.
+// Like "OPTIONS *" it is answered by the proxy itself: only origin-form
+// requests match, so a proxied request for some site's path of the same
+// name is still forwarded. In reverse-proxy mode the path is shadowed on
+// the backends.
+func (p *proxy) isEchoRequest(req *http.Request) bool {
+	return p.echoPath != "" && strings.HasPrefix(req.RequestURI, "/") && req.URL.Path == p.echoPath
+}
+
+// echoedRequest is the JSON body served at -echo-path.
+type echoedRequest struct {
+	Method        string      `json:"method"`
+	URL           string      `json:"url"`
+	Proto         string      `json:"proto"`
+	Host          string      `json:"host"`
+	ClientIP      string      `json:"client_ip"`
+	XForwardedFor string      `json:"x_forwarded_for,omitempty"`
+	Header        http.Header `json:"header"`
+}
+
+// serveEcho answers with req as it would be forwarded: headers after
+// hop-by-hop stripping and the proxy's own header filtering, and the
+// X-Forwarded-For a backend would receive.
+func (p *proxy) serveEcho(wr http.ResponseWriter, req *http.Request) {
+	header := req.Header.Clone()
+	delHopHeaders(header)
+	p.filterRequestHeader(header)
+
+	clientIP, _ := remoteHost(req.RemoteAddr)
+	addClient := p.forwarded.scrub(header, req.RemoteAddr)
+	if p.noXFF {
+		for _, name := range forwardingHeaders {
+			header.Del(name)
+		}
+	} else {
+		if clientIP != "" && addClient {
+			appendHostToXForwardHeader(header, clientIP)
+		}
+		p.forwarded.addForwarded(header, req, req.Host, clientIP, addClient)
+	}
+
+	wr.Header().Set("Content-Type", "application/json")
+	wr.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(wr)
+	enc.SetIndent("", "  ")
+	enc.Encode(echoedRequest{
+		Method:        req.Method,
+		URL:           req.URL.String(),
+		Proto:         req.Proto,
+		Host:          req.Host,
+		ClientIP:      clientIP,
+		XForwardedFor: header.Get("X-Forwarded-For"),
+		Header:        header,
+	})
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEchoPath(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	p := newTestProxy(t, "-backend", b.URL, "-echo-path", "/_echo")
+	req := httptest.NewRequest("GET", "/_echo?x=1", nil)
+	req.Host = "front.test"
+	req.RemoteAddr = "192.0.2.7:5000"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	req.Header.Set("Connection", "keep-alive")
+	req.Header.Set("Proxy-Authorization", "Basic x")
+	req.Header.Set("X-Kept", "yes")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+
+	if b.hits != 0 || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("echo got %d %s, %d backend hits; want JSON from the proxy", rec.Code, rec.Header().Get("Content-Type"), b.hits)
+	}
+	var got echoedRequest
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Method != "GET" || got.URL != "/_echo?x=1" || got.Host != "front.test" || got.ClientIP != "192.0.2.7" {
+		t.Errorf("echoed %+v", got)
+	}
+	if got.XForwardedFor != "198.51.100.1, 192.0.2.7" {
+		t.Errorf("echoed X-Forwarded-For %q, want the client appended", got.XForwardedFor)
+	}
+	if got.Header.Get("Proxy-Authorization") != "" || got.Header.Get("Connection") != "" || got.Header.Get("X-Kept") != "yes" {
+		t.Errorf("echoed header %v, want hop-by-hop headers stripped", got.Header)
+	}
+
+	// A proxied request for the same path elsewhere is forwarded.
+	fp := newTestProxy(t, "-echo-path", "/_echo")
+	if rec := serve(fp, "GET", b.URL+"/_echo"); rec.Code != http.StatusOK || b.hits != 1 {
+		t.Errorf("absolute-form /_echo got %d with %d backend hits, want it forwarded", rec.Code, b.hits)
+	}
+}
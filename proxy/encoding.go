@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// errDecompressionLimit aborts a response that inflates past the
+// configured limits, such as a gzip bomb.
+var errDecompressionLimit = errors.New("decompressed response exceeds limit")
+
+// decompressionLimits bound how far a decoded response may grow: maxBytes
+// in total, and maxRatio times its compressed size once past
+// ratioGrace bytes, so small, highly compressible bodies still pass.
+// Zero disables a limit.
+type decompressionLimits struct {
+	maxBytes int64
+	maxRatio float64
+}
+
+const ratioGrace = 1 << 20
+
+// decodeIdentity undoes a gzip Content-Encoding on resp for
+// -force-identity-encoding, for backends that compress even after being
+// asked for identity. Other encodings are left alone. Reading past limits
+// fails with errDecompressionLimit.
+func decodeIdentity(resp *http.Response, limits decompressionLimits) error {
+	ce := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if ce != "gzip" && ce != "x-gzip" {
+		return nil
+	}
+	compressed := &countingBody{ReadCloser: resp.Body}
+	zr, err := gzip.NewReader(compressed)
+	if err != nil {
+		return err
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{&limitedInflater{r: zr, compressed: compressed, limits: limits}, resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// limitedInflater reads decompressed data from r, failing once it breaks
+// the limits relative to the compressed bytes read so far.
+type limitedInflater struct {
+	r          io.Reader
+	compressed *countingBody
+	limits     decompressionLimits
+	n          int64
+}
+
+func (l *limitedInflater) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.limits.maxBytes > 0 && l.n > l.limits.maxBytes {
+		return n, fmt.Errorf("%w: over %d bytes", errDecompressionLimit, l.limits.maxBytes)
+	}
+	if l.limits.maxRatio > 0 && l.n > ratioGrace && float64(l.n) > l.limits.maxRatio*float64(max(l.compressed.n, 1)) {
+		return n, fmt.Errorf("%w: ratio over %g", errDecompressionLimit, l.limits.maxRatio)
+	}
+	return n, err
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// gzipped returns data gzip compressed.
+func gzipped(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// gzipBackend answers with body gzipped whatever the request asked for.
+func gzipBackend(t *testing.T, body []byte) *countingBackend {
+	z := gzipped(body)
+	return newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("Content-Encoding", "gzip")
+		wr.Write(z)
+	})
+}
+
+func TestForceIdentityEncoding(t *testing.T) {
+	b := gzipBackend(t, []byte("hello, plain text"))
+
+	p := newTestProxy(t, "-backend", b.URL)
+	rec := serve(p, "GET", "http://front.test/", "Accept-Encoding: gzip, br")
+	if got := b.last.Header.Get("Accept-Encoding"); got != "gzip, br" {
+		t.Errorf("without the flag backend got Accept-Encoding %q, want the client's", got)
+	}
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Error("without the flag the gzipped response was decoded")
+	}
+
+	p = newTestProxy(t, "-backend", b.URL, "-force-identity-encoding")
+	rec = serve(p, "GET", "http://front.test/", "Accept-Encoding: gzip, br")
+	if got := b.last.Header.Get("Accept-Encoding"); got != "identity" {
+		t.Errorf("backend got Accept-Encoding %q, want identity", got)
+	}
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != "hello, plain text" {
+		t.Errorf("client got %q encoded %q, want the plain body", rec.Body, rec.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestDecompressionBombAborted(t *testing.T) {
+	b := gzipBackend(t, make([]byte, 16<<20))
+	for _, tt := range []struct {
+		args  []string
+		abort bool
+	}{
+		{[]string{"-max-decompression-ratio", "100"}, true},
+		{[]string{"-max-decompression-ratio", "0", "-max-decompressed-bytes", "8388608"}, true},
+		{[]string{"-max-decompression-ratio", "0"}, false},
+	} {
+		srv := newProxyServer(t, append([]string{"-backend", b.URL, "-force-identity-encoding"}, tt.args...)...)
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if aborted := err != nil; aborted != tt.abort {
+			t.Errorf("%q: read %d bytes, err %v; want aborted %v", tt.args, n, err, tt.abort)
+		}
+	}
+}
+
+func TestLimitedInflater(t *testing.T) {
+	// Small bodies compress well without tripping the ratio.
+	b := gzipBackend(t, make([]byte, ratioGrace))
+	p := newTestProxy(t, "-backend", b.URL, "-force-identity-encoding", "-max-decompression-ratio", "2")
+	if rec := serve(p, "GET", "http://front.test/"); rec.Body.Len() != ratioGrace {
+		t.Errorf("got %d bytes, want the whole %d under the ratio grace", rec.Body.Len(), ratioGrace)
+	}
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// What -forwarded-untrusted does with the forwarding headers of clients
+// outside -trusted-proxies.
+const (
+	// forwardedReplace drops them and starts afresh with the client.
+	forwardedReplace = "replace"
+	// forwardedStrip drops them and leaves the client out too.
+	forwardedStrip = "strip"
+)
+
+// forwardedPolicy decides which clients' forwarding headers (X-Forwarded-*,
+// Forwarded, X-Real-Ip) are believed, and which the proxy adds. Without
+// it, or with no trusted prefixes, every client's X-Forwarded-For is
+// extended as it came, as before -trusted-proxies existed.
+type forwardedPolicy struct {
+	trusted   []netip.Prefix
+	untrusted string
+	// rfc7239 adds an RFC 7239 Forwarded header alongside
+	// X-Forwarded-For.
+	rfc7239 bool
+	// protoHost sets X-Forwarded-Proto and X-Forwarded-Host on forward
+	// proxy requests too, not just reverse-proxied ones.
+	protoHost bool
+}
+
+// trusts reports whether the client at remoteAddr is one of the
+// -trusted-proxies, whose forwarding headers are passed on.
+func (f *forwardedPolicy) trusts(remoteAddr string) bool {
+	if f == nil {
+		return false
+	}
+	host, _ := remoteHost(remoteAddr)
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, p := range f.trusted {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// scrub removes the forwarding headers an untrusted client sent and
+// reports whether the client's own address is to be added.
+func (f *forwardedPolicy) scrub(header http.Header, remoteAddr string) (addClient bool) {
+	if f == nil || len(f.trusted) == 0 || f.trusts(remoteAddr) {
+		return true
+	}
+	for _, name := range forwardingHeaders {
+		header.Del(name)
+	}
+	return f.untrusted != forwardedStrip
+}
+
+// setProtoHost sets X-Forwarded-Proto and X-Forwarded-Host to what the
+// client asked for, keeping the values a trusted proxy passed on.
+func (f *forwardedPolicy) setProtoHost(header http.Header, req *http.Request, host string) {
+	keep := f.trusts(req.RemoteAddr)
+	if !keep || header.Get("X-Forwarded-Host") == "" {
+		header.Set("X-Forwarded-Host", host)
+	}
+	if !keep || header.Get("X-Forwarded-Proto") == "" {
+		header.Set("X-Forwarded-Proto", requestProto(req))
+	}
+}
+
+// addForwarded adds the -forwarded-header element for this hop: the
+// client, if addClient, and the protocol and host it used.
+func (f *forwardedPolicy) addForwarded(header http.Header, req *http.Request, host, clientIP string, addClient bool) {
+	if f == nil || !f.rfc7239 {
+		return
+	}
+	elem := "proto=" + requestProto(req) + ";host=" + forwardedValue(host)
+	if addClient {
+		elem = "for=" + forwardedNode(clientIP) + ";" + elem
+	}
+	if prior := header.Values("Forwarded"); len(prior) > 0 {
+		elem = strings.Join(prior, ", ") + ", " + elem
+	}
+	header.Set("Forwarded", elem)
+}
+
+// requestProto returns the scheme the client reached the proxy with.
+func requestProto(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// forwardedNode formats a client address as an RFC 7239 node: IPv6 in
+// quoted brackets, or "unknown" for clients without one, such as those on
+// a Unix socket.
+func forwardedNode(clientIP string) string {
+	ip, err := netip.ParseAddr(clientIP)
+	switch {
+	case err != nil:
+		return "unknown"
+	case ip.Unmap().Is6():
+		return `"[` + ip.String() + `]"`
+	}
+	return ip.Unmap().String()
+}
+
+// forwardedValue returns s as an RFC 7239 value: as it is if it is a
+// token, else quoted.
+func forwardedValue(s string) string {
+	token := s != ""
+	for _, c := range s {
+		if !isTokenChar(c) {
+			token = false
+			break
+		}
+	}
+	if token {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// isTokenChar reports whether c may appear in an HTTP token.
+func isTokenChar(c rune) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
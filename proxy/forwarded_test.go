@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// forwardedHeaders sends a request from remoteAddr with the header lines
+// given through a proxy configured by args, and returns the headers its
+// backend got.
+func forwardedHeaders(t *testing.T, args []string, remoteAddr string, header ...string) http.Header {
+	t.Helper()
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	p := newTestProxy(t, append([]string{"-backend", b.URL}, args...)...)
+	req := httptest.NewRequest("GET", "http://front.test/", nil)
+	req.RemoteAddr = remoteAddr
+	for _, line := range header {
+		name, value, _ := strings.Cut(line, ": ")
+		req.Header.Add(name, value)
+	}
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if b.last == nil {
+		t.Fatalf("request didn't reach the backend: %d %s", rec.Code, rec.Body)
+	}
+	return b.last.Header
+}
+
+func TestXForwardedForRemoteAddr(t *testing.T) {
+	for _, tt := range []struct {
+		remote, want string
+	}{
+		{"192.0.2.7:5000", "192.0.2.7"},
+		{"[2001:db8::1]:5000", "2001:db8::1"},
+		// Some listeners, and servers embedding the proxy, give no port.
+		{"192.0.2.7", "192.0.2.7"},
+		{"", ""},
+	} {
+		h := forwardedHeaders(t, nil, tt.remote)
+		if got := h.Get("X-Forwarded-For"); got != tt.want {
+			t.Errorf("RemoteAddr %q: X-Forwarded-For = %q, want %q", tt.remote, got, tt.want)
+		}
+	}
+}
+
+func TestMaxForwardHops(t *testing.T) {
+	const chain = "X-Forwarded-For: 198.51.100.1, 198.51.100.2, 198.51.100.3"
+
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	p := newTestProxy(t, "-backend", b.URL, "-max-forward-hops", "2")
+	if rec := serve(p, "GET", "http://front.test/", chain); rec.Code != http.StatusBadGateway || b.hits != 0 {
+		t.Errorf("3 hops, max 2: got %d and %d backend hits, want 502 and none", rec.Code, b.hits)
+	}
+	if rec := serve(p, "GET", "http://front.test/", "X-Forwarded-For: 198.51.100.1", "X-Forwarded-For: 198.51.100.2"); rec.Code != http.StatusOK {
+		t.Errorf("2 hops over two headers, max 2: got %d", rec.Code)
+	}
+
+	h := forwardedHeaders(t, []string{"-max-forward-hops", "2", "-forward-hops-action", "truncate"}, "192.0.2.7:5000", chain)
+	if got, want := h.Get("X-Forwarded-For"), "198.51.100.2, 198.51.100.3, 192.0.2.7"; got != want {
+		t.Errorf("truncated X-Forwarded-For = %q, want %q", got, want)
+	}
+
+	if _, err := New(WithFlags("-forward-hops-action", "drop")); err == nil {
+		t.Error("-forward-hops-action drop accepted")
+	}
+}
+
+func TestNoXFF(t *testing.T) {
+	sent := []string{"X-Forwarded-For: 198.51.100.1", "Forwarded: for=198.51.100.1", "X-Forwarded-Host: origin.test", "X-Forwarded-Proto: https", "X-Real-Ip: 198.51.100.1"}
+	h := forwardedHeaders(t, []string{"-no-xff"}, "192.0.2.7:5000", sent...)
+	for _, name := range forwardingHeaders {
+		if got := h.Values(name); len(got) != 0 {
+			t.Errorf("-no-xff: backend got %s %q", name, got)
+		}
+	}
+	if h := forwardedHeaders(t, nil, "192.0.2.7:5000"); h.Get("X-Forwarded-For") != "192.0.2.7" {
+		t.Errorf("without -no-xff X-Forwarded-For = %q, want the client", h.Get("X-Forwarded-For"))
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	sent := []string{"X-Forwarded-For: 198.51.100.1", "X-Forwarded-Host: origin.test", "X-Forwarded-Proto: https", "X-Real-Ip: 198.51.100.1"}
+	for _, tt := range []struct {
+		args          []string
+		remote        string
+		xff, host     string
+		proto, realIP string
+	}{
+		// Without -trusted-proxies the chain is extended as it came, while
+		// the backend is told what the client asked for.
+		{nil, "192.0.2.7:5000", "198.51.100.1, 192.0.2.7", "front.test", "http", "198.51.100.1"},
+		{[]string{"-trusted-proxies", "10.0.0.0/8"}, "10.1.2.3:5000", "198.51.100.1, 10.1.2.3", "origin.test", "https", "198.51.100.1"},
+		{[]string{"-trusted-proxies", "10.0.0.0/8, 192.0.2.9"}, "192.0.2.9:5000", "198.51.100.1, 192.0.2.9", "origin.test", "https", "198.51.100.1"},
+		{[]string{"-trusted-proxies", "10.0.0.0/8"}, "192.0.2.7:5000", "192.0.2.7", "front.test", "http", ""},
+		{[]string{"-trusted-proxies", "10.0.0.0/8", "-forwarded-untrusted", "strip"}, "192.0.2.7:5000", "", "front.test", "http", ""},
+	} {
+		h := forwardedHeaders(t, tt.args, tt.remote, sent...)
+		if h.Get("X-Forwarded-For") != tt.xff || h.Get("X-Forwarded-Host") != tt.host || h.Get("X-Forwarded-Proto") != tt.proto || h.Get("X-Real-Ip") != tt.realIP {
+			t.Errorf("%q from %s: backend got X-Forwarded-For %q, -Host %q, -Proto %q, X-Real-Ip %q; want %q, %q, %q, %q",
+				tt.args, tt.remote, h.Get("X-Forwarded-For"), h.Get("X-Forwarded-Host"), h.Get("X-Forwarded-Proto"), h.Get("X-Real-Ip"), tt.xff, tt.host, tt.proto, tt.realIP)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"-trusted-proxies", "10.0.0.0/33"},
+		{"-trusted-proxies", "10.0.0.0/8", "-forwarded-untrusted", "keep"},
+	} {
+		if _, err := New(WithFlags(args...)); err == nil {
+			t.Errorf("%q accepted", args)
+		}
+	}
+}
+
+func TestForwardedHeader(t *testing.T) {
+	for _, tt := range []struct {
+		args   []string
+		remote string
+		sent   []string
+		want   string
+	}{
+		{nil, "192.0.2.7:5000", nil, "for=192.0.2.7;proto=http;host=front.test"},
+		{nil, "[2001:db8::1]:5000", nil, `for="[2001:db8::1]";proto=http;host=front.test`},
+		{nil, "@", nil, "for=unknown;proto=http;host=front.test"},
+		{[]string{"-trusted-proxies", "10.0.0.0/8"}, "10.1.2.3:5000", []string{"Forwarded: for=198.51.100.1"}, "for=198.51.100.1, for=10.1.2.3;proto=http;host=front.test"},
+		{[]string{"-trusted-proxies", "10.0.0.0/8"}, "192.0.2.7:5000", []string{"Forwarded: for=198.51.100.1"}, "for=192.0.2.7;proto=http;host=front.test"},
+		{[]string{"-trusted-proxies", "10.0.0.0/8", "-forwarded-untrusted", "strip"}, "192.0.2.7:5000", []string{"Forwarded: for=198.51.100.1"}, "proto=http;host=front.test"},
+	} {
+		h := forwardedHeaders(t, append([]string{"-forwarded-header"}, tt.args...), tt.remote, tt.sent...)
+		if got := h.Get("Forwarded"); got != tt.want {
+			t.Errorf("%q from %s: Forwarded = %q, want %q", tt.args, tt.remote, got, tt.want)
+		}
+	}
+	if h := forwardedHeaders(t, nil, "192.0.2.7:5000"); h.Get("Forwarded") != "" {
+		t.Errorf("without -forwarded-header the backend got Forwarded %q", h.Get("Forwarded"))
+	}
+}
+
+func TestForwardedProtoHost(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		host string
+	}{
+		{nil, ""},
+		{[]string{"-forwarded-proto-host"}, "origin.test"},
+	} {
+		b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+		p := newTestProxy(t, tt.args...)
+		req := httptest.NewRequest("GET", b.URL+"/", nil)
+		req.Host = "origin.test"
+		p.ServeHTTP(httptest.NewRecorder(), req)
+		if b.last == nil {
+			t.Fatalf("%q: request didn't reach the backend", tt.args)
+		}
+		h := b.last.Header
+		if h.Get("X-Forwarded-Host") != tt.host || (tt.host != "") != (h.Get("X-Forwarded-Proto") == "http") {
+			t.Errorf("%q: forward proxy request got X-Forwarded-Host %q, -Proto %q", tt.args, h.Get("X-Forwarded-Host"), h.Get("X-Forwarded-Proto"))
+		}
+	}
+}
+
+func TestForwardedValue(t *testing.T) {
+	for in, want := range map[string]string{
+		"front.test":      "front.test",
+		"front.test:8080": `"front.test:8080"`,
+		`a"b\c`:           `"a\"b\\c"`,
+		"":                `""`,
+	} {
+		if got := forwardedValue(in); got != want {
+			t.Errorf("forwardedValue(%q) = %s, want %s", in, got, want)
+		}
+	}
+	for in, want := range map[string]string{
+		"192.0.2.7":        "192.0.2.7",
+		"::ffff:192.0.2.7": "192.0.2.7",
+		"2001:db8::1":      `"[2001:db8::1]"`,
+		"":                 "unknown",
+	} {
+		if got := forwardedNode(in); got != want {
+			t.Errorf("forwardedNode(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
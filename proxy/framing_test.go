@@ -0,0 +1,324 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rawRequest writes raw to the proxy at addr and returns the response.
+func rawRequest(t *testing.T, addr, raw string) *http.Response {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestCheckFraming(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		header http.Header
+		te     []string
+		ok     bool
+	}{
+		{"length", http.Header{"Content-Length": {"5"}}, nil, true},
+		{"chunked", nil, []string{"chunked"}, true},
+		{"none", nil, nil, true},
+		{"both", http.Header{"Content-Length": {"5"}}, []string{"chunked"}, false},
+		{"both headers", http.Header{"Content-Length": {"5"}, "Transfer-Encoding": {"chunked"}}, []string{"chunked"}, false},
+		{"unapplied TE", http.Header{"Transfer-Encoding": {"chunked"}}, nil, false},
+		{"gzip TE", nil, []string{"gzip", "chunked"}, false},
+		{"identity TE", nil, []string{"identity"}, false},
+	} {
+		req := httptest.NewRequest("POST", "http://x.test/", nil)
+		req.Header = tt.header
+		if req.Header == nil {
+			req.Header = http.Header{}
+		}
+		req.TransferEncoding = tt.te
+		if err := checkFraming(req); (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestFramingRejectedByHandler(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	p := newTestProxy(t, "-backend", b.URL)
+	req := httptest.NewRequest("POST", "http://front.test/", strings.NewReader("hello"))
+	req.TransferEncoding = []string{"chunked"}
+	req.Header.Set("Content-Length", "5")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest || rec.Header().Get("Connection") != "close" {
+		t.Errorf("got %d, Connection %q; want 400 and close", rec.Code, rec.Header().Get("Connection"))
+	}
+	if b.hits != 0 {
+		t.Error("request reached the backend")
+	}
+}
+
+// TestSmugglingOverTheWire sends the classic CL.TE request. The proxy
+// reads it as chunked, so the backend must too: it may see the trailing
+// request only as a request of its own, never inside the first one's body.
+func TestSmugglingOverTheWire(t *testing.T) {
+	type seen struct {
+		method, path, contentLength, body string
+	}
+	got := make(chan seen, 2)
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		got <- seen{req.Method, req.URL.Path, req.Header.Get("Content-Length"), string(body)}
+	})
+	srv := newProxyServer(t, "-backend", b.URL)
+	rawRequest(t, srv.Listener.Addr().String(), "POST / HTTP/1.1\r\nHost: front.test\r\n"+
+		"Content-Length: 30\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"0\r\n\r\nGET /smuggled HTTP/1.1\r\n\r\n")
+	if first := <-got; first != (seen{"POST", "/", "", ""}) {
+		t.Errorf("backend got %+v, want an empty POST without Content-Length", first)
+	}
+}
+
+func TestNormalizeFraming(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://x.test/", strings.NewReader("x"))
+	req.Header.Set("Content-Length", "1")
+	req.Header.Set("Transfer-Encoding", "chunked")
+	req.TransferEncoding = []string{"chunked"}
+	normalizeFraming(req)
+	if len(req.Header.Values("Content-Length"))+len(req.Header.Values("Transfer-Encoding")) != 0 || req.ContentLength != -1 {
+		t.Errorf("after normalizing: header %v, ContentLength %d", req.Header, req.ContentLength)
+	}
+}
+
+func TestBodyAllowed(t *testing.T) {
+	for _, tt := range []struct {
+		method string
+		status int
+		want   bool
+	}{
+		{"GET", 200, true},
+		{"HEAD", 200, false},
+		{"GET", 101, false},
+		{"GET", 204, false},
+		{"GET", 304, false},
+		{"POST", 404, true},
+	} {
+		if got := bodyAllowed(tt.method, tt.status); got != tt.want {
+			t.Errorf("bodyAllowed(%s, %d) = %v, want %v", tt.method, tt.status, got, tt.want)
+		}
+	}
+}
+
+// TestHeadKeepsConnectionUsable sends HEAD then GET on one connection to
+// the proxy; a HEAD response with a body would corrupt the second one.
+func TestHeadKeepsConnectionUsable(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("Content-Length", "5")
+		io.WriteString(wr, "hello")
+	})
+	srv := newProxyServer(t, "-backend", b.URL)
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "HEAD / HTTP/1.1\r\nHost: front.test\r\n\r\nGET / HTTP/1.1\r\nHost: front.test\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+	head, err := http.ReadResponse(br, &http.Request{Method: "HEAD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Header.Get("Content-Length") != "5" {
+		t.Errorf("HEAD Content-Length = %q, want the representation's 5", head.Header.Get("Content-Length"))
+	}
+	get, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("reading the GET after HEAD: %v", err)
+	}
+	if body, _ := io.ReadAll(get.Body); string(body) != "hello" {
+		t.Errorf("GET after HEAD got %q", body)
+	}
+}
+
+// closeDelimitedBackend answers every connection with body, delimited only
+// by closing the connection.
+func closeDelimitedBackend(t *testing.T, body string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				http.ReadRequest(bufio.NewReader(conn))
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n"+body)
+			}()
+		}
+	}()
+	return "http://" + ln.Addr().String()
+}
+
+func TestCloseDelimitedResponse(t *testing.T) {
+	body := strings.Repeat("close-delimited ", 1000)
+	srv := newProxyServer(t, "-backend", closeDelimitedBackend(t, body))
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+
+	// HTTP/1.1 clients get it chunked and keep the connection.
+	for i := range 2 {
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: front.test\r\n\r\n")
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("response %d: %v", i+1, err)
+		}
+		got, err := io.ReadAll(resp.Body)
+		if err != nil || string(got) != body || len(resp.TransferEncoding) == 0 || resp.Close {
+			t.Errorf("response %d: %d of %d bytes, err %v, Transfer-Encoding %q, close %v", i+1, len(got), len(body), err, resp.TransferEncoding, resp.Close)
+		}
+	}
+
+	// HTTP/1.0 clients can't take chunks, so the body ends at close.
+	conn, err = net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.0\r\nHost: front.test\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(resp.Body); err != nil || string(got) != body || !resp.Close {
+		t.Errorf("HTTP/1.0: %d of %d bytes, err %v, close %v", len(got), len(body), err, resp.Close)
+	}
+}
+
+func TestHeaderValuesRejected(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	logger, logs := newTestLogger()
+	p, err := New(WithFlags("-backend", b.URL), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"a\r\nX-Injected: 1", "a\nb", "a\x00b"} {
+		req := httptest.NewRequest("GET", "http://front.test/", nil)
+		req.Header["X-Evil"] = []string{v}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("header value %q got %d, want 400", v, rec.Code)
+		}
+	}
+	if b.hits != 0 {
+		t.Error("a request with a bad header reached the backend")
+	}
+	if strings.Contains(logs.String(), "X-Injected") || strings.Contains(logs.String(), "\x00") {
+		t.Errorf("offending value logged:\n%q", logs)
+	}
+	if err := checkHeaderValues(http.Header{"X-Fine": {"tab\tand ünïcode"}}); err != nil {
+		t.Errorf("ordinary value refused: %v", err)
+	}
+}
+
+func TestHeaderCounts(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	p := newTestProxy(t, "-backend", b.URL, "-max-request-headers", "4", "-max-cookies", "3")
+	for _, tt := range []struct {
+		name   string
+		header []string
+		status int
+	}{
+		{"under both", []string{"Accept: */*", "Cookie: a=1; b=2"}, http.StatusOK},
+		{"at both", []string{"Accept: */*", "X-A: 1", "Cookie: a=1; b=2", "Cookie: c=3"}, http.StatusOK},
+		{"too many headers", []string{"X-A: 1", "X-B: 2", "X-C: 3", "X-D: 4", "X-E: 5"}, http.StatusBadRequest},
+		{"repeated header lines", []string{"X-A: 1", "X-A: 2", "X-A: 3", "X-A: 4", "X-A: 5"}, http.StatusBadRequest},
+		{"too many cookies", []string{"Cookie: a=1; b=2; c=3; d=4"}, http.StatusBadRequest},
+		{"cookies over two headers", []string{"Cookie: a=1; b=2", "Cookie: c=3; d=4"}, http.StatusBadRequest},
+		{"empty pairs", []string{"Cookie: a=1;; ; b=2;"}, http.StatusOK},
+	} {
+		hits := b.hits
+		rec := serve(p, "GET", "http://front.test/", tt.header...)
+		if rec.Code != tt.status {
+			t.Errorf("%s: got %d, want %d", tt.name, rec.Code, tt.status)
+		}
+		if tt.status == http.StatusBadRequest && (b.hits != hits || rec.Header().Get("Connection") != "close") {
+			t.Errorf("%s: refused request reached the backend or kept the connection", tt.name)
+		}
+	}
+
+	// Without the flags there is no limit.
+	p = newTestProxy(t, "-backend", b.URL)
+	if rec := serve(p, "GET", "http://front.test/", "Cookie: a=1; b=2; c=3; d=4; e=5", "X-A: 1", "X-B: 2", "X-C: 3", "X-D: 4"); rec.Code != http.StatusOK {
+		t.Errorf("unlimited proxy got %d", rec.Code)
+	}
+}
+
+func TestExpect(t *testing.T) {
+	var got string
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		got = readBody(t, req.Body)
+	})
+	p := newTestProxy(t, "-backend", b.URL)
+	for _, expect := range []string{"200-ok", "100-continue, 200-ok"} {
+		if rec := serve(p, "POST", "http://front.test/", "Expect: "+expect); rec.Code != http.StatusExpectationFailed {
+			t.Errorf("Expect: %s got %d, want 417", expect, rec.Code)
+		}
+	}
+	if b.hits != 0 {
+		t.Error("request with an unsupported expectation reached the backend")
+	}
+
+	// 100-continue is met over the wire and the body forwarded.
+	srv := newProxyServer(t, "-backend", b.URL)
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "POST / HTTP/1.1\r\nHost: front.test\r\nExpect: 100-Continue\r\nContent-Length: 5\r\n\r\n")
+	br := bufio.NewReader(conn)
+	if line, _ := br.ReadString('\n'); !strings.HasPrefix(line, "HTTP/1.1 100 ") {
+		t.Fatalf("got %q, want 100 Continue", line)
+	}
+	br.ReadString('\n')
+	io.WriteString(conn, "hello")
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || got != "hello" {
+		t.Errorf("after 100 Continue got %s, backend read %q", resp.Status, got)
+	}
+}
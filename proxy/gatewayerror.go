@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// gatewayErrorBody is the JSON body of a -verbose-errors gateway error.
+// It names what went wrong in broad terms only: the error text itself can
+// carry internal addresses and is left to the log.
+type gatewayErrorBody struct {
+	Error    string `json:"error"`
+	Category string `json:"category"`
+	Target   string `json:"target"`
+}
+
+// gatewayErrorCategory classifies a failed backend round trip: the
+// dialErrorKind categories, plus "closed" for a backend that hung up
+// without responding.
+func gatewayErrorCategory(err error) string {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return "closed"
+	}
+	return dialErrorKind(err)
+}
+
+// serveGatewayError answers a request whose backend round trip failed
+// with err: 504 for timeouts, else 502. msg is the terse plain text body;
+// with -verbose-errors the body is JSON with the category and target host
+// instead.
+func (p *proxy) serveGatewayError(wr http.ResponseWriter, req *http.Request, msg string, err error) {
+	category := gatewayErrorCategory(err)
+	status := http.StatusBadGateway
+	if category == "timeout" {
+		status = http.StatusGatewayTimeout
+	}
+	if !p.verboseErrors {
+		http.Error(wr, msg, status)
+		return
+	}
+	wr.Header().Set("Content-Type", "application/json")
+	wr.Header().Set("X-Content-Type-Options", "nosniff")
+	wr.WriteHeader(status)
+	json.NewEncoder(wr).Encode(gatewayErrorBody{
+		Error:    msg,
+		Category: category,
+		Target:   req.URL.Host,
+	})
+}
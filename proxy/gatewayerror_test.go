@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerboseErrors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := ln.Addr().String()
+	ln.Close()
+	// Not a countingBackend: requests timed out overlap on it.
+	slow := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	t.Cleanup(slow.Close)
+	slowHost := strings.TrimPrefix(slow.URL, "http://")
+
+	for _, tt := range []struct {
+		backend  string
+		status   int
+		category string
+	}{
+		{refused, http.StatusBadGateway, "refused"},
+		{slowHost, http.StatusGatewayTimeout, "timeout"},
+	} {
+		args := []string{"-backend", "http://" + tt.backend, "-connect-retries", "0", "-response-header-timeout", "50ms"}
+
+		rec := serve(newTestProxy(t, args...), "GET", "http://front.test/")
+		if rec.Code != tt.status || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+			t.Errorf("%s: terse error got %d %s, want %d as text", tt.category, rec.Code, rec.Header().Get("Content-Type"), tt.status)
+		}
+		if strings.Contains(rec.Body.String(), tt.backend) || strings.Contains(rec.Body.String(), tt.category) {
+			t.Errorf("%s: terse error body %q gives details", tt.category, rec.Body)
+		}
+
+		rec = serve(newTestProxy(t, append(args, "-verbose-errors")...), "GET", "http://front.test/")
+		var body gatewayErrorBody
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != tt.status {
+			t.Fatalf("%s: verbose error got %d %q (%v), want %d with JSON", tt.category, rec.Code, rec.Body, err, tt.status)
+		}
+		if body.Category != tt.category || body.Target != tt.backend || body.Error == "" {
+			t.Errorf("%s: verbose error body %+v", tt.category, body)
+		}
+		if strings.Contains(body.Error, "127.0.0.1") {
+			t.Errorf("%s: error message %q carries the address", tt.category, body.Error)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// geoHeader carries the client's country to backends. Any value the
+// client sent is replaced so it can't be spoofed.
+const geoHeader = "X-Client-Country"
+
+// geoFilter resolves client IPs to ISO country codes from a MaxMind
+// database and applies the -geoip-allow and -geoip-deny lists. A nil
+// *geoFilter resolves nothing and permits everyone.
+type geoFilter struct {
+	db    *mmdb
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+func newGeoFilter(path string, allow, deny []string) (*geoFilter, error) {
+	db, err := openMMDB(path)
+	if err != nil {
+		return nil, err
+	}
+	g := &geoFilter{db: db}
+	if len(allow) > 0 {
+		g.allow = countrySet(allow)
+	}
+	if len(deny) > 0 {
+		g.deny = countrySet(deny)
+	}
+	return g, nil
+}
+
+func countrySet(codes []string) map[string]bool {
+	set := make(map[string]bool, len(codes))
+	for _, c := range codes {
+		set[strings.ToUpper(c)] = true
+	}
+	return set
+}
+
+// country returns the ISO code for the host part of remoteAddr, or "" if
+// the address is not in the database.
+func (g *geoFilter) country(remoteAddr string) string {
+	if g == nil {
+		return ""
+	}
+	host, _ := remoteHost(remoteAddr)
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return ""
+	}
+	record, err := g.db.lookup(ip.Unmap())
+	if err != nil {
+		return ""
+	}
+	for _, key := range []string{"country", "registered_country"} {
+		if c, ok := record[key].(map[string]any); ok {
+			if code, ok := c["iso_code"].(string); ok {
+				return code
+			}
+		}
+	}
+	return ""
+}
+
+// permits reports whether clients from country may use the proxy. With an
+// allow list, clients whose country is unknown are refused too.
+func (g *geoFilter) permits(country string) bool {
+	if g == nil {
+		return true
+	}
+	if g.deny[country] {
+		return false
+	}
+	return g.allow == nil || g.allow[country]
+}
+
+// mmdb is a read-only MaxMind DB, loaded into memory once at startup. Only
+// what country lookups need is implemented; see
+// https://maxmind.github.io/MaxMind-DB/ for the format.
+type mmdb struct {
+	buf        []byte
+	nodeCount  uint
+	recordSize uint
+	dataStart  int
+	ipv4Start  uint
+	ipv6       bool
+}
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+func openMMDB(path string) (*mmdb, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%s: not a MaxMind DB file", path)
+	}
+	meta, _, err := decodeMMDB(buf[i+len(mmdbMetadataMarker):], 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: reading metadata: %w", path, err)
+	}
+	m, ok := meta.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: metadata is not a map", path)
+	}
+	nodeCount, _ := m["node_count"].(uint64)
+	recordSize, _ := m["record_size"].(uint64)
+	ipVersion, _ := m["ip_version"].(uint64)
+	switch recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, recordSize)
+	}
+	db := &mmdb{
+		buf:        buf[:i],
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+		ipv6:       ipVersion == 6,
+	}
+	treeSize := int(db.nodeCount * db.recordSize / 4)
+	db.dataStart = treeSize + 16
+	if db.dataStart > len(db.buf) {
+		return nil, fmt.Errorf("%s: search tree is truncated", path)
+	}
+	if db.ipv6 {
+		// IPv4 addresses live under ::/96.
+		for range 96 {
+			if db.ipv4Start >= db.nodeCount {
+				break
+			}
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *mmdb) record(node, bit uint) uint {
+	b := db.buf[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+var errNotInDB = errors.New("address not in database")
+
+// lookup returns the data record for ip.
+func (db *mmdb) lookup(ip netip.Addr) (map[string]any, error) {
+	var node uint
+	if ip.Is4() {
+		if db.ipv6 {
+			node = db.ipv4Start
+		}
+	} else if !db.ipv6 {
+		return nil, errNotInDB
+	}
+	addr := ip.AsSlice()
+	for i := 0; i < len(addr)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(addr[i/8]>>(7-i%8)&1))
+	}
+	if node <= db.nodeCount {
+		return nil, errNotInDB
+	}
+	v, _, err := decodeMMDB(db.buf[db.dataStart:], int(node-db.nodeCount-16))
+	if err != nil {
+		return nil, err
+	}
+	record, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("data record is not a map")
+	}
+	return record, nil
+}
+
+var errMMDBData = errors.New("malformed data section")
+
+// mmdbMaxDepth caps how deeply maps, arrays and pointers may nest, so a
+// crafted database can't recurse without end.
+const mmdbMaxDepth = 64
+
+// decodeMMDB decodes the value at off in the data section data, returning
+// it and the offset just past it. Maps become map[string]any, arrays []any
+// and all unsigned integers uint64.
+func decodeMMDB(data []byte, off int) (any, int, error) {
+	return decodeMMDBValue(data, off, mmdbMaxDepth)
+}
+
+// decodeMMDBValue is decodeMMDB for a value that may nest depth more
+// levels.
+func decodeMMDBValue(data []byte, off, depth int) (any, int, error) {
+	if off < 0 || off >= len(data) || depth <= 0 {
+		return nil, 0, errMMDBData
+	}
+	ctrl := data[off]
+	off++
+	typ := int(ctrl >> 5)
+
+	if typ == 1 {
+		// Pointers hold their own size in the control byte and point at
+		// the value to use in their place.
+		ss, vvv := int(ctrl>>3&3), int(ctrl&7)
+		if off+ss+1 > len(data) {
+			return nil, 0, errMMDBData
+		}
+		var ptr int
+		switch ss {
+		case 0:
+			ptr = vvv<<8 | int(data[off])
+		case 1:
+			ptr = (vvv<<16 | int(data[off])<<8 | int(data[off+1])) + 2048
+		case 2:
+			ptr = (vvv<<24 | int(data[off])<<16 | int(data[off+1])<<8 | int(data[off+2])) + 526336
+		case 3:
+			ptr = int(binary.BigEndian.Uint32(data[off:]))
+		}
+		v, _, err := decodeMMDBValue(data, ptr, depth-1)
+		return v, off + ss + 1, err
+	}
+
+	if typ == 0 {
+		if off >= len(data) {
+			return nil, 0, errMMDBData
+		}
+		typ = 7 + int(data[off])
+		off++
+	}
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > len(data) {
+			return nil, 0, errMMDBData
+		}
+		ext := 0
+		for _, b := range data[off : off+n] {
+			ext = ext<<8 | int(b)
+		}
+		size = []int{29, 285, 65821}[n-1] + ext
+		off += n
+	}
+
+	switch typ {
+	case 7: // map
+		// Every entry takes at least two bytes, so a bogus size can't
+		// make the map any bigger than the data.
+		m := make(map[string]any, min(size, (len(data)-off)/2))
+		for range size {
+			k, next, err := decodeMMDBValue(data, off, depth-1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBData
+			}
+			v, next, err := decodeMMDBValue(data, next, depth-1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			off = next
+		}
+		return m, off, nil
+	case 11: // array
+		a := make([]any, 0, min(size, len(data)-off))
+		for range size {
+			v, next, err := decodeMMDBValue(data, off, depth-1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = next
+		}
+		return a, off, nil
+	case 14: // boolean, stored in the size
+		return size != 0, off, nil
+	}
+
+	if off+size > len(data) {
+		return nil, 0, errMMDBData
+	}
+	b := data[off : off+size]
+	off += size
+	switch typ {
+	case 2: // UTF-8 string
+		return string(b), off, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errMMDBData
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case 4: // bytes
+		return bytes.Clone(b), off, nil
+	case 5, 6, 9, 10: // uint16, uint32, uint64, uint128
+		// uint128 values wider than 64 bits are only used for IDs a
+		// country lookup never reads, so truncating them is harmless.
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+		return u, off, nil
+	case 8: // int32
+		var u uint32
+		for _, c := range b {
+			u = u<<8 | uint32(c)
+		}
+		if size == 4 {
+			return int64(int32(u)), off, nil
+		}
+		return int64(u), off, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errMMDBData
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off, nil
+	}
+	return nil, 0, fmt.Errorf("%w: type %d", errMMDBData, typ)
+}
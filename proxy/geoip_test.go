@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The helpers below encode just enough of the MaxMind DB format to build
+// small fixtures.
+
+func mmdbCtrl(typ, size int) []byte {
+	if typ > 7 {
+		return []byte{byte(size), byte(typ - 7)}
+	}
+	return []byte{byte(typ<<5 | size)}
+}
+
+func mmdbString(s string) []byte {
+	return append(mmdbCtrl(2, len(s)), s...)
+}
+
+func mmdbUint(typ int, v uint64) []byte {
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	return append(mmdbCtrl(typ, len(b)), b...)
+}
+
+// mmdbMap encodes a map from alternating encoded keys and values.
+func mmdbMap(kv ...[]byte) []byte {
+	return append(mmdbCtrl(7, len(kv)/2), bytes.Join(kv, nil)...)
+}
+
+// mmdbPointer encodes a pointer to off, which must be under 2048.
+func mmdbPointer(off int) []byte {
+	return []byte{byte(1<<5 | off>>8), byte(off)}
+}
+
+// writeMMDB writes an IPv4 database with 24-bit records in which prefix
+// leads to the value at recordOff in data, and returns its path.
+func writeMMDB(t *testing.T, prefix netip.Prefix, data []byte, recordOff int) string {
+	t.Helper()
+	nodes := prefix.Bits()
+	addr := prefix.Addr().As4()
+	var tree []byte
+	for i := range nodes {
+		next, empty := uint32(i+1), uint32(nodes)
+		if i == nodes-1 {
+			next = uint32(nodes + 16 + recordOff)
+		}
+		records := [2]uint32{empty, empty}
+		records[addr[i/8]>>(7-i%8)&1] = next
+		for _, r := range records {
+			tree = append(tree, byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.Write(tree)
+	buf.Write(make([]byte, 16))
+	buf.Write(data)
+	buf.Write(mmdbMetadataMarker)
+	buf.Write(mmdbMap(
+		mmdbString("node_count"), mmdbUint(6, uint64(nodes)),
+		mmdbString("record_size"), mmdbUint(5, 24),
+		mmdbString("ip_version"), mmdbUint(5, 4),
+	))
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGeoFilterCountry(t *testing.T) {
+	// The country code is stored once and pointed to, as real databases
+	// do.
+	code := mmdbString("DE")
+	record := mmdbMap(
+		mmdbString("country"), mmdbMap(mmdbString("iso_code"), mmdbPointer(0)),
+	)
+	data := append(code, record...)
+	path := writeMMDB(t, netip.MustParsePrefix("10.0.0.0/8"), data, len(code))
+
+	g, err := newGeoFilter(path, nil, []string{"de"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		remote, want string
+	}{
+		{"10.1.2.3:4567", "DE"},
+		{"10.255.255.255:1", "DE"},
+		{"11.0.0.1:4567", ""},
+		{"[::ffff:10.0.0.1]:4567", "DE"},
+		{"[2001:db8::1]:4567", ""},
+		{"not an address", ""},
+	} {
+		if got := g.country(tt.remote); got != tt.want {
+			t.Errorf("country(%q) = %q, want %q", tt.remote, got, tt.want)
+		}
+	}
+	if g.permits("DE") {
+		t.Error("permits(DE) with -geoip-deny DE")
+	}
+	if !g.permits("") {
+		t.Error("unknown country refused without an allow list")
+	}
+}
+
+func TestGeoFilterPermits(t *testing.T) {
+	g := &geoFilter{allow: countrySet([]string{"fr", "NL"}), deny: countrySet([]string{"nl"})}
+	for country, want := range map[string]bool{"FR": true, "NL": false, "DE": false, "": false} {
+		if got := g.permits(country); got != want {
+			t.Errorf("permits(%q) = %v, want %v", country, got, want)
+		}
+	}
+	var none *geoFilter
+	if !none.permits("") || none.country("10.0.0.1:1") != "" {
+		t.Error("nil geoFilter should permit everyone and resolve nothing")
+	}
+}
+
+func TestOpenMMDBRejects(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string][]byte{
+		"no marker":   []byte("just some bytes"),
+		"record size": append(append([]byte{}, mmdbMetadataMarker...), mmdbMap(mmdbString("record_size"), mmdbUint(5, 20))...),
+		"truncated tree": append(append([]byte{}, mmdbMetadataMarker...), mmdbMap(
+			mmdbString("node_count"), mmdbUint(6, 1000),
+			mmdbString("record_size"), mmdbUint(5, 24),
+		)...),
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := openMMDB(path); err == nil {
+			t.Errorf("%s: openMMDB succeeded", name)
+		}
+	}
+}
+
+func TestDecodeMMDBCrafted(t *testing.T) {
+	deep := bytes.Repeat(mmdbCtrl(11, 1), mmdbMaxDepth+1) // arrays in arrays
+	for name, data := range map[string][]byte{
+		"pointer to itself":    mmdbPointer(0),
+		"pointers in a cycle":  append(mmdbPointer(2), mmdbPointer(0)...),
+		"map holding itself":   mmdbMap(mmdbString("k"), mmdbPointer(0)),
+		"nested too deep":      deep,
+		"truncated pointer":    mmdbPointer(0)[:1],
+		"oversized map":        {0xe0 | 31, 0xff, 0xff, 0xff},
+		"string past the end":  mmdbCtrl(2, 10),
+		"non-string map key":   mmdbMap(mmdbUint(5, 1), mmdbUint(5, 2)),
+		"unknown type":         mmdbCtrl(13, 0),
+		"double of wrong size": append(mmdbCtrl(3, 4), 0, 0, 0, 0),
+	} {
+		if _, _, err := decodeMMDB(data, 0); !errors.Is(err, errMMDBData) {
+			t.Errorf("%s: err = %v, want errMMDBData", name, err)
+		}
+	}
+}
+
+func TestDecodeMMDBValues(t *testing.T) {
+	data := mmdbMap(
+		mmdbString("n"), mmdbUint(9, 1<<40),
+		mmdbString("list"), append(mmdbCtrl(11, 2), append(mmdbString("a"), mmdbString("b")...)...),
+		mmdbString("yes"), mmdbCtrl(14, 1),
+	)
+	v, next, err := decodeMMDB(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != len(data) {
+		t.Errorf("next = %d, want %d", next, len(data))
+	}
+	m := v.(map[string]any)
+	if m["n"] != uint64(1<<40) {
+		t.Errorf("n = %v", m["n"])
+	}
+	if l, _ := m["list"].([]any); len(l) != 2 || l[0] != "a" || l[1] != "b" {
+		t.Errorf("list = %v", m["list"])
+	}
+	if m["yes"] != true {
+		t.Errorf("yes = %v", m["yes"])
+	}
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// isGRPC reports whether req is a gRPC call.
+func isGRPC(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcTransport returns a copy of base that only speaks HTTP/2: h2c to
+// http:// backends and h2 over TLS to https:// ones, as gRPC requires.
+func grpcTransport(base *http.Transport) *http.Transport {
+	t := base.Clone()
+	t.Protocols = new(http.Protocols)
+	t.Protocols.SetHTTP2(true)
+	t.Protocols.SetUnencryptedHTTP2(true)
+	return t
+}
+
+// copyTrailers sends the backend's trailers on to the client. It must be
+// called after the body has been read to EOF, when resp.Trailer is filled.
+func copyTrailers(wr http.ResponseWriter, trailer http.Header) {
+	for k, vv := range trailer {
+		for _, v := range vv {
+			wr.Header().Add(http.TrailerPrefix+k, v)
+		}
+	}
+}
+
+// flushWriter flushes after every write so streamed messages (gRPC
+// streams, for one) reach the client as soon as the backend sends them.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func newFlushWriter(wr http.ResponseWriter) *flushWriter {
+	return &flushWriter{w: wr, rc: http.NewResponseController(wr)}
+}
+
+func (f *flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	if err == nil {
+		f.rc.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newH2CBackend is a backend speaking only cleartext HTTP/2, as gRPC
+// servers do, answering with a gRPC status trailer.
+func newH2CBackend(t *testing.T) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		wr.Header().Set("Content-Type", "application/grpc")
+		wr.Header().Set("Trailer", "Grpc-Status")
+		fmt.Fprintf(wr, "%s %s te=%s", req.Proto, body, req.Header.Get("Te"))
+		wr.Header().Set("Grpc-Status", "0")
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGRPCOverH2C(t *testing.T) {
+	b := newH2CBackend(t)
+	p := newTestProxy(t, "-backend", b.URL, "-h2c")
+
+	req := httptest.NewRequest("POST", "http://front.test/pkg.Service/Method", strings.NewReader("msg"))
+	req.Header.Set("Content-Type", "application/grpc")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	resp := rec.Result()
+
+	if body, _ := io.ReadAll(resp.Body); string(body) != "HTTP/2.0 msg te=trailers" {
+		t.Errorf("backend answered %q, want an HTTP/2 request with TE: trailers", body)
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("Grpc-Status trailer = %q, want 0", got)
+	}
+}
+
+func TestIsGRPC(t *testing.T) {
+	for ct, want := range map[string]bool{
+		"application/grpc":       true,
+		"application/grpc+proto": true,
+		"application/json":       false,
+		"":                       false,
+	} {
+		req := httptest.NewRequest("POST", "http://x.test/", nil)
+		req.Header.Set("Content-Type", ct)
+		if got := isGRPC(req); got != want {
+			t.Errorf("isGRPC(%q) = %v, want %v", ct, got, want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// streamConn is an HTTP/2 CONNECT stream as a net.Conn, for clients that
+// tunnel over an HTTP/2 proxy connection, which can't be hijacked. Reads
+// come from the request body and writes go straight out as response data.
+type streamConn struct {
+	body io.ReadCloser
+	wr   http.ResponseWriter
+	rc   *http.ResponseController
+	req  *http.Request
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newStreamConn(wr http.ResponseWriter, req *http.Request) *streamConn {
+	return &streamConn{body: req.Body, wr: wr, rc: http.NewResponseController(wr), req: req}
+}
+
+// hijackTunnel returns the client side of a CONNECT tunnel: the hijacked
+// connection for HTTP/1, or the request's stream for HTTP/2.
+func hijackTunnel(wr http.ResponseWriter, req *http.Request) (net.Conn, error) {
+	if req.ProtoMajor == 2 {
+		return newStreamConn(wr, req), nil
+	}
+	conn, _, err := http.NewResponseController(wr).Hijack()
+	return conn, err
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	n, err := c.wr.Write(b)
+	if err == nil {
+		err = c.rc.Flush()
+	}
+	return n, err
+}
+
+// writeResponse sends the tunnel's response head, standing in for
+// writeRawResponse on a hijacked connection.
+func (c *streamConn) writeResponse(status string, header http.Header) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	code, _ := strconv.Atoi(status[:3])
+	for k, v := range header {
+		if k != "Connection" {
+			c.wr.Header()[k] = v
+		}
+	}
+	c.wr.WriteHeader(code)
+	return c.rc.Flush()
+}
+
+// Close ends the stream. No writes happen after it returns, so the
+// handler may return right after.
+func (c *streamConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.body.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	if addr, ok := c.req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", c.req.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.rc.SetWriteDeadline(t)
+	return c.rc.SetReadDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return c.rc.SetReadDeadline(t)
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return c.rc.SetWriteDeadline(t)
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import "sync"
+
+// otherHost is the host label for hosts without their own.
+const otherHost = "other"
+
+// hostLabeler decides which target hosts get their own metrics label, so an
+// open proxy can't grow the number of series without bound. Hosts on the
+// allow list are always labelled; beyond those, the first max distinct
+// hosts seen keep their own label and everything else is "other". Hosts
+// are never relabelled by how busy they turn out to be, as moving a
+// host's counts from one series to another would break its counters, so
+// hosts that matter should go on the allow list.
+type hostLabeler struct {
+	allow map[string]bool
+	max   int
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+// newHostLabeler returns nil, disabling the host label, if there is neither
+// an allow list nor a cap.
+func newHostLabeler(allow []string, max int) *hostLabeler {
+	if len(allow) == 0 && max <= 0 {
+		return nil
+	}
+	h := &hostLabeler{allow: make(map[string]bool), max: max, seen: make(map[string]bool)}
+	for _, host := range allow {
+		h.allow[normalizeHost(host)] = true
+	}
+	return h
+}
+
+// label returns the label value for host, or "" when host labels are off.
+func (h *hostLabeler) label(host string) string {
+	if h == nil {
+		return ""
+	}
+	host = normalizeHost(host)
+	if h.allow[host] {
+		return host
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.seen[host] {
+		return host
+	}
+	if len(h.seen) < h.max && host != "" {
+		h.seen[host] = true
+		return host
+	}
+	return otherHost
+}
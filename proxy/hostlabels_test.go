@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHostLabeler(t *testing.T) {
+	if newHostLabeler(nil, 0) != nil {
+		t.Error("host labels on with neither -metrics-hosts nor -metrics-max-hosts")
+	}
+	h := newHostLabeler([]string{"API.example.com"}, 2)
+	for _, tt := range []struct{ host, want string }{
+		{"a.test", "a.test"},
+		{"api.example.com", "api.example.com"},
+		{"B.test.", "b.test"},
+		{"c.test", otherHost},
+		{"a.test", "a.test"},
+		{"", otherHost},
+		{"api.example.com", "api.example.com"},
+	} {
+		if got := h.label(tt.host); got != tt.want {
+			t.Errorf("label(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestMetricsHostLabels(t *testing.T) {
+	// Answered by the hook, so no host need exist.
+	p, err := New(WithFlags("-metrics-addr", "127.0.0.1:0", "-metrics-hosts", "pinned.test", "-metrics-max-hosts", "1"),
+		OnRequest(func(req *http.Request) *http.Response {
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"first.test", "second.test", "third.test", "pinned.test"} {
+		serve(p, "GET", "http://"+host+"/")
+	}
+	page := scrape(t, p)
+	for _, want := range []string{`host="first.test"`, `host="pinned.test"`, `host="other"`} {
+		if !strings.Contains(page, want) {
+			t.Errorf("metrics lack %s:\n%s", want, page)
+		}
+	}
+	if strings.Contains(page, `host="second.test"`) {
+		t.Error("host past -metrics-max-hosts got its own label")
+	}
+}
@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// userFile holds the -auth-file users. Each line is an htpasswd entry,
+// user:hash, where the hash may be Apache MD5 ($apr1$), {SHA}, bcrypt
+// (with -tags bcrypt) or a plain password, or an htdigest entry,
+// user:realm:HA1, for the minprox realm. A single user:password line is
+// the simplest valid file. Blank lines and # comments are skipped. The
+// file is re-read on SIGHUP.
+type userFile struct {
+	path string
+
+	mu    sync.RWMutex
+	users map[string]userEntry
+}
+
+// userEntry is one user's credentials. ha1 is the Digest HA1, known only
+// for plain passwords and htdigest entries.
+type userEntry struct {
+	kind string
+	hash string
+	ha1  string
+}
+
+// Password hash kinds in a userFile.
+const (
+	hashPlain  = "plain"
+	hashAPR1   = "apr1"
+	hashSHA    = "sha"
+	hashBcrypt = "bcrypt"
+	hashDigest = "digest"
+)
+
+func loadUserFile(path string) (*userFile, error) {
+	f := &userFile{path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// reload re-reads the file. On error the previous users are kept.
+func (f *userFile) reload() error {
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	users := make(map[string]userEntry)
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, e, err := parseUserLine(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", f.path, n, err)
+		}
+		users[user] = e
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return fmt.Errorf("%s: no users", f.path)
+	}
+	f.mu.Lock()
+	f.users = users
+	f.mu.Unlock()
+	return nil
+}
+
+func parseUserLine(line string) (string, userEntry, error) {
+	user, hash, ok := strings.Cut(line, ":")
+	if !ok || user == "" {
+		return "", userEntry{}, fmt.Errorf("want user:password or user:hash")
+	}
+	if realm, ha1, ok := strings.Cut(hash, ":"); ok && realm == authRealm && isMD5Hex(ha1) {
+		return user, userEntry{kind: hashDigest, ha1: strings.ToLower(ha1)}, nil
+	}
+	switch {
+	case strings.HasPrefix(hash, "$apr1$"):
+		return user, userEntry{kind: hashAPR1, hash: hash}, nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		return user, userEntry{kind: hashSHA, hash: hash}, nil
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		if !bcryptSupported {
+			return "", userEntry{}, fmt.Errorf("bcrypt hash for %q needs a build with -tags bcrypt", user)
+		}
+		return user, userEntry{kind: hashBcrypt, hash: hash}, nil
+	case strings.HasPrefix(hash, "$"):
+		return "", userEntry{}, fmt.Errorf("unsupported password hash for %q", user)
+	}
+	return user, userEntry{kind: hashPlain, hash: hash, ha1: digestHA1(user, hash)}, nil
+}
+
+func isMD5Hex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && len(s) == 2*md5.Size
+}
+
+// digestHA1 returns the Digest HA1 for user and pass in the minprox realm.
+func digestHA1(user, pass string) string {
+	return md5Hex(user + ":" + authRealm + ":" + pass)
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// check reports whether pass is user's password.
+func (f *userFile) check(user, pass string) bool {
+	f.mu.RLock()
+	e, ok := f.users[user]
+	f.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	var want, got string
+	switch e.kind {
+	case hashPlain:
+		want, got = e.hash, pass
+	case hashAPR1:
+		salt, _, _ := strings.Cut(strings.TrimPrefix(e.hash, "$apr1$"), "$")
+		want, got = e.hash, apr1(pass, salt)
+	case hashSHA:
+		sum := sha1.Sum([]byte(pass))
+		want, got = e.hash, "{SHA}"+base64.StdEncoding.EncodeToString(sum[:])
+	case hashBcrypt:
+		return bcryptMatches(e.hash, pass)
+	case hashDigest:
+		want, got = e.ha1, digestHA1(user, pass)
+	}
+	return subtle.ConstantTimeCompare([]byte(want), []byte(got)) == 1
+}
+
+// ha1 returns user's Digest HA1, if the file has what it takes to check
+// Digest credentials for them.
+func (f *userFile) ha1(user string) (string, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	e, ok := f.users[user]
+	return e.ha1, ok && e.ha1 != ""
+}
+
+// apr1 computes the Apache MD5 crypt hash of pass with salt, as written
+// by htpasswd -m.
+func apr1(pass, salt string) string {
+	const magic = "$apr1$"
+	pw := []byte(pass)
+
+	alt := md5.Sum([]byte(pass + salt + pass))
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(magic + salt))
+	for i := len(pw); i > 0; i -= md5.Size {
+		h.Write(alt[:min(i, md5.Size)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	sum := h.Sum(nil)
+
+	for i := range 1000 {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(pw)
+		}
+		sum = h.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out strings.Builder
+	out.WriteString(magic + salt + "$")
+	encode := func(v uint, n int) {
+		for range n {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(sum[g[0]])<<16|uint(sum[g[1]])<<8|uint(sum[g[2]]), 4)
+	}
+	encode(uint(sum[11]), 2)
+	return out.String()
+}
@@ -0,0 +1,12 @@
+//go:build bcrypt
+
+package proxy
+
+import "golang.org/x/crypto/bcrypt"
+
+const bcryptSupported = true
+
+// bcryptMatches reports whether pass matches an htpasswd -B hash.
+func bcryptMatches(hash, pass string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+}
@@ -0,0 +1,11 @@
+//go:build !bcrypt
+
+package proxy
+
+// bcrypt hashes are only supported when built with -tags bcrypt, which
+// compiles in golang.org/x/crypto. The default build uses none of its code.
+const bcryptSupported = false
+
+func bcryptMatches(hash, pass string) bool {
+	return false
+}
@@ -0,0 +1,720 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// heuristicFreshnessMax caps the freshness guessed from Last-Modified for
+// responses that give none, so RFC 7234's 113 warning is never due.
+const heuristicFreshnessMax = 24 * time.Hour
+
+// httpCache is a shared HTTP cache following RFC 7234: GET responses are
+// stored and served again while fresh according to Cache-Control and
+// Expires, then revalidated with their ETag or Last-Modified. Responses
+// that Vary are stored per variant. Bodies are kept in memory, or in dir
+// if it is set, where they survive restarts. The least recently used
+// entries are evicted once maxSize is reached.
+type httpCache struct {
+	maxSize   int64
+	maxObject int64
+	dir       string
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string][]*cacheEntry
+}
+
+// cacheEntry is one stored response. Entries are never changed once they
+// are in the cache; revalidation replaces them with an updated copy.
+type cacheEntry struct {
+	URL      string            `json:"url"`
+	Vary     map[string]string `json:"vary,omitempty"`
+	Status   int               `json:"status"`
+	Header   http.Header       `json:"header"`
+	Request  time.Time         `json:"request_time"`
+	Response time.Time         `json:"response_time"`
+	Length   int64             `json:"length"`
+
+	body []byte // in memory
+	file string // on disk, with the entry as JSON in file+".json"
+	elem *list.Element
+}
+
+func newHTTPCache(maxSize, maxObject int64, dir string) (*httpCache, error) {
+	c := &httpCache{
+		maxSize:   maxSize,
+		maxObject: min(maxObject, maxSize),
+		dir:       dir,
+		lru:       list.New(),
+		entries:   make(map[string][]*cacheEntry),
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+		if err := c.load(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// load indexes the entries left in dir by an earlier run, removing any
+// whose body or description is missing.
+func (c *httpCache) load() error {
+	names, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	var loaded []*cacheEntry
+	described := make(map[string]bool)
+	for _, n := range names {
+		if !strings.HasSuffix(n.Name(), ".json") {
+			continue
+		}
+		file := filepath.Join(c.dir, strings.TrimSuffix(n.Name(), ".json"))
+		e, err := readCacheEntry(file)
+		if err != nil {
+			slog.Warn("dropping unreadable cache entry", "file", file, "error", err)
+			os.Remove(file)
+			os.Remove(file + ".json")
+			continue
+		}
+		described[file] = true
+		loaded = append(loaded, e)
+	}
+	for _, n := range names {
+		file := filepath.Join(c.dir, n.Name())
+		if !strings.HasSuffix(file, ".json") && !described[file] {
+			os.Remove(file)
+		}
+	}
+
+	// The oldest responses are taken as the least recently used.
+	slices.SortFunc(loaded, func(a, b *cacheEntry) int { return a.Response.Compare(b.Response) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range loaded {
+		c.insert(e)
+	}
+	c.evict()
+	slog.Info("Loaded cache", "dir", c.dir, "entries", c.lru.Len(), "bytes", c.size)
+	return nil
+}
+
+func readCacheEntry(file string) (*cacheEntry, error) {
+	data, err := os.ReadFile(file + ".json")
+	if err != nil {
+		return nil, err
+	}
+	e := &cacheEntry{file: file}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(file); err != nil || fi.Size() != e.Length {
+		return nil, errCacheBodyMissing
+	}
+	return e, nil
+}
+
+var errCacheBodyMissing = errors.New("body missing or incomplete")
+
+// cacheControl returns the Cache-Control directives in header, with
+// names lowercased and the quotes taken off values.
+func cacheControl(header http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, v := range header.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+// seconds returns directive name of cc as a duration, and whether it was
+// given with a valid value.
+func seconds(cc map[string]string, name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(min(n, 1<<31)) * time.Second, true
+}
+
+// eligible reports whether req may be answered from the cache. Ranges
+// are always passed to the backend, as only whole bodies are stored.
+func (c *httpCache) eligible(req *http.Request) bool {
+	if c == nil || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return false
+	}
+	if _, ok := req.Header["Range"]; ok {
+		return false
+	}
+	_, noStore := cacheControl(req.Header)["no-store"]
+	return !noStore
+}
+
+// matches reports whether e was stored for a request with the same
+// values as req for the headers the response varies on.
+func (e *cacheEntry) matches(req *http.Request) bool {
+	for name, v := range e.Vary {
+		if strings.Join(req.Header.Values(name), ",") != v {
+			return false
+		}
+	}
+	return true
+}
+
+// lifetime is how long e stays fresh after it was generated.
+func (e *cacheEntry) lifetime() time.Duration {
+	cc := cacheControl(e.Header)
+	if _, ok := cc["no-cache"]; ok {
+		return 0
+	}
+	if d, ok := seconds(cc, "s-maxage"); ok {
+		return d
+	}
+	if d, ok := seconds(cc, "max-age"); ok {
+		return d
+	}
+	date := e.date()
+	if v := e.Header.Get("Expires"); v != "" {
+		// An invalid Expires, such as 0, means already expired.
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0
+		}
+		return max(expires.Sub(date), 0)
+	}
+	if lm, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && date.After(lm) {
+		return min(date.Sub(lm)/10, heuristicFreshnessMax)
+	}
+	return 0
+}
+
+// date returns e's Date header, or when it arrived if it has none.
+func (e *cacheEntry) date() time.Time {
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return date
+	}
+	return e.Response
+}
+
+// age is e's current age, as RFC 7234 section 4.2.3 computes it.
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparent := max(e.Response.Sub(e.date()), 0)
+	corrected := e.Response.Sub(e.Request)
+	if n, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && n > 0 {
+		corrected += time.Duration(min(n, 1<<31)) * time.Second
+	}
+	return max(apparent, corrected) + now.Sub(e.Response)
+}
+
+// usable reports whether e may answer req without asking the backend:
+// it is fresh enough for the client, or stale by no more than the client
+// accepts with max-stale and the backend allows it.
+func (e *cacheEntry) usable(req *http.Request, now time.Time) bool {
+	cc := cacheControl(req.Header)
+	if _, ok := cc["no-cache"]; ok {
+		return false
+	}
+	if _, ok := req.Header["Cache-Control"]; !ok && strings.Contains(strings.ToLower(req.Header.Get("Pragma")), "no-cache") {
+		return false
+	}
+	age, lifetime := e.age(now), e.lifetime()
+	if d, ok := seconds(cc, "max-age"); ok && age > d {
+		return false
+	}
+	if d, ok := seconds(cc, "min-fresh"); ok {
+		age += d
+	}
+	if age < lifetime {
+		return true
+	}
+	if v, ok := cc["max-stale"]; ok {
+		rc := cacheControl(e.Header)
+		for _, d := range []string{"must-revalidate", "proxy-revalidate", "no-cache", "s-maxage"} {
+			if _, ok := rc[d]; ok {
+				return false
+			}
+		}
+		if v == "" {
+			return true
+		}
+		d, ok := seconds(cc, "max-stale")
+		return ok && age-lifetime < d
+	}
+	return false
+}
+
+// lookup returns the stored response for req, if there is one, and
+// whether it can be served as it is. An entry that can't has to be
+// revalidated with the backend first.
+func (c *httpCache) lookup(req *http.Request) (e *cacheEntry, usable bool) {
+	key := cacheKey(req)
+	c.mu.Lock()
+	for _, v := range c.entries[key] {
+		if v.matches(req) {
+			e = v
+			c.lru.MoveToFront(e.elem)
+			break
+		}
+	}
+	c.mu.Unlock()
+	if e == nil {
+		return nil, false
+	}
+	return e, e.usable(req, time.Now())
+}
+
+// cacheKey returns the key responses to req are stored under: its URL,
+// which names the backend once the request is rewritten for one, and the
+// Host sent to the backend if that differs, as with -preserve-host, since
+// virtual hosts sharing a backend each answer for themselves.
+func cacheKey(req *http.Request) string {
+	key := req.URL.String()
+	if req.Host != "" && req.Host != req.URL.Host {
+		key += " Host:" + req.Host
+	}
+	return key
+}
+
+// onlyIfCached reports whether the client asked not to contact the
+// backend at all.
+func onlyIfCached(req *http.Request) bool {
+	_, ok := cacheControl(req.Header)["only-if-cached"]
+	return ok
+}
+
+// revalidate turns req into a conditional request for e, unless e has no
+// validators or the client's request is conditional already, in which
+// case the client's own conditions go to the backend untouched. It
+// reports whether req was changed.
+func revalidate(req *http.Request, e *cacheEntry) bool {
+	for _, h := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+		if _, ok := req.Header[h]; ok {
+			return false
+		}
+	}
+	etag, lm := e.Header.Get("ETag"), e.Header.Get("Last-Modified")
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lm != "" {
+		req.Header.Set("If-Modified-Since", lm)
+	}
+	return etag != "" || lm != ""
+}
+
+// storable reports whether resp, the answer to req, may be stored. Only
+// statuses that are cacheable by default are kept, and responses setting
+// cookies are left out so one client's cookie is never handed to others.
+func (c *httpCache) storable(req *http.Request, resp *http.Response) bool {
+	if c == nil || req.Method != http.MethodGet || !c.eligible(req) {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo,
+		http.StatusMultipleChoices, http.StatusMovedPermanently, http.StatusPermanentRedirect,
+		http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusGone,
+		http.StatusRequestURITooLong, http.StatusNotImplemented:
+	default:
+		return false
+	}
+	if resp.ContentLength > c.maxObject {
+		return false
+	}
+	return sharedStorable(req, resp)
+}
+
+// sharedStorable reports whether the headers of req and resp allow a
+// shared cache to keep resp: neither no-store nor private, no Set-Cookie,
+// no Vary: *, and for a request with credentials, an explicit sign that
+// the response is meant for everyone.
+func sharedStorable(req *http.Request, resp *http.Response) bool {
+	cc := cacheControl(resp.Header)
+	for _, d := range []string{"no-store", "private"} {
+		if _, ok := cc[d]; ok {
+			return false
+		}
+	}
+	if _, ok := req.Header["Authorization"]; ok {
+		_, public := cc["public"]
+		_, mustRevalidate := cc["must-revalidate"]
+		_, sMaxAge := cc["s-maxage"]
+		if !public && !mustRevalidate && !sMaxAge {
+			return false
+		}
+	}
+	if _, ok := resp.Header["Set-Cookie"]; ok {
+		return false
+	}
+	for _, v := range resp.Header.Values("Vary") {
+		if strings.Contains(v, "*") {
+			return false
+		}
+	}
+	return true
+}
+
+// cacheFill collects a response body on its way to the client. It never
+// fails a write: a body that grows too large or can't be written to disk
+// is simply not stored.
+type cacheFill struct {
+	c      *httpCache
+	entry  *cacheEntry
+	buf    bytes.Buffer
+	file   *os.File
+	failed bool
+}
+
+// fill starts storing resp, the answer to req sent at requested. The
+// header is copied now, so later changes to resp don't reach the cache.
+func (c *httpCache) fill(req *http.Request, resp *http.Response, requested time.Time) *cacheFill {
+	e := &cacheEntry{
+		URL:      cacheKey(req),
+		Status:   resp.StatusCode,
+		Header:   resp.Header.Clone(),
+		Request:  requested,
+		Response: time.Now(),
+	}
+	for _, v := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+				if e.Vary == nil {
+					e.Vary = make(map[string]string)
+				}
+				e.Vary[name] = strings.Join(req.Header.Values(name), ",")
+			}
+		}
+	}
+	f := &cacheFill{c: c, entry: e}
+	if c.dir != "" {
+		sum := sha256.Sum256([]byte(e.URL))
+		file, err := os.CreateTemp(c.dir, hex.EncodeToString(sum[:8])+"-*")
+		if err != nil {
+			slog.Warn("creating cache file", "error", err)
+			f.failed = true
+		}
+		f.file = file
+	}
+	return f
+}
+
+func (f *cacheFill) Write(b []byte) (int, error) {
+	if f.failed {
+		return len(b), nil
+	}
+	f.entry.Length += int64(len(b))
+	if f.entry.Length > f.c.maxObject {
+		f.abandon()
+		return len(b), nil
+	}
+	if f.file == nil {
+		f.buf.Write(b)
+	} else if _, err := f.file.Write(b); err != nil {
+		slog.Warn("writing cache file", "error", err)
+		f.abandon()
+	}
+	return len(b), nil
+}
+
+// abandon drops whatever was collected.
+func (f *cacheFill) abandon() {
+	if f.failed {
+		return
+	}
+	f.failed = true
+	f.buf = bytes.Buffer{}
+	if f.file != nil {
+		f.file.Close()
+		os.Remove(f.file.Name())
+	}
+}
+
+// finish stores the collected response if the whole body made it, and
+// drops it otherwise.
+func (f *cacheFill) finish(complete bool) {
+	if !complete {
+		f.abandon()
+	}
+	if f.failed {
+		return
+	}
+	e := f.entry
+	if f.file == nil {
+		e.body = f.buf.Bytes()
+	} else {
+		e.file = f.file.Name()
+		err := f.file.Close()
+		if err == nil {
+			err = writeCacheEntry(e)
+		}
+		if err != nil {
+			slog.Warn("writing cache file", "error", err)
+			os.Remove(e.file)
+			return
+		}
+	}
+	f.c.put(e)
+}
+
+func writeCacheEntry(e *cacheEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	tmp := e.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, e.file+".json")
+}
+
+// put adds e, replacing the variant it was stored for.
+func (c *httpCache) put(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, old := range c.entries[e.URL] {
+		if sameVary(old.Vary, e.Vary) {
+			c.remove(old, true)
+			break
+		}
+	}
+	c.insert(e)
+	c.evict()
+}
+
+func sameVary(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// insert adds e as the most recently used entry. c.mu must be held.
+func (c *httpCache) insert(e *cacheEntry) {
+	e.elem = c.lru.PushFront(e)
+	c.entries[e.URL] = append(c.entries[e.URL], e)
+	c.size += e.size()
+}
+
+// remove takes e out of the cache, deleting its files if deleteFiles is
+// set. c.mu must be held.
+func (c *httpCache) remove(e *cacheEntry, deleteFiles bool) {
+	if e.elem == nil {
+		return
+	}
+	c.lru.Remove(e.elem)
+	e.elem = nil
+	c.size -= e.size()
+	variants := c.entries[e.URL]
+	for i, v := range variants {
+		if v == e {
+			variants = append(variants[:i:i], variants[i+1:]...)
+			break
+		}
+	}
+	if len(variants) == 0 {
+		delete(c.entries, e.URL)
+	} else {
+		c.entries[e.URL] = variants
+	}
+	if deleteFiles && e.file != "" {
+		os.Remove(e.file)
+		os.Remove(e.file + ".json")
+	}
+}
+
+// flush empties the cache, deleting the stored files, and returns how
+// many entries there were.
+func (c *httpCache) flush() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.lru.Len()
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Front().Value.(*cacheEntry), true)
+	}
+	return n
+}
+
+// evict drops the least recently used entries until the cache fits
+// maxSize. c.mu must be held.
+func (c *httpCache) evict() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		c.remove(c.lru.Back().Value.(*cacheEntry), true)
+	}
+}
+
+// size is what e counts against maxSize: its body and roughly its
+// header.
+func (e *cacheEntry) size() int64 {
+	n := e.Length + int64(len(e.URL))
+	for k, vs := range e.Header {
+		for _, v := range vs {
+			n += int64(len(k) + len(v) + 4)
+		}
+	}
+	return n
+}
+
+// refresh updates e with the header of resp, a 304 answer to revalidating
+// it sent at requested, and returns the updated entry.
+func (c *httpCache) refresh(e *cacheEntry, resp *http.Response, requested time.Time) *cacheEntry {
+	n := *e
+	n.Header = e.Header.Clone()
+	for k, v := range resp.Header {
+		switch k {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "Content-Range":
+		default:
+			n.Header[k] = v
+		}
+	}
+	n.Request, n.Response = requested, time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e.elem == nil {
+		// Evicted or replaced meanwhile; serve it once more anyway.
+		return &n
+	}
+	if n.file != "" {
+		if err := writeCacheEntry(&n); err != nil {
+			slog.Warn("writing cache file", "error", err)
+		}
+	}
+	c.remove(e, false)
+	c.insert(&n)
+	c.evict()
+	return &n
+}
+
+// drop removes e, if it is still cached.
+func (c *httpCache) drop(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(e, true)
+}
+
+// isSafeMethod reports whether method is safe in the RFC 7231 sense, so
+// requests with it leave stored responses valid.
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// invalidate removes what is stored for the URLs an unsafe request req
+// may have changed: its own and, on the same host, the Location and
+// Content-Location of the response.
+func (c *httpCache) invalidate(req *http.Request, resp *http.Response) {
+	u := req.URL
+	keys := []string{cacheKey(req)}
+	for _, h := range []string{"Location", "Content-Location"} {
+		if ref, err := u.Parse(resp.Header.Get(h)); err == nil && resp.Header.Get(h) != "" && ref.Host == u.Host {
+			keys = append(keys, cacheKey(&http.Request{URL: ref, Host: req.Host}))
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		for _, e := range c.entries[key] {
+			c.remove(e, true)
+		}
+	}
+}
+
+// serve answers req with e. Conditional requests the entry satisfies get
+// 304, and entries served past their freshness carry the RFC 7234
+// "Response is Stale" warning.
+func (e *cacheEntry) serve(wr http.ResponseWriter, req *http.Request, statusHeader string, log *slog.Logger) {
+	now := time.Now()
+	age := e.age(now)
+	header := wr.Header()
+	copyHeader(header, e.Header)
+	header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	if age >= e.lifetime() {
+		header.Add("Warning", `110 - "Response is Stale"`)
+	}
+	setCacheStatus(header, statusHeader, cacheHit)
+
+	if e.Status == http.StatusOK && e.notModified(req) {
+		header.Del("Content-Length")
+		log.Info("Response", "status", http.StatusNotModified, "cache", cacheHit)
+		wr.WriteHeader(http.StatusNotModified)
+		return
+	}
+	log.Info("Response", "status", e.Status, "cache", cacheHit)
+	wr.WriteHeader(e.Status)
+	if !bodyAllowed(req.Method, e.Status) {
+		return
+	}
+	if e.file == "" {
+		wr.Write(e.body)
+		return
+	}
+	f, err := os.Open(e.file)
+	if err != nil {
+		log.Error("reading cache file", "error", err)
+		panic(http.ErrAbortHandler)
+	}
+	defer f.Close()
+	io.Copy(wr, f)
+}
+
+// notModified reports whether req's conditions say the client already
+// has e.
+func (e *cacheEntry) notModified(req *http.Request) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimSpace(t)
+			if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
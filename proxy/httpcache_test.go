@@ -0,0 +1,339 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheServesFreshResponses(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(wr, "hello")
+	})
+	p := newTestProxy(t, "-backend", b.URL, "-cache-size", "1000000")
+
+	first := serve(p, "GET", "http://front.test/a")
+	if got := first.Header().Get("X-Cache"); got != cacheMiss {
+		t.Errorf("first X-Cache = %q, want %s", got, cacheMiss)
+	}
+	second := serve(p, "GET", "http://front.test/a")
+	if b.hits != 1 {
+		t.Errorf("backend hit %d times, want 1", b.hits)
+	}
+	if got := second.Header().Get("X-Cache"); got != cacheHit {
+		t.Errorf("second X-Cache = %q, want %s", got, cacheHit)
+	}
+	if second.Body.String() != "hello" || second.Header().Get("Age") == "" {
+		t.Errorf("cached response = %q, Age %q", second.Body, second.Header().Get("Age"))
+	}
+
+	// The client can insist on a fresh copy.
+	serve(p, "GET", "http://front.test/a", "Cache-Control: no-cache")
+	if b.hits != 2 {
+		t.Errorf("no-cache request: backend hit %d times, want 2", b.hits)
+	}
+	serve(p, "GET", "http://front.test/a", "Cache-Control: max-age=0")
+	if b.hits != 3 {
+		t.Errorf("max-age=0 request: backend hit %d times, want 3", b.hits)
+	}
+}
+
+func TestCacheDoesNotStore(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		header []string
+		status int
+		method string
+		req    []string
+	}{
+		{name: "no-store", header: []string{"Cache-Control: no-store, max-age=60"}},
+		{name: "private", header: []string{"Cache-Control: private, max-age=60"}},
+		{name: "Set-Cookie", header: []string{"Cache-Control: max-age=60", "Set-Cookie: id=1"}},
+		{name: "Vary *", header: []string{"Cache-Control: max-age=60", "Vary: *"}},
+		{name: "uncacheable status", header: []string{"Cache-Control: max-age=60"}, status: http.StatusCreated},
+		{name: "no freshness", header: []string{"Cache-Control: no-cache"}},
+		{name: "authorized", header: []string{"Cache-Control: max-age=60"}, req: []string{"Authorization: Bearer x"}},
+		{name: "POST", header: []string{"Cache-Control: max-age=60"}, method: "POST"},
+		{name: "range", header: []string{"Cache-Control: max-age=60"}, req: []string{"Range: bytes=0-1"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+				for _, line := range tt.header {
+					name, value, _ := strings.Cut(line, ": ")
+					wr.Header().Add(name, value)
+				}
+				if tt.status != 0 {
+					wr.WriteHeader(tt.status)
+				}
+				fmt.Fprint(wr, "body")
+			})
+			p := newTestProxy(t, "-backend", b.URL, "-cache-size", "1000000")
+			method := tt.method
+			if method == "" {
+				method = "GET"
+			}
+			serve(p, method, "http://front.test/", tt.req...)
+			serve(p, method, "http://front.test/", tt.req...)
+			if b.hits != 2 {
+				t.Errorf("backend hit %d times, want 2", b.hits)
+			}
+		})
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("Cache-Control", "max-age=60")
+		wr.Header().Set("Vary", "Accept-Language")
+		fmt.Fprint(wr, "lang="+req.Header.Get("Accept-Language"))
+	})
+	p := newTestProxy(t, "-backend", b.URL, "-cache-size", "1000000")
+
+	for i, tt := range []struct {
+		lang, want string
+		hits       int
+	}{
+		{"en", "lang=en", 1},
+		{"fr", "lang=fr", 2},
+		{"en", "lang=en", 2},
+		{"fr", "lang=fr", 2},
+		{"", "lang=", 3},
+	} {
+		var header []string
+		if tt.lang != "" {
+			header = []string{"Accept-Language: " + tt.lang}
+		}
+		rec := serve(p, "GET", "http://front.test/", header...)
+		if rec.Body.String() != tt.want || b.hits != tt.hits {
+			t.Errorf("request %d (%q): body %q after %d backend hits, want %q after %d", i, tt.lang, rec.Body, b.hits, tt.want, tt.hits)
+		}
+	}
+}
+
+func TestCacheRevalidates(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("ETag", `"v1"`)
+		wr.Header().Set("Cache-Control", "no-cache")
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			wr.Header().Set("X-Revalidated", "yes")
+			wr.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(wr, "original")
+	})
+	p := newTestProxy(t, "-backend", b.URL, "-cache-size", "1000000")
+
+	serve(p, "GET", "http://front.test/doc")
+	rec := serve(p, "GET", "http://front.test/doc")
+	if b.hits != 2 {
+		t.Fatalf("backend hit %d times, want 2", b.hits)
+	}
+	if got := b.last.Header.Get("If-None-Match"); got != `"v1"` {
+		t.Errorf("revalidation If-None-Match = %q", got)
+	}
+	if rec.Code != http.StatusOK || rec.Body.String() != "original" {
+		t.Errorf("revalidated response = %d %q, want the stored 200", rec.Code, rec.Body)
+	}
+	if rec.Header().Get("X-Revalidated") != "yes" {
+		t.Error("headers of the 304 weren't merged into the stored response")
+	}
+
+	// A client with the stored version gets a 304 of its own.
+	rec = serve(p, "GET", "http://front.test/doc", `If-None-Match: "v1"`)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("conditional request got %d, want 304", rec.Code)
+	}
+}
+
+func TestCacheReplacesChangedResponse(t *testing.T) {
+	version := "v1"
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("ETag", `"`+version+`"`)
+		wr.Header().Set("Cache-Control", "no-cache")
+		if req.Header.Get("If-None-Match") == `"`+version+`"` {
+			wr.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(wr, version)
+	})
+	p := newTestProxy(t, "-backend", b.URL, "-cache-size", "1000000")
+
+	serve(p, "GET", "http://front.test/")
+	version = "v2"
+	if rec := serve(p, "GET", "http://front.test/"); rec.Body.String() != "v2" {
+		t.Errorf("after change got %q, want v2", rec.Body)
+	}
+	if rec := serve(p, "GET", "http://front.test/"); rec.Body.String() != "v2" || rec.Header().Get("X-Cache") != cacheHit {
+		t.Errorf("revalidated v2 = %q (%s), want a v2 hit", rec.Body, rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestCacheKeysByHost(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(wr, "site "+req.Host)
+	})
+	p := newTestProxy(t, "-backend", b.URL, "-cache-size", "1000000", "-preserve-host")
+
+	for _, host := range []string{"a.test", "b.test", "a.test", "b.test"} {
+		if rec := serve(p, "GET", "http://"+host+"/"); rec.Body.String() != "site "+host {
+			t.Errorf("%s got %q", host, rec.Body)
+		}
+	}
+	if b.hits != 2 {
+		t.Errorf("backend hit %d times, want 2", b.hits)
+	}
+}
+
+func TestCacheInvalidatedByUnsafeRequests(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		if req.Method == "POST" {
+			wr.Header().Set("Location", "/other")
+			wr.WriteHeader(http.StatusSeeOther)
+			return
+		}
+		wr.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(wr, req.URL.Path)
+	})
+	p := newTestProxy(t, "-backend", b.URL, "-cache-size", "1000000")
+
+	serve(p, "GET", "http://front.test/item")
+	serve(p, "GET", "http://front.test/other")
+	serve(p, "POST", "http://front.test/item")
+	hits := b.hits
+	serve(p, "GET", "http://front.test/item")
+	serve(p, "GET", "http://front.test/other")
+	if b.hits != hits+2 {
+		t.Errorf("backend hit %d times after the POST, want 2", b.hits-hits)
+	}
+}
+
+func TestCacheOnlyIfCached(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	p := newTestProxy(t, "-backend", b.URL, "-cache-size", "1000000")
+	if rec := serve(p, "GET", "http://front.test/", "Cache-Control: only-if-cached"); rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("only-if-cached miss got %d, want 504", rec.Code)
+	}
+	if b.hits != 0 {
+		t.Error("only-if-cached request reached the backend")
+	}
+}
+
+func TestCacheDirSurvivesRestart(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(wr, "kept")
+	})
+	dir := t.TempDir()
+	args := []string{"-backend", b.URL, "-cache-size", "1000000", "-cache-dir", dir}
+	serve(newTestProxy(t, args...), "GET", "http://front.test/")
+
+	rec := serve(newTestProxy(t, args...), "GET", "http://front.test/")
+	if b.hits != 1 || rec.Body.String() != "kept" {
+		t.Errorf("after restart: %q with %d backend hits, want the stored body", rec.Body, b.hits)
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c, err := newHTTPCache(300, 300, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := func(url string) {
+		e := &cacheEntry{URL: url, Length: 100, Header: http.Header{}}
+		c.put(e)
+	}
+	add("a")
+	add("b")
+	c.mu.Lock()
+	c.lru.MoveToFront(c.entries["a"][0].elem)
+	c.mu.Unlock()
+	add("c")
+	if _, ok := c.entries["b"]; ok {
+		t.Error("b, the least recently used, wasn't evicted")
+	}
+	if _, ok := c.entries["a"]; !ok {
+		t.Error("a was evicted")
+	}
+}
+
+func TestCacheEntryLifetime(t *testing.T) {
+	date := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{"max-age", http.Header{"Cache-Control": {"max-age=30"}}, 30 * time.Second},
+		{"s-maxage first", http.Header{"Cache-Control": {"max-age=30, s-maxage=90"}}, 90 * time.Second},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache, max-age=30"}}, 0},
+		{"Expires", http.Header{"Expires": {date.Add(time.Hour).Format(http.TimeFormat)}}, time.Hour},
+		{"invalid Expires", http.Header{"Expires": {"0"}}, 0},
+		{"heuristic", http.Header{"Last-Modified": {date.Add(-100 * time.Hour).Format(http.TimeFormat)}}, 10 * time.Hour},
+		{"heuristic cap", http.Header{"Last-Modified": {date.Add(-1000 * time.Hour).Format(http.TimeFormat)}}, heuristicFreshnessMax},
+		{"nothing", http.Header{}, 0},
+	} {
+		tt.header.Set("Date", date.Format(http.TimeFormat))
+		e := &cacheEntry{Header: tt.header, Response: date}
+		if got := e.lifetime(); got != tt.want {
+			t.Errorf("%s: lifetime = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCacheEntryUsable(t *testing.T) {
+	now := time.Now()
+	// Stored 100s ago, fresh for 60s.
+	e := &cacheEntry{
+		Header:   http.Header{"Cache-Control": {"max-age=60"}},
+		Request:  now.Add(-100 * time.Second),
+		Response: now.Add(-100 * time.Second),
+	}
+	fresh := &cacheEntry{Header: e.Header, Request: now.Add(-10 * time.Second), Response: now.Add(-10 * time.Second)}
+	for _, tt := range []struct {
+		name string
+		e    *cacheEntry
+		cc   string
+		want bool
+	}{
+		{"fresh", fresh, "", true},
+		{"stale", e, "", false},
+		{"max-stale", e, "max-stale", true},
+		{"max-stale enough", e, "max-stale=50", true},
+		{"max-stale too little", e, "max-stale=30", false},
+		{"max-age", fresh, "max-age=5", false},
+		{"min-fresh", fresh, "min-fresh=55", false},
+		{"no-cache", fresh, "no-cache", false},
+	} {
+		req, _ := http.NewRequest("GET", "http://x.test/", nil)
+		if tt.cc != "" {
+			req.Header.Set("Cache-Control", tt.cc)
+		}
+		if got := tt.e.usable(req, now); got != tt.want {
+			t.Errorf("%s: usable = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	mustRevalidate := &cacheEntry{Header: http.Header{"Cache-Control": {"max-age=60, must-revalidate"}}, Request: e.Request, Response: e.Response}
+	req, _ := http.NewRequest("GET", "http://x.test/", nil)
+	req.Header.Set("Cache-Control", "max-stale")
+	if mustRevalidate.usable(req, now) {
+		t.Error("max-stale overrode must-revalidate")
+	}
+}
+
+func TestCacheEntryAge(t *testing.T) {
+	now := time.Now()
+	e := &cacheEntry{
+		Header:   http.Header{"Age": {"30"}, "Date": {now.Add(-10 * time.Second).UTC().Format(http.TimeFormat)}},
+		Request:  now.Add(-12 * time.Second),
+		Response: now.Add(-10 * time.Second),
+	}
+	// 30s old when it arrived after a 2s round trip, and 10s since.
+	if got := e.age(now).Round(time.Second); got != 42*time.Second {
+		t.Errorf("age = %v, want 42s", got)
+	}
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategies for -lb-strategy.
+const (
+	lbRoundRobin   = "round-robin"
+	lbLeastLatency = "least-latency"
+)
+
+const (
+	// latencyWeight is how much each new response time moves a backend's
+	// moving average.
+	latencyWeight = 0.2
+
+	// unhealthyFor is how long a backend that failed a request is passed
+	// over by least-latency before it is tried again.
+	unhealthyFor = 10 * time.Second
+)
+
+// backendPool spreads requests over the backends given by repeating
+// -backend.
+type backendPool struct {
+	strategy string
+	backends []*url.URL
+	next     atomic.Uint32
+
+	mu      sync.Mutex
+	latency []backendLatency // indexed like backends
+}
+
+// backendLatency is the running record least-latency chooses by.
+type backendLatency struct {
+	avg      time.Duration // zero until the first response
+	failedAt time.Time
+}
+
+func newBackendPool(strategy string, backends []*url.URL) (*backendPool, error) {
+	switch strategy {
+	case lbRoundRobin, lbLeastLatency:
+	default:
+		return nil, fmt.Errorf("-lb-strategy %q is not %s or %s", strategy, lbRoundRobin, lbLeastLatency)
+	}
+	return &backendPool{
+		strategy: strategy,
+		backends: backends,
+		latency:  make([]backendLatency, len(backends)),
+	}, nil
+}
+
+// choose returns the backend for the next request.
+func (bp *backendPool) choose() *url.URL {
+	if bp.strategy == lbRoundRobin {
+		return bp.backends[int(bp.next.Add(1)-1)%len(bp.backends)]
+	}
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	// Healthy backends win over failed ones, then the lowest average.
+	// Backends with no average yet count as fastest so each one gets
+	// measured.
+	now := time.Now()
+	best, bestHealthy := -1, false
+	for i, l := range bp.latency {
+		healthy := now.Sub(l.failedAt) >= unhealthyFor
+		switch {
+		case best < 0, healthy && !bestHealthy:
+		case healthy == bestHealthy && l.avg < bp.latency[best].avg:
+		default:
+			continue
+		}
+		best, bestHealthy = i, healthy
+	}
+	return bp.backends[best]
+}
+
+// observe records how long backend took to respond, or that it failed.
+// Backends not in the pool, such as an -ab-backend, are ignored.
+func (bp *backendPool) observe(backend *url.URL, elapsed time.Duration, failed bool) {
+	if bp == nil || bp.strategy != lbLeastLatency {
+		return
+	}
+	for i, b := range bp.backends {
+		if b != backend {
+			continue
+		}
+		bp.mu.Lock()
+		l := &bp.latency[i]
+		if failed {
+			l.failedAt = time.Now()
+		} else if l.avg == 0 {
+			l.avg = elapsed
+		} else {
+			l.avg += time.Duration(latencyWeight * float64(elapsed-l.avg))
+		}
+		bp.mu.Unlock()
+		return
+	}
+}
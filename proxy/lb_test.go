@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundRobin(t *testing.T) {
+	a, b, c := echoBackend(t, "a"), echoBackend(t, "b"), echoBackend(t, "c")
+	p := newTestProxy(t, "-backend", a.URL, "-backend", b.URL, "-backend", c.URL)
+	var order []string
+	for range 6 {
+		served, _, _ := strings.Cut(serve(p, "GET", "http://front.test/").Body.String(), " ")
+		order = append(order, served)
+	}
+	if got := strings.Join(order, ""); got != "abcabc" {
+		t.Errorf("served in order %s, want abcabc", got)
+	}
+}
+
+func TestLeastLatency(t *testing.T) {
+	slow := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+	})
+	fast := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	p := newTestProxy(t, "-backend", slow.URL, "-backend", fast.URL, "-lb-strategy", "least-latency")
+	for range 30 {
+		serve(p, "GET", "http://front.test/")
+	}
+	if slow.hits == 0 || fast.hits < 25 {
+		t.Errorf("slow backend got %d requests, fast %d; want each measured and most on the fast one", slow.hits, fast.hits)
+	}
+}
+
+func TestLeastLatencyPassesOverFailures(t *testing.T) {
+	a, b := &url.URL{Host: "a.test"}, &url.URL{Host: "b.test"}
+	bp, err := newBackendPool(lbLeastLatency, []*url.URL{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp.observe(a, 10*time.Millisecond, false)
+	bp.observe(b, 50*time.Millisecond, false)
+	if got := bp.choose(); got != a {
+		t.Errorf("chose %s, want the faster a", got.Host)
+	}
+	bp.observe(a, 0, true)
+	if got := bp.choose(); got != b {
+		t.Errorf("chose %s after a failed, want b", got.Host)
+	}
+	// Others, like an -ab-backend, don't count.
+	bp.observe(&url.URL{Host: "b.test"}, time.Hour, true)
+	if got := bp.choose(); got != b {
+		t.Errorf("chose %s after a backend outside the pool failed, want b", got.Host)
+	}
+
+	if _, err := newBackendPool("random", []*url.URL{a, b}); err == nil {
+		t.Error("-lb-strategy random accepted")
+	}
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// agedConn is a backend connection that is closed once it is older than
+// its lifetime and no request is using it, so pooled connections don't
+// stay pinned to one endpoint behind a load balancer forever.
+type agedConn struct {
+	net.Conn
+	timer *time.Timer
+
+	mu      sync.Mutex
+	active  int
+	expired bool
+}
+
+func newAgedConn(conn net.Conn, lifetime time.Duration) *agedConn {
+	c := &agedConn{Conn: conn}
+	c.timer = time.AfterFunc(lifetime, c.expire)
+	return c
+}
+
+func (c *agedConn) expire() {
+	c.mu.Lock()
+	c.expired = true
+	idle := c.active == 0
+	c.mu.Unlock()
+	if idle {
+		c.Conn.Close()
+	}
+}
+
+func (c *agedConn) acquire() {
+	c.mu.Lock()
+	c.active++
+	c.mu.Unlock()
+}
+
+func (c *agedConn) release() {
+	c.mu.Lock()
+	c.active--
+	done := c.expired && c.active == 0
+	c.mu.Unlock()
+	if done {
+		c.Conn.Close()
+	}
+}
+
+func (c *agedConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
+
+// agedDialer wraps dial so every connection it makes expires after
+// lifetime.
+func agedDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error), lifetime time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return newAgedConn(conn, lifetime), nil
+	}
+}
+
+// lifetimeTransport tells each agedConn when requests start and finish on
+// it, so an expired connection is only closed between requests.
+type lifetimeTransport struct {
+	base http.RoundTripper
+}
+
+func (t *lifetimeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var conn *agedConn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if conn != nil {
+				// The transport retried on a fresh connection.
+				conn.release()
+			}
+			conn = agedConnOf(info.Conn)
+			if conn != nil {
+				conn.acquire()
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	resp, err := t.base.RoundTrip(req)
+	if conn == nil {
+		return resp, err
+	}
+	if err != nil {
+		conn.release()
+		return resp, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: sync.OnceFunc(conn.release)}
+	return resp, nil
+}
+
+// agedConnOf finds the agedConn under conn, looking through TLS.
+func agedConnOf(conn net.Conn) *agedConn {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	c, _ := conn.(*agedConn)
+	return c
+}
+
+// releaseBody calls release once the body has been read to the end or
+// closed.
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.release()
+	}
+	return n, err
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnMaxLifetime(t *testing.T) {
+	for _, tt := range []struct {
+		args  []string
+		conns int64
+	}{
+		{nil, 1},
+		{[]string{"-conn-max-lifetime", "50ms"}, 2},
+	} {
+		srv, conns := connCountingBackend(t)
+		p := newTestProxy(t, append([]string{"-backend", srv.URL}, tt.args...)...)
+		serve(p, "GET", "http://front.test/")
+		time.Sleep(150 * time.Millisecond)
+		serve(p, "GET", "http://front.test/")
+		if got := conns.Load(); got != tt.conns {
+			t.Errorf("%q: %d backend connections for 2 requests, want %d", tt.args, got, tt.conns)
+		}
+	}
+}
+
+// TestConnMaxLifetimeSparesActiveRequests has a response outlive the
+// connection's lifetime; it must still arrive whole.
+func TestConnMaxLifetimeSparesActiveRequests(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		wr.Write([]byte("start "))
+		wr.(http.Flusher).Flush()
+		time.Sleep(150 * time.Millisecond)
+		wr.Write([]byte("end"))
+	})
+	p := newTestProxy(t, "-backend", b.URL, "-conn-max-lifetime", "50ms")
+	if rec := serve(p, "GET", "http://front.test/"); rec.Code != http.StatusOK || !strings.HasSuffix(rec.Body.String(), "end") {
+		t.Errorf("got %d %q, want the whole response", rec.Code, rec.Body)
+	}
+}
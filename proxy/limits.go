@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// errTooManyConns is the read error of a connection refused by
+// -max-conns-per-client.
+var errTooManyConns = errors.New("too many connections from this client")
+
+// connLimiter caps the connections each client IP may have open at once,
+// tunnels included, for -max-conns-per-client. It is shared by a
+// listener's addresses and its SOCKS5 server. Clients without an IP
+// address, on a Unix socket, aren't limited.
+type connLimiter struct {
+	max int
+	// retryAfter is the proxy's Retry-After for refused clients.
+	retryAfter func(wait time.Duration) string
+
+	mu   sync.Mutex
+	open map[netip.Addr]int
+}
+
+func newConnLimiter(max int, retryAfter func(time.Duration) string) *connLimiter {
+	return &connLimiter{max: max, retryAfter: retryAfter, open: make(map[netip.Addr]int)}
+}
+
+// listener returns ln with its connections counted against l. Refused
+// connections are answered with a 429 if plain is set, as it is for HTTP
+// without TLS, and otherwise just closed. A nil *connLimiter returns ln.
+func (l *connLimiter) listener(ln net.Listener, plain bool) net.Listener {
+	if l == nil {
+		return ln
+	}
+	return &connLimitListener{Listener: ln, limiter: l, plain: plain}
+}
+
+func (l *connLimiter) acquire(ip netip.Addr) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.open[ip] >= l.max {
+		return false
+	}
+	l.open[ip]++
+	return true
+}
+
+func (l *connLimiter) release(ip netip.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.open[ip]--; l.open[ip] <= 0 {
+		delete(l.open, ip)
+	}
+}
+
+type connLimitListener struct {
+	net.Listener
+	limiter *connLimiter
+	plain   bool
+}
+
+func (l *connLimitListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &limitedConn{Conn: conn, l: l}, nil
+}
+
+// limitedConn is counted against its client's limit on first use, in the
+// goroutine serving it, since behind -proxy-protocol the client is only
+// known once the header has been read.
+type limitedConn struct {
+	net.Conn
+	l *connLimitListener
+
+	once sync.Once
+	err  error
+
+	mu     sync.Mutex
+	closed bool
+	client netip.Addr // valid while counted
+}
+
+func (c *limitedConn) admit() error {
+	c.once.Do(func() {
+		tcp, ok := c.Conn.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return
+		}
+		ip := tcp.AddrPort().Addr().Unmap()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.closed {
+			return
+		}
+		if !c.l.limiter.acquire(ip) {
+			slog.Warn("client over -max-conns-per-client, refusing connection", "client", ip.String(), "max", c.l.limiter.max)
+			if c.l.plain {
+				c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+				refuseTunnel(c.Conn, "429 Too Many Requests", "Too many connections, slow down.",
+					http.Header{"Retry-After": {c.l.limiter.retryAfter(0)}})
+			}
+			c.err = errTooManyConns
+			c.closed = true
+			c.Conn.Close()
+			return
+		}
+		c.client = ip
+	})
+	return c.err
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	if err := c.admit(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// RemoteAddr returns the client's address. Asking for it counts the
+// connection, as the SOCKS5 server and tunnels do before reading.
+func (c *limitedConn) RemoteAddr() net.Addr {
+	c.admit()
+	return c.Conn.RemoteAddr()
+}
+
+func (c *limitedConn) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		if c.client.IsValid() {
+			c.l.limiter.release(c.client)
+		}
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// CloseWrite half-closes the connection, for tunnels.
+func (c *limitedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// NetConn returns the underlying connection, for socket options.
+func (c *limitedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// limitBody enforces -max-body-bytes on req, answering 413 at once if its
+// Content-Length is over, and otherwise cutting the body off where it
+// passes the limit. It returns false if it answered.
+func (p *proxy) limitBody(wr http.ResponseWriter, req *http.Request, log *slog.Logger) bool {
+	if p.maxBodyBytes <= 0 || req.Method == http.MethodConnect {
+		return true
+	}
+	if req.ContentLength > p.maxBodyBytes {
+		logBlocked(log, req, blockReasonLimits, "-max-body-bytes")
+		wr.Header().Set("Connection", "close")
+		http.Error(wr, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	req.Body = http.MaxBytesReader(wr, req.Body, p.maxBodyBytes)
+	return true
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keepAliveGet sends a GET for url over a new connection to the proxy at
+// addr, returning the connection, left open, and the response.
+func keepAliveGet(t *testing.T, addr, url string) (net.Conn, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	host, _, _ := strings.Cut(strings.TrimPrefix(url, "http://"), "/")
+	io.WriteString(conn, "GET "+url+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("reading the response: %v", err)
+	}
+	resp.Body.Close()
+	return conn, resp
+}
+
+func TestMaxConnsPerClient(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	addr, _, _ := startRun(t, time.Second, "-max-conns-per-client", "2")
+	first, _ := keepAliveGet(t, addr, b.URL+"/")
+	if _, resp := keepAliveGet(t, addr, b.URL+"/"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("second connection got %s", resp.Status)
+	}
+	_, resp := keepAliveGet(t, addr, b.URL+"/")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("third connection got %s with Retry-After %q, want 429 with one", resp.Status, resp.Header.Get("Retry-After"))
+	}
+
+	// Closing one makes room for another.
+	first.Close()
+	waitFor(t, func() bool {
+		_, resp := keepAliveGet(t, addr, b.URL+"/")
+		return resp.StatusCode == http.StatusOK
+	})
+}
+
+func TestConnLimiter(t *testing.T) {
+	l := newConnLimiter(1, func(time.Duration) string { return "1" })
+	a, b := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	if !l.acquire(a) || l.acquire(a) {
+		t.Error("want one connection from 192.0.2.1 admitted, and only one")
+	}
+	if !l.acquire(b) {
+		t.Error("192.0.2.2 refused for 192.0.2.1's connection")
+	}
+	l.release(a)
+	if !l.acquire(a) {
+		t.Error("192.0.2.1 refused after its connection closed")
+	}
+	l.release(a)
+	l.release(b)
+	if len(l.open) != 0 {
+		t.Errorf("released clients still tracked: %v", l.open)
+	}
+	if ln := (*connLimiter)(nil).listener(nil, true); ln != nil {
+		t.Error("nil limiter wrapped the listener")
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		io.Copy(io.Discard, req.Body)
+	})
+	p := newTestProxy(t, "-max-body-bytes", "10")
+	for _, tt := range []struct {
+		name string
+		body io.Reader
+		code int
+		// kept is whether the request must not reach the backend at all.
+		kept bool
+	}{
+		{"under", strings.NewReader("0123456789"), http.StatusOK, false},
+		{"Content-Length over", strings.NewReader("0123456789a"), http.StatusRequestEntityTooLarge, true},
+		// Without a Content-Length the body is cut off in passing.
+		{"streamed over", io.MultiReader(strings.NewReader("01234"), strings.NewReader("56789a")), http.StatusRequestEntityTooLarge, false},
+	} {
+		hits := b.hits
+		if rec := serveBody(p, "POST", b.URL+"/", tt.body); rec.Code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, rec.Code, tt.code)
+		}
+		if tt.kept && b.hits != hits {
+			t.Errorf("%s: request reached the backend", tt.name)
+		}
+	}
+
+	// CONNECT isn't a body.
+	srv := newProxyServer(t, "-max-body-bytes", "1")
+	conn, br, resp := connect(t, srv.Listener.Addr().String(), newEchoServer(t))
+	if resp.StatusCode != http.StatusOK || !echoes(conn, br, "more than a byte") {
+		t.Error("tunnel cut off by -max-body-bytes")
+	}
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// proxiedMethods are the methods forwarded to backends.
+var proxiedMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "TRACE"}
+
+// allowedMethods returns the Allow header value describing what the proxy
+// accepts.
+func (p *proxy) allowedMethods() string {
+	methods := proxiedMethods
+	if !p.noConnect {
+		methods = append(methods[:len(methods):len(methods)], "CONNECT")
+	}
+	return strings.Join(methods, ", ")
+}
+
+// isServerWideOptions reports whether req is an asterisk-form "OPTIONS *",
+// which asks about the proxy itself and has no target to forward to.
+func isServerWideOptions(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.RequestURI == "*"
+}
+
+// isH2CPreface reports whether req is the start of the HTTP/2 connection
+// preface, "PRI * HTTP/2.0", sent by an h2c client with prior knowledge.
+// With -h2c net/http takes these connections over before the handler runs,
+// so the handler only sees the preface when h2c is off.
+func isH2CPreface(req *http.Request) bool {
+	return req.Method == "PRI" && req.RequestURI == "*" && req.ProtoMajor == 2
+}
+
+// serveOptions answers "OPTIONS *" with the proxy's own capabilities.
+func (p *proxy) serveOptions(wr http.ResponseWriter) {
+	wr.Header().Set("Allow", p.allowedMethods())
+	wr.Header().Set("Content-Length", "0")
+	wr.WriteHeader(http.StatusOK)
+}
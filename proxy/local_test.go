@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServerWideOptions(t *testing.T) {
+	for _, tt := range []struct {
+		args    []string
+		connect bool
+	}{
+		{nil, true},
+		{[]string{"-no-connect"}, false},
+	} {
+		srv := newProxyServer(t, tt.args...)
+		resp := rawRequest(t, srv.Listener.Addr().String(), "OPTIONS * HTTP/1.1\r\nHost: proxy.test\r\n\r\n")
+		if resp.StatusCode != http.StatusOK || resp.ContentLength != 0 {
+			t.Errorf("%q: OPTIONS * got %s with length %d, want an empty 200", tt.args, resp.Status, resp.ContentLength)
+		}
+		allow := resp.Header.Get("Allow")
+		if !strings.Contains(allow, "GET") || strings.Contains(allow, "CONNECT") != tt.connect {
+			t.Errorf("%q: Allow = %q", tt.args, allow)
+		}
+	}
+}
+
+func TestH2CPriorKnowledge(t *testing.T) {
+	srv := newProxyServer(t)
+	resp := rawRequest(t, srv.Listener.Addr().String(), "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	if resp.StatusCode != http.StatusHTTPVersionNotSupported || !resp.Close {
+		t.Errorf("h2c preface without -h2c got %s, close %v; want 505 and close", resp.Status, resp.Close)
+	}
+
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	l, err := newListener("minprox", []string{"-backend", b.URL, "-h2c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2c := httptest.NewUnstartedServer(nil)
+	h2c.Config = l.server
+	h2c.Start()
+	defer h2c.Close()
+	tr := &http.Transport{Protocols: new(http.Protocols)}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	defer tr.CloseIdleConnections()
+	got, err := (&http.Client{Transport: tr}).Get(h2c.URL)
+	if err != nil {
+		t.Fatalf("h2c with prior knowledge and -h2c: %v", err)
+	}
+	got.Body.Close()
+	if got.ProtoMajor != 2 || got.StatusCode != http.StatusOK {
+		t.Errorf("with -h2c got %s over %s, want 200 over HTTP/2", got.Status, got.Proto)
+	}
+}
@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// methodOverrideHeader is how method-tunneling clients name the method a
+// POST really stands for.
+const methodOverrideHeader = "X-HTTP-Method-Override"
+
+// applyMethodOverride rewrites a POST carrying X-HTTP-Method-Override to
+// the method it names, so backends and the rest of the pipeline see the
+// real one, and removes the header. Only methods the proxy forwards are
+// accepted. The header is removed from other requests too, and ignored.
+func applyMethodOverride(req *http.Request) error {
+	override := req.Header.Get(methodOverrideHeader)
+	req.Header.Del(methodOverrideHeader)
+	if override == "" || req.Method != http.MethodPost {
+		return nil
+	}
+	method := strings.ToUpper(strings.TrimSpace(override))
+	if !slices.Contains(proxiedMethods, method) {
+		return fmt.Errorf("%s %q is not a supported method", methodOverrideHeader, override)
+	}
+	req.Method = method
+	return nil
+}
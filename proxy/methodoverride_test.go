@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMethodOverride(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	p := newTestProxy(t, "-backend", b.URL, "-honor-method-override")
+	for _, tt := range []struct {
+		method, override string
+		status           int
+		want             string
+	}{
+		{"POST", "DELETE", http.StatusOK, "DELETE"},
+		{"POST", " patch ", http.StatusOK, "PATCH"},
+		{"POST", "", http.StatusOK, "POST"},
+		{"GET", "DELETE", http.StatusOK, "GET"},
+		{"POST", "CONNECT", http.StatusBadRequest, ""},
+		{"POST", "FROB", http.StatusBadRequest, ""},
+	} {
+		b.last = nil
+		var header []string
+		if tt.override != "" {
+			header = append(header, "X-HTTP-Method-Override: "+tt.override)
+		}
+		rec := serve(p, tt.method, "http://front.test/", header...)
+		if rec.Code != tt.status {
+			t.Errorf("%s overridden by %q: got %d, want %d", tt.method, tt.override, rec.Code, tt.status)
+			continue
+		}
+		if tt.want == "" {
+			if b.last != nil {
+				t.Errorf("%s overridden by %q reached the backend", tt.method, tt.override)
+			}
+			continue
+		}
+		if b.last.Method != tt.want || b.last.Header.Get(methodOverrideHeader) != "" {
+			t.Errorf("%s overridden by %q: backend got %s with override %q, want %s and none", tt.method, tt.override, b.last.Method, b.last.Header.Get(methodOverrideHeader), tt.want)
+		}
+	}
+
+	// Without the flag the header passes through untouched.
+	p = newTestProxy(t, "-backend", b.URL)
+	serve(p, "POST", "http://front.test/", "X-HTTP-Method-Override: DELETE")
+	if b.last.Method != "POST" || b.last.Header.Get(methodOverrideHeader) != "DELETE" {
+		t.Errorf("without -honor-method-override backend got %s with override %q", b.last.Method, b.last.Header.Get(methodOverrideHeader))
+	}
+}
@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the
+// minprox_request_duration_seconds histogram buckets.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// metrics counts requests for Prometheus, served in the text exposition
+// format on -metrics-addr.
+type metrics struct {
+	hosts *hostLabeler
+
+	mu         sync.Mutex
+	requests   map[requestLabels]int64
+	tls        map[tlsLabels]int64
+	dialErrors map[string]int64
+	mirrored   map[string]int64
+	latency    []int64 // per latencyBuckets entry, not cumulative
+	latencySum float64
+	latencyN   int64
+
+	bytesUp, bytesDown atomic.Int64 // from and to clients
+	tunnels            atomic.Int64
+}
+
+// requestLabels are the labels of minprox_requests_total. host is empty
+// unless host labelling is enabled.
+type requestLabels struct {
+	method, code, host string
+}
+
+// tlsLabels are the labels of minprox_tls_handshakes_total.
+type tlsLabels struct {
+	version, cipher string
+}
+
+func newMetrics(hosts *hostLabeler) *metrics {
+	return &metrics{
+		hosts:      hosts,
+		requests:   make(map[requestLabels]int64),
+		tls:        make(map[tlsLabels]int64),
+		dialErrors: make(map[string]int64),
+		mirrored:   make(map[string]int64),
+		latency:    make([]int64, len(latencyBuckets)),
+	}
+}
+
+// countTLS makes cfg count every completed client handshake by negotiated
+// version and cipher suite, so clients still on old TLS show up. It chains
+// onto any VerifyConnection cfg already has.
+func (m *metrics) countTLS(cfg *tls.Config) {
+	if m == nil || cfg == nil {
+		return
+	}
+	verify := cfg.VerifyConnection
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		labels := tlsLabels{version: tls.VersionName(cs.Version), cipher: tls.CipherSuiteName(cs.CipherSuite)}
+		m.mu.Lock()
+		m.tls[labels]++
+		m.mu.Unlock()
+		return nil
+	}
+}
+
+// observe counts one finished request that took took. Methods the proxy
+// doesn't forward are counted as "other" so clients can't mint label
+// values. CONNECT tunnels are left out of the latency histogram, as they
+// last as long as the client keeps them open.
+func (m *metrics) observe(method string, status int, host string, took time.Duration) {
+	if m == nil {
+		return
+	}
+	labels := requestLabels{method: "other", code: strconv.Itoa(status)}
+	if slices.Contains(proxiedMethods, method) || method == http.MethodConnect {
+		labels.method = method
+	}
+	if status == 0 {
+		// Hijacked CONNECT tunnels answer on the raw connection.
+		labels.code = "tunnel"
+	}
+	labels.host = m.hosts.label(host)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[labels]++
+	if method == http.MethodConnect {
+		return
+	}
+	seconds := took.Seconds()
+	if i, _ := slices.BinarySearch(latencyBuckets, seconds); i < len(latencyBuckets) {
+		m.latency[i]++
+	}
+	m.latencySum += seconds
+	m.latencyN++
+}
+
+// addBytes counts up bytes received from a client and down bytes sent to
+// it.
+func (m *metrics) addBytes(up, down int64) {
+	if m != nil {
+		m.bytesUp.Add(up)
+		m.bytesDown.Add(down)
+	}
+}
+
+// dialFailed counts a failed outbound dial by dialErrorKind.
+func (m *metrics) dialFailed(err error) {
+	if m == nil {
+		return
+	}
+	kind := dialErrorKind(err)
+	m.mu.Lock()
+	m.dialErrors[kind]++
+	m.mu.Unlock()
+}
+
+// mirrorDone counts a -mirror-to request by its response status, or as
+// "error" if it got none or "skipped" if it wasn't sent.
+func (m *metrics) mirrorDone(result string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.mirrored[result]++
+	m.mu.Unlock()
+}
+
+// tunnel counts an open CONNECT tunnel and returns the function that
+// counts it closed.
+func (m *metrics) tunnel() func() {
+	if m == nil {
+		return func() {}
+	}
+	m.tunnels.Add(1)
+	return func() { m.tunnels.Add(-1) }
+}
+
+// meter returns conn, the client side of a tunnel, counting the bytes
+// through it.
+func (m *metrics) meter(conn net.Conn) net.Conn {
+	if m == nil {
+		return conn
+	}
+	return &directedConn{Conn: conn, read: &m.bytesUp, written: &m.bytesDown}
+}
+
+// directedConn counts the bytes read from and written to a connection
+// separately, unlike meteredConn.
+type directedConn struct {
+	net.Conn
+	read, written *atomic.Int64
+}
+
+func (c *directedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *directedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// labelEscaper escapes label values for the text exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *metrics) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	m.mu.Lock()
+	lines := make([]string, 0, len(m.requests))
+	for l, n := range m.requests {
+		labels := `method="` + labelEscaper.Replace(l.method) + `",code="` + l.code + `"`
+		if l.host != "" {
+			labels += `,host="` + labelEscaper.Replace(l.host) + `"`
+		}
+		lines = append(lines, fmt.Sprintf("minprox_requests_total{%s} %d", labels, n))
+	}
+	tlsLines := make([]string, 0, len(m.tls))
+	for l, n := range m.tls {
+		tlsLines = append(tlsLines, fmt.Sprintf(`minprox_tls_handshakes_total{version="%s",cipher="%s"} %d`, labelEscaper.Replace(l.version), labelEscaper.Replace(l.cipher), n))
+	}
+	dialLines := make([]string, 0, len(m.dialErrors))
+	for kind, n := range m.dialErrors {
+		dialLines = append(dialLines, fmt.Sprintf(`minprox_dial_errors_total{kind="%s"} %d`, kind, n))
+	}
+	mirrorLines := make([]string, 0, len(m.mirrored))
+	for result, n := range m.mirrored {
+		mirrorLines = append(mirrorLines, fmt.Sprintf(`minprox_mirror_requests_total{result="%s"} %d`, result, n))
+	}
+	latencyLines := make([]string, 0, len(latencyBuckets)+3)
+	var cumulative int64
+	for i, bound := range latencyBuckets {
+		cumulative += m.latency[i]
+		latencyLines = append(latencyLines, fmt.Sprintf(`minprox_request_duration_seconds_bucket{le="%s"} %d`, strconv.FormatFloat(bound, 'g', -1, 64), cumulative))
+	}
+	latencyLines = append(latencyLines,
+		fmt.Sprintf(`minprox_request_duration_seconds_bucket{le="+Inf"} %d`, m.latencyN),
+		fmt.Sprintf("minprox_request_duration_seconds_sum %s", strconv.FormatFloat(m.latencySum, 'g', -1, 64)),
+		fmt.Sprintf("minprox_request_duration_seconds_count %d", m.latencyN))
+	m.mu.Unlock()
+	sort.Strings(lines)
+	sort.Strings(tlsLines)
+	sort.Strings(dialLines)
+	sort.Strings(mirrorLines)
+
+	wr.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(wr, "minprox_requests_total", "counter", "Requests handled, by method and status.", lines)
+	writeMetric(wr, "minprox_request_duration_seconds", "histogram", "Time taken to serve requests other than CONNECT.", latencyLines)
+	writeMetric(wr, "minprox_bytes_total", "counter", "Bytes transferred with clients, in request and response bodies and tunnels.", []string{
+		fmt.Sprintf(`minprox_bytes_total{direction="up"} %d`, m.bytesUp.Load()),
+		fmt.Sprintf(`minprox_bytes_total{direction="down"} %d`, m.bytesDown.Load()),
+	})
+	writeMetric(wr, "minprox_tunnels_active", "gauge", "CONNECT tunnels open now.", []string{
+		fmt.Sprintf("minprox_tunnels_active %d", m.tunnels.Load()),
+	})
+	writeMetric(wr, "minprox_dial_errors_total", "counter", "Failed outbound connections, by kind: dns, refused, timeout, fd-limit or other.", dialLines)
+	if len(mirrorLines) > 0 {
+		writeMetric(wr, "minprox_mirror_requests_total", "counter", "Requests mirrored to -mirror-to, by response status, error or skipped.", mirrorLines)
+	}
+	if len(tlsLines) > 0 {
+		writeMetric(wr, "minprox_tls_handshakes_total", "counter", "Client TLS handshakes, by negotiated version and cipher suite.", tlsLines)
+	}
+}
+
+// writeMetric writes one metric family of type typ with its HELP and TYPE
+// lines.
+func writeMetric(wr io.Writer, name, typ, help string, lines []string) {
+	fmt.Fprintf(wr, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(wr, "# TYPE %s %s\n", name, typ)
+	fmt.Fprint(wr, strings.Join(lines, "\n"))
+	if len(lines) > 0 {
+		fmt.Fprintln(wr)
+	}
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTLSMetrics(t *testing.T) {
+	m := newMetrics(nil)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {}))
+	srv.TLS = &tls.Config{}
+	m.countTLS(srv.TLS)
+	srv.StartTLS()
+	defer srv.Close()
+
+	for _, cfg := range []*tls.Config{
+		{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}},
+		{MinVersion: tls.VersionTLS13},
+		{MinVersion: tls.VersionTLS13},
+	} {
+		cfg.InsecureSkipVerify = true
+		conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	out := serve(m, "GET", "http://metrics.test/metrics").Body.String()
+	for _, want := range []string{
+		"# TYPE minprox_tls_handshakes_total counter",
+		`minprox_tls_handshakes_total{version="TLS 1.2",cipher="TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"} 1`,
+		`minprox_tls_handshakes_total{version="TLS 1.3",cipher="TLS_AES_128_GCM_SHA256"} 2`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics lack %s:\n%s", want, out)
+		}
+	}
+
+	if out := serve(newMetrics(nil), "GET", "http://metrics.test/metrics").Body.String(); strings.Contains(out, "minprox_tls_handshakes_total") {
+		t.Errorf("TLS family shown with no handshakes:\n%s", out)
+	}
+}
+
+// TestTLSMetricsKeepVerification checks countTLS leaves a refusing
+// VerifyConnection in charge.
+func TestTLSMetricsKeepVerification(t *testing.T) {
+	errRefused := errors.New("refused")
+	m := newMetrics(nil)
+	cfg := &tls.Config{VerifyConnection: func(tls.ConnectionState) error { return errRefused }}
+	m.countTLS(cfg)
+	if err := cfg.VerifyConnection(tls.ConnectionState{Version: tls.VersionTLS13}); err != errRefused {
+		t.Errorf("VerifyConnection = %v, want the original's error", err)
+	}
+	if len(m.tls) != 0 {
+		t.Errorf("refused handshake counted: %v", m.tls)
+	}
+}
+
+// metricValue returns the value of the sample named by series, such as
+// `minprox_bytes_total{direction="up"}`, on a metrics page.
+func metricValue(t *testing.T, page, series string) int64 {
+	t.Helper()
+	for _, line := range strings.Split(page, "\n") {
+		if value, ok := strings.CutPrefix(line, series+" "); ok {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				t.Fatalf("%s: %v", line, err)
+			}
+			return n
+		}
+	}
+	t.Fatalf("metrics lack %s:\n%s", series, page)
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			http.NotFound(wr, req)
+			return
+		}
+		io.Copy(io.Discard, req.Body)
+		io.WriteString(wr, "hello")
+	})
+	p := newTestProxy(t, "-metrics-addr", "127.0.0.1:0", "-backend", b.URL, "-connect-retries", "0")
+	serve(p, "GET", "http://front.test/")
+	serve(p, "GET", "http://front.test/missing")
+	serveBody(p, "POST", "http://front.test/upload", strings.NewReader(strings.Repeat("x", 1000)))
+
+	page := scrape(t, p)
+	for series, want := range map[string]int64{
+		`minprox_requests_total{method="GET",code="200"}`:    1,
+		`minprox_requests_total{method="GET",code="404"}`:    1,
+		`minprox_requests_total{method="POST",code="200"}`:   1,
+		`minprox_request_duration_seconds_bucket{le="+Inf"}`: 3,
+		`minprox_request_duration_seconds_count`:             3,
+		`minprox_tunnels_active`:                             0,
+	} {
+		if got := metricValue(t, page, series); got != want {
+			t.Errorf("%s = %d, want %d", series, got, want)
+		}
+	}
+	if up := metricValue(t, page, `minprox_bytes_total{direction="up"}`); up < 1000 {
+		t.Errorf("%d bytes up, want at least the 1000 uploaded", up)
+	}
+	if down := metricValue(t, page, `minprox_bytes_total{direction="down"}`); down < 10 {
+		t.Errorf("%d bytes down, want at least the 10 of the bodies", down)
+	}
+
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	conn, br, resp := connect(t, srv.Listener.Addr().String(), newEchoServer(t))
+	if resp.StatusCode != http.StatusOK || !echoes(conn, br, "ping") {
+		t.Fatalf("CONNECT got %s", resp.Status)
+	}
+	if got := metricValue(t, scrape(t, p), "minprox_tunnels_active"); got != 1 {
+		t.Errorf("%d tunnels active with one open", got)
+	}
+	conn.Close()
+	waitFor(t, func() bool { return metricValue(t, scrape(t, p), "minprox_tunnels_active") == 0 })
+
+	connect(t, srv.Listener.Addr().String(), closedAddr(t))
+	page = scrape(t, p)
+	if got := metricValue(t, page, `minprox_dial_errors_total{kind="refused"}`); got != 1 {
+		t.Errorf("%d refused dials counted, want 1", got)
+	}
+	if got := metricValue(t, page, `minprox_requests_total{method="CONNECT",code="tunnel"}`); got != 2 {
+		t.Errorf("%d CONNECTs counted, want 2", got)
+	}
+}
+
+func TestMetricsHistogram(t *testing.T) {
+	m := newMetrics(nil)
+	m.observe("GET", 200, "", 3*time.Millisecond)
+	m.observe("GET", 200, "", 200*time.Millisecond)
+	m.observe("BREW", 418, "", 40*time.Second)
+	m.observe("CONNECT", 0, "", time.Hour)
+	page := serve(m, "GET", "http://metrics.test/metrics").Body.String()
+	for series, want := range map[string]int64{
+		`minprox_request_duration_seconds_bucket{le="0.005"}`:    1,
+		`minprox_request_duration_seconds_bucket{le="0.1"}`:      1,
+		`minprox_request_duration_seconds_bucket{le="0.25"}`:     2,
+		`minprox_request_duration_seconds_bucket{le="30"}`:       2,
+		`minprox_request_duration_seconds_bucket{le="+Inf"}`:     3,
+		`minprox_requests_total{method="other",code="418"}`:      1,
+		`minprox_requests_total{method="CONNECT",code="tunnel"}`: 1,
+	} {
+		if got := metricValue(t, page, series); got != want {
+			t.Errorf("%s = %d, want %d", series, got, want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// mirror sends shadow copies of proxied requests to a second backend. Its
+// responses are discarded; only their status is logged and counted in the
+// metrics.
+type mirror struct {
+	target  *url.URL
+	client  *http.Client
+	maxBody int64
+}
+
+func newMirror(target *url.URL, timeout time.Duration, maxBody int64) *mirror {
+	return &mirror{
+		target:  target,
+		client:  &http.Client{Timeout: timeout},
+		maxBody: maxBody,
+	}
+}
+
+// send buffers req's body so both the primary request and the mirror can
+// read it, then fires the mirror request in the background. Requests with
+// bodies larger than maxBody are not mirrored. The outcome is counted in
+// metrics.
+func (m *mirror) send(req *http.Request, metrics *metrics, log *slog.Logger) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		buf, err := io.ReadAll(io.LimitReader(req.Body, m.maxBody+1))
+		// Whatever happens, the primary request still gets the full body.
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		if err != nil || int64(len(buf)) > m.maxBody {
+			log.Debug("not mirroring request", "reason", "body too large or unreadable")
+			metrics.mirrorDone("skipped")
+			return
+		}
+		body = buf
+	}
+
+	mreq := req.Clone(context.Background())
+	mreq.URL.Scheme = m.target.Scheme
+	mreq.URL.Host = m.target.Host
+	mreq.Host = m.target.Host
+	mreq.Body = io.NopCloser(bytes.NewReader(body))
+	mreq.ContentLength = int64(len(body))
+	if body == nil {
+		mreq.Body = nil
+	}
+
+	go func() {
+		resp, err := m.client.Do(mreq)
+		if err != nil {
+			log.Debug("mirror request failed", "mirror", m.target.Host, "error", err)
+			metrics.mirrorDone("error")
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		log.Debug("mirror response", "mirror", m.target.Host, "status", resp.StatusCode)
+		metrics.mirrorDone(strconv.Itoa(resp.StatusCode))
+	}()
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mirrored is a request seen by the mirror backend.
+type mirrored struct {
+	method, host, path, body string
+}
+
+func newMirrorBackend(t *testing.T, status int) (*countingBackend, chan mirrored) {
+	got := make(chan mirrored, 10)
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		got <- mirrored{req.Method, req.Host, req.URL.Path, string(body)}
+		wr.WriteHeader(status)
+	})
+	return b, got
+}
+
+func TestMirror(t *testing.T) {
+	mirror, got := newMirrorBackend(t, http.StatusTeapot)
+	var primaryBody string
+	primary := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		primaryBody = string(b)
+		fmt.Fprint(wr, "primary")
+	})
+	p := newTestProxy(t, "-backend", primary.URL, "-mirror-to", mirror.URL, "-metrics-addr", "127.0.0.1:0")
+
+	req := strings.NewReader("payload")
+	rec := serveBody(p, "POST", "http://front.test/submit", req)
+	if rec.Body.String() != "primary" || primaryBody != "payload" {
+		t.Errorf("primary got body %q and answered %q", primaryBody, rec.Body)
+	}
+	select {
+	case m := <-got:
+		want := mirrored{"POST", strings.TrimPrefix(mirror.URL, "http://"), "/submit", "payload"}
+		if m != want {
+			t.Errorf("mirror got %+v, want %+v", m, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("mirror got nothing")
+	}
+	waitFor(t, func() bool {
+		return strings.Contains(scrape(t, p), `minprox_mirror_requests_total{result="418"} 1`)
+	})
+}
+
+func TestMirrorSkipsLargeBodies(t *testing.T) {
+	mirror, got := newMirrorBackend(t, http.StatusOK)
+	var primaryBody string
+	primary := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		primaryBody = string(b)
+	})
+	p := newTestProxy(t, "-backend", primary.URL, "-mirror-to", mirror.URL, "-mirror-max-body", "4", "-metrics-addr", "127.0.0.1:0")
+
+	serveBody(p, "POST", "http://front.test/", strings.NewReader("too long"))
+	if primaryBody != "too long" {
+		t.Errorf("primary got %q, want the whole body", primaryBody)
+	}
+	if !strings.Contains(scrape(t, p), `minprox_mirror_requests_total{result="skipped"} 1`) {
+		t.Error("skipped mirror not counted")
+	}
+	select {
+	case m := <-got:
+		t.Errorf("mirror got %+v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMirrorErrorsCounted(t *testing.T) {
+	mirror, _ := newMirrorBackend(t, http.StatusOK)
+	mirror.Close()
+	primary := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	p := newTestProxy(t, "-backend", primary.URL, "-mirror-to", mirror.URL, "-metrics-addr", "127.0.0.1:0")
+
+	if rec := serve(p, "GET", "http://front.test/"); rec.Code != http.StatusOK {
+		t.Errorf("primary answer %d with the mirror down", rec.Code)
+	}
+	waitFor(t, func() bool {
+		return strings.Contains(scrape(t, p), `minprox_mirror_requests_total{result="error"} 1`)
+	})
+}
@@ -0,0 +1,313 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// mitmCertLifetime is how long minted host certificates are valid.
+	mitmCertLifetime = 30 * 24 * time.Hour
+
+	// interceptedHeaderTimeout is how long a client of an intercepted
+	// tunnel has to send each request's headers.
+	interceptedHeaderTimeout = 30 * time.Second
+
+	// mitmCacheSize caps the minted certificates kept; the cache starts
+	// over once it is full.
+	mitmCacheSize = 1000
+)
+
+// interceptor terminates CONNECT tunnels with certificates it mints per
+// host from a local CA, so the requests inside go through the proxy like
+// plain ones: logged, filtered, rewritten, and sent on to the origin over
+// a fresh TLS connection. Clients must trust the CA for this to work;
+// those that don't, or that pin certificates, fail their handshake and
+// can be left out with -mitm-hosts.
+type interceptor struct {
+	ca    *x509.Certificate
+	caKey crypto.Signer
+	key   *ecdsa.PrivateKey // shared by every minted certificate
+	hosts *domainSet        // nil intercepts every host
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+// newInterceptor loads the CA from certPath and keyPath, first creating
+// a new one there if neither file exists yet.
+func newInterceptor(certPath, keyPath string, hosts []string) (*interceptor, error) {
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist) {
+		if err := writeMITMCA(certPath, keyPath); err != nil {
+			return nil, fmt.Errorf("creating interception CA: %w", err)
+		}
+		slog.Info("Created interception CA, install it on clients to trust", "cert", certPath)
+	}
+
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok || !ca.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", certPath)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	in := &interceptor{ca: ca, caKey: signer, key: key, certs: make(map[string]*tls.Certificate)}
+	if len(hosts) > 0 {
+		in.hosts = newDomainSet(hosts)
+	}
+	return in, nil
+}
+
+// writeMITMCA creates a new CA and writes it to certPath and keyPath.
+func writeMITMCA(certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "minprox interception CA " + host, Organization: []string{"minprox"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+}
+
+// intercepts reports whether tunnels to host are intercepted.
+func (in *interceptor) intercepts(host string) bool {
+	if in == nil {
+		return false
+	}
+	if in.hosts == nil {
+		return true
+	}
+	_, ok := in.hosts.match(host)
+	return ok
+}
+
+// certificate returns the certificate for host, minting it if there is
+// none yet or the cached one is about to expire.
+func (in *interceptor) certificate(host string) (*tls.Certificate, error) {
+	host = normalizeHost(host)
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if cert, ok := in.certs[host]; ok && time.Until(cert.Leaf.NotAfter) > 24*time.Hour {
+		return cert, nil
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	notAfter := time.Now().Add(mitmCertLifetime)
+	if notAfter.After(in.ca.NotAfter) {
+		notAfter = in.ca.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		tmpl.IPAddresses = []net.IP{ip.AsSlice()}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, in.ca, &in.key.PublicKey, in.caKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der, in.ca.Raw}, PrivateKey: in.key, Leaf: leaf}
+	if len(in.certs) >= mitmCacheSize {
+		clear(in.certs)
+	}
+	in.certs[host] = cert
+	return cert, nil
+}
+
+// interceptedKey is the context key marking requests that arrived inside
+// an intercepted tunnel. Its value is the user who opened the tunnel, as
+// those requests carry no Proxy-Authorization of their own.
+type interceptedKey struct{}
+
+// interceptedUser returns who opened the intercepted tunnel req came
+// through, if it did.
+func interceptedUser(req *http.Request) (user string, ok bool) {
+	user, ok = req.Context().Value(interceptedKey{}).(string)
+	return user, ok
+}
+
+// serveIntercepted takes over a tunnel to addr, already answered as
+// established, by terminating TLS on clientConn itself and serving the
+// requests inside with p, until the client is done with the connection.
+// The tunnel has the timeouts of one relayed, and its bytes are logged
+// and added to its access log entry; the requests inside are counted
+// against quotas and in the metrics as they are served.
+func (p *proxy) serveIntercepted(clientConn net.Conn, req *http.Request, addr, user string, log *slog.Logger) {
+	host, _, _ := net.SplitHostPort(addr)
+	p.stats.tunnel()
+	defer p.metrics.tunnel()()
+	defer p.tunnels.add(clientConn, req)()
+
+	start := time.Now()
+	var up, down atomic.Int64
+	rawClient := clientConn
+	clientConn = &directedConn{Conn: clientConn, read: &up, written: &down}
+	defer func() {
+		if entry := accessEntryFrom(req); entry != nil {
+			entry.up.Add(up.Load())
+			entry.down.Add(down.Load())
+		}
+		log.Info("Tunnel closed", "duration", time.Since(start).Round(time.Millisecond), "bytes_up", up.Load(), "bytes_down", down.Load())
+	}()
+	if p.tunnelIdleTimeout > 0 {
+		idle := newIdleTimer(p.tunnelIdleTimeout, func() {
+			log.Info("closing idle tunnel", "timeout", p.tunnelIdleTimeout)
+			rawClient.Close()
+		})
+		defer idle.Stop()
+		clientConn = idle.wrap(clientConn)
+	}
+	if p.tunnelMaxDuration > 0 {
+		limit := time.AfterFunc(p.tunnelMaxDuration, func() {
+			log.Info("closing tunnel at -tunnel-max-duration", "limit", p.tunnelMaxDuration)
+			rawClient.Close()
+		})
+		defer limit.Stop()
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = host
+			}
+			return p.mitm.certificate(name)
+		},
+		// The requests are served with HTTP/1.1 whatever the origin
+		// speaks.
+		NextProtos: []string{"http/1.1"},
+	}
+	p.metrics.countTLS(tlsConfig)
+	tlsConn := tls.Server(clientConn, tlsConfig)
+	ctx, cancel := context.WithTimeout(req.Context(), sniPeekTimeout)
+	err := tlsConn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		log.Warn("intercepted client TLS handshake failed, does it trust the CA?", "error", err)
+		clientConn.Close()
+		return
+	}
+
+	authority := stripDefaultPort(addr)
+	done := make(chan struct{})
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(wr http.ResponseWriter, inner *http.Request) {
+			inner.URL.Scheme = "https"
+			inner.URL.Host = authority
+			ctx := context.WithValue(inner.Context(), interceptedKey{}, user)
+			p.ServeHTTP(wr, inner.WithContext(ctx))
+		}),
+		ReadHeaderTimeout: interceptedHeaderTimeout,
+		IdleTimeout:       p.tunnelIdleTimeout,
+		ErrorLog:          serverErrorLog(),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				close(done)
+			}
+		},
+	}
+	srv.Serve(&singleConnListener{conn: tlsConn, addr: clientConn.LocalAddr()})
+	<-done
+}
+
+// singleConnListener hands out one connection, then reports itself
+// closed.
+type singleConnListener struct {
+	mu   sync.Mutex
+	conn net.Conn
+	addr net.Addr
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return nil, net.ErrClosed
+	}
+	conn := l.conn
+	l.conn = nil
+	return conn, nil
+}
+
+func (l *singleConnListener) Close() error   { return nil }
+func (l *singleConnListener) Addr() net.Addr { return l.addr }
+
+// stripDefaultPort returns addr's host, bracketed if it is IPv6, when
+// addr names the default HTTPS port.
+func stripDefaultPort(addr string) string {
+	if host, port, err := net.SplitHostPort(addr); err == nil && port == "443" {
+		if strings.Contains(host, ":") {
+			return "[" + host + "]"
+		}
+		return host
+	}
+	return addr
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// mitmCA returns -mitm-ca-cert and -mitm-ca-key paths in a new directory,
+// neither of them written yet.
+func mitmCA(t *testing.T) (certPath, keyPath string) {
+	t.Helper()
+	dir := t.TempDir()
+	return filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")
+}
+
+// caPool loads the PEM certificates in path.
+func caPool(t *testing.T, path string) *x509.CertPool {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		t.Fatalf("%s: no certificates", path)
+	}
+	return pool
+}
+
+func TestMITM(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("X-Secret", "1")
+		fmt.Fprintf(wr, "origin %s", req.URL)
+	}))
+	defer origin.Close()
+	target := origin.Listener.Addr().String()
+	cert, key := mitmCA(t)
+	logger, logs := newTestLogger()
+	p, err := New(WithFlags("-connect-ports", "*", "-mitm-ca-cert", cert, "-mitm-ca-key", key, "-tls-verify", "127.0.0.1=ca:"+backendCA(t, origin), "-strip-response-headers", "X-Secret"), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	conn, _, resp := connect(t, srv.Listener.Addr().String(), target)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT got %s", resp.Status)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{RootCAs: caPool(t, cert), ServerName: "127.0.0.1"})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("handshake with the minted certificate: %v", err)
+	}
+	fmt.Fprint(tlsConn, "GET /inside?q=1 HTTP/1.1\r\nHost: "+target+"\r\nConnection: close\r\n\r\n")
+	resp, err = http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatalf("reading the intercepted response: %v", err)
+	}
+	if body := readBody(t, resp.Body); body != "origin /inside?q=1" || resp.Header.Get("X-Secret") != "" {
+		t.Errorf("intercepted GET got %q with X-Secret %q, want the origin's body stripped of it", body, resp.Header.Get("X-Secret"))
+	}
+	waitFor(t, func() bool { return strings.Contains(logs.String(), "Tunnel closed") })
+	if want := `URL="https://` + target + `/inside?q=1"`; !strings.Contains(logs.String(), want) {
+		t.Errorf("intercepted request not logged with %s:\n%s", want, logs)
+	}
+}
+
+// TestMITMCountsHandshakes checks the handshakes of intercepted tunnels
+// show in minprox_tls_handshakes_total like those of -tls-cert listeners.
+func TestMITMCountsHandshakes(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {}))
+	defer origin.Close()
+	cert, key := mitmCA(t)
+	p := newTestProxy(t, "-mitm-ca-cert", cert, "-mitm-ca-key", key, "-metrics-addr", "127.0.0.1:0")
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	conn, _, resp := connect(t, srv.Listener.Addr().String(), origin.Listener.Addr().String())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT got %s", resp.Status)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{RootCAs: caPool(t, cert), ServerName: "127.0.0.1", MaxVersion: tls.VersionTLS12})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("handshake with the minted certificate: %v", err)
+	}
+	want := `minprox_tls_handshakes_total{version="TLS 1.2",cipher="` + tls.CipherSuiteName(tlsConn.ConnectionState().CipherSuite) + `"} 1`
+	if out := scrape(t, p); !strings.Contains(out, want) {
+		t.Errorf("intercepted handshake not counted, want %s in:\n%s", want, out)
+	}
+}
+
+func TestMITMHosts(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {}))
+	defer origin.Close()
+	cert, key := mitmCA(t)
+	srv := newProxyServer(t, "-mitm-ca-cert", cert, "-mitm-ca-key", key, "-mitm-hosts", "intercepted.test")
+	conn, _, resp := connect(t, srv.Listener.Addr().String(), origin.Listener.Addr().String())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT got %s", resp.Status)
+	}
+	// An unlisted host is tunnelled as is: the origin's own certificate.
+	pool := x509.NewCertPool()
+	pool.AddCert(origin.Certificate())
+	if err := tls.Client(conn, &tls.Config{RootCAs: pool, ServerName: "example.com"}).Handshake(); err != nil {
+		t.Errorf("handshake with the origin through an unintercepted tunnel: %v", err)
+	}
+}
+
+func TestInterceptor(t *testing.T) {
+	cert, key := mitmCA(t)
+	in, err := newInterceptor(cert, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := caPool(t, cert)
+	a, err := in.certificate("A.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Leaf.Verify(x509.VerifyOptions{Roots: pool, DNSName: "a.test"}); err != nil {
+		t.Errorf("minted certificate doesn't verify for a.test: %v", err)
+	}
+	if again, _ := in.certificate("a.test"); again != a {
+		t.Error("certificate for a.test minted twice")
+	}
+	ip, _ := in.certificate("192.0.2.1")
+	if _, err := ip.Leaf.Verify(x509.VerifyOptions{Roots: pool, DNSName: "192.0.2.1"}); err != nil {
+		t.Errorf("minted certificate doesn't verify for 192.0.2.1: %v", err)
+	}
+
+	// The CA is kept, not made anew, once written.
+	reloaded, err := newInterceptor(cert, key, []string{"example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.ca.Equal(in.ca) {
+		t.Error("existing CA replaced")
+	}
+	for host, want := range map[string]bool{"example.com": true, "www.example.com": true, "example.org": false} {
+		if got := reloaded.intercepts(host); got != want {
+			t.Errorf("intercepts(%q) = %v, want %v", host, got, want)
+		}
+	}
+	if (*interceptor)(nil).intercepts("example.com") {
+		t.Error("nil interceptor intercepts")
+	}
+
+	dir, _ := writeTestPKI(t)
+	if _, err := newInterceptor(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"), nil); err == nil {
+		t.Error("a leaf certificate accepted as the CA")
+	}
+	if _, err := New(WithFlags("-mitm-ca-cert", cert)); err == nil {
+		t.Error("-mitm-ca-cert accepted without -mitm-ca-key")
+	}
+}
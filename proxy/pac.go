@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// pacConfig serves a proxy auto-config file pointing browsers at this
+// listener: -pac at /proxy.pac, and with -wpad also at /wpad.dat for WPAD
+// discovery. Plain host names and loopback go direct, as do the -pac-direct
+// patterns. If the ACL has allow rules, only the destinations they admit
+// are sent to the proxy and everything else goes direct, since the proxy
+// would refuse it anyway. A nil *pacConfig serves nothing.
+type pacConfig struct {
+	// proxy is the host:port advertised, or "" for the one the file was
+	// fetched from.
+	proxy  string
+	direct []aclRule
+	wpad   bool
+}
+
+// pacPaths are where the file is served.
+const (
+	pacPath  = "/proxy.pac"
+	wpadPath = "/wpad.dat"
+)
+
+// parsePACDirect parses the -pac-direct patterns, written as ACL rules
+// without ports.
+func parsePACDirect(patterns []string) ([]aclRule, error) {
+	var rules []aclRule
+	for _, s := range patterns {
+		r, err := parseACLRule(s)
+		if err != nil {
+			return nil, fmt.Errorf("-pac-direct: %w", err)
+		}
+		if r.lo != 0 {
+			return nil, fmt.Errorf("-pac-direct %q: ports can't be matched in a PAC file", s)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// isPACRequest reports whether req is for the PAC file. Like -echo-path,
+// only origin-form requests match.
+func (p *proxy) isPACRequest(req *http.Request) bool {
+	if p.pac == nil || !strings.HasPrefix(req.RequestURI, "/") {
+		return false
+	}
+	return req.URL.Path == pacPath || (p.pac.wpad && req.URL.Path == wpadPath)
+}
+
+// servePAC answers with the PAC file. It is built for each request, so
+// ACL changes made through the admin API show up in it.
+func (p *proxy) servePAC(wr http.ResponseWriter, req *http.Request) {
+	addr := p.pac.proxy
+	if addr == "" {
+		addr = pacProxyAddr(req)
+	}
+	kind := "PROXY"
+	if req.TLS != nil {
+		kind = "HTTPS"
+	}
+
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\tif (isPlainHostName(host) || host == \"localhost\" || isInNet(host, \"127.0.0.0\", \"255.0.0.0\"))\n\t\treturn \"DIRECT\";\n")
+	for _, r := range p.pac.direct {
+		fmt.Fprintf(&b, "\tif (%s)\n\t\treturn \"DIRECT\";\n", pacCondition(r))
+	}
+	if allow := p.acl.allowRules(); len(allow) > 0 {
+		conds := make([]string, len(allow))
+		for i, r := range allow {
+			conds[i] = pacCondition(r)
+		}
+		fmt.Fprintf(&b, "\tif (!(%s))\n\t\treturn \"DIRECT\";\n", strings.Join(conds, " ||\n\t    "))
+	}
+	fmt.Fprintf(&b, "\treturn %s;\n}\n", strconv.Quote(kind+" "+addr))
+
+	wr.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	wr.Header().Set("Cache-Control", "max-age=300")
+	wr.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+	wr.WriteHeader(http.StatusOK)
+	if req.Method != http.MethodHead {
+		wr.Write([]byte(b.String()))
+	}
+}
+
+// pacProxyAddr returns the address the PAC file was fetched from. A Host
+// without a port, as WPAD's http://wpad/wpad.dat has, gets the port the
+// request came in on.
+func pacProxyAddr(req *http.Request) string {
+	if _, _, err := net.SplitHostPort(req.Host); err == nil {
+		return req.Host
+	}
+	port := "80"
+	if req.TLS != nil {
+		port = "443"
+	}
+	if local, ok := req.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		port = strconv.Itoa(local.Port)
+	}
+	return net.JoinHostPort(strings.Trim(req.Host, "[]"), port)
+}
+
+// pacCondition returns the PAC expression matching the hosts r covers,
+// ignoring its ports. IPv6 prefixes need isInNetEx, which only some
+// browsers have; others treat them as not matching.
+func pacCondition(r aclRule) string {
+	switch {
+	case r.any:
+		return "true"
+	case r.prefix.IsValid() && r.prefix.Addr().Is4():
+		mask := net.CIDRMask(r.prefix.Bits(), 32)
+		return fmt.Sprintf("isInNet(host, %q, %q)", r.prefix.Addr(), net.IP(mask).String())
+	case r.prefix.IsValid():
+		return fmt.Sprintf("(typeof isInNetEx == \"function\" && isInNetEx(host, %q))", r.prefix)
+	case r.wildcard:
+		return fmt.Sprintf("dnsDomainIs(host, %q)", "."+r.host)
+	}
+	return fmt.Sprintf("host == %q", r.host)
+}
+
+// allowRules returns the allow rules, for the PAC file.
+func (a *accessList) allowRules() []aclRule {
+	if a == nil {
+		return nil
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.allow
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fetchPAC asks the proxy p for path in origin form, as a browser
+// fetching its PAC file does.
+func fetchPAC(p http.Handler, method, host, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Host = host
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPAC(t *testing.T) {
+	p := newTestProxy(t, "-pac", "-pac-direct", "intranet.test, *.corp.test, 10.0.0.0/8, 2001:db8::/32")
+	rec := fetchPAC(p, "GET", "proxy.lan:3128", pacPath)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-ns-proxy-autoconfig" {
+		t.Fatalf("GET %s got %d as %q", pacPath, rec.Code, rec.Header().Get("Content-Type"))
+	}
+	pac := rec.Body.String()
+	for _, want := range []string{
+		"function FindProxyForURL(url, host) {",
+		`isPlainHostName(host)`,
+		`if (host == "intranet.test")`,
+		`if (dnsDomainIs(host, ".corp.test"))`,
+		`if (isInNet(host, "10.0.0.0", "255.0.0.0"))`,
+		`isInNetEx(host, "2001:db8::/32")`,
+		`return "PROXY proxy.lan:3128";`,
+	} {
+		if !strings.Contains(pac, want) {
+			t.Errorf("PAC file lacks %s:\n%s", want, pac)
+		}
+	}
+	if strings.Contains(pac, "if (!(") {
+		t.Errorf("PAC file limits destinations without ACL allow rules:\n%s", pac)
+	}
+
+	if head := fetchPAC(p, "HEAD", "proxy.lan:3128", pacPath); head.Code != http.StatusOK || head.Body.Len() != 0 || head.Header().Get("Content-Length") != rec.Header().Get("Content-Length") {
+		t.Errorf("HEAD got %d with %d bytes, Content-Length %q; want GET's length and no body", head.Code, head.Body.Len(), head.Header().Get("Content-Length"))
+	}
+	if rec := fetchPAC(p, "GET", "proxy.lan:3128", wpadPath); rec.Code == http.StatusOK && strings.Contains(rec.Body.String(), "FindProxyForURL") {
+		t.Error("wpad.dat served without -wpad")
+	}
+	// A request for some site's /proxy.pac is proxied, not answered.
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	serve(p, "GET", b.URL+pacPath)
+	if b.hits != 1 {
+		t.Error("absolute-form request for /proxy.pac answered by the proxy")
+	}
+}
+
+func TestPACOptions(t *testing.T) {
+	p := newTestProxy(t, "-wpad", "-pac-proxy", "proxy.example:8080", "-acl-allow", "*.allowed.test, 192.0.2.0/24:443")
+	rec := fetchPAC(p, "GET", "wpad", wpadPath)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("-wpad: GET %s got %d", wpadPath, rec.Code)
+	}
+	pac := rec.Body.String()
+	for _, want := range []string{
+		`return "PROXY proxy.example:8080";`,
+		"if (!(dnsDomainIs(host, \".allowed.test\") ||\n\t    isInNet(host, \"192.0.2.0\", \"255.255.255.0\")))\n\t\treturn \"DIRECT\";",
+	} {
+		if !strings.Contains(pac, want) {
+			t.Errorf("PAC file lacks %q:\n%s", want, pac)
+		}
+	}
+
+	// Over TLS the browser is told to speak TLS to the proxy.
+	req := httptest.NewRequest("GET", pacPath, nil)
+	req.TLS = &tls.ConnectionState{}
+	wr := httptest.NewRecorder()
+	p.ServeHTTP(wr, req)
+	if !strings.Contains(wr.Body.String(), `return "HTTPS proxy.example:8080";`) {
+		t.Errorf("PAC file over TLS:\n%s", wr.Body)
+	}
+
+	for _, args := range [][]string{
+		{"-pac", "-pac-direct", "intranet.test:80"},
+		{"-pac", "-pac-direct", "10.0.0.0/99"},
+	} {
+		if _, err := New(WithFlags(args...)); err == nil {
+			t.Errorf("%q accepted", args)
+		}
+	}
+}
+
+func TestPACProxyAddr(t *testing.T) {
+	for _, tt := range []struct {
+		host  string
+		local net.Addr
+		tls   bool
+		want  string
+	}{
+		{"proxy.lan:3128", nil, false, "proxy.lan:3128"},
+		{"wpad", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 8080}, false, "wpad:8080"},
+		{"wpad", nil, false, "wpad:80"},
+		{"wpad", nil, true, "wpad:443"},
+		{"[2001:db8::1]", nil, false, "[2001:db8::1]:80"},
+	} {
+		req := httptest.NewRequest("GET", "/proxy.pac", nil)
+		req.Host = tt.host
+		if tt.local != nil {
+			req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, tt.local))
+		}
+		if tt.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		if got := pacProxyAddr(req); got != tt.want {
+			t.Errorf("Host %q from %v: got %s, want %s", tt.host, tt.local, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,1113 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"log/slog"
+)
+
+// Hop-by-hop headers. These are removed when sent to the backend.
+// http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te", // canonicalized version of "TE"
+	"Trailers",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+func delHopHeaders(header http.Header) {
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+}
+
+// dedupeHeaders keeps only the first value of each named header.
+func dedupeHeaders(header http.Header, names []string) {
+	for _, h := range names {
+		if vv := header.Values(h); len(vv) > 1 {
+			header.Set(h, vv[0])
+		}
+	}
+}
+
+// framingHeaders describe how a message body is encoded and always pass a
+// header allowlist, since dropping them would corrupt the body, or leave
+// it unreadable in the case of Content-Type.
+var framingHeaders = []string{"Content-Length", "Transfer-Encoding", "Content-Encoding", "Content-Type", "Te", "Trailer"}
+
+// headerAllowlist returns the set of canonical header names in names plus
+// the framing headers, or nil if names is empty.
+func headerAllowlist(names []string) map[string]bool {
+	if len(names) == 0 {
+		return nil
+	}
+	allow := make(map[string]bool)
+	for _, name := range append(names, framingHeaders...) {
+		allow[http.CanonicalHeaderKey(name)] = true
+	}
+	return allow
+}
+
+// keepOnly removes every header not in allow. A nil allow keeps them all.
+func keepOnly(header http.Header, allow map[string]bool) {
+	if allow == nil {
+		return
+	}
+	for name := range header {
+		if !allow[name] {
+			delete(header, name)
+		}
+	}
+}
+
+// listFlag is a flag that may be repeated, collecting every value.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// forwardedFor returns the entries of the X-Forwarded-For chain, folding
+// multiple headers together.
+func forwardedFor(header http.Header) []string {
+	var hops []string
+	for _, v := range header.Values("X-Forwarded-For") {
+		hops = append(hops, splitList(v)...)
+	}
+	return hops
+}
+
+// forwardingHeaders carry client addresses and are removed by -no-xff.
+var forwardingHeaders = []string{"X-Forwarded-For", "Forwarded", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-Ip"}
+
+func appendHostToXForwardHeader(header http.Header, host string) {
+	// If we aren't the first proxy retain prior
+	// X-Forwarded-For information as a comma+space
+	// separated list and fold multiple headers into one.
+	if prior, ok := header["X-Forwarded-For"]; ok {
+		host = strings.Join(prior, ", ") + ", " + host
+	}
+	header.Set("X-Forwarded-For", host)
+}
+
+// remoteHost returns the host part of a RemoteAddr. Addresses without a
+// port (unix sockets, some test setups) are returned unchanged along with
+// the split error.
+func remoteHost(addr string) (string, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, err
+	}
+	return host, nil
+}
+
+type proxy struct {
+	// dialer and transport carry outbound connection settings. Either may
+	// be nil, in which case the net and net/http defaults are used.
+	dialer    *net.Dialer
+	transport http.RoundTripper
+
+	// upstream, if set, is a parent HTTP proxy all traffic is sent through.
+	// Its userinfo holds the -upstream-auth credentials, unless
+	// upstreamAuthFile supplies them; use upstreamURL to get both.
+	upstream         *url.URL
+	upstreamAuthFile *credentialFile
+
+	// retry, if set, retries failed backend requests for
+	// -request-retries.
+	retry *retryPolicy
+
+	// upstreamFailover, if set, holds upstream and the other -upstream
+	// parent proxies that take over while it is down.
+	upstreamFailover *upstreamFailover
+
+	// mitm, if set, intercepts CONNECT tunnels to serve the requests
+	// inside them like plain ones.
+	mitm *interceptor
+
+	// serverCert, if set, is the -tls-cert the listener serves.
+	serverCert *certFile
+
+	// upstreamRoutes pick a different parent proxy, or none, for some
+	// destinations. The first match wins over upstream.
+	upstreamRoutes []upstreamRoute
+
+	// metrics, if set, counts requests for the -metrics-addr endpoint.
+	metrics *metrics
+
+	// accessLog, if set, records every completed request in -access-log.
+	accessLog *accessLog
+
+	// retryAfterBase and retryAfterJitter shape the Retry-After sent
+	// with 429 and 503 responses; see retryAfter.
+	retryAfterBase   time.Duration
+	retryAfterJitter float64
+
+	// stats, if set, counts traffic for the shutdown summary.
+	stats *serverStats
+
+	// tunnels, if set, tracks open tunnels for shutdown to drain.
+	tunnels *tunnelSet
+
+	// auth, if set, requires clients to authenticate as an -auth-file
+	// user with Proxy-Authorization.
+	auth *proxyAuth
+
+	// grpcTransport, if set, is used for gRPC requests so they reach the
+	// backend over HTTP/2 (h2c for http:// targets).
+	grpcTransport http.RoundTripper
+
+	// client and grpcClient send every backend request over transport
+	// and grpcTransport, sharing their connection pools.
+	client, grpcClient *http.Client
+
+	// backend and routes put the proxy in reverse-proxy mode: every
+	// non-CONNECT request is sent to the backend of the longest matching
+	// route, or to backend, instead of to its own URL.
+	backend *url.URL
+	routes  []route
+
+	// forwardUnmatched forwards proxy requests for absolute URLs that no
+	// route matches, so one listener serves as both a reverse and a
+	// forward proxy.
+	forwardUnmatched bool
+
+	// rules, if set, edits, redirects and blocks requests by URL for
+	// -rules.
+	rules *ruleSet
+
+	// transformer, if set, rewrites response bodies for -transform.
+	transformer *transformer
+
+	// settings are the options the proxy was built from, for the admin
+	// API's GET /config.
+	settings map[string]string
+
+	// dns, if set, resolves target hosts for -hosts-file and
+	// -dns-cache-ttl.
+	dns *dnsLayer
+
+	// negDNS, if set, caches failed lookups for -dns-neg-ttl.
+	negDNS *negativeDNSCache
+
+	// fallback, if set, lists other endpoints dialled when the backend's
+	// own address fails.
+	fallback *dialFallback
+
+	// pool, if set, holds every -backend when more than one was given;
+	// backend is then just its first member.
+	pool *backendPool
+
+	// abSplit, if set, sends a share of reverse-proxied clients to a
+	// second backend.
+	abSplit *abSplit
+
+	// timeoutOverride, if set, lets trusted clients choose the upstream
+	// timeout with X-Proxy-Timeout.
+	timeoutOverride *timeoutOverride
+
+	// backendHeader names a request header trusted internal callers use
+	// to pick the backend themselves, from those in allowedBackends.
+	backendHeader   string
+	allowedBackends map[string]*url.URL
+	stripPrefix     string
+	addPrefix       string
+
+	// preserveHost forwards the client's Host header instead of the one
+	// derived from the target URL. In forward-proxy mode the two always
+	// agree: net/http ignores the Host header of absolute-form requests
+	// (RFC 7230 section 5.4).
+	preserveHost bool
+
+	// blocklist, if set, rejects requests for listed domains using the
+	// response selected by blockMode.
+	blocklist *domainSet
+	blockMode string
+
+	// acl, if set, limits the destinations requests and tunnels may
+	// reach; see -acl-file.
+	acl *accessList
+
+	// quota, if set, limits the bytes each client IP may transfer per
+	// window, tunnels included.
+	quota *quotaTracker
+
+	// faults injects artificial delays and errors for chaos testing.
+	faults *faultInjector
+
+	// serveStale enables serving the last good response for a URL when
+	// the backend is unreachable or answers 502/504.
+	serveStale bool
+	stale      *staleCache
+
+	// cache, if set, stores cacheable responses and serves them again
+	// while they are fresh.
+	cache *httpCache
+
+	// coalescer, if set, merges concurrent identical GETs into one
+	// backend request.
+	coalescer *coalescer
+
+	// cacheStatusHeader names the response header reporting the cache
+	// outcome (HIT, MISS, STALE or BYPASS) when caching is enabled.
+	cacheStatusHeader string
+
+	// tunnelIdleTimeout closes CONNECT tunnels that see no traffic in
+	// either direction for this long. Zero disables it.
+	tunnelIdleTimeout time.Duration
+
+	// tunnelMaxDuration closes CONNECT tunnels this long after they open,
+	// however busy. Zero disables it.
+	tunnelMaxDuration time.Duration
+
+	// tunnelLinger is how long one side of a tunnel may keep sending
+	// after the other has finished. Zero waits indefinitely.
+	tunnelLinger time.Duration
+
+	// noConnect refuses CONNECT requests outright.
+	noConnect bool
+
+	// connectRetries is how many times a transient CONNECT dial failure is
+	// retried, starting at connectRetryBackoff and doubling.
+	connectRetries      int
+	connectRetryBackoff time.Duration
+
+	// connectDefaultPort is dialled for CONNECT targets without a port.
+	connectDefaultPort string
+
+	// connectPorts, if set, are the only ports CONNECT may reach: 80 and
+	// 443 unless -connect-ports says otherwise.
+	connectPorts portSet
+
+	// logSNI peeks at the TLS ClientHello in CONNECT tunnels and logs the
+	// server name the client asked for.
+	logSNI bool
+
+	// serverHeader replaces the backend's Server header; "-" removes it
+	// and empty passes it through.
+	serverHeader string
+
+	// stripResponseHeaders are removed from backend responses, for
+	// headers such as X-Powered-By that fingerprint the backend.
+	stripResponseHeaders []string
+
+	// bufferResponses, if positive, is how much of each response body is
+	// read before the status is sent, so backend failures within it give
+	// a clean 502 instead of a truncated response.
+	bufferResponses int64
+
+	// forceIdentity asks backends for uncompressed responses, so bodies
+	// can be logged and inspected as-is.
+	forceIdentity       bool
+	decompressionLimits decompressionLimits
+
+	// requestHeaderAllow and responseHeaderAllow, if set, are the only
+	// headers forwarded in each direction, besides those framing the body.
+	requestHeaderAllow  map[string]bool
+	responseHeaderAllow map[string]bool
+
+	// stripAltSvc removes backend Alt-Svc headers so clients aren't
+	// steered to HTTP/3 endpoints that bypass the proxy.
+	stripAltSvc bool
+
+	// via is the pseudonym this proxy adds to Via headers and looks for
+	// to detect loops. Empty disables both.
+	via string
+
+	// maxForwardHops limits the incoming X-Forwarded-For chain length.
+	// Longer chains are rejected as a suspected loop, or cut down to the
+	// most recent hops if truncateForwardHops is set.
+	maxForwardHops      int
+	truncateForwardHops bool
+
+	// verboseErrors puts the error category and target in the body of
+	// 502 and 504 responses for failed backend requests.
+	verboseErrors bool
+
+	// honorMethodOverride turns POSTs with X-HTTP-Method-Override into
+	// the method named there.
+	honorMethodOverride bool
+
+	// tunnelSockOpts are set on both sockets of every CONNECT tunnel.
+	tunnelSockOpts sockOpts
+
+	// globalRate, if set, limits outbound requests and tunnels across
+	// all clients; requests wait up to globalRateWait for a token.
+	globalRate     *tokenBucket
+	globalRateWait time.Duration
+
+	// rateLimits answer clients over a per client, user or destination
+	// request rate with 429; bandwidthLimits throttle the bytes of
+	// request and response bodies and of tunnels the same way.
+	rateLimits      []*keyedLimiter
+	bandwidthLimits []*keyedLimiter
+
+	// maxTunnels caps concurrent CONNECT tunnels, counted in
+	// activeTunnels; zero is unlimited.
+	maxTunnels    int
+	activeTunnels atomic.Int64
+
+	// echoPath, if set, is answered locally with a JSON description of
+	// the request; see serveEcho.
+	echoPath string
+
+	// logger, aclHook, onRequest and onResponse are set by embedding
+	// programs, through New's options.
+	logger     *slog.Logger
+	aclHook    func(req *http.Request, target string) bool
+	onRequest  func(*http.Request) *http.Response
+	onResponse func(*http.Response)
+
+	// pac, if set, serves a proxy auto-config file for this listener.
+	pac *pacConfig
+
+	// geo, if set, tags requests with the client's country and refuses
+	// countries excluded by -geoip-allow or -geoip-deny.
+	geo *geoFilter
+
+	// maxRequestHeaders and maxCookies cap how many header lines and
+	// cookies a request may carry; zero is unlimited.
+	maxRequestHeaders int
+	maxCookies        int
+
+	// maxBodyBytes caps request bodies for -max-body-bytes.
+	maxBodyBytes int64
+
+	// stripReferer removes Referer from forwarded requests; otherwise
+	// refererPolicy "origin" cuts it down to scheme and host.
+	stripReferer  bool
+	refererPolicy string
+
+	// noXFF hides the client from backends: no X-Forwarded-For is added
+	// and any forwarding headers the client sent are removed.
+	noXFF bool
+
+	// forwarded, if set, limits whose forwarding headers are believed for
+	// -trusted-proxies and adds the optional ones.
+	forwarded *forwardedPolicy
+
+	// dedupeHeaders lists single-value headers for which only the first
+	// value is forwarded, in both directions.
+	dedupeHeaders []string
+
+	// bodyLog, if set, logs bodies of a sample of requests.
+	bodyLog *bodyLogger
+
+	// debugSample, if set, gives a sample of requests full body capture
+	// and timing traces.
+	debugSample *debugSampler
+
+	// tracer, if set, exports a span per request to an OTLP collector.
+	tracer *tracer
+
+	// recorder saves interactions to a cassette; replay serves them back
+	// without contacting any backend.
+	recorder *recorder
+	replay   *cassette
+
+	// capture, if set, writes forwarded exchanges to a HAR or JSON lines
+	// file for debugging.
+	capture *trafficCapture
+
+	// adapter, if set, vets request and response bodies with an external
+	// content adaptation service.
+	adapter *adapter
+
+	// mirror, if set, receives a shadow copy of every proxied request.
+	mirror *mirror
+
+	// warmer, if set, keeps connections to the backends open.
+	warmer *warmer
+
+	// securityHeaders, if set, are added to reverse-proxied responses.
+	securityHeaders *securityHeaders
+}
+
+// filterRequestHeader applies the configured end-to-end header rules to a
+// client request before it is forwarded. Hop-by-hop headers must already
+// have been removed.
+func (p *proxy) filterRequestHeader(header http.Header) {
+	keepOnly(header, p.requestHeaderAllow)
+	if p.requestHeaderAllow != nil && !p.requestHeaderAllow["User-Agent"] {
+		// An empty value stops net/http sending its own User-Agent.
+		header.Set("User-Agent", "")
+	}
+	dedupeHeaders(header, p.dedupeHeaders)
+	if p.forceIdentity {
+		header.Set("Accept-Encoding", "identity")
+	}
+}
+
+// filterResponseHeader applies the configured end-to-end header rules to a
+// backend response before it is copied to the client. Hop-by-hop headers
+// must already have been removed.
+func (p *proxy) filterResponseHeader(header http.Header) {
+	keepOnly(header, p.responseHeaderAllow)
+	dedupeHeaders(header, p.dedupeHeaders)
+	if p.stripAltSvc {
+		header.Del("Alt-Svc")
+	}
+	for _, name := range p.stripResponseHeaders {
+		header.Del(name)
+	}
+	switch p.serverHeader {
+	case "":
+	case "-":
+		header.Del("Server")
+	default:
+		header.Set("Server", p.serverHeader)
+	}
+	p.securityHeaders.apply(header)
+}
+
+func (p *proxy) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	log := p.log().With("remote", req.RemoteAddr, "method", req.Method, "URL", req.URL)
+	log.Info("Incoming Request")
+
+	if p.metrics != nil {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: wr}
+		// Tunnels count their own bytes, whether hijacked or streamed.
+		var body *countingBody
+		if req.Body != nil && req.Method != http.MethodConnect {
+			body = &countingBody{ReadCloser: req.Body}
+			req.Body = body
+		}
+		defer func() {
+			p.metrics.observe(req.Method, sw.status, targetHost(req), time.Since(start))
+			if req.Method != http.MethodConnect {
+				var up int64
+				if body != nil {
+					up = body.n
+				}
+				p.metrics.addBytes(up, sw.bytes)
+			}
+		}()
+		wr = sw
+	}
+
+	if p.accessLog != nil {
+		var entry *accessEntry
+		entry, req = p.accessLog.begin(req)
+		sw := &statusWriter{ResponseWriter: wr}
+		var body *countingBody
+		if req.Body != nil && req.Method != http.MethodConnect {
+			body = &countingBody{ReadCloser: req.Body}
+			req.Body = body
+		}
+		defer func() {
+			if sw.status != 0 {
+				entry.status = sw.status
+			}
+			if body != nil {
+				entry.up.Add(body.n)
+			}
+			if req.Method != http.MethodConnect {
+				entry.down.Add(sw.bytes)
+			}
+			entry.dest = req.URL.Host
+			if entry.dest == "" {
+				entry.dest = req.Host
+			}
+			p.accessLog.write(entry)
+		}()
+		wr = sw
+	}
+
+	if p.stats != nil {
+		defer p.stats.begin()()
+		sw := &statusWriter{ResponseWriter: wr}
+		wr = sw
+		var body *countingBody
+		if req.Body != nil {
+			body = &countingBody{ReadCloser: req.Body}
+			req.Body = body
+		}
+		defer func() {
+			n := sw.bytes
+			if body != nil {
+				n += body.n
+			}
+			p.stats.addBytes(n)
+		}()
+	}
+
+	if p.tracer != nil {
+		span := p.tracer.start(req)
+		sw := &statusWriter{ResponseWriter: wr}
+		defer func() { span.finish(sw.status) }()
+		wr = sw
+	}
+
+	if isH2CPreface(req) {
+		log.Warn("refusing HTTP/2 prior knowledge, h2c is not enabled")
+		wr.Header().Set("Connection", "close")
+		http.Error(wr, "HTTP/2 without TLS (h2c) is not enabled on this listener, see -h2c", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	if isServerWideOptions(req) {
+		p.serveOptions(wr)
+		return
+	}
+
+	if p.isEchoRequest(req) {
+		p.serveEcho(wr, req)
+		return
+	}
+
+	if p.isPACRequest(req) {
+		p.servePAC(wr, req)
+		return
+	}
+
+	if viaContains(req.Header, p.via) {
+		logBlocked(log, req, blockReasonLoop, "Via contains "+p.via)
+		http.Error(wr, "Loop Detected", http.StatusLoopDetected)
+		return
+	}
+
+	user, ok := p.requireAuth(wr, req)
+	if user != "" {
+		log = log.With("user", user)
+		accessEntryFrom(req).setUser(user)
+	}
+	if !ok {
+		log.Warn("client failed proxy authentication")
+		return
+	}
+
+	if req.Method != http.MethodConnect {
+		// Rules run first so that rewritten URLs are the ones checked.
+		if wr, ok = p.rules.apply(wr, req, log); !ok {
+			return
+		}
+	}
+
+	if rule, ok := p.blocklist.match(targetHost(req)); ok {
+		p.serveBlocked(wr, req, log, rule)
+		return
+	}
+
+	if rule, ok := p.checkACL(req, p.aclTarget(req)); !ok {
+		logBlocked(log, req, blockReasonACL, rule)
+		http.Error(wr, "Forbidden", http.StatusForbidden)
+		return
+	}
+	req = p.acl.pin(req, p.aclTarget(req))
+
+	if rule, blocked := p.routeBlocks(p.aclTarget(req)); blocked {
+		logBlocked(log, req, blockReasonRoute, rule)
+		http.Error(wr, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	country := p.geo.country(req.RemoteAddr)
+	if !p.geo.permits(country) {
+		rule := "country " + country
+		if country == "" {
+			rule = "country unknown"
+		}
+		logBlocked(log, req, blockReasonGeo, rule)
+		http.Error(wr, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if rule, wait, over := p.overRateLimit(req, user); over {
+		log.Warn("client over -rate-limit", "rule", rule, "retry", wait)
+		wr.Header().Set("Retry-After", p.retryAfter(wait))
+		http.Error(wr, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+	req = p.shapeBandwidth(req, user)
+
+	if p.quota != nil {
+		client, _ := remoteHost(req.RemoteAddr)
+		if wait, over := p.quota.exceeded(client); over {
+			log.Warn("client over byte quota", "client", client, "reset", wait)
+			wr.Header().Set("Retry-After", p.retryAfter(wait))
+			http.Error(wr, "Transfer quota exceeded", http.StatusTooManyRequests)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: wr}
+		wr = sw
+		var body *countingBody
+		if req.Body != nil {
+			body = &countingBody{ReadCloser: req.Body}
+			req.Body = body
+		}
+		defer func() {
+			n := sw.bytes
+			if body != nil {
+				n += body.n
+			}
+			p.quota.add(client, n)
+		}()
+	}
+
+	if p.faults.apply(wr, req, log) {
+		return
+	}
+
+	if proto := masqueProtocol(req); proto != "" {
+		log.Warn("unsupported tunnel protocol", "protocol", proto)
+		http.Error(wr, "tunnel protocol "+proto+" is not supported", http.StatusNotImplemented)
+		return
+	}
+
+	if strings.ToUpper(req.Method) == "CONNECT" {
+		if p.noConnect {
+			logBlocked(log, req, blockReasonMethod, "-no-connect")
+			wr.Header().Set("Allow", p.allowedMethods())
+			http.Error(wr, "CONNECT is disabled", http.StatusMethodNotAllowed)
+			return
+		}
+		if !p.waitGlobalRate(wr, req, log) {
+			return
+		}
+		p.serveConnect(wr, req, user, log)
+		return
+	}
+
+	if err := checkFraming(req); err != nil {
+		logBlocked(log, req, blockReasonFraming, err.Error())
+		wr.Header().Set("Connection", "close")
+		http.Error(wr, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	if err := checkHeaderValues(req.Header); err != nil {
+		logBlocked(log, req, blockReasonFraming, err.Error())
+		wr.Header().Set("Connection", "close")
+		http.Error(wr, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	if !expectationSupported(req.Header) {
+		log.Warn("unsupported expectation", "expect", req.Header.Values("Expect"))
+		http.Error(wr, "Expectation Failed", http.StatusExpectationFailed)
+		return
+	}
+
+	if err := checkHeaderCounts(req, p.maxRequestHeaders, p.maxCookies); err != nil {
+		logBlocked(log, req, blockReasonLimits, err.Error())
+		wr.Header().Set("Connection", "close")
+		http.Error(wr, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if !p.limitBody(wr, req, log) {
+		return
+	}
+
+	if p.honorMethodOverride {
+		if err := applyMethodOverride(req); err != nil {
+			log.Warn("bad method override", "error", err)
+			http.Error(wr, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if d, ok, err := p.timeoutOverride.timeout(req); err != nil {
+		log.Warn("ignoring upstream timeout header", "error", err)
+	} else if ok {
+		ctx, cancel := context.WithTimeout(req.Context(), d)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	backend, ok := p.headerBackend(wr, req, log)
+	if !ok {
+		return
+	}
+	if backend == nil && p.reverseMode() {
+		backend = p.selectBackend(req)
+		switch {
+		case backend == nil && p.forwardUnmatched && req.URL.IsAbs():
+			// A proxy request for somewhere no route covers is
+			// forwarded as it stands.
+		case backend == nil:
+			http.NotFound(wr, req)
+			return
+		case p.abSplit != nil:
+			variant, b := p.abSplit.choose(req)
+			if b != nil {
+				backend = b
+			}
+			if p.abSplit.header != "" {
+				wr.Header().Set(p.abSplit.header, variant)
+			}
+		}
+	}
+	// What the client asked for, before a backend's host replaces it.
+	host := req.Host
+	addClient := p.forwarded.scrub(req.Header, req.RemoteAddr)
+	if backend != nil {
+		p.rewriteToBackend(req, backend)
+	}
+
+	client := p.client
+	grpc := isGRPC(req)
+	upgrade := upgradeProtocol(req)
+	if grpc && p.grpcClient != nil {
+		client = p.grpcClient
+	}
+	if upgrade != "" && client.Timeout > 0 {
+		// -request-timeout would cut the switched connection off.
+		c := *client
+		c.Timeout = 0
+		client = &c
+	}
+
+	//http: Request.RequestURI can't be set in client requests.
+	//http://golang.org/src/pkg/net/http/client.go
+	req.RequestURI = ""
+
+	delHopHeaders(req.Header)
+	if grpc {
+		// TE is hop-by-hop, but gRPC backends require "TE: trailers".
+		req.Header.Set("Te", "trailers")
+	}
+	if upgrade != "" {
+		// The switch is end to end, so it is asked for again.
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", upgrade)
+	}
+	normalizeFraming(req)
+	applyRefererPolicy(req.Header, p.stripReferer, p.refererPolicy)
+	p.filterRequestHeader(req.Header)
+	addVia(req.Header, req.ProtoMajor, req.ProtoMinor, p.via)
+
+	if p.noXFF {
+		for _, name := range forwardingHeaders {
+			req.Header.Del(name)
+		}
+	} else {
+		if hops := forwardedFor(req.Header); p.maxForwardHops > 0 && len(hops) > p.maxForwardHops {
+			if !p.truncateForwardHops {
+				logBlocked(log, req, blockReasonLoop, fmt.Sprintf("X-Forwarded-For has %d hops, max %d", len(hops), p.maxForwardHops))
+				http.Error(wr, "Too many forwarding hops, proxy loop suspected", http.StatusBadGateway)
+				return
+			}
+			req.Header.Set("X-Forwarded-For", strings.Join(hops[len(hops)-p.maxForwardHops:], ", "))
+		}
+
+		clientIP, err := remoteHost(req.RemoteAddr)
+		if err != nil {
+			log.Debug("RemoteAddr has no port, using it as-is", "error", err)
+		}
+		if clientIP != "" && addClient {
+			appendHostToXForwardHeader(req.Header, clientIP)
+		}
+		if backend == nil && p.forwarded != nil && p.forwarded.protoHost {
+			p.forwarded.setProtoHost(req.Header, req, host)
+		}
+		p.forwarded.addForwarded(req.Header, req, host, clientIP, addClient)
+	}
+	if p.geo != nil {
+		req.Header.Del(geoHeader)
+		if country != "" {
+			req.Header.Set(geoHeader, country)
+		}
+	}
+
+	if p.adapter != nil && req.Body != nil && req.Body != http.NoBody {
+		body, modified, err := p.adapter.adapt(req.Context(), "request", req.URL.String(), req.Header, req.Body)
+		if err != nil {
+			p.adaptFailed(wr, req, log, err)
+			return
+		}
+		req.Body = body
+		if modified {
+			req.ContentLength = -1
+		}
+	}
+
+	if p.mirror != nil {
+		p.mirror.send(req, p.metrics, log)
+	}
+
+	cacheKey := ""
+	if p.stale != nil && upgrade == "" {
+		cacheKey = staleKey(req)
+	}
+
+	if p.replay != nil {
+		p.replay.serve(wr, req, log)
+		return
+	}
+
+	cacheable := upgrade == "" && p.cache.eligible(req)
+	var (
+		cached       *cacheEntry
+		revalidating bool
+	)
+	if cacheable {
+		var usable bool
+		cached, usable = p.cache.lookup(req)
+		switch {
+		case usable:
+			cached.serve(wr, req, p.cacheStatusHeader, log)
+			return
+		case onlyIfCached(req):
+			setCacheStatus(wr.Header(), p.cacheStatusHeader, cacheMiss)
+			http.Error(wr, "Not in cache", http.StatusGatewayTimeout)
+			log.Info("Response", "status", http.StatusGatewayTimeout, "cache", cacheMiss)
+			return
+		case cached != nil:
+			revalidating = revalidate(req, cached)
+		}
+	}
+
+	if !p.waitGlobalRate(wr, req, log) {
+		return
+	}
+
+	if p.onRequest != nil {
+		if resp := p.onRequest(req); resp != nil {
+			p.serveHookResponse(wr, req, resp, log)
+			return
+		}
+	}
+
+	debug := p.debugSample.sampled()
+	if debug {
+		log = log.With("debug_sample", true)
+		var timing *requestTiming
+		req, timing = traceTiming(req)
+		defer timing.log(log)
+	}
+
+	capture := p.bodyLog.start(req)
+	if capture == nil && debug {
+		capture = p.debugSample.bodyLog.start(req)
+	}
+	defer capture.log(log)
+	rec := p.recorder.start(req)
+	captured := p.capture.start(req, host)
+
+	// The request body is streamed to the backend as the client sends it:
+	// nothing above reads it ahead except the mirror (up to
+	// -mirror-max-body) and the adapter (spooled to disk). Bodies of unknown
+	// length go out chunked, so no Content-Length is needed.
+	start := time.Now()
+	resp, err := p.roundTrip(client, req, log)
+	// A client hanging up says nothing about the backend.
+	if req.Context().Err() == nil {
+		p.pool.observe(backend, time.Since(start), err != nil)
+	}
+	if err != nil {
+		if cacheKey != "" {
+			if e := p.stale.get(cacheKey); e != nil {
+				log.Warn("backend unreachable, serving stale response", "error", err, "age", time.Since(e.stored))
+				e.serve(wr, p.cacheStatusHeader)
+				return
+			}
+		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			logBlocked(log, req, blockReasonLimits, "-max-body-bytes")
+			http.Error(wr, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if fdExhausted(err) {
+			logFDExhausted(log, err)
+			wr.Header().Set("Retry-After", p.retryAfter(0))
+			http.Error(wr, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			p.serveGatewayError(wr, req, "Backend closed the connection without sending a response", err)
+			log.Error("backend sent no response", "backend", req.URL.Host, "error", err)
+			return
+		}
+		p.serveGatewayError(wr, req, "Server Error performing request", err)
+		log.Error("client request failed", "error", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if upgrade != "" && resp.StatusCode == http.StatusSwitchingProtocols {
+		p.serveUpgrade(wr, req, resp, log)
+		return
+	}
+
+	if revalidating && resp.StatusCode == http.StatusNotModified {
+		delHopHeaders(resp.Header)
+		p.filterResponseHeader(resp.Header)
+		log.Debug("cached response revalidated", "url", cached.URL)
+		// The conditions were the proxy's, not the client's.
+		req.Header.Del("If-None-Match")
+		req.Header.Del("If-Modified-Since")
+		p.cache.refresh(cached, resp, start).serve(wr, req, p.cacheStatusHeader, log)
+		return
+	}
+	if cached != nil && resp.StatusCode != http.StatusNotModified && resp.StatusCode < http.StatusInternalServerError {
+		p.cache.drop(cached)
+	}
+	if p.cache != nil && !isSafeMethod(req.Method) && resp.StatusCode < http.StatusBadRequest {
+		p.cache.invalidate(req, resp)
+	}
+
+	if p.forceIdentity && bodyAllowed(req.Method, resp.StatusCode) {
+		if err := decodeIdentity(resp, p.decompressionLimits); err != nil {
+			http.Error(wr, "Bad Gateway", http.StatusBadGateway)
+			log.Error("decoding backend response", "error", err)
+			return
+		}
+	}
+
+	if p.adapter != nil && bodyAllowed(req.Method, resp.StatusCode) {
+		body, modified, err := p.adapter.adapt(req.Context(), "response", req.URL.String(), resp.Header, resp.Body)
+		if err != nil {
+			p.adaptFailed(wr, req, log, err)
+			return
+		}
+		defer body.Close()
+		resp.Body = body
+		if modified {
+			resp.Header.Del("Content-Length")
+			resp.ContentLength = -1
+		}
+	}
+
+	if p.transformer != nil && bodyAllowed(req.Method, resp.StatusCode) {
+		if err := p.transformer.transform(req.Context(), resp, req.URL.String()); err != nil {
+			http.Error(wr, "Response transformation failed", http.StatusBadGateway)
+			log.Error("response transformation failed", "error", err)
+			return
+		}
+	}
+
+	if p.bufferResponses > 0 && bodyAllowed(req.Method, resp.StatusCode) {
+		if err := bufferResponse(resp, p.bufferResponses); err != nil {
+			http.Error(wr, "Backend failed while sending the response", http.StatusBadGateway)
+			log.Error("backend response failed", "backend", req.URL.Host, "error", err)
+			return
+		}
+	}
+
+	if p.onResponse != nil {
+		p.onResponse(resp)
+	}
+
+	capture.wrapResponse(resp)
+	rec.wrapResponse(resp)
+	captured.wrapResponse(resp)
+
+	log.Info("Response", "status", resp.Status)
+
+	if cacheKey != "" && (resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusGatewayTimeout) {
+		if e := p.stale.get(cacheKey); e != nil {
+			log.Warn("backend failed, serving stale response", "status", resp.Status, "age", time.Since(e.stored))
+			e.serve(wr, p.cacheStatusHeader)
+			return
+		}
+	}
+
+	delHopHeaders(resp.Header)
+	p.filterResponseHeader(resp.Header)
+	addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor, p.via)
+
+	copyHeader(wr.Header(), resp.Header)
+	if p.stale != nil || p.cache != nil {
+		if cacheKey != "" || cacheable {
+			setCacheStatus(wr.Header(), p.cacheStatusHeader, cacheMiss)
+		} else {
+			setCacheStatus(wr.Header(), p.cacheStatusHeader, cacheBypass)
+		}
+	}
+	// A backend body delimited by closing the connection arrives with
+	// ContentLength -1 and no Content-Length header, so net/http frames it
+	// for the client itself: chunked for HTTP/1.1, close-delimited for
+	// HTTP/1.0. The client connection stays reusable either way.
+	wr.WriteHeader(resp.StatusCode)
+
+	if !bodyAllowed(req.Method, resp.StatusCode) {
+		rec.finish(resp, log)
+		captured.finish(resp, nil, log)
+		return
+	}
+
+	var (
+		dst  io.Writer = wr
+		body io.Reader = shaperFor(req).reader(resp.Body)
+		buf  *cappedBuffer
+	)
+	if grpc {
+		dst = newFlushWriter(wr)
+	}
+	if cacheKey != "" && staleStorable(req, resp) {
+		buf = &cappedBuffer{max: p.stale.maxBody}
+		body = io.TeeReader(body, buf)
+	}
+	var fill *cacheFill
+	if p.cache.storable(req, resp) {
+		fill = p.cache.fill(req, resp, start)
+		body = io.TeeReader(body, fill)
+	}
+
+	_, err = io.Copy(dst, body)
+	if errors.Is(err, errDecompressionLimit) {
+		// Abort rather than end the body cleanly, so the client can't
+		// take the truncated response for a complete one.
+		log.Warn("aborting response", "error", err)
+		panic(http.ErrAbortHandler)
+	}
+	copyTrailers(wr, resp.Trailer)
+	if err == nil {
+		rec.finish(resp, log)
+	}
+	captured.finish(resp, err, log)
+	if fill != nil {
+		fill.finish(err == nil)
+	}
+
+	if buf != nil && err == nil && !buf.overflow {
+		p.stale.put(cacheKey, &staleEntry{
+			status: resp.StatusCode,
+			header: resp.Header.Clone(),
+			body:   buf.Bytes(),
+			stored: time.Now(),
+		})
+	}
+}
+
+// logLevel is the minimum level logged, which the admin API can change.
+var logLevel = new(slog.LevelVar)
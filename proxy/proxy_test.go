@@ -0,0 +1,287 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	os.Exit(m.Run())
+}
+
+// newTestProxy returns the proxy args configure, as New builds it. Its
+// tunnels may reach any port, since test servers listen on random ones,
+// unless args give -connect-ports.
+func newTestProxy(t *testing.T, args ...string) *Proxy {
+	t.Helper()
+	p, err := New(WithFlags(append([]string{"-connect-ports", "*"}, args...)...))
+	if err != nil {
+		t.Fatalf("New(%q): %v", args, err)
+	}
+	return p
+}
+
+// serve sends a request for url through h with the header lines given as
+// "Name: value", and returns the recorded response.
+func serve(h http.Handler, method, url string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, nil)
+	for _, line := range header {
+		name, value, _ := strings.Cut(line, ":")
+		req.Header.Add(name, strings.TrimSpace(value))
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// countingBackend is a test backend that counts the requests it gets and
+// keeps the last one.
+type countingBackend struct {
+	*httptest.Server
+	hits int
+	last *http.Request
+}
+
+func newCountingBackend(t *testing.T, h http.HandlerFunc) *countingBackend {
+	t.Helper()
+	b := &countingBackend{}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		b.hits++
+		b.last = req
+		h(wr, req)
+	}))
+	t.Cleanup(b.Close)
+	return b
+}
+
+func readBody(t *testing.T, r io.Reader) string {
+	t.Helper()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// scrape returns the proxy's metrics page; it needs -metrics-addr.
+func scrape(t *testing.T, p *Proxy) string {
+	t.Helper()
+	m := p.l.handler.metrics
+	if m == nil {
+		t.Fatal("metrics not enabled")
+	}
+	return serve(m, "GET", "http://metrics.test/metrics").Body.String()
+}
+
+// serveBody is serve for a request with a body and no extra headers.
+func serveBody(h http.Handler, method, url string, body io.Reader) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, url, body))
+	return rec
+}
+
+// waitFor polls cond until it holds, failing the test after five seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+	}
+}
+
+// headerBackend is a backend answering with the header lines given.
+func headerBackend(t *testing.T, header ...string) *countingBackend {
+	t.Helper()
+	return newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		for _, line := range header {
+			name, value, _ := strings.Cut(line, ": ")
+			wr.Header().Add(name, value)
+		}
+	})
+}
+
+func TestAltSvc(t *testing.T) {
+	b := headerBackend(t, `Alt-Svc: h3=":443"; ma=86400`)
+	if rec := serve(newTestProxy(t, "-backend", b.URL), "GET", "http://front.test/"); rec.Header().Get("Alt-Svc") == "" {
+		t.Error("Alt-Svc not passed through by default")
+	}
+	if rec := serve(newTestProxy(t, "-backend", b.URL, "-strip-alt-svc"), "GET", "http://front.test/"); rec.Header().Get("Alt-Svc") != "" {
+		t.Error("Alt-Svc passed through with -strip-alt-svc")
+	}
+}
+
+func TestDedupeHeaders(t *testing.T) {
+	b := headerBackend(t, "X-Single: one", "X-Single: two", "X-Multi: a", "X-Multi: b")
+	p := newTestProxy(t, "-backend", b.URL, "-dedupe-headers", "-dedupe-header-list", "X-Single,Content-Type")
+	rec := serve(p, "GET", "http://front.test/", "Content-Type: text/plain", "Content-Type: text/html", "X-Multi: 1", "X-Multi: 2")
+
+	if got := b.last.Header.Values("Content-Type"); len(got) != 1 || got[0] != "text/plain" {
+		t.Errorf("request Content-Type = %q, want the first", got)
+	}
+	if got := b.last.Header.Values("X-Multi"); len(got) != 2 {
+		t.Errorf("unlisted request header X-Multi = %q, want both", got)
+	}
+	if got := rec.Header().Values("X-Single"); len(got) != 1 || got[0] != "one" {
+		t.Errorf("response X-Single = %q, want the first", got)
+	}
+	if got := rec.Header().Values("X-Multi"); len(got) != 2 {
+		t.Errorf("unlisted response header X-Multi = %q, want both", got)
+	}
+}
+
+func TestHeaderAllowlists(t *testing.T) {
+	b := headerBackend(t, "Content-Type: text/plain", "Cache-Control: no-store", "Set-Cookie: id=1", "X-Debug: on")
+	p := newTestProxy(t, "-backend", b.URL, "-request-header-allowlist", "accept, authorization", "-response-header-allowlist", "Cache-Control")
+	rec := serve(p, "GET", "http://front.test/", "Accept: */*", "Authorization: Bearer x", "Cookie: id=1", "Referer: http://elsewhere.test/", "X-Forwarded-For: 192.0.2.1")
+
+	for name, want := range map[string]string{"Accept": "*/*", "Authorization": "Bearer x", "Cookie": "", "Referer": "", "User-Agent": ""} {
+		if got := b.last.Header.Get(name); got != want {
+			t.Errorf("backend got %s %q, want %q", name, got, want)
+		}
+	}
+	for name, want := range map[string]string{"Content-Type": "text/plain", "Cache-Control": "no-store", "Set-Cookie": "", "X-Debug": ""} {
+		if got := rec.Header().Get(name); got != want {
+			t.Errorf("client got %s %q, want %q", name, got, want)
+		}
+	}
+
+	// Without allowlists everything end-to-end passes.
+	rec = serve(newTestProxy(t, "-backend", b.URL), "GET", "http://front.test/", "Cookie: id=1")
+	if b.last.Header.Get("Cookie") == "" || rec.Header().Get("X-Debug") == "" {
+		t.Error("headers dropped with no allowlist set")
+	}
+}
+
+func TestServerHeader(t *testing.T) {
+	b := headerBackend(t, "Server: Apache/2.4.1 (Unix)", "X-Powered-By: PHP/8.1", "X-AspNet-Version: 4.0", "X-Kept: yes")
+	for _, tt := range []struct {
+		args   []string
+		server string
+	}{
+		{nil, "Apache/2.4.1 (Unix)"},
+		{[]string{"-server-header", "-"}, ""},
+		{[]string{"-server-header", "minprox"}, "minprox"},
+	} {
+		p := newTestProxy(t, append([]string{"-backend", b.URL, "-strip-response-headers", "x-powered-by, X-AspNet-Version"}, tt.args...)...)
+		h := serve(p, "GET", "http://front.test/").Header()
+		if got := h.Values("Server"); len(got) > 1 || h.Get("Server") != tt.server {
+			t.Errorf("%q: Server = %q, want %q", tt.args, got, tt.server)
+		}
+		if h.Get("X-Powered-By") != "" || h.Get("X-AspNet-Version") != "" || h.Get("X-Kept") != "yes" {
+			t.Errorf("%q: stripping left %v", tt.args, h)
+		}
+	}
+}
+
+func TestBackendClosesWithoutResponse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// Closing only once the request is in, so the transport doesn't
+			// take it for an idle connection closed before use.
+			bufio.NewReader(conn).ReadString('\n')
+			conn.Close()
+		}
+	}()
+
+	logger, logs := newTestLogger()
+	p, err := New(WithFlags("-backend", "http://"+ln.Addr().String()), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := serve(p, "GET", "http://front.test/")
+	if rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), "without sending a response") {
+		t.Errorf("got %d %q, want 502 saying the backend sent nothing", rec.Code, rec.Body)
+	}
+	if want := "backend=" + ln.Addr().String(); !strings.Contains(logs.String(), want) {
+		t.Errorf("log lacks %s:\n%s", want, logs)
+	}
+}
+
+// TestRequestBodyStreams sends the rest of a chunked upload only once the
+// backend has the start of it, which no proxy buffering the body could
+// pass.
+func TestRequestBodyStreams(t *testing.T) {
+	started := make(chan struct{})
+	var received int64
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		buf := make([]byte, 1<<16)
+		n, _ := io.ReadAtLeast(req.Body, buf, 1)
+		close(started)
+		rest, _ := io.Copy(io.Discard, req.Body)
+		received = int64(n) + rest
+	})
+	p := newTestProxy(t, "-backend", b.URL)
+
+	pr, pw := io.Pipe()
+	const chunk, chunks = 1 << 20, 32
+	go func() {
+		pw.Write(make([]byte, chunk))
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			pw.CloseWithError(errors.New("backend never saw the start of the body"))
+			return
+		}
+		for range chunks - 1 {
+			pw.Write(make([]byte, chunk))
+		}
+		pw.Close()
+	}()
+	if rec := serveBody(p, "POST", "http://front.test/upload", pr); rec.Code != http.StatusOK {
+		t.Fatalf("upload got %d %s", rec.Code, rec.Body)
+	}
+	if received != chunk*chunks {
+		t.Errorf("backend received %d bytes, want %d", received, chunk*chunks)
+	}
+	if len(b.last.TransferEncoding) == 0 || b.last.TransferEncoding[0] != "chunked" {
+		t.Errorf("body of unknown length sent with Transfer-Encoding %q, want chunked", b.last.TransferEncoding)
+	}
+}
+
+// logBuffer collects log output, safe for the proxy's goroutines to
+// write.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// newTestLogger returns a logger writing text records to the buffer
+// returned.
+func newTestLogger() (*slog.Logger, *logBuffer) {
+	buf := new(logBuffer)
+	return slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})), buf
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a load balancer may take to send the
+// PROXY protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts every PROXY protocol version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoListener reads the PROXY protocol header, version 1 or 2,
+// that load balancers in trusted send ahead of each connection, so the
+// client they relay is the connection's remote address for the logs,
+// ACLs, limits and X-Forwarded-For. Connections from other peers are
+// served as they are, and can't claim an address. Peers on a Unix socket
+// are trusted, its file permissions having let them in.
+type proxyProtoListener struct {
+	net.Listener
+	trusted []netip.Prefix
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusts(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyProtoConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (l *proxyProtoListener) trusts(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	ip := tcp.AddrPort().Addr().Unmap()
+	for _, p := range l.trusted {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtoConn is a connection from a trusted load balancer. The header
+// is read on first use, in the goroutine serving the connection, so a slow
+// balancer holds up only its own connection; one that sends no valid
+// header is dropped.
+type proxyProtoConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		addr, err := readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			slog.Warn("bad PROXY protocol header, closing connection", "peer", c.remote.String(), "error", err)
+			c.err = err
+			c.Conn.Close()
+			return
+		}
+		if addr != nil {
+			c.remote = addr
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client the load balancer relays, or the balancer
+// itself for its own health checks.
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// CloseWrite half-closes the connection, for tunnels.
+func (c *proxyProtoConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// NetConn returns the underlying connection, for socket options.
+func (c *proxyProtoConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// readProxyHeader reads a PROXY protocol header off r and returns the
+// source address it gives, or nil if it gives none: a version 2 LOCAL
+// connection, an UNKNOWN one, or a family other than TCP over IPv4 or
+// IPv6.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		return readProxyV2(r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyV1(r)
+	}
+	return nil, errors.New("no PROXY protocol header")
+}
+
+// readProxyV1 reads the text form, "PROXY TCP4 SRC DST SPORT DPORT\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// The longest valid line is 107 bytes.
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("malformed version 1 header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed version 1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("version 1 source address: %w", err)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("version 1 source port: %w", err)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// readProxyV2 reads the binary form: the signature, version and command,
+// address family, length, then the addresses and any TLVs, which are
+// skipped.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var head [16]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	if head[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", head[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch head[12] & 0xf {
+	case 0:
+		// LOCAL: the balancer's own connection, such as a health check.
+		return nil, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("unknown version 2 command %d", head[12]&0xf)
+	}
+
+	var ip netip.Addr
+	var port []byte
+	switch head[13] >> 4 {
+	case 1:
+		if len(body) < 12 {
+			return nil, errors.New("short version 2 IPv4 addresses")
+		}
+		ip, port = netip.AddrFrom4([4]byte(body[:4])), body[8:10]
+	case 2:
+		if len(body) < 36 {
+			return nil, errors.New("short version 2 IPv6 addresses")
+		}
+		ip, port = netip.AddrFrom16([16]byte(body[:16])), body[32:34]
+	default:
+		return nil, nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(port))), nil
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2 builds a version 2 header for cmd that relays src to dst.
+func proxyV2(cmd byte, src, dst netip.AddrPort) []byte {
+	family, body := byte(0x11), append(src.Addr().AsSlice(), dst.Addr().AsSlice()...)
+	if src.Addr().Is6() {
+		family = 0x21
+	}
+	body = binary.BigEndian.AppendUint16(body, src.Port())
+	body = binary.BigEndian.AppendUint16(body, dst.Port())
+	h := append([]byte(nil), proxyV2Signature...)
+	h = append(h, 0x20|cmd, family)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(body)))
+	return append(h, body...)
+}
+
+// forwardedThrough sends header and then a GET for url over a new
+// connection to the proxy at addr, returning the X-Forwarded-For the
+// backend saw, or an error if the proxy answered nothing.
+func forwardedThrough(t *testing.T, addr, url string, header []byte) (string, error) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	host, _, _ := strings.Cut(strings.TrimPrefix(url, "http://"), "/")
+	conn.Write(append(header, "GET "+url+" HTTP/1.1\r\nHost: "+host+"\r\nConnection: close\r\n\r\n"...))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	return readBody(t, resp.Body), nil
+}
+
+func TestProxyProtocol(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		io.WriteString(wr, req.Header.Get("X-Forwarded-For"))
+	})
+	client := netip.MustParseAddrPort("192.0.2.7:5000")
+	addr, _, _ := startRun(t, time.Second, "-proxy-protocol", "127.0.0.0/8")
+	for _, tt := range []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"version 1", "PROXY TCP4 192.0.2.7 127.0.0.1 5000 80\r\n", "192.0.2.7"},
+		{"version 1 IPv6", "PROXY TCP6 2001:db8::7 ::1 5000 80\r\n", "2001:db8::7"},
+		{"version 1 UNKNOWN", "PROXY UNKNOWN\r\n", "127.0.0.1"},
+		{"version 2", string(proxyV2(1, client, netip.MustParseAddrPort("127.0.0.1:80"))), "192.0.2.7"},
+		{"version 2 LOCAL", string(proxyV2(0, client, netip.MustParseAddrPort("127.0.0.1:80"))), "127.0.0.1"},
+	} {
+		if got, err := forwardedThrough(t, addr, b.URL+"/", []byte(tt.header)); err != nil || got != tt.want {
+			t.Errorf("%s: backend saw X-Forwarded-For %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	// A trusted peer that sends no header is dropped unanswered.
+	if got, err := forwardedThrough(t, addr, b.URL+"/", nil); err == nil {
+		t.Errorf("request without a header answered, backend saw %q", got)
+	}
+
+	// Other peers can't claim an address.
+	addr, _, _ = startRun(t, time.Second, "-proxy-protocol", "192.0.2.0/24")
+	if got, err := forwardedThrough(t, addr, b.URL+"/", nil); err != nil || got != "127.0.0.1" {
+		t.Errorf("untrusted peer: backend saw %q, %v; want 127.0.0.1", got, err)
+	}
+	hits := b.hits
+	forwardedThrough(t, addr, b.URL+"/", []byte("PROXY TCP4 192.0.2.7 127.0.0.1 5000 80\r\n"))
+	if b.hits != hits {
+		t.Error("untrusted peer's PROXY header taken as the client's")
+	}
+
+	if _, err := New(WithFlags("-proxy-protocol", "10.0.0.0/99")); err == nil {
+		t.Error("bad -proxy-protocol prefix accepted")
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	dst := netip.MustParseAddrPort("[2001:db8::1]:443")
+	v2 := proxyV2(1, netip.MustParseAddrPort("[2001:db8::7]:5000"), dst)
+	for _, tt := range []struct {
+		in   string
+		want string
+	}{
+		{"PROXY TCP4 192.0.2.7 192.0.2.1 5000 80\r\nGET", "192.0.2.7:5000"},
+		{"PROXY UNKNOWN ffff::1 ::1 1 2\r\n", ""},
+		{string(v2) + "GET", "[2001:db8::7]:5000"},
+		{string(proxyV2(0, netip.MustParseAddrPort("[2001:db8::7]:5000"), dst)), ""},
+		// A version 2 UNIX family relays no address.
+		{string(proxyV2Signature) + "\x21\x31\x00\x00", ""},
+	} {
+		br := bufio.NewReader(strings.NewReader(tt.in))
+		addr, err := readProxyHeader(br)
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+		if rest, _ := io.ReadAll(br); strings.HasSuffix(tt.in, "GET") && string(rest) != "GET" {
+			t.Errorf("%q: left %q to read, want GET", tt.in, rest)
+		}
+	}
+
+	for _, in := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 192.0.2.7 192.0.2.1 5000 80\n",
+		"PROXY TCP4 192.0.2.7 192.0.2.1 5000\r\n",
+		"PROXY UDP4 192.0.2.7 192.0.2.1 5000 80\r\n",
+		"PROXY TCP4 192.0.2.x 192.0.2.1 5000 80\r\n",
+		"PROXY TCP4 192.0.2.7 192.0.2.1 70000 80\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n",
+		string(v2[:len(v2)-4]),
+		string(proxyV2Signature) + "\x11\x11\x00\x00",
+		string(proxyV2Signature) + "\x22\x11\x00\x00",
+		string(proxyV2Signature) + "\x21\x11\x00\x04abcd",
+	} {
+		if addr, err := readProxyHeader(bufio.NewReader(strings.NewReader(in))); err == nil {
+			t.Errorf("%q accepted as %v", in, addr)
+		}
+	}
+}
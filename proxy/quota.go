@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// quotaTracker counts bytes transferred per client IP over a fixed window
+// that starts with the client's first byte.
+type quotaTracker struct {
+	mu      sync.Mutex
+	limit   int64
+	window  time.Duration
+	clients map[string]*quotaUsage
+	done    chan struct{}
+}
+
+type quotaUsage struct {
+	bytes int64
+	reset time.Time
+}
+
+func newQuotaTracker(limit int64, window time.Duration) *quotaTracker {
+	q := &quotaTracker{
+		limit:   limit,
+		window:  window,
+		clients: make(map[string]*quotaUsage),
+		done:    make(chan struct{}),
+	}
+	go q.sweep()
+	return q
+}
+
+// exceeded reports whether client has used up its quota and, if so, how
+// long until its window resets.
+func (q *quotaTracker) exceeded(client string) (time.Duration, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.clients[client]
+	if u == nil || time.Now().After(u.reset) || u.bytes < q.limit {
+		return 0, false
+	}
+	return time.Until(u.reset), true
+}
+
+// add charges n bytes to client.
+func (q *quotaTracker) add(client string, n int64) {
+	if n <= 0 {
+		return
+	}
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.clients[client]
+	if u == nil || now.After(u.reset) {
+		u = &quotaUsage{reset: now.Add(q.window)}
+		q.clients[client] = u
+	}
+	u.bytes += n
+}
+
+// sweep drops clients whose window has expired so the map doesn't grow
+// without bound, until the tracker is stopped.
+func (q *quotaTracker) sweep() {
+	t := time.NewTicker(q.window)
+	defer t.Stop()
+	for {
+		select {
+		case <-q.done:
+			return
+		case now := <-t.C:
+			q.mu.Lock()
+			for c, u := range q.clients {
+				if now.After(u.reset) {
+					delete(q.clients, c)
+				}
+			}
+			q.mu.Unlock()
+		}
+	}
+}
+
+// stop ends the sweeping.
+func (q *quotaTracker) stop() {
+	if q != nil {
+		close(q.done)
+	}
+}
+
+// retune takes the limit and window of fresh, built by a reload, and
+// stops it, so what clients have used so far counts against the new
+// settings.
+func (q *quotaTracker) retune(fresh *quotaTracker) {
+	fresh.stop()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.limit, q.window = fresh.limit, fresh.window
+}
+
+// countingBody counts the bytes read through it into n.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// meteredConn reports every byte read or written through it to count, so
+// long-lived tunnels are charged as they go.
+type meteredConn struct {
+	net.Conn
+	count func(n int64)
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.count(int64(n))
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.count(int64(n))
+	return n, err
+}
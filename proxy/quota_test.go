@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuota(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		wr.Write(make([]byte, 60))
+	})
+	p := newTestProxy(t, "-backend", b.URL, "-quota-bytes", "100")
+	fetch := func(client string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://front.test/", nil)
+		req.RemoteAddr = client + ":4000"
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if rec := fetch("192.0.2.1"); rec.Code != want {
+			t.Errorf("request %d got %d, want %d", i+1, rec.Code, want)
+		} else if want == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+			t.Error("over quota without a Retry-After")
+		}
+	}
+	if rec := fetch("192.0.2.2"); rec.Code != http.StatusOK {
+		t.Errorf("another client got %d, want its own quota", rec.Code)
+	}
+	if b.hits != 3 {
+		t.Errorf("backend hit %d times, want 3", b.hits)
+	}
+}
+
+func TestQuotaChargesTunnels(t *testing.T) {
+	srv := newProxyServer(t, "-quota-bytes", "100")
+	echo := newEchoServer(t)
+	conn, br, resp := connect(t, srv.Listener.Addr().String(), echo)
+	if resp.StatusCode != http.StatusOK || !echoes(conn, br, strings.Repeat("x", 60)) {
+		t.Fatalf("first tunnel: %s", resp.Status)
+	}
+	conn.Close()
+	// Both directions count, so 60 bytes echoed are 120 charged.
+	waitFor(t, func() bool {
+		_, _, resp := connect(t, srv.Listener.Addr().String(), echo)
+		return resp.StatusCode == http.StatusTooManyRequests
+	})
+}
+
+func TestQuotaWindow(t *testing.T) {
+	q := newQuotaTracker(10, 50*time.Millisecond)
+	defer q.stop()
+	q.add("c", 10)
+	if wait, over := q.exceeded("c"); !over || wait <= 0 || wait > 50*time.Millisecond {
+		t.Errorf("exceeded = %v, %v; want over with the window's remainder", wait, over)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, over := q.exceeded("c"); over {
+		t.Error("still over quota after the window")
+	}
+	q.add("c", 5)
+	if _, over := q.exceeded("c"); over {
+		t.Error("fresh window charged the old usage")
+	}
+}
@@ -0,0 +1,352 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a token bucket refilled at rate tokens per second up to
+// burst. Tokens are reserved ahead: the level may go negative, and the
+// caller waits until its token would have been there.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	b := float64(max(burst, 1))
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+// reserve takes a token and returns how long the caller must wait before
+// using it. If that would be longer than maxWait nothing is taken, ok is
+// false and wait is how long until a token is free.
+func (b *tokenBucket) reserve(maxWait time.Duration) (wait time.Duration, ok bool) {
+	return b.reserveN(1, maxWait)
+}
+
+// reserveN is reserve for n tokens at once.
+func (b *tokenBucket) reserveN(n float64, maxWait time.Duration) (wait time.Duration, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	wait = time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+	if wait > maxWait {
+		return wait, false
+	}
+	b.tokens -= n
+	return max(wait, 0), true
+}
+
+// idle reports whether b has been full for a while, so dropping it
+// changes nothing.
+func (b *tokenBucket) idle(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// waitGlobalRate holds req back until -global-rate allows another outbound
+// request, for up to -global-rate-wait. Past that it answers 503 and
+// returns false.
+func (p *proxy) waitGlobalRate(wr http.ResponseWriter, req *http.Request, log *slog.Logger) bool {
+	if p.globalRate == nil {
+		return true
+	}
+	wait, ok := p.globalRate.reserve(p.globalRateWait)
+	if !ok {
+		log.Warn("over -global-rate, refusing request", "retry", wait)
+		wr.Header().Set("Retry-After", p.retryAfter(wait))
+		http.Error(wr, "Service Unavailable", http.StatusServiceUnavailable)
+		return false
+	}
+	if wait <= 0 {
+		return true
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-req.Context().Done():
+		return false
+	}
+}
+
+// What a -rate-limit or -bandwidth-limit rule keeps a bucket per.
+const (
+	rateKeyIP   = "ip"
+	rateKeyUser = "user"
+	rateKeyHost = "host"
+)
+
+// keyedLimiter is one -rate-limit or -bandwidth-limit rule: a token bucket
+// per client IP, authenticated user or destination host. Unauthenticated
+// clients of a user rule are keyed by IP instead.
+type keyedLimiter struct {
+	rule  string
+	key   string
+	rate  float64
+	burst int
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	done    chan struct{}
+}
+
+// parseKeyedLimiter parses a rule of the form KEY=RATE or KEY=RATE/BURST.
+// Without a burst, one second's worth is allowed at once.
+func parseKeyedLimiter(rule string) (*keyedLimiter, error) {
+	key, spec, ok := strings.Cut(rule, "=")
+	if !ok {
+		return nil, fmt.Errorf("%q is not KEY=RATE", rule)
+	}
+	switch key {
+	case rateKeyIP, rateKeyUser, rateKeyHost:
+	default:
+		return nil, fmt.Errorf("%q: key %q is not ip, user or host", rule, key)
+	}
+	rateText, burstText, hasBurst := strings.Cut(spec, "/")
+	rate, err := strconv.ParseFloat(rateText, 64)
+	if err != nil || rate <= 0 {
+		return nil, fmt.Errorf("%q: bad rate %q", rule, rateText)
+	}
+	burst := int(math.Ceil(rate))
+	if hasBurst {
+		if burst, err = strconv.Atoi(burstText); err != nil || burst <= 0 {
+			return nil, fmt.Errorf("%q: bad burst %q", rule, burstText)
+		}
+	}
+	l := &keyedLimiter{rule: rule, key: key, rate: rate, burst: burst, buckets: make(map[string]*tokenBucket), done: make(chan struct{})}
+	go l.sweep()
+	return l, nil
+}
+
+// bucket returns the bucket req, made by user, counts against.
+func (l *keyedLimiter) bucket(req *http.Request, user string) *tokenBucket {
+	var key string
+	switch {
+	case l.key == rateKeyHost:
+		key = normalizeHost(targetHost(req))
+	case l.key == rateKeyUser && user != "":
+		key = "user:" + user
+	default:
+		key, _ = remoteHost(req.RemoteAddr)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buckets[key]
+	if b == nil {
+		b = newTokenBucket(l.rate, l.burst)
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// sweep drops buckets that have refilled, so the map only holds keys seen
+// lately, until the limiter is stopped.
+func (l *keyedLimiter) sweep() {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case now := <-t.C:
+			l.mu.Lock()
+			for key, b := range l.buckets {
+				if b.idle(now) {
+					delete(l.buckets, key)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// stop ends the sweeping.
+func (l *keyedLimiter) stop() {
+	close(l.done)
+}
+
+// carryLimiters returns fresh, the limiters of a reload, with those whose
+// rule old has too replaced by old's, so their buckets keep their state.
+// The limiters left out are stopped.
+func carryLimiters(old, fresh []*keyedLimiter) []*keyedLimiter {
+	byRule := make(map[string]*keyedLimiter, len(old))
+	for _, l := range old {
+		byRule[l.rule] = l
+	}
+	carried := make([]*keyedLimiter, len(fresh))
+	for i, l := range fresh {
+		if prev, ok := byRule[l.rule]; ok {
+			delete(byRule, l.rule)
+			l.stop()
+			l = prev
+		}
+		carried[i] = l
+	}
+	for _, l := range byRule {
+		l.stop()
+	}
+	return carried
+}
+
+// overRateLimit charges req, made by user, against every -rate-limit rule
+// and reports the first one it is over, with how long until it would
+// pass.
+func (p *proxy) overRateLimit(req *http.Request, user string) (rule string, wait time.Duration, over bool) {
+	for _, l := range p.rateLimits {
+		if wait, ok := l.bucket(req, user).reserve(0); !ok {
+			return l.rule, wait, true
+		}
+	}
+	return "", 0, false
+}
+
+// shapedKey is the context key for the -bandwidth-limit buckets a request
+// and its tunnel are charged to.
+type shapedKey struct{}
+
+// shapeBandwidth returns req carrying the -bandwidth-limit buckets it is
+// charged to, with its body throttled by them.
+func (p *proxy) shapeBandwidth(req *http.Request, user string) *http.Request {
+	if len(p.bandwidthLimits) == 0 {
+		return req
+	}
+	s := &shaper{ctx: req.Context()}
+	for _, l := range p.bandwidthLimits {
+		b := l.bucket(req, user)
+		s.buckets = append(s.buckets, b)
+		if s.chunk == 0 || l.burst < s.chunk {
+			s.chunk = l.burst
+		}
+	}
+	req = req.WithContext(context.WithValue(req.Context(), shapedKey{}, s))
+	if req.Body != nil && req.Body != http.NoBody && req.Method != http.MethodConnect {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{s.reader(req.Body), req.Body}
+	}
+	return req
+}
+
+// shaperFor returns the shaper shapeBandwidth gave req, or nil.
+func shaperFor(req *http.Request) *shaper {
+	s, _ := req.Context().Value(shapedKey{}).(*shaper)
+	return s
+}
+
+// shaper throttles bytes to the rate of its slowest bucket. Transfers are
+// charged in chunks no larger than the smallest burst, so a bucket never
+// has to wait for more than it can hold.
+type shaper struct {
+	ctx     context.Context
+	buckets []*tokenBucket
+	chunk   int
+}
+
+// take waits until every bucket has n bytes to spare.
+func (s *shaper) take(n int) error {
+	var wait time.Duration
+	for _, b := range s.buckets {
+		w, _ := b.reserveN(float64(n), time.Duration(math.MaxInt64))
+		wait = max(wait, w)
+	}
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+// reader returns r throttled by s. A nil s returns r as it is.
+func (s *shaper) reader(r io.Reader) io.Reader {
+	if s == nil {
+		return r
+	}
+	return &shapedReader{r: r, s: s}
+}
+
+type shapedReader struct {
+	r io.Reader
+	s *shaper
+}
+
+func (r *shapedReader) Read(b []byte) (int, error) {
+	if len(b) > r.s.chunk {
+		b = b[:r.s.chunk]
+	}
+	n, err := r.r.Read(b)
+	if werr := r.s.take(n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+// conn returns c, the client side of a tunnel, with both directions
+// throttled by s. A nil s returns c as it is.
+func (s *shaper) conn(c net.Conn) net.Conn {
+	if s == nil {
+		return c
+	}
+	// A tunnel may outlive its request, so only closing it stops the
+	// waits.
+	return &shapedConn{Conn: c, s: &shaper{ctx: context.Background(), buckets: s.buckets, chunk: s.chunk}}
+}
+
+type shapedConn struct {
+	net.Conn
+	s *shaper
+}
+
+func (c *shapedConn) Read(b []byte) (int, error) {
+	if len(b) > c.s.chunk {
+		b = b[:c.s.chunk]
+	}
+	n, err := c.Conn.Read(b)
+	if werr := c.s.take(n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+func (c *shapedConn) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		chunk := b[:min(len(b), c.s.chunk)]
+		if err := c.s.take(len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
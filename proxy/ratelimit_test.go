@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(10, 2)
+	for i := range 2 {
+		if wait, ok := b.reserve(0); !ok || wait != 0 {
+			t.Fatalf("token %d of a burst of 2: wait %v, ok %v", i+1, wait, ok)
+		}
+	}
+	if wait, ok := b.reserve(0); ok || wait <= 0 || wait > 100*time.Millisecond {
+		t.Errorf("over the burst with no wait allowed: wait %v, ok %v; want refused, about 100ms", wait, ok)
+	}
+	// Waiting is allowed up to maxWait, reserving the token ahead.
+	if wait, ok := b.reserve(time.Second); !ok || wait <= 0 {
+		t.Errorf("over the burst with 1s allowed: wait %v, ok %v", wait, ok)
+	}
+	if b.idle(time.Now()) || !b.idle(time.Now().Add(time.Second)) {
+		t.Error("idle doesn't track the bucket refilling")
+	}
+}
+
+// TestGlobalRate sends from many clients at once; they share one budget.
+func TestGlobalRate(t *testing.T) {
+	b := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {}))
+	defer b.Close()
+	p := newTestProxy(t, "-backend", b.URL, "-global-rate", "10", "-global-burst", "5", "-global-rate-wait", "0")
+	var passed int
+	for i := range 30 {
+		req := httptest.NewRequest("GET", "http://front.test/", nil)
+		req.RemoteAddr = fmt.Sprintf("192.0.2.%d:4000", i+1)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		switch rec.Code {
+		case http.StatusOK:
+			passed++
+		case http.StatusServiceUnavailable:
+			if rec.Header().Get("Retry-After") == "" {
+				t.Error("503 without Retry-After")
+			}
+		default:
+			t.Errorf("got %d", rec.Code)
+		}
+	}
+	if passed < 5 || passed > 7 {
+		t.Errorf("%d of 30 requests from 30 clients passed, want the burst of 5", passed)
+	}
+
+	// Requests over the rate wait their turn while -global-rate-wait allows.
+	p = newTestProxy(t, "-backend", b.URL, "-global-rate", "20", "-global-burst", "1")
+	start := time.Now()
+	for range 5 {
+		if rec := serve(p, "GET", "http://front.test/"); rec.Code != http.StatusOK {
+			t.Errorf("waiting request got %d", rec.Code)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("5 requests at 20/s with a burst of 1 took %v, want about 200ms", elapsed)
+	}
+}
+
+func TestGlobalRateChargesTunnels(t *testing.T) {
+	p := newTestProxy(t, "-global-rate", "0.01", "-global-burst", "1", "-global-rate-wait", "0")
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	echo := newEchoServer(t)
+	if _, _, resp := connect(t, srv.Listener.Addr().String(), echo); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first CONNECT got %s", resp.Status)
+	}
+	if _, _, resp := connect(t, srv.Listener.Addr().String(), echo); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("CONNECT over -global-rate got %s, want 503", resp.Status)
+	}
+}
+
+func TestParseKeyedLimiter(t *testing.T) {
+	for _, tt := range []struct {
+		rule  string
+		key   string
+		rate  float64
+		burst int
+	}{
+		{"ip=10", rateKeyIP, 10, 10},
+		{"user=0.5", rateKeyUser, 0.5, 1},
+		{"host=2.5/20", rateKeyHost, 2.5, 20},
+		{"ip", "", 0, 0},
+		{"client=10", "", 0, 0},
+		{"ip=0", "", 0, 0},
+		{"ip=-1", "", 0, 0},
+		{"ip=fast", "", 0, 0},
+		{"ip=10/0", "", 0, 0},
+		{"ip=10/x", "", 0, 0},
+	} {
+		l, err := parseKeyedLimiter(tt.rule)
+		if tt.key == "" {
+			if err == nil {
+				t.Errorf("%q accepted", tt.rule)
+				l.stop()
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.rule, err)
+			continue
+		}
+		if l.key != tt.key || l.rate != tt.rate || l.burst != tt.burst {
+			t.Errorf("%q parsed as %s=%v/%d, want %s=%v/%d", tt.rule, l.key, l.rate, l.burst, tt.key, tt.rate, tt.burst)
+		}
+		l.stop()
+	}
+}
+
+// serveFrom is serve for a request from the client at remote, with an
+// optional Proxy-Authorization.
+func serveFrom(h http.Handler, remote, url, auth string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", url, nil)
+	req.RemoteAddr = remote + ":4000"
+	if auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRateLimit(t *testing.T) {
+	b := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {}))
+	defer b.Close()
+	_, port, _ := net.SplitHostPort(b.Listener.Addr().String())
+	alice, bob := "Basic YWxpY2U6c2VjcmV0", "Basic Ym9iOmh1bnRlcjI="
+	users := writeUserFile(t, "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "bob:hunter2")
+
+	for _, tt := range []struct {
+		rule string
+		// The first two requests take the burst; the third is from
+		// another key and passes, the fourth is from the first and is
+		// refused.
+		remote, auth, host [4]string
+	}{
+		{"ip=0.01/2",
+			[4]string{"192.0.2.1", "192.0.2.1", "192.0.2.2", "192.0.2.1"},
+			[4]string{}, [4]string{"127.0.0.1", "localhost", "127.0.0.1", "localhost"}},
+		{"user=0.01/2",
+			[4]string{"192.0.2.1", "192.0.2.2", "192.0.2.1", "192.0.2.3"},
+			[4]string{alice, alice, bob, alice}, [4]string{"127.0.0.1", "127.0.0.1", "127.0.0.1", "127.0.0.1"}},
+		{"host=0.01/2",
+			[4]string{"192.0.2.1", "192.0.2.2", "192.0.2.1", "192.0.2.3"},
+			[4]string{}, [4]string{"127.0.0.1", "127.0.0.1", "localhost", "127.0.0.1"}},
+	} {
+		args := []string{"-rate-limit", tt.rule}
+		if tt.auth[0] != "" {
+			args = append(args, "-auth-file", users)
+		}
+		p := newTestProxy(t, args...)
+		for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+			rec := serveFrom(p, tt.remote[i], "http://"+tt.host[i]+":"+port+"/", tt.auth[i])
+			if rec.Code != want {
+				t.Errorf("%s: request %d got %d, want %d", tt.rule, i+1, rec.Code, want)
+			}
+			if want == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+				t.Errorf("%s: 429 without Retry-After", tt.rule)
+			}
+		}
+	}
+
+	if _, err := New(WithFlags("-rate-limit", "ip=many")); err == nil {
+		t.Error("bad -rate-limit accepted")
+	}
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	const size = 30_000
+	b := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		wr.Write(make([]byte, size))
+	}))
+	defer b.Close()
+	// 50kB/s with a 10kB burst: the rest of 30kB takes 400ms. Responses
+	// kept for -serve-stale are no exception.
+	for _, args := range [][]string{nil, {"-serve-stale"}} {
+		p := newTestProxy(t, append([]string{"-bandwidth-limit", "ip=50000/10000"}, args...)...)
+		start := time.Now()
+		rec := serve(p, "GET", b.URL+"/")
+		if elapsed := time.Since(start); rec.Body.Len() != size || elapsed < 300*time.Millisecond {
+			t.Errorf("%q: %d bytes in %v, want %d in about 400ms", args, rec.Body.Len(), elapsed, size)
+		}
+	}
+
+	srv := httptest.NewServer(newTestProxy(t, "-bandwidth-limit", "ip=50000/10000"))
+	defer srv.Close()
+	conn, br, resp := connect(t, srv.Listener.Addr().String(), newEchoServer(t))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT got %s", resp.Status)
+	}
+	start := time.Now()
+	msg := string(make([]byte, size/2))
+	if !echoes(conn, br, msg) {
+		t.Fatal("tunnel didn't carry data")
+	}
+	// 15kB each way, 20kB over the burst.
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("tunnel echoed %d bytes in %v, want about 400ms", size/2, elapsed)
+	}
+}
+
+func TestCarryLimiters(t *testing.T) {
+	mk := func(rule string) *keyedLimiter {
+		l, err := parseKeyedLimiter(rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	kept, dropped := mk("ip=1"), mk("user=1")
+	fresh := []*keyedLimiter{mk("ip=1"), mk("host=1")}
+	got := carryLimiters([]*keyedLimiter{kept, dropped}, fresh)
+	if len(got) != 2 || got[0] != kept || got[1] != fresh[1] {
+		t.Errorf("carried %v, want the old ip=1 and the new host=1", got)
+	}
+	select {
+	case <-dropped.done:
+	default:
+		t.Error("limiter dropped by the reload not stopped")
+	}
+	for _, l := range got {
+		l.stop()
+	}
+}
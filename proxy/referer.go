@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Values for -referer-policy.
+const (
+	refererKeep   = ""
+	refererOrigin = "origin"
+)
+
+func validRefererPolicy(policy string) error {
+	switch policy {
+	case refererKeep, refererOrigin:
+		return nil
+	}
+	return fmt.Errorf("invalid -referer-policy %q, want %s", policy, refererOrigin)
+}
+
+// applyRefererPolicy removes Referer if strip is set, or with the origin
+// policy cuts it down to scheme and host, so backends don't learn the full
+// page the client came from. A Referer that isn't an absolute URL can't be
+// cut down safely and is removed.
+func applyRefererPolicy(header http.Header, strip bool, policy string) {
+	ref := header.Get("Referer")
+	if ref == "" {
+		return
+	}
+	if strip {
+		header.Del("Referer")
+		return
+	}
+	if policy != refererOrigin {
+		return
+	}
+	u, err := url.Parse(ref)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		header.Del("Referer")
+		return
+	}
+	header.Set("Referer", u.Scheme+"://"+u.Host+"/")
+}
@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRefererPolicy(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	const full = "https://shop.test:8443/cart/42?session=abc#top"
+	for _, tt := range []struct {
+		args    []string
+		referer string
+		want    string
+	}{
+		{nil, full, full},
+		{[]string{"-strip-referer"}, full, ""},
+		{[]string{"-referer-policy", "origin"}, full, "https://shop.test:8443/"},
+		{[]string{"-referer-policy", "origin"}, "/relative/page", ""},
+		{[]string{"-strip-referer", "-referer-policy", "origin"}, full, ""},
+	} {
+		p := newTestProxy(t, append([]string{"-backend", b.URL}, tt.args...)...)
+		serve(p, "GET", "http://front.test/", "Referer: "+tt.referer)
+		if got := b.last.Header.Get("Referer"); got != tt.want {
+			t.Errorf("%q, Referer %q: backend got %q, want %q", tt.args, tt.referer, got, tt.want)
+		}
+	}
+	if _, err := New(WithFlags("-referer-policy", "same-origin")); err == nil {
+		t.Error("-referer-policy same-origin accepted")
+	}
+}
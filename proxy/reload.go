@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+)
+
+// swappableHandler serves a -config listener's current proxy, so a reload
+// can replace it without touching the server or its open connections.
+// Requests already being served finish on the proxy they started with.
+type swappableHandler struct {
+	p atomic.Pointer[proxy]
+}
+
+func newSwappableHandler(p *proxy) *swappableHandler {
+	h := &swappableHandler{}
+	h.p.Store(p)
+	return h
+}
+
+func (h *swappableHandler) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	h.p.Load().ServeHTTP(wr, req)
+}
+
+// reloadConfig rebuilds the listeners from the -config file and moves each
+// running one onto its new proxy. If the file doesn't load, nothing
+// changes. Only proxy options take effect: addresses and server settings
+// such as TLS stay as they were at startup, so listeners added to or
+// removed from the file are reported and left alone until a restart.
+// Metrics keep counting where they were; cached and -serve-stale
+// responses are kept, in stores of the size they started with; and so are
+// clients' quota usage and rate limit buckets. An access log, capture or
+// recording file whose name is unchanged keeps being written by the same
+// writer; one that changes or goes is closed, as is the old tracer once
+// it has sent what it holds.
+func reloadConfig(ctx context.Context, path string, base []string, running []*listener) error {
+	fresh, err := configListeners(path, base)
+	if err != nil {
+		return err
+	}
+	byAddr := make(map[string]*listener, len(fresh))
+	for _, l := range fresh {
+		byAddr[l.server.Addr] = l
+	}
+
+	for _, l := range running {
+		n, ok := byAddr[l.server.Addr]
+		if !ok {
+			slog.Warn("listener is gone from the config, it keeps running until restart", "listen", l.server.Addr)
+			continue
+		}
+		delete(byAddr, l.server.Addr)
+
+		old := l.handler
+		n.handler.stats = old.stats
+		n.handler.tunnels = old.tunnels
+		if old.metrics != nil && n.handler.metrics != nil {
+			n.handler.metrics = old.metrics
+		}
+		if old.accessLog != nil && n.handler.accessLog != nil && old.accessLog.path == n.handler.accessLog.path && old.accessLog.format == n.handler.accessLog.format {
+			// One writer per file, so rotation stays in step.
+			old.accessLog.retune(n.handler.accessLog)
+			n.handler.accessLog = old.accessLog
+		} else if old.accessLog != nil {
+			old.accessLog.close()
+		}
+		if old.capture != nil && n.handler.capture != nil && old.capture.out.path == n.handler.capture.out.path {
+			// Reopening would start a HAR file over.
+			n.handler.capture.out.close()
+			n.handler.capture.out = old.capture.out
+		} else if old.capture != nil {
+			old.capture.out.close()
+		}
+		if old.recorder != nil && n.handler.recorder != nil && old.recorder.path == n.handler.recorder.path {
+			n.handler.recorder.close()
+			n.handler.recorder = old.recorder
+		} else {
+			old.recorder.close()
+		}
+		if old.quota != nil && n.handler.quota != nil {
+			// Clients don't get a fresh quota on every SIGHUP.
+			old.quota.retune(n.handler.quota)
+			n.handler.quota = old.quota
+		} else {
+			old.quota.stop()
+		}
+		n.handler.rateLimits = carryLimiters(old.rateLimits, n.handler.rateLimits)
+		n.handler.bandwidthLimits = carryLimiters(old.bandwidthLimits, n.handler.bandwidthLimits)
+		if old.cache != nil && n.handler.cache != nil {
+			// Stored responses stay valid across a reload.
+			n.handler.cache = old.cache
+		}
+		if old.stale != nil && n.handler.stale != nil {
+			n.handler.stale = old.stale
+		}
+		if old.serverCert != nil {
+			// The server keeps its TLS config, so its certificate is
+			// renewed in place.
+			n.handler.serverCert = old.serverCert
+			if err := old.serverCert.reload(); err != nil {
+				slog.Error("reloading -tls-cert", "file", old.serverCert.path, "error", err)
+			}
+		}
+		l.server.Handler.(*swappableHandler).p.Store(n.handler)
+		if l.socks != nil {
+			l.socks.handler.Store(n.handler)
+		}
+		l.handler = n.handler
+
+		old.warmer.stop()
+		old.tracer.stop()
+		if n.handler.warmer != nil {
+			go n.handler.warmer.run(ctx)
+		}
+		if t, ok := old.transport.(interface{ CloseIdleConnections() }); ok {
+			t.CloseIdleConnections()
+		}
+	}
+	for addr, l := range byAddr {
+		slog.Warn("new listener in the config needs a restart", "listen", addr)
+		l.handler.release()
+	}
+	slog.Info("Reloaded config", "file", path)
+	return nil
+}
+
+// release stops the sweepers and tracer and closes the files of a proxy
+// built by a reload that won't serve.
+func (p *proxy) release() {
+	p.quota.stop()
+	for _, l := range append(p.rateLimits, p.bandwidthLimits...) {
+		l.stop()
+	}
+	p.recorder.close()
+	p.tracer.stop()
+	if p.accessLog != nil {
+		p.accessLog.close()
+	}
+	if p.capture != nil {
+		p.capture.out.close()
+	}
+}
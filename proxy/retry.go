@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// retryPolicy retries backend requests that failed in passing: dials that
+// were refused or timed out, connections reset or closed before the
+// response, and answers with one of statuses. Attempts are spaced by
+// backoff, doubling each time, and no retry starts once budget has passed
+// since the first attempt would be overrun. A nil *retryPolicy never
+// retries.
+type retryPolicy struct {
+	retries  int
+	backoff  time.Duration
+	statuses []int
+	budget   time.Duration
+}
+
+// parseRetryStatuses parses the -request-retry-statuses list.
+func parseRetryStatuses(s string) ([]int, error) {
+	var statuses []int
+	for _, v := range splitList(s) {
+		code, err := strconv.Atoi(v)
+		if err != nil || code < 400 || code > 599 {
+			return nil, fmt.Errorf("invalid -request-retry-statuses code %q", v)
+		}
+		statuses = append(statuses, code)
+	}
+	return statuses, nil
+}
+
+// replayable reports whether req can be sent again: its method is
+// idempotent and it has no body, which would be gone after the first
+// attempt.
+func replayable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return req.ContentLength == 0
+}
+
+// retryableError reports whether err is a failure worth another attempt.
+func retryableError(err error) bool {
+	var op *net.OpError
+	if errors.As(err, &op) && (op.Op == "dial" || op.Op == "proxyconnect") {
+		return transientDialError(err)
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// parentProxyError reports whether err means the parent proxy itself
+// couldn't be reached, rather than the target behind it.
+func parentProxyError(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && (op.Op == "proxyconnect" || strings.HasPrefix(op.Op, "socks"))
+}
+
+// roundTrip sends req with client, retrying it under -request-retries and
+// failing over between -upstream parent proxies. Only replayable requests
+// are sent more than once. A request whose parent proxy couldn't be
+// reached goes straight to the next one, not counting as a retry.
+func (p *proxy) roundTrip(client *http.Client, req *http.Request, log *slog.Logger) (*http.Response, error) {
+	if (p.retry == nil && p.upstreamFailover == nil) || !replayable(req) {
+		return p.coalescer.do(client, req)
+	}
+	start := time.Now()
+	failovers := 0
+	for attempt := 0; ; {
+		resp, err := p.coalescer.do(client, req)
+		if req.Context().Err() != nil {
+			return resp, err
+		}
+		if err != nil && parentProxyError(err) && p.upstreamFailover.available() && failovers < len(p.upstreamFailover.urls)-1 {
+			failovers++
+			log.Warn("parent proxy failed, failing over", "error", err)
+			continue
+		}
+		r := p.retry
+		switch {
+		case r == nil || attempt >= r.retries:
+			return resp, err
+		case err != nil && !retryableError(err):
+			return resp, err
+		case err == nil && !slices.Contains(r.statuses, resp.StatusCode):
+			return resp, err
+		}
+		wait := r.backoff << attempt
+		if r.budget > 0 && time.Since(start)+wait > r.budget {
+			log.Warn("retry budget spent, giving up", "attempts", attempt+1, "budget", r.budget)
+			return resp, err
+		}
+		attempt++
+		if err != nil {
+			log.Warn("backend request failed, retrying", "attempt", attempt, "kind", dialErrorKind(err), "error", err, "backoff", wait)
+		} else {
+			log.Warn("backend answered with a retryable status, retrying", "attempt", attempt, "status", resp.StatusCode, "backoff", wait)
+			// Drain a little so the connection can be reused.
+			io.CopyN(io.Discard, resp.Body, 4<<10)
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyBackend fails its first failures requests, answering with status
+// or, if status is 0, closing the connection unanswered; later ones get
+// "ok". It returns the backend and its request count.
+func flakyBackend(t *testing.T, failures int64, status int) (*countingBackend, *atomic.Int64) {
+	t.Helper()
+	var n atomic.Int64
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		if n.Add(1) > failures {
+			io.WriteString(wr, "ok")
+			return
+		}
+		if status != 0 {
+			wr.WriteHeader(status)
+			return
+		}
+		if conn, _, err := http.NewResponseController(wr).Hijack(); err == nil {
+			conn.Close()
+		}
+	})
+	return b, &n
+}
+
+func TestRequestRetries(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		args     []string
+		method   string
+		failures int64
+		status   int
+		code     int
+		attempts int64
+	}{
+		{"503 retried", []string{"-request-retries", "2"}, "GET", 2, http.StatusServiceUnavailable, http.StatusOK, 3},
+		{"retries run out", []string{"-request-retries", "1"}, "GET", 2, http.StatusServiceUnavailable, http.StatusServiceUnavailable, 2},
+		{"connection closed retried", []string{"-request-retries", "1"}, "GET", 1, 0, http.StatusOK, 2},
+		{"status not listed", []string{"-request-retries", "2", "-request-retry-statuses", "502"}, "GET", 1, http.StatusServiceUnavailable, http.StatusServiceUnavailable, 1},
+		{"POST not retried", []string{"-request-retries", "2"}, "POST", 1, http.StatusServiceUnavailable, http.StatusServiceUnavailable, 1},
+		{"no retries", nil, "GET", 1, http.StatusServiceUnavailable, http.StatusServiceUnavailable, 1},
+		{"budget spent", []string{"-request-retries", "2", "-request-retry-backoff", "100ms", "-request-retry-budget", "50ms"}, "GET", 1, http.StatusServiceUnavailable, http.StatusServiceUnavailable, 1},
+	} {
+		b, attempts := flakyBackend(t, tt.failures, tt.status)
+		args := append([]string{"-request-retry-backoff", "1ms"}, tt.args...)
+		p := newTestProxy(t, args...)
+		rec := serve(p, tt.method, b.URL+"/")
+		if rec.Code != tt.code || attempts.Load() != tt.attempts {
+			t.Errorf("%s: got %d after %d attempts, want %d after %d", tt.name, rec.Code, attempts.Load(), tt.code, tt.attempts)
+		}
+	}
+}
+
+func TestRequestRetryBackoff(t *testing.T) {
+	b, _ := flakyBackend(t, 2, http.StatusBadGateway)
+	p := newTestProxy(t, "-request-retries", "2", "-request-retry-backoff", "40ms")
+	start := time.Now()
+	if rec := serve(p, "GET", b.URL+"/"); rec.Code != http.StatusOK {
+		t.Fatalf("got %d, want the third attempt's 200", rec.Code)
+	}
+	// 40ms, then 80ms.
+	if d := time.Since(start); d < 120*time.Millisecond {
+		t.Errorf("two retries took %v, want the backoff doubling from 40ms", d)
+	}
+}
+
+func TestUpstreamFailover(t *testing.T) {
+	second, _ := newRecordingParent(t, "second")
+	down := "http://" + closedAddr(t)
+	p := newTestProxy(t, "-upstream", down+","+second.URL)
+	for range 2 {
+		if rec := serve(p, "GET", "http://target.test/x"); rec.Code != http.StatusOK || rec.Body.String() != "second http://target.test/x" {
+			t.Errorf("got %d %q, want the second parent to answer", rec.Code, rec.Body)
+		}
+	}
+	if got := p.l.handler.upstreamFailover.pick().String(); got != second.URL {
+		t.Errorf("picked %s, want %s while the first is down", got, second.URL)
+	}
+	// With every parent down the first is tried anyway, and the client
+	// hears of the failure.
+	p = newTestProxy(t, "-upstream", down+",http://"+closedAddr(t))
+	if rec := serve(p, "GET", "http://target.test/x"); rec.Code != http.StatusBadGateway {
+		t.Errorf("all parents down got %d, want 502", rec.Code)
+	}
+	if got := p.l.handler.upstreamFailover.pick().String(); got != down {
+		t.Errorf("picked %s with all parents down, want the first, %s", got, down)
+	}
+}
+
+func TestUpstreamFailoverObserve(t *testing.T) {
+	first, _ := parseUpstreamURL("upstream", "http://first.test:3128")
+	second, _ := parseUpstreamURL("upstream", "http://second.test")
+	f := newUpstreamFailover([]*url.URL{first, second})
+	f.observe("other.test:80", errors.New("refused"))
+	if f.pick() != first {
+		t.Error("a failure dialing another host passed the first parent over")
+	}
+	f.observe("first.test:3128", errors.New("refused"))
+	if f.pick() != second || !f.available() {
+		t.Error("a failed parent wasn't passed over")
+	}
+	f.observe("second.test:80", errors.New("refused"))
+	if f.pick() != first || f.available() {
+		t.Error("with both down, want the first picked and none available")
+	}
+	f.observe("first.test:3128", nil)
+	if f.pick() != first || !f.available() {
+		t.Error("a parent answering again wasn't brought back")
+	}
+	if (*upstreamFailover)(nil).available() {
+		t.Error("nil failover has a parent available")
+	}
+}
+
+func TestRetryableError(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, true},
+		{&net.OpError{Op: "proxyconnect", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, true},
+		{&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, true},
+		{fmt.Errorf("reading response: %w", io.ErrUnexpectedEOF), true},
+		{io.EOF, true},
+		{&net.DNSError{Err: "no such host", Name: "missing.test", IsNotFound: true}, false},
+		{errors.New("malformed HTTP response"), false},
+	} {
+		if got := retryableError(tt.err); got != tt.want {
+			t.Errorf("retryableError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestParseRetryStatuses(t *testing.T) {
+	if got, err := parseRetryStatuses("502, 503,429"); err != nil || fmt.Sprint(got) != "[502 503 429]" {
+		t.Errorf("got %v, %v", got, err)
+	}
+	for _, s := range []string{"200", "abc", "600"} {
+		if _, err := parseRetryStatuses(s); err == nil {
+			t.Errorf("%q accepted", s)
+		}
+	}
+	for method, want := range map[string]bool{"GET": true, "PUT": true, "DELETE": true, "POST": false, "PATCH": false} {
+		if got := replayable(httptest.NewRequest(method, "http://target.test/", nil)); got != want {
+			t.Errorf("replayable(%s) = %v, want %v", method, got, want)
+		}
+	}
+	if replayable(httptest.NewRequest("PUT", "http://target.test/", strings.NewReader("body"))) {
+		t.Error("PUT with a body replayable")
+	}
+}
@@ -0,0 +1,20 @@
+package proxy
+
+import (
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"time"
+)
+
+// retryAfter returns the Retry-After value, in whole seconds, for a
+// throttled request that could succeed after wait. It is never less than
+// -retry-after, and a random -retry-after-jitter share is added on top so
+// clients turned away together don't all come back at the same moment.
+func (p *proxy) retryAfter(wait time.Duration) string {
+	wait = max(wait, p.retryAfterBase)
+	if p.retryAfterJitter > 0 {
+		wait += time.Duration(rand.Float64() * p.retryAfterJitter * float64(wait))
+	}
+	return strconv.Itoa(max(1, int(math.Ceil(wait.Seconds()))))
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	p := &proxy{retryAfterBase: 5 * time.Second}
+	for wait, want := range map[time.Duration]string{
+		0:                        "5",
+		2 * time.Second:          "5",
+		12200 * time.Millisecond: "13",
+	} {
+		if got := p.retryAfter(wait); got != want {
+			t.Errorf("retryAfter(%v) = %s, want %s", wait, got, want)
+		}
+	}
+	if got := (&proxy{}).retryAfter(0); got != "1" {
+		t.Errorf("retryAfter with no base = %s, want at least 1", got)
+	}
+
+	p = &proxy{retryAfterBase: 10 * time.Second, retryAfterJitter: 0.5}
+	seen := map[string]bool{}
+	for range 200 {
+		got := p.retryAfter(0)
+		if n, err := strconv.Atoi(got); err != nil || n < 10 || n > 15 {
+			t.Fatalf("jittered Retry-After = %q, want 10 to 15", got)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("200 jittered values all %v", seen)
+	}
+}
+
+func TestRetryAfterOnThrottle(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	p := newTestProxy(t, "-backend", b.URL, "-rate-limit", "ip=1/1", "-retry-after", "2s", "-retry-after-jitter", "0")
+	serve(p, "GET", "http://front.test/")
+	rec := serve(p, "GET", "http://front.test/")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "2" {
+		t.Errorf("throttled request got %d with Retry-After %q, want 429 with 2", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,8 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package proxy
+
+import "syscall"
+
+// soReusePort is SO_REUSEPORT, under the name the Linux files define.
+const soReusePort = syscall.SO_REUSEPORT
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package proxy
+
+import "syscall"
+
+// reusePortControl reports that SO_REUSEPORT isn't supported here.
+func reusePortControl() (func(network, address string, c syscall.RawConn) error, bool) {
+	return nil, false
+}
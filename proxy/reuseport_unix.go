@@ -0,0 +1,20 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package proxy
+
+import "syscall"
+
+// reusePortControl returns a listener Control func setting SO_REUSEPORT,
+// so a new process can bind the address while the old one drains.
+func reusePortControl() (func(network, address string, c syscall.RawConn) error, bool) {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}, true
+}
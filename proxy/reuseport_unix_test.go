@@ -0,0 +1,23 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package proxy
+
+import "testing"
+
+func TestReusePort(t *testing.T) {
+	first, err := listen("127.0.0.1:0", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	addr := first.Addr().String()
+	if ln, err := listen(addr, false); err == nil {
+		ln.Close()
+		t.Fatal("second bind without SO_REUSEPORT succeeded")
+	}
+	second, err := listen(addr, true)
+	if err != nil {
+		t.Fatalf("second bind with SO_REUSEPORT: %v", err)
+	}
+	second.Close()
+}
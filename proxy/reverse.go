@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// route sends requests for a host, under a path prefix, or both to their
+// own backend.
+type route struct {
+	host    string // "" matches any; "*.example.com" matches subdomains
+	prefix  string
+	backend *url.URL
+}
+
+// parseRoute parses a -route value of the form /prefix=URL, host=URL or
+// host/prefix=URL.
+func parseRoute(s string) (route, error) {
+	pattern, target, ok := strings.Cut(s, "=")
+	host, prefix := pattern, "/"
+	if i := strings.IndexByte(pattern, '/'); i >= 0 {
+		host, prefix = pattern[:i], pattern[i:]
+	}
+	if !ok || pattern == "" || strings.Contains(host, ":") || strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+		return route{}, fmt.Errorf("route %q is not /prefix=URL, host=URL or host/prefix=URL", s)
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return route{}, fmt.Errorf("route %q has an invalid backend URL", s)
+	}
+	return route{host: normalizeHost(host), prefix: prefix, backend: u}, nil
+}
+
+// sortRoutes orders routes with a host before those without, then longest
+// prefix first, so the first match is the most specific.
+func sortRoutes(routes []route) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		if (routes[i].host != "") != (routes[j].host != "") {
+			return routes[i].host != ""
+		}
+		return len(strings.TrimSuffix(routes[i].prefix, "/")) > len(strings.TrimSuffix(routes[j].prefix, "/"))
+	})
+}
+
+// matches reports whether r covers a request for path on host.
+func (r route) matches(host, path string) bool {
+	if wildcard, ok := strings.CutPrefix(r.host, "*"); ok {
+		if !strings.HasSuffix(host, wildcard) {
+			return false
+		}
+	} else if r.host != "" && r.host != host {
+		return false
+	}
+	return hasPathPrefix(path, r.prefix)
+}
+
+// selectBackend returns the backend for req: the most specific matching
+// -route, else -backend, chosen by -lb-strategy when it was repeated. It
+// returns nil if neither applies.
+func (p *proxy) selectBackend(req *http.Request) *url.URL {
+	host := normalizeHost(targetHost(req))
+	for _, r := range p.routes {
+		if r.matches(host, req.URL.Path) {
+			return r.backend
+		}
+	}
+	if p.pool != nil {
+		return p.pool.choose()
+	}
+	return p.backend
+}
+
+// backendKey identifies a backend by scheme and host for -backend-allow.
+func backendKey(u *url.URL) string {
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host)
+}
+
+// headerBackend returns the backend named in the -backend-header request
+// header, or nil if there is none, removing the header either way. Backends
+// not on the -backend-allow list get a 403 and ok is false.
+func (p *proxy) headerBackend(wr http.ResponseWriter, req *http.Request, log *slog.Logger) (backend *url.URL, ok bool) {
+	if p.backendHeader == "" {
+		return nil, true
+	}
+	value := req.Header.Get(p.backendHeader)
+	req.Header.Del(p.backendHeader)
+	if value == "" {
+		return nil, true
+	}
+	if u, err := url.Parse(value); err == nil && u.Host != "" {
+		backend = p.allowedBackends[backendKey(u)]
+	}
+	if backend == nil {
+		logBlocked(log, req, blockReasonBackend, value)
+		http.Error(wr, "Backend not allowed", http.StatusForbidden)
+		return nil, false
+	}
+	return backend, true
+}
+
+// reverseMode reports whether the proxy fronts configured backends rather
+// than forwarding to each request's own URL.
+func (p *proxy) reverseMode() bool {
+	return p.backend != nil || len(p.routes) > 0
+}
+
+// rewriteToBackend points req at backend, applying -strip-prefix and
+// -add-prefix to the path on the way. The backend sees its own host in the
+// Host header unless -preserve-host is set, in which case it gets the
+// client's; X-Forwarded-Host and X-Forwarded-Proto tell it what the client
+// asked for either way, or what a -trusted-proxies client passed on.
+func (p *proxy) rewriteToBackend(req *http.Request, backend *url.URL) {
+	p.forwarded.setProtoHost(req.Header, req, req.Host)
+
+	path := req.URL.Path
+	if p.stripPrefix != "" {
+		path = stripPathPrefix(path, p.stripPrefix)
+	}
+	if p.addPrefix != "" {
+		path = joinURLPath(p.addPrefix, path)
+	}
+
+	req.URL.Scheme = backend.Scheme
+	req.URL.Host = backend.Host
+	req.URL.Path = joinURLPath(backend.Path, path)
+	req.URL.RawPath = ""
+	if backend.RawQuery != "" {
+		if req.URL.RawQuery == "" {
+			req.URL.RawQuery = backend.RawQuery
+		} else {
+			req.URL.RawQuery = backend.RawQuery + "&" + req.URL.RawQuery
+		}
+	}
+	if !p.preserveHost {
+		req.Host = ""
+	}
+}
+
+// hasPathPrefix reports whether prefix matches path on a segment boundary.
+func hasPathPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	rest, ok := strings.CutPrefix(path, prefix)
+	return ok && (rest == "" || rest[0] == '/')
+}
+
+// stripPathPrefix removes prefix from path if it matches on a segment
+// boundary, so "/api" strips "/api/users" and "/api" but not "/apiary". A
+// trailing slash on prefix is ignored. The result always starts with "/".
+func stripPathPrefix(path, prefix string) string {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return path
+	}
+	if !hasPathPrefix(path, prefix) {
+		return path
+	}
+	rest := path[len(prefix):]
+	if rest == "" {
+		return "/"
+	}
+	return rest
+}
+
+// joinURLPath joins two path fragments with exactly one slash between them,
+// keeping any trailing slash on b.
+func joinURLPath(a, b string) string {
+	if a == "" {
+		return b
+	}
+	if b == "" || b == "/" {
+		if strings.HasSuffix(a, "/") {
+			return a
+		}
+		return a + b
+	}
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// echoBackend answers with its name and the Host and request URI it got.
+func echoBackend(t *testing.T, name string) *countingBackend {
+	t.Helper()
+	return newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(wr, "%s %s %s", name, req.Host, req.URL.RequestURI())
+	})
+}
+
+func TestStripAndAddPrefix(t *testing.T) {
+	b := echoBackend(t, "b")
+	for _, tt := range []struct {
+		args       []string
+		path, want string
+	}{
+		{[]string{"-strip-prefix", "/app"}, "/app/users?id=1", "/base/users?id=1"},
+		{[]string{"-strip-prefix", "/app/"}, "/app", "/base/"},
+		{[]string{"-strip-prefix", "/app"}, "/apple", "/base/apple"},
+		{[]string{"-add-prefix", "/v2"}, "/users", "/base/v2/users"},
+		{[]string{"-strip-prefix", "/app", "-add-prefix", "/v2/"}, "/app/users/", "/base/v2/users/"},
+	} {
+		p := newTestProxy(t, append([]string{"-backend", b.URL + "/base"}, tt.args...)...)
+		rec := serve(p, "GET", "http://front.test"+tt.path)
+		if want := "b " + b.Listener.Addr().String() + " " + tt.want; rec.Body.String() != want {
+			t.Errorf("%q %s: backend got %q, want %q", tt.args, tt.path, rec.Body, want)
+		}
+	}
+}
+
+func TestStripPathPrefix(t *testing.T) {
+	for _, tt := range []struct {
+		path, prefix, want string
+	}{
+		{"/api/users", "/api", "/users"},
+		{"/api", "/api", "/"},
+		{"/api/", "/api/", "/"},
+		{"/apiary", "/api", "/apiary"},
+		{"/other", "/api", "/other"},
+		{"/x", "", "/x"},
+	} {
+		if got := stripPathPrefix(tt.path, tt.prefix); got != tt.want {
+			t.Errorf("stripPathPrefix(%q, %q) = %q, want %q", tt.path, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestJoinURLPath(t *testing.T) {
+	for _, tt := range []struct {
+		a, b, want string
+	}{
+		{"", "/x", "/x"},
+		{"/base", "/x", "/base/x"},
+		{"/base/", "/x", "/base/x"},
+		{"/base", "x", "/base/x"},
+		{"/base", "/", "/base/"},
+		{"/base/", "", "/base/"},
+		{"/base", "/x/", "/base/x/"},
+	} {
+		if got := joinURLPath(tt.a, tt.b); got != tt.want {
+			t.Errorf("joinURLPath(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestPreserveHost(t *testing.T) {
+	b := echoBackend(t, "b")
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{nil, b.Listener.Addr().String()},
+		{[]string{"-preserve-host"}, "www.front.test"},
+	} {
+		p := newTestProxy(t, append([]string{"-backend", b.URL}, tt.args...)...)
+		req := httptest.NewRequest("GET", "http://front.test/", nil)
+		req.Host = "www.front.test"
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		if want := "b " + tt.want + " /"; rec.Body.String() != want {
+			t.Errorf("%q: backend got %q, want %q", tt.args, rec.Body, want)
+		}
+		if got := b.last.Header.Get("X-Forwarded-Host"); got != "www.front.test" {
+			t.Errorf("%q: X-Forwarded-Host = %q", tt.args, got)
+		}
+	}
+}
+
+func TestPreserveHostCacheKey(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(wr, req.Host)
+	})
+	p := newTestProxy(t, "-backend", b.URL, "-preserve-host", "-cache-size", "1000000")
+	for _, host := range []string{"a.test", "b.test", "a.test"} {
+		if rec := serve(p, "GET", "http://"+host+"/"); rec.Body.String() != host {
+			t.Errorf("virtual host %s got %q", host, rec.Body)
+		}
+	}
+	if b.hits != 2 {
+		t.Errorf("backend hit %d times, want once per virtual host", b.hits)
+	}
+}
+
+func TestPathRoutes(t *testing.T) {
+	api, v2, def := echoBackend(t, "api"), echoBackend(t, "v2"), echoBackend(t, "default")
+	routes := []string{"-route", "/api=" + api.URL, "-route", "/api/v2/=" + v2.URL}
+	for _, tt := range []struct {
+		args       []string
+		path, want string
+		status     int
+	}{
+		{nil, "/api/users", "api", http.StatusOK},
+		{nil, "/api", "api", http.StatusOK},
+		{nil, "/api/v2/users", "v2", http.StatusOK},
+		{nil, "/api/v2", "v2", http.StatusOK},
+		{nil, "/apiv2", "", http.StatusNotFound},
+		{nil, "/", "", http.StatusNotFound},
+		{[]string{"-backend", def.URL}, "/other", "default", http.StatusOK},
+		{[]string{"-backend", def.URL}, "/api/v2/x", "v2", http.StatusOK},
+	} {
+		p := newTestProxy(t, append(routes, tt.args...)...)
+		rec := serve(p, "GET", "http://front.test"+tt.path)
+		name, _, _ := strings.Cut(rec.Body.String(), " ")
+		if rec.Code != tt.status || tt.want != "" && name != tt.want {
+			t.Errorf("%q %s: got %d from %q, want %d from %q", tt.args, tt.path, rec.Code, name, tt.status, tt.want)
+		}
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	for _, tt := range []struct {
+		s, host, prefix string
+		ok              bool
+	}{
+		{"/api=http://api:8000", "", "/api", true},
+		{"Example.COM=http://web", "example.com", "/", true},
+		{"*.example.com/static=http://cdn", "*.example.com", "/static", true},
+		{"/api", "", "", false},
+		{"=http://api", "", "", false},
+		{"/api=api:8000", "", "", false},
+		{"example.com:80=http://web", "", "", false},
+		{"a.*.com=http://web", "", "", false},
+	} {
+		r, err := parseRoute(tt.s)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseRoute(%q) err = %v, want ok %v", tt.s, err, tt.ok)
+			continue
+		}
+		if tt.ok && (r.host != tt.host || r.prefix != tt.prefix) {
+			t.Errorf("parseRoute(%q) = host %q prefix %q, want %q %q", tt.s, r.host, r.prefix, tt.host, tt.prefix)
+		}
+	}
+}
+
+func TestBackendHeader(t *testing.T) {
+	def, svc := echoBackend(t, "default"), echoBackend(t, "svc")
+	p := newTestProxy(t, "-backend", def.URL, "-backend-header", "X-Proxy-Backend", "-backend-allow", strings.ToUpper(svc.URL))
+	for _, tt := range []struct {
+		header []string
+		status int
+		want   string
+	}{
+		{nil, http.StatusOK, "default"},
+		{[]string{"X-Proxy-Backend: " + svc.URL}, http.StatusOK, "svc"},
+		{[]string{"X-Proxy-Backend: " + svc.URL + "/ignored/path"}, http.StatusOK, "svc"},
+		{[]string{"X-Proxy-Backend: http://evil.test"}, http.StatusForbidden, ""},
+		{[]string{"X-Proxy-Backend: not a url"}, http.StatusForbidden, ""},
+	} {
+		rec := serve(p, "GET", "http://front.test/x", tt.header...)
+		name, _, _ := strings.Cut(rec.Body.String(), " ")
+		if rec.Code != tt.status || tt.want != "" && name != tt.want {
+			t.Errorf("%q: got %d from %q, want %d from %q", tt.header, rec.Code, name, tt.status, tt.want)
+		}
+	}
+	if svc.last.Header.Get("X-Proxy-Backend") != "" {
+		t.Error("routing header forwarded to the backend")
+	}
+}
+
+func TestHostRoutes(t *testing.T) {
+	web, static, api, sub := echoBackend(t, "web"), echoBackend(t, "static"), echoBackend(t, "api"), echoBackend(t, "sub")
+	p := newTestProxy(t,
+		"-route", "example.com="+web.URL,
+		"-route", "example.com/static="+static.URL,
+		"-route", "/api="+api.URL,
+		"-route", "*.example.com="+sub.URL)
+	for _, tt := range []struct {
+		url, want string
+		status    int
+	}{
+		{"http://example.com/", "web", http.StatusOK},
+		{"http://EXAMPLE.com:8080/page", "web", http.StatusOK},
+		{"http://example.com/static/app.js", "static", http.StatusOK},
+		{"http://example.com/api/users", "web", http.StatusOK},
+		{"http://other.test/api/users", "api", http.StatusOK},
+		{"http://www.example.com/", "sub", http.StatusOK},
+		{"http://a.b.example.com/x", "sub", http.StatusOK},
+		{"http://notexample.com/", "", http.StatusNotFound},
+		{"http://other.test/", "", http.StatusNotFound},
+	} {
+		rec := serve(p, "GET", tt.url)
+		name, _, _ := strings.Cut(rec.Body.String(), " ")
+		if rec.Code != tt.status || tt.want != "" && name != tt.want {
+			t.Errorf("%s: got %d from %q, want %d from %q", tt.url, rec.Code, name, tt.status, tt.want)
+		}
+	}
+}
+
+func TestHostRouteTLS(t *testing.T) {
+	b := httptest.NewTLSServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(wr, "secure")
+	}))
+	defer b.Close()
+	p := newTestProxy(t, "-route", "app.test="+b.URL, "-tls-verify", "127.0.0.1=ca:"+backendCA(t, b))
+	if rec := serve(p, "GET", "http://app.test/"); rec.Code != http.StatusOK || rec.Body.String() != "secure" {
+		t.Errorf("route to an https:// backend got %d %q", rec.Code, rec.Body)
+	}
+}
+
+func TestForwardedHostProto(t *testing.T) {
+	b := echoBackend(t, "b")
+	p := newTestProxy(t, "-route", "app.test="+b.URL)
+	serve(p, "GET", "http://app.test/", "X-Forwarded-Host: spoofed.test", "X-Forwarded-Proto: https")
+	if got := b.last.Header.Get("X-Forwarded-Host"); got != "app.test" {
+		t.Errorf("X-Forwarded-Host = %q, want app.test", got)
+	}
+	if got := b.last.Header.Get("X-Forwarded-Proto"); got != "http" {
+		t.Errorf("X-Forwarded-Proto = %q, want http", got)
+	}
+
+	req := httptest.NewRequest("GET", "https://app.test/", nil)
+	p.ServeHTTP(httptest.NewRecorder(), req)
+	if got := b.last.Header.Get("X-Forwarded-Proto"); got != "https" {
+		t.Errorf("X-Forwarded-Proto over TLS = %q, want https", got)
+	}
+}
+
+func TestForwardUnmatched(t *testing.T) {
+	routed, elsewhere := echoBackend(t, "routed"), echoBackend(t, "elsewhere")
+	p := newTestProxy(t, "-route", "app.test="+routed.URL, "-forward-unmatched")
+	for _, tt := range []struct {
+		url, want string
+		status    int
+	}{
+		{"http://app.test/x", "routed", http.StatusOK},
+		{elsewhere.URL + "/y", "elsewhere", http.StatusOK},
+	} {
+		rec := serve(p, "GET", tt.url)
+		name, _, _ := strings.Cut(rec.Body.String(), " ")
+		if rec.Code != tt.status || name != tt.want {
+			t.Errorf("%s: got %d from %q, want %d from %q", tt.url, rec.Code, name, tt.status, tt.want)
+		}
+	}
+	// Without an absolute URL there is nowhere to forward to.
+	req := httptest.NewRequest("GET", "/z", nil)
+	req.Host = "other.test"
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unmatched origin-form request got %d, want 404", rec.Code)
+	}
+
+	for _, args := range [][]string{
+		{"-forward-unmatched"},
+		{"-forward-unmatched", "-route", "app.test=" + routed.URL, "-backend", routed.URL},
+	} {
+		if _, err := New(WithFlags(args...)); err == nil {
+			t.Errorf("%q accepted", args)
+		}
+	}
+}
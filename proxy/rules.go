@@ -0,0 +1,351 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Actions of -rules lines.
+const (
+	ruleSetHeader             = "set-header"
+	ruleAddHeader             = "add-header"
+	ruleDelHeader             = "del-header"
+	ruleReplaceHeader         = "replace-header"
+	ruleSetResponseHeader     = "set-response-header"
+	ruleAddResponseHeader     = "add-response-header"
+	ruleDelResponseHeader     = "del-response-header"
+	ruleReplaceResponseHeader = "replace-response-header"
+	ruleRewrite               = "rewrite"
+	ruleRedirect              = "redirect"
+	ruleBlock                 = "block"
+)
+
+// ruleSet is the -rules file: edits to requests and responses chosen by a
+// regular expression on the request URL. Every matching rule applies, in
+// file order, so a rewrite is seen by the rules after it; a block or
+// redirect answers the request and ends the run. Rules see plain requests
+// and, with -mitm, the requests inside intercepted tunnels, but not
+// CONNECT itself. A nil *ruleSet has no rules.
+type ruleSet struct {
+	rules []*rule
+}
+
+// rule is one line of the -rules file.
+type rule struct {
+	text    string
+	pattern *regexp.Regexp
+	action  string
+
+	name  string         // header actions
+	re    *regexp.Regexp // replace-header, replace-response-header
+	value string         // header value, replacement, or URL template
+
+	status   int // redirect, block
+	page     []byte
+	pageType string
+}
+
+// loadRules reads a -rules file. Each line is
+//
+//	PATTERN ACTION ARGUMENTS
+//
+// where PATTERN is a regular expression matched against the full request
+// URL and the arguments depend on the action:
+//
+//	set-header NAME VALUE       (and add-header)
+//	del-header NAME
+//	replace-header NAME REGEXP REPLACEMENT
+//	set-response-header NAME VALUE (and the other three for responses)
+//	rewrite URL
+//	redirect STATUS URL
+//	block STATUS [FILE]
+//
+// VALUE and REPLACEMENT run to the end of the line. The URL of rewrite
+// and redirect and a REPLACEMENT may refer to submatches as $1 or ${name}.
+// block answers with STATUS and the contents of FILE, or a plain text
+// page. Lines starting with # are comments.
+func loadRules(path string) (*ruleSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rs := &ruleSet{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		rs.rules = append(rs.rules, r)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func parseRule(line string) (*rule, error) {
+	fields := splitFields(line, 3)
+	if len(fields) < 2 {
+		return nil, errors.New("want PATTERN ACTION ARGUMENTS")
+	}
+	pattern, err := regexp.Compile(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	r := &rule{text: line, pattern: pattern, action: fields[1]}
+	rest := ""
+	if len(fields) == 3 {
+		rest = fields[2]
+	}
+	// want splits the arguments into args, the last running to the end of
+	// the line if tail is set, and checks there are min to max of them.
+	var args []string
+	want := func(min, max int, tail bool, usage string) error {
+		if tail {
+			args = splitFields(rest, max)
+		} else {
+			args = splitFields(rest, max+1)
+		}
+		if len(args) < min || len(args) > max {
+			return fmt.Errorf("%s wants %s", r.action, usage)
+		}
+		return nil
+	}
+
+	switch r.action {
+	case ruleSetHeader, ruleAddHeader, ruleSetResponseHeader, ruleAddResponseHeader:
+		if err := want(2, 2, true, "NAME VALUE"); err != nil {
+			return nil, err
+		}
+		r.name, r.value = http.CanonicalHeaderKey(args[0]), args[1]
+	case ruleDelHeader, ruleDelResponseHeader:
+		if err := want(1, 1, false, "NAME"); err != nil {
+			return nil, err
+		}
+		r.name = http.CanonicalHeaderKey(args[0])
+	case ruleReplaceHeader, ruleReplaceResponseHeader:
+		if err := want(3, 3, true, "NAME REGEXP REPLACEMENT"); err != nil {
+			return nil, err
+		}
+		r.name, r.value = http.CanonicalHeaderKey(args[0]), args[2]
+		if r.re, err = regexp.Compile(args[1]); err != nil {
+			return nil, err
+		}
+	case ruleRewrite:
+		if err := want(1, 1, false, "URL"); err != nil {
+			return nil, err
+		}
+		r.value = args[0]
+	case ruleRedirect:
+		if err := want(2, 2, false, "STATUS URL"); err != nil {
+			return nil, err
+		}
+		r.status, err = strconv.Atoi(args[0])
+		if err != nil || r.status < 300 || r.status > 399 {
+			return nil, fmt.Errorf("redirect status %q is not 3xx", args[0])
+		}
+		r.value = args[1]
+	case ruleBlock:
+		if err := want(1, 2, false, "STATUS [FILE]"); err != nil {
+			return nil, err
+		}
+		r.status, err = strconv.Atoi(args[0])
+		if err != nil || r.status < 200 || r.status > 599 {
+			return nil, fmt.Errorf("block status %q is not 200-599", args[0])
+		}
+		if len(args) == 2 {
+			if r.page, err = os.ReadFile(args[1]); err != nil {
+				return nil, err
+			}
+			r.pageType = http.DetectContentType(r.page)
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %q", r.action)
+	}
+	if r.name == "Host" {
+		return nil, errors.New("the Host header is changed with rewrite")
+	}
+	return r, nil
+}
+
+// splitFields splits s around runs of white space into at most n fields,
+// the last holding the rest of s as it is.
+func splitFields(s string, n int) []string {
+	var fields []string
+	for s = strings.TrimSpace(s); s != "" && len(fields) < n-1; {
+		i := strings.IndexAny(s, " \t")
+		if i < 0 {
+			break
+		}
+		fields = append(fields, s[:i])
+		s = strings.TrimLeft(s[i:], " \t")
+	}
+	if s != "" {
+		fields = append(fields, s)
+	}
+	return fields
+}
+
+// response reports whether r edits the response rather than the request.
+func (r *rule) response() bool {
+	return strings.HasSuffix(r.action, "-response-header")
+}
+
+// apply runs the rules matching req. It returns the writer to answer
+// through, which makes the response header edits, and false if a rule
+// answered the request itself.
+func (rs *ruleSet) apply(wr http.ResponseWriter, req *http.Request, log *slog.Logger) (http.ResponseWriter, bool) {
+	if rs == nil {
+		return wr, true
+	}
+	var edits []*rule
+	for _, r := range rs.rules {
+		target := ruleURL(req)
+		m := r.pattern.FindStringSubmatchIndex(target)
+		if m == nil {
+			continue
+		}
+		switch r.action {
+		case ruleBlock:
+			logBlocked(log, req, blockReasonRule, r.text)
+			r.serveBlock(wr)
+			return wr, false
+		case ruleRedirect:
+			location := string(r.pattern.ExpandString(nil, r.value, target, m))
+			log.Info("Redirected by rule", "rule", r.text, "location", location)
+			http.Redirect(wr, req, location, r.status)
+			return wr, false
+		case ruleRewrite:
+			rewritten := string(r.pattern.ExpandString(nil, r.value, target, m))
+			u, err := url.Parse(rewritten)
+			if err != nil || !u.IsAbs() || u.Host == "" {
+				log.Warn("rule rewrote to an invalid URL, ignoring it", "rule", r.text, "url", rewritten)
+				continue
+			}
+			log.Debug("Rewrote URL", "rule", r.text, "url", rewritten)
+			req.URL = u
+			req.Host = u.Host
+		default:
+			if r.response() {
+				edits = append(edits, r)
+			} else {
+				r.edit(req.Header)
+			}
+		}
+	}
+	if len(edits) > 0 {
+		wr = &ruleWriter{ResponseWriter: wr, edits: edits}
+	}
+	return wr, true
+}
+
+// ruleURL returns the URL rules are matched against: the request's own
+// for proxy requests, else one made from the Host header, for reverse
+// proxying.
+func ruleURL(req *http.Request) string {
+	if req.URL.IsAbs() {
+		return req.URL.String()
+	}
+	u := *req.URL
+	u.Scheme = "http"
+	if req.TLS != nil {
+		u.Scheme = "https"
+	}
+	u.Host = req.Host
+	return u.String()
+}
+
+// edit makes the rule's header change to header.
+func (r *rule) edit(header http.Header) {
+	switch r.action {
+	case ruleSetHeader, ruleSetResponseHeader:
+		header.Set(r.name, r.value)
+	case ruleAddHeader, ruleAddResponseHeader:
+		header.Add(r.name, r.value)
+	case ruleDelHeader, ruleDelResponseHeader:
+		header.Del(r.name)
+	case ruleReplaceHeader, ruleReplaceResponseHeader:
+		for i, v := range header[r.name] {
+			header[r.name][i] = r.re.ReplaceAllString(v, r.value)
+		}
+	}
+}
+
+// serveBlock answers with the rule's status and page.
+func (r *rule) serveBlock(wr http.ResponseWriter) {
+	if r.page == nil {
+		http.Error(wr, http.StatusText(r.status), r.status)
+		return
+	}
+	wr.Header().Set("Content-Type", r.pageType)
+	wr.Header().Set("Content-Length", strconv.Itoa(len(r.page)))
+	wr.Header().Set("Cache-Control", "no-store")
+	wr.WriteHeader(r.status)
+	wr.Write(r.page)
+}
+
+// ruleWriter makes response header edits just before the header goes
+// out, so they reach every response: the backend's, cached ones and the
+// proxy's own errors alike.
+type ruleWriter struct {
+	http.ResponseWriter
+	edits []*rule
+	done  bool
+}
+
+func (w *ruleWriter) edit() {
+	if !w.done {
+		w.done = true
+		for _, r := range w.edits {
+			r.edit(w.Header())
+		}
+	}
+}
+
+func (w *ruleWriter) WriteHeader(code int) {
+	if code >= 200 {
+		// Informational responses go out as they are.
+		w.edit()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *ruleWriter) Write(b []byte) (int, error) {
+	w.edit()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *ruleWriter) Flush() {
+	w.edit()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *ruleWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	return h.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *ruleWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
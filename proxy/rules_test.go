@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("X-Backend", "b")
+		wr.Write([]byte(req.URL.Path))
+	})
+	page := writeTempFile(t, "blocked.html", "<html><body>blocked</body></html>")
+	rules := writeTempFile(t, "rules", strings.Join([]string{
+		"# comment",
+		"",
+		`^http://[^/]+/ set-header X-Set hello  world`,
+		`/add add-header X-Add two`,
+		`/del del-header X-Remove`,
+		`/repl replace-header X-Version v(\d+) version-$1`,
+		`^http://[^/]+/old/(.*) rewrite ` + b.URL + `/new/$1`,
+		`/go/(?P<rest>.*) redirect 301 https://elsewhere.test/${rest}`,
+		`/blocked block 451 ` + page,
+		`/forbidden block 403`,
+		`. set-response-header X-Resp yes`,
+		`/quiet del-response-header X-Backend`,
+	}, "\n"))
+	p := newTestProxy(t, "-rules", rules)
+
+	rec := serve(p, "GET", b.URL+"/add/del/repl", "X-Add: one", "X-Remove: me", "X-Version: v2, v3")
+	h := b.last.Header
+	if h.Get("X-Set") != "hello  world" || strings.Join(h.Values("X-Add"), ",") != "one,two" || h.Get("X-Remove") != "" || h.Get("X-Version") != "version-2, version-3" {
+		t.Errorf("backend got X-Set %q, X-Add %q, X-Remove %q, X-Version %q", h.Get("X-Set"), h.Values("X-Add"), h.Get("X-Remove"), h.Get("X-Version"))
+	}
+	if rec.Header().Get("X-Resp") != "yes" || rec.Header().Get("X-Backend") != "b" {
+		t.Errorf("response header %v, want X-Resp added and X-Backend kept", rec.Header())
+	}
+
+	if rec := serve(p, "GET", "http://unreachable.test/old/page?x=1"); rec.Body.String() != "/new/page" {
+		t.Errorf("rewritten request reached %q, want /new/page", rec.Body)
+	}
+	if rec := serve(p, "GET", b.URL+"/quiet"); rec.Header().Get("X-Backend") != "" || rec.Header().Get("X-Resp") != "yes" {
+		t.Errorf("response header %v, want X-Backend removed", rec.Header())
+	}
+
+	hits := b.hits
+	rec = serve(p, "GET", b.URL+"/go/a/b")
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "https://elsewhere.test/a/b" {
+		t.Errorf("redirect got %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+	rec = serve(p, "GET", b.URL+"/blocked")
+	if rec.Code != 451 || rec.Body.String() != "<html><body>blocked</body></html>" || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("block with a page got %d %q as %q", rec.Code, rec.Body, rec.Header().Get("Content-Type"))
+	}
+	if rec := serve(p, "GET", b.URL+"/forbidden"); rec.Code != http.StatusForbidden || rec.Header().Get("X-Resp") != "" {
+		t.Errorf("block got %d with X-Resp %q, want 403 ending the run", rec.Code, rec.Header().Get("X-Resp"))
+	}
+	if b.hits != hits {
+		t.Errorf("%d answered requests reached the backend", b.hits-hits)
+	}
+
+	// Response edits reach the proxy's own errors too.
+	if rec := serve(p, "GET", "http://"+closedAddr(t)+"/"); rec.Code != http.StatusBadGateway || rec.Header().Get("X-Resp") != "yes" {
+		t.Errorf("gateway error got %d with X-Resp %q", rec.Code, rec.Header().Get("X-Resp"))
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	r, err := parseRule(`example\.com set-header x-note  two words `)
+	if err != nil || r.name != "X-Note" || r.value != "two words" {
+		t.Errorf("set-header parsed as %+v, %v", r, err)
+	}
+	for _, line := range []string{
+		"example.com",
+		"( set-header A b",
+		"x set-header A",
+		"x del-header A B",
+		"x replace-header A ( b",
+		"x rewrite",
+		"x bogus A",
+		"x redirect 200 http://a.test/",
+		"x redirect 301",
+		"x block 99",
+		"x block 403 /no/such/file",
+		"x set-header Host other.test",
+	} {
+		if _, err := parseRule(line); err == nil {
+			t.Errorf("%q accepted", line)
+		}
+	}
+
+	if _, err := loadRules(writeTempFile(t, "rules", "x set-header A b\nx bogus\n")); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("bad rules file got %v, want the line number", err)
+	}
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// credentialFile holds user:password credentials read from a file, such as
+// a Kubernetes secret mount, so they never appear in the process arguments.
+// It is re-read on SIGHUP to pick up rotated credentials.
+type credentialFile struct {
+	path string
+
+	mu         sync.RWMutex
+	user, pass string
+}
+
+// loadCredentialFile reads credentials from path.
+func loadCredentialFile(path string) (*credentialFile, error) {
+	c := &credentialFile{path: path}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload re-reads the file. On error the previous credentials are kept.
+func (c *credentialFile) reload() error {
+	b, err := os.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	user, pass, ok := strings.Cut(strings.TrimSpace(string(b)), ":")
+	if !ok || user == "" || strings.ContainsAny(user+pass, "\r\n") {
+		return fmt.Errorf("%s: credentials must be a single user:password line", c.path)
+	}
+	c.mu.Lock()
+	c.user, c.pass = user, pass
+	c.mu.Unlock()
+	return nil
+}
+
+// get returns the current credentials.
+func (c *credentialFile) get() (user, pass string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.user, c.pass
+}
+
+// upstreamURL returns the upstream proxy URL, failing over to the next
+// -upstream while one is down, with the current -upstream-auth-file
+// credentials, if any, filled in.
+func (p *proxy) upstreamURL() *url.URL {
+	upstream := p.upstream
+	if p.upstreamFailover != nil {
+		upstream = p.upstreamFailover.pick()
+	}
+	if upstream == nil || p.upstreamAuthFile == nil {
+		return upstream
+	}
+	u := *upstream
+	u.User = url.UserPassword(p.upstreamAuthFile.get())
+	return &u
+}
+
+// reloadSecrets re-reads every credential file, keeping the old values of
+// any that fail to load.
+func (p *proxy) reloadSecrets() {
+	type secretFile interface{ reload() error }
+	files := make(map[string]secretFile)
+	if p.auth != nil {
+		files[p.auth.users.path] = p.auth.users
+	}
+	if p.upstreamAuthFile != nil {
+		files[p.upstreamAuthFile.path] = p.upstreamAuthFile
+	}
+	if p.serverCert != nil {
+		files[p.serverCert.path] = p.serverCert
+	}
+	for path, f := range files {
+		if err := f.reload(); err != nil {
+			slog.Error("reloading credentials", "file", path, "error", err)
+			continue
+		}
+		slog.Info("Reloaded credentials", "file", path)
+	}
+}
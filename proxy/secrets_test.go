@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestLoadCredentialFile(t *testing.T) {
+	for _, tt := range []struct {
+		content, user, pass string
+		ok                  bool
+	}{
+		{"bob:hunter2\n", "bob", "hunter2", true},
+		{"  bob:pa:ss  \n\n", "bob", "pa:ss", true},
+		{"bob:", "bob", "", true},
+		{"bob", "", "", false},
+		{":hunter2", "", "", false},
+		{"bob:hunter2\nalice:secret\n", "", "", false},
+		{"", "", "", false},
+	} {
+		c, err := loadCredentialFile(writeTempFile(t, "creds", tt.content))
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: err = %v, want ok %v", tt.content, err, tt.ok)
+			continue
+		}
+		if tt.ok {
+			if user, pass := c.get(); user != tt.user || pass != tt.pass {
+				t.Errorf("%q: got %q:%q, want %q:%q", tt.content, user, pass, tt.user, tt.pass)
+			}
+		}
+	}
+}
+
+func TestReloadSecrets(t *testing.T) {
+	parent, seen := newParentProxy(t, "Basic Ym9iOmh1bnRlcjI=") // bob:hunter2
+	creds := writeTempFile(t, "creds", "bob:old\n")
+	p := newTestProxy(t, "-upstream", parent.URL, "-upstream-auth-file", creds)
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	if _, _, resp := connect(t, srv.Listener.Addr().String(), "target.test:443"); resp.StatusCode == http.StatusOK {
+		t.Error("parent accepted the old credentials")
+	}
+	<-seen
+
+	// A broken rotation keeps the credentials there were.
+	os.WriteFile(creds, []byte("garbage"), 0o600)
+	p.l.handler.reloadSecrets()
+	if user, pass := p.l.handler.upstreamAuthFile.get(); user != "bob" || pass != "old" {
+		t.Errorf("after a bad reload credentials are %q:%q, want the old ones kept", user, pass)
+	}
+
+	os.WriteFile(creds, []byte("bob:hunter2\n"), 0o600)
+	p.l.handler.reloadSecrets()
+	if _, _, resp := connect(t, srv.Listener.Addr().String(), "target.test:443"); resp.StatusCode != http.StatusOK {
+		t.Errorf("CONNECT after rotating the credentials got %s", resp.Status)
+	}
+}
+
+func TestReloadUserFile(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	users := writeUserFile(t, "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=")
+	p := newTestProxy(t, "-auth-file", users)
+	const alice = "Proxy-Authorization: Basic YWxpY2U6c2VjcmV0" // alice:secret
+	if rec := serve(p, "GET", b.URL, alice); rec.Code != http.StatusOK {
+		t.Fatalf("alice got %d", rec.Code)
+	}
+
+	os.WriteFile(users, []byte("carol:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0o600)
+	p.l.handler.reloadSecrets()
+	if rec := serve(p, "GET", b.URL, alice); rec.Code != http.StatusProxyAuthRequired {
+		t.Errorf("alice got %d after being removed, want 407", rec.Code)
+	}
+	if rec := serve(p, "GET", b.URL, "Proxy-Authorization: Basic Y2Fyb2w6c2VjcmV0"); rec.Code != http.StatusOK {
+		t.Errorf("carol got %d after being added", rec.Code)
+	}
+}
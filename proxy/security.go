@@ -0,0 +1,39 @@
+package proxy
+
+import "net/http"
+
+// securityHeaders are hardening headers added to responses in reverse-proxy
+// mode, for backends that don't send their own.
+type securityHeaders struct {
+	header http.Header
+	// override replaces values the backend set instead of keeping them.
+	override bool
+}
+
+// newSecurityHeaders builds the header set. Empty values are left out.
+func newSecurityHeaders(hsts, frameOptions, csp string, override bool) *securityHeaders {
+	s := &securityHeaders{header: make(http.Header), override: override}
+	for name, value := range map[string]string{
+		"Strict-Transport-Security": hsts,
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           frameOptions,
+		"Content-Security-Policy":   csp,
+	} {
+		if value != "" {
+			s.header.Set(name, value)
+		}
+	}
+	return s
+}
+
+// apply adds the security headers to header.
+func (s *securityHeaders) apply(header http.Header) {
+	if s == nil {
+		return
+	}
+	for name, values := range s.header {
+		if s.override || len(header.Values(name)) == 0 {
+			header[name] = values
+		}
+	}
+}
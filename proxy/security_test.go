@@ -0,0 +1,32 @@
+package proxy
+
+import "testing"
+
+func TestSecurityHeaders(t *testing.T) {
+	b := headerBackend(t, "X-Frame-Options: SAMEORIGIN")
+	for _, tt := range []struct {
+		args                 []string
+		hsts, frame, nosniff string
+		csp                  string
+	}{
+		{[]string{"-csp", "default-src 'self'"}, "max-age=31536000; includeSubDomains", "SAMEORIGIN", "nosniff", "default-src 'self'"},
+		{[]string{"-security-headers-override"}, "max-age=31536000; includeSubDomains", "DENY", "nosniff", ""},
+		{[]string{"-hsts", "", "-frame-options", ""}, "", "SAMEORIGIN", "nosniff", ""},
+	} {
+		p := newTestProxy(t, append([]string{"-backend", b.URL, "-security-headers"}, tt.args...)...)
+		h := serve(p, "GET", "http://front.test/").Header()
+		got := [4]string{h.Get("Strict-Transport-Security"), h.Get("X-Frame-Options"), h.Get("X-Content-Type-Options"), h.Get("Content-Security-Policy")}
+		if want := [4]string{tt.hsts, tt.frame, tt.nosniff, tt.csp}; got != want {
+			t.Errorf("%q: got HSTS, framing, nosniff, CSP %q, want %q", tt.args, got, want)
+		}
+		if n := len(h.Values("X-Frame-Options")); n != 1 {
+			t.Errorf("%q: %d X-Frame-Options headers, want 1", tt.args, n)
+		}
+	}
+
+	// Forward proxies leave other sites' responses alone.
+	p := newTestProxy(t, "-security-headers")
+	if h := serve(p, "GET", b.URL+"/").Header(); h.Get("X-Content-Type-Options") != "" {
+		t.Errorf("forward proxy added security headers: %v", h)
+	}
+}
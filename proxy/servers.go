@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// serveHooks are called as run starts and stops serving, so the command
+// can tell systemd.
+type serveHooks struct {
+	// ready is called once every address is listening, with a context
+	// done when shutdown starts.
+	ready func(ctx context.Context)
+	// stopping is called as shutdown starts.
+	stopping func()
+}
+
+// run serves every listener, along with its auxiliary servers, until ctx is
+// done or one of them fails. All servers are then shut down together,
+// letting in-flight requests finish for up to timeout, and run returns once
+// every one has stopped. Per-server shutdown failures are logged and joined
+// into the returned error. hooks hear of serving starting and stopping.
+func run(ctx context.Context, listeners []*listener, timeout time.Duration, hooks serveHooks) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var servers []*http.Server
+	var bindings []binding
+	var socks []*socksServer
+	tunnels := make(map[*tunnelSet]bool)
+	for _, l := range listeners {
+		servers = append(servers, l.server)
+		servers = append(servers, l.aux...)
+		if l.socks != nil {
+			socks = append(socks, l.socks)
+		}
+		addrs := l.addrs
+		if len(addrs) == 0 {
+			addrs = []string{l.server.Addr}
+		}
+		for _, addr := range addrs {
+			bindings = append(bindings, binding{server: l.server, addr: addr, tls: l.server.TLSConfig != nil, retry: l.bindRetry, reusePort: l.reusePort, proxyProto: l.proxyProto, connLimit: l.connLimit})
+		}
+		for _, s := range l.aux {
+			bindings = append(bindings, binding{server: s, addr: s.Addr, tls: s.TLSConfig != nil, retry: l.bindRetry, reusePort: l.reusePort})
+		}
+		if l.handler.tunnels != nil {
+			tunnels[l.handler.tunnels] = true
+		}
+		if l.handler.warmer != nil {
+			go l.handler.warmer.run(ctx)
+		}
+	}
+
+	var mu sync.Mutex
+	var errs []error
+	var served sync.WaitGroup
+	// bound is done once every address is listening, or has failed.
+	var bound sync.WaitGroup
+	bound.Add(len(bindings) + len(socks))
+	go func() {
+		bound.Wait()
+		if ctx.Err() == nil && hooks.ready != nil {
+			hooks.ready(ctx)
+		}
+	}()
+	for _, b := range bindings {
+		served.Add(1)
+		go func() {
+			defer served.Done()
+			ready := sync.OnceFunc(bound.Done)
+			defer ready()
+			slog.Info("Starting proxy", "listen", b.addr, "tls", b.tls)
+			err := b.listenAndServe(ctx, ready)
+			if !errors.Is(err, http.ErrServerClosed) {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", b.addr, err))
+				mu.Unlock()
+				cancel()
+			}
+		}()
+	}
+	for _, s := range socks {
+		served.Add(1)
+		go func() {
+			defer served.Done()
+			ready := sync.OnceFunc(bound.Done)
+			defer ready()
+			slog.Info("Starting SOCKS5 proxy", "listen", s.addr)
+			if err := s.listenAndServe(ready); !errors.Is(err, net.ErrClosed) {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", s.addr, err))
+				mu.Unlock()
+				cancel()
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	if hooks.stopping != nil {
+		hooks.stopping()
+	}
+	slog.Info("Shutting down", "servers", len(servers)+len(socks), "timeout", timeout)
+	shutdownCtx, stop := context.WithTimeout(context.Background(), timeout)
+	defer stop()
+	var shutdown sync.WaitGroup
+	for _, s := range servers {
+		shutdown.Add(1)
+		go func() {
+			defer shutdown.Done()
+			if err := s.Shutdown(shutdownCtx); err != nil {
+				slog.Error("server shutdown failed", "listen", s.Addr, "error", err)
+				s.Close()
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("shutting down %s: %w", s.Addr, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, s := range socks {
+		shutdown.Add(1)
+		go func() {
+			defer shutdown.Done()
+			if err := s.shutdown(shutdownCtx); err != nil {
+				slog.Error("SOCKS5 server shutdown failed", "listen", s.addr, "error", err)
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("shutting down %s: %w", s.addr, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	for t := range tunnels {
+		// The servers stop taking new tunnels as they shut down.
+		shutdown.Add(1)
+		go func() {
+			defer shutdown.Done()
+			if n := t.count(); n > 0 {
+				slog.Info("Waiting for tunnels to close", "tunnels", n)
+			}
+			if t.drain(shutdownCtx) != nil {
+				slog.Warn("closing tunnels still open at -shutdown-timeout")
+			}
+		}()
+	}
+	shutdown.Wait()
+	served.Wait()
+	return errors.Join(errs...)
+}
+
+// serverErrorLog routes net/http's own error log (TLS handshake failures,
+// broken pipes, malformed requests) through slog at debug level, so it is
+// formatted like everything else and hidden unless asked for. It logs to
+// whatever the default logger is at the time, such as -syslog.
+func serverErrorLog() *log.Logger {
+	return log.New(slogWriter{}, "", 0)
+}
+
+type slogWriter struct{}
+
+func (slogWriter) Write(b []byte) (int, error) {
+	slog.Debug("Server error", "error", strings.TrimSpace(string(b)))
+	return len(b), nil
+}
+
+// bindRetryInterval is how often a busy address is retried under
+// -bind-retry.
+const bindRetryInterval = 250 * time.Millisecond
+
+// binding is one address a server listens on. A server may have several,
+// each served on its own. Whether it serves TLS is settled before any is
+// served, since serving can fill in a TLS config for HTTP/2.
+type binding struct {
+	server    *http.Server
+	addr      string
+	tls       bool
+	retry     time.Duration
+	reusePort bool
+	// proxyProto, if set, are the load balancers whose PROXY protocol
+	// headers are read.
+	proxyProto []netip.Prefix
+	// connLimit, if set, caps each client's open connections.
+	connLimit *connLimiter
+}
+
+// listenAndServe serves b's server on b's address, calling bound once it
+// is listening. If the address is in use it keeps trying to bind for up to
+// retry, so a restarted proxy can take over a port its predecessor is
+// still releasing; with reusePort the two can share it instead.
+func (b binding) listenAndServe(ctx context.Context, bound func()) error {
+	addr, retry := b.addr, b.retry
+	if addr == "" {
+		addr = ":http"
+		if b.tls {
+			addr = ":https"
+		}
+	}
+
+	deadline := time.Now().Add(retry)
+	var ln net.Listener
+	for attempt := 0; ; attempt++ {
+		var err error
+		ln, err = listen(addr, b.reusePort)
+		if err == nil {
+			if attempt > 0 {
+				slog.Info("Address is free, listening", "listen", addr)
+			}
+			break
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return err
+		}
+		if retry <= 0 {
+			return fmt.Errorf("address already in use by another process (-bind-retry waits for it): %w", err)
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("address still in use after -bind-retry %s: %w", retry, err)
+		}
+		if attempt == 0 {
+			slog.Warn("Address in use, retrying", "listen", addr, "for", retry)
+		}
+		select {
+		case <-time.After(bindRetryInterval):
+		case <-ctx.Done():
+			return http.ErrServerClosed
+		}
+	}
+
+	if b.proxyProto != nil {
+		ln = &proxyProtoListener{Listener: ln, trusted: b.proxyProto}
+	}
+	ln = b.connLimit.listener(ln, !b.tls)
+	bound()
+	if b.tls {
+		return b.server.ServeTLS(ln, "", "")
+	}
+	return b.server.Serve(ln)
+}
+
+// listen listens on addr, a host:port or unix:PATH for a Unix domain
+// socket, setting SO_REUSEPORT first on TCP if reusePort is set. A socket
+// file left behind by a proxy that is gone is removed first. A systemd:
+// address takes a socket passed in by systemd instead.
+func listen(addr string, reusePort bool) (net.Listener, error) {
+	if name, ok := strings.CutPrefix(addr, "systemd:"); ok {
+		return systemdListener(name)
+	}
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.Dial("unix", path); err == nil {
+				conn.Close()
+				return nil, &net.OpError{Op: "listen", Net: "unix", Err: syscall.EADDRINUSE}
+			}
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+	var lc net.ListenConfig
+	if reusePort {
+		lc.Control, _ = reusePortControl()
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// addrFlag is -addr, given once per address to listen on. Each use adds an
+// address, except that the first replaces the default and an empty one
+// forgets those before it, so a -config listener's address stands in for
+// the command line's.
+type addrFlag struct {
+	addrs []string
+	set   bool
+}
+
+func (f *addrFlag) String() string {
+	return strings.Join(f.addrs, ",")
+}
+
+func (f *addrFlag) Set(v string) error {
+	if !f.set || v == "" {
+		f.addrs, f.set = nil, true
+	}
+	if v != "" {
+		f.addrs = append(f.addrs, v)
+	}
+	return nil
+}
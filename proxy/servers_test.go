@@ -0,0 +1,274 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// unixGet fetches path from the HTTP server on the Unix socket sock.
+func unixGet(sock, path string) (*http.Response, error) {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+	resp, err := client.Get("http://unix.test" + path)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+func TestRunShutsDownEveryServer(t *testing.T) {
+	dir := t.TempDir()
+	proxySock, metricsSock, adminSock := filepath.Join(dir, "proxy"), filepath.Join(dir, "metrics"), filepath.Join(dir, "admin")
+	l, err := newListener("minprox", []string{"-addr", "unix:" + proxySock, "-metrics-addr", "unix:" + metricsSock, "-admin-addr", "unix:" + adminSock})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ready, stopping := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- run(ctx, []*listener{l}, time.Second, serveHooks{
+			ready:    func(context.Context) { close(ready) },
+			stopping: func() { close(stopping) },
+		})
+	}()
+	select {
+	case <-ready:
+	case err := <-done:
+		t.Fatalf("run returned before serving: %v", err)
+	}
+	for _, sock := range []string{proxySock, metricsSock, adminSock} {
+		if _, err := unixGet(sock, "/"); err != nil {
+			t.Errorf("%s not serving: %v", filepath.Base(sock), err)
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("run = %v, want a clean shutdown", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run didn't return after shutdown")
+	}
+	<-stopping
+	for _, sock := range []string{proxySock, metricsSock, adminSock} {
+		if _, err := unixGet(sock, "/"); err == nil {
+			t.Errorf("%s still serving after run returned", filepath.Base(sock))
+		}
+	}
+}
+
+func TestRunStopsAllWhenOneFails(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	sock := filepath.Join(t.TempDir(), "proxy")
+	l, err := newListener("minprox", []string{"-addr", "unix:" + sock, "-metrics-addr", busy.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- run(context.Background(), []*listener{l}, time.Second, serveHooks{}) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("run = nil with the metrics address in use")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run kept serving after a server failed to bind")
+	}
+	if _, err := unixGet(sock, "/"); err == nil {
+		t.Error("proxy still serving after the metrics server failed")
+	}
+}
+
+// TestHandshakeErrorsLogged sends plaintext to a TLS listener configured
+// as newListener configures the proxy's.
+func TestHandshakeErrorsLogged(t *testing.T) {
+	l, err := newListener("minprox", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, logs := newTestLogger()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(slog.New(slog.DiscardHandler)) })
+	var std strings.Builder
+	log.SetOutput(&std)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	srv := httptest.NewUnstartedServer(l.server.Handler)
+	srv.Config.ErrorLog = l.server.ErrorLog
+	srv.StartTLS()
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: front.test\r\n\r\n")
+	io.ReadAll(conn)
+	conn.Close()
+
+	waitFor(t, func() bool { return strings.Contains(logs.String(), "TLS handshake error") })
+	if out := logs.String(); !strings.Contains(out, `level=DEBUG msg="Server error"`) {
+		t.Errorf("handshake error not logged at debug:\n%s", out)
+	}
+	if std.Len() != 0 {
+		t.Errorf("standard logger got %q", std.String())
+	}
+}
+
+func TestBindRetry(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	addr := busy.Addr().String()
+	newBinding := func(retry time.Duration) binding {
+		return binding{server: &http.Server{Handler: http.NotFoundHandler()}, addr: addr, retry: retry}
+	}
+
+	err = newBinding(0).listenAndServe(context.Background(), func() {})
+	if !errors.Is(err, syscall.EADDRINUSE) || !strings.Contains(err.Error(), "-bind-retry") {
+		t.Errorf("busy address without -bind-retry: %v, want EADDRINUSE pointing at -bind-retry", err)
+	}
+	start := time.Now()
+	err = newBinding(300*time.Millisecond).listenAndServe(context.Background(), func() {})
+	if !errors.Is(err, syscall.EADDRINUSE) || !strings.Contains(err.Error(), "still in use") || time.Since(start) < 300*time.Millisecond {
+		t.Errorf("address busy throughout -bind-retry: %v after %v", err, time.Since(start))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if err := newBinding(time.Minute).listenAndServe(ctx, func() {}); err != http.ErrServerClosed {
+		t.Errorf("stopped while retrying: %v, want ErrServerClosed", err)
+	}
+
+	// Freed part way through, the address is taken over.
+	b := newBinding(5 * time.Second)
+	bound := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- b.listenAndServe(context.Background(), func() { close(bound) }) }()
+	time.Sleep(300 * time.Millisecond)
+	busy.Close()
+	select {
+	case <-bound:
+	case err := <-done:
+		t.Fatalf("listenAndServe = %v, want it to bind once the address is free", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("address freed but not bound")
+	}
+	resp, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatalf("rebound server not serving: %v", err)
+	}
+	resp.Body.Close()
+	b.server.Close()
+	if err := <-done; err != http.ErrServerClosed {
+		t.Errorf("after Close listenAndServe = %v", err)
+	}
+}
+
+func TestAddrFlag(t *testing.T) {
+	for _, tt := range []struct {
+		sets []string
+		want string
+	}{
+		{nil, "127.0.0.1:8080"},
+		{[]string{":3128"}, ":3128"},
+		{[]string{":3128", "unix:/run/minprox.sock", "[::1]:3128"}, ":3128,unix:/run/minprox.sock,[::1]:3128"},
+		{[]string{":3128", "", ":8080"}, ":8080"},
+		{[]string{""}, ""},
+	} {
+		f := &addrFlag{addrs: []string{"127.0.0.1:8080"}}
+		for _, v := range tt.sets {
+			f.Set(v)
+		}
+		if got := f.String(); got != tt.want {
+			t.Errorf("-addr %q = %q, want %q", tt.sets, got, tt.want)
+		}
+	}
+	if _, err := newListener("minprox", []string{"-addr", ""}); err == nil {
+		t.Error("empty -addr accepted")
+	}
+}
+
+func TestMultipleAddrs(t *testing.T) {
+	sock, tcp := filepath.Join(t.TempDir(), "proxy.sock"), closedAddr(t)
+	l, err := newListener("minprox", []string{"-addr", "unix:" + sock, "-addr", tcp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ready := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, []*listener{l}, time.Second, serveHooks{ready: func(context.Context) { close(ready) }})
+	}()
+	select {
+	case <-ready:
+	case err := <-done:
+		t.Fatalf("run returned before serving: %v", err)
+	}
+	if _, err := unixGet(sock, "/"); err != nil {
+		t.Errorf("Unix socket not serving: %v", err)
+	}
+	if resp, err := http.Get("http://" + tcp + "/"); err != nil {
+		t.Errorf("%s not serving: %v", tcp, err)
+	} else {
+		resp.Body.Close()
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("run = %v", err)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "proxy.sock")
+	ln, err := listen("unix:"+sock, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen("unix:"+sock, false); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("listening on a live socket got %v, want EADDRINUSE", err)
+	}
+
+	// A socket left behind by a proxy that is gone is taken over.
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	if _, err := os.Stat(sock); err != nil {
+		t.Fatalf("stale socket not left behind: %v", err)
+	}
+	ln, err = listen("unix:"+sock, false)
+	if err != nil {
+		t.Fatalf("listening over a stale socket: %v", err)
+	}
+	ln.Close()
+
+	// Other files are left alone.
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0o600)
+	if _, err := listen("unix:"+file, false); err == nil {
+		t.Error("a regular file replaced by a socket")
+	}
+}
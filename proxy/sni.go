@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// sniPeekTimeout bounds how long a tunnel waits for the client to start a
+// TLS handshake before relaying whatever it has sent so far.
+const sniPeekTimeout = 5 * time.Second
+
+// tlsAccessDenied is a fatal access_denied TLS alert record, the TLS
+// equivalent of a 403 for tunnels refused after the ClientHello.
+var tlsAccessDenied = []byte{21, 3, 3, 0, 2, 2, 49}
+
+// errHelloRead stops the handshake once the ClientHello has been parsed.
+var errHelloRead = errors.New("client hello read")
+
+// peekClientHello reads the start of a TLS handshake from conn and returns
+// the server name the client asked for, along with every byte read so they
+// can be replayed to the backend. Nothing is ever written to conn. If the
+// client doesn't speak TLS the name is empty, and hello still holds the
+// bytes consumed.
+func peekClientHello(conn net.Conn) (sni string, hello []byte) {
+	var buf bytes.Buffer
+	conn.SetReadDeadline(time.Now().Add(sniPeekTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	// Let crypto/tls parse the ClientHello and abort before it answers.
+	tls.Server(&helloConn{Conn: conn, r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = info.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	return sni, buf.Bytes()
+}
+
+// helloConn reads from r and discards writes, so a handshake run over it
+// can't send alerts or a ServerHello to the client.
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *helloConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *helloConn) Write(b []byte) (int, error) { return len(b), nil }
+func (c *helloConn) Close() error                { return nil }
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPeekClientHello(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: "example.com"}).Handshake()
+	}()
+	sni, hello := peekClientHello(server)
+	client.Close()
+	if sni != "example.com" {
+		t.Errorf("sni = %q, want example.com", sni)
+	}
+	if len(hello) < 5 || hello[0] != 22 {
+		t.Errorf("peeked bytes %x aren't a TLS handshake record", hello)
+	}
+
+	client, server = net.Pipe()
+	defer server.Close()
+	go func() {
+		io.WriteString(client, "SSH-2.0-OpenSSH_9.6\r\n")
+		client.Close()
+	}()
+	if sni, hello := peekClientHello(server); sni != "" || len(hello) == 0 || !strings.HasPrefix("SSH-2.0-OpenSSH_9.6\r\n", string(hello)) {
+		t.Errorf("non-TLS client: sni %q, peeked %q; want no name and the bytes read kept", sni, hello)
+	}
+}
+
+// tlsThroughTunnel opens a CONNECT tunnel to target through the proxy at
+// proxyAddr and runs a TLS handshake for serverName over it.
+func tlsThroughTunnel(t *testing.T, proxyAddr, target, serverName string) error {
+	t.Helper()
+	conn, br, resp := connect(t, proxyAddr, target)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT %s got %s", target, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		t.Fatal("bytes after the CONNECT response")
+	}
+	return tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+}
+
+func TestLogSNI(t *testing.T) {
+	backend := httptest.NewTLSServer(nil)
+	defer backend.Close()
+	logger, logs := newTestLogger()
+	p, err := New(WithFlags("-connect-ports", "*", "-log-sni"), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	if err := tlsThroughTunnel(t, srv.Listener.Addr().String(), backend.Listener.Addr().String(), "www.example.com"); err != nil {
+		t.Fatalf("handshake through a peeking tunnel: %v", err)
+	}
+	if !strings.Contains(logs.String(), "sni=www.example.com") {
+		t.Errorf("SNI not logged:\n%s", logs)
+	}
+}
+
+func TestSNIBlocked(t *testing.T) {
+	backend := httptest.NewTLSServer(nil)
+	defer backend.Close()
+	list := writeTempFile(t, "blocklist", "blocked.test\n")
+	srv := newProxyServer(t, "-blocklist", list)
+	// The CONNECT names only the IP; the ClientHello gives the domain away.
+	target := backend.Listener.Addr().String()
+
+	err := tlsThroughTunnel(t, srv.Listener.Addr().String(), target, "www.blocked.test")
+	if err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Errorf("handshake for a blocked SNI: err = %v, want an access_denied alert", err)
+	}
+	if err := tlsThroughTunnel(t, srv.Listener.Addr().String(), target, "allowed.test"); err != nil {
+		t.Errorf("handshake for an unlisted SNI: %v", err)
+	}
+}
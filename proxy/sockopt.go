@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// sockOpts are the socket options applied to both ends of a CONNECT
+// tunnel. Zero buffer sizes leave the OS defaults.
+type sockOpts struct {
+	noDelay     bool
+	readBuffer  int
+	writeBuffer int
+}
+
+// apply sets o on conn, looking through TLS and other wrappers that expose
+// the underlying connection via NetConn. Connections that are not TCP,
+// such as unix sockets, are left alone.
+func (o sockOpts) apply(conn net.Conn) error {
+	for {
+		w, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = w.NetConn()
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	// Go already disables Nagle's algorithm on new TCP connections, so
+	// this only changes anything for -tunnel-nodelay=false.
+	err := tcp.SetNoDelay(o.noDelay)
+	if o.readBuffer > 0 {
+		err = errors.Join(err, tcp.SetReadBuffer(o.readBuffer))
+	}
+	if o.writeBuffer > 0 {
+		err = errors.Join(err, tcp.SetWriteBuffer(o.writeBuffer))
+	}
+	return err
+}
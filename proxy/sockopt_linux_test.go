@@ -0,0 +1,80 @@
+//go:build linux
+
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// sockOpt reads the integer socket option opt at level from conn.
+func sockOpt(t *testing.T, conn *net.TCPConn, level, opt int) int {
+	t.Helper()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var serr error
+	raw.Control(func(fd uintptr) { v, serr = syscall.GetsockoptInt(int(fd), level, opt) })
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return v
+}
+
+func TestSockOpts(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tcp := conn.(*net.TCPConn)
+
+	// Through a TLS wrapper, as a tunnel's connections may be.
+	o := sockOpts{noDelay: false, readBuffer: 64 << 10, writeBuffer: 128 << 10}
+	if err := o.apply(tls.Client(conn, &tls.Config{})); err != nil {
+		t.Fatal(err)
+	}
+	if got := sockOpt(t, tcp, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); got != 0 {
+		t.Errorf("TCP_NODELAY = %d after noDelay false", got)
+	}
+	// Linux reports double what was set, to allow for its bookkeeping.
+	if got := sockOpt(t, tcp, syscall.SOL_SOCKET, syscall.SO_RCVBUF); got < o.readBuffer {
+		t.Errorf("SO_RCVBUF = %d, want at least %d", got, o.readBuffer)
+	}
+	if got := sockOpt(t, tcp, syscall.SOL_SOCKET, syscall.SO_SNDBUF); got < o.writeBuffer {
+		t.Errorf("SO_SNDBUF = %d, want at least %d", got, o.writeBuffer)
+	}
+
+	if err := (sockOpts{noDelay: true}).apply(conn); err != nil {
+		t.Fatal(err)
+	}
+	if got := sockOpt(t, tcp, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); got == 0 {
+		t.Error("TCP_NODELAY unset after noDelay true")
+	}
+
+	// Other connections are left alone.
+	sock := filepath.Join(t.TempDir(), "sock")
+	uln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uln.Close()
+	uconn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uconn.Close()
+	if err := o.apply(uconn); err != nil {
+		t.Errorf("applying to a unix socket: %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+)
+
+// SOCKS5 protocol values (RFC 1928, RFC 1929).
+const (
+	socksVersion = 5
+
+	socksAuthNone     = 0x00
+	socksAuthPassword = 0x02
+	socksAuthRejected = 0xff // none of the offered methods
+
+	socksCmdConnect   = 0x01
+	socksCmdBind      = 0x02
+	socksCmdAssociate = 0x03
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksReplySucceeded       = 0x00
+	socksReplyFailure         = 0x01
+	socksReplyNotAllowed      = 0x02
+	socksReplyHostUnreach     = 0x04
+	socksReplyRefused         = 0x05
+	socksReplyCmdUnsupported  = 0x07
+	socksReplyAddrUnsupported = 0x08
+)
+
+// isSOCKS reports whether u is a SOCKS5 proxy URL. socks5h is accepted as
+// a synonym: names are always sent to the proxy to resolve, never looked up
+// here, just as net/http does for plain requests.
+func isSOCKS(u *url.URL) bool {
+	return u.Scheme == "socks5" || u.Scheme == "socks5h"
+}
+
+// socksConnect asks the SOCKS5 proxy at the other end of conn to connect
+// it to addr, authenticating with user's name and password if set.
+func socksConnect(conn net.Conn, addr string, user *url.Userinfo) error {
+	methods := []byte{socksAuthNone}
+	if user != nil {
+		methods = []byte{socksAuthPassword}
+	}
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var choice [2]byte
+	if _, err := io.ReadFull(conn, choice[:]); err != nil {
+		return err
+	}
+	if choice[0] != socksVersion {
+		return fmt.Errorf("upstream is not a SOCKS5 proxy")
+	}
+	switch choice[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		if user == nil {
+			return errors.New("upstream SOCKS5 proxy wants a password")
+		}
+		name := user.Username()
+		pass, _ := user.Password()
+		if len(name) > 255 || len(pass) > 255 {
+			return errors.New("upstream SOCKS5 credentials are too long")
+		}
+		msg := append([]byte{1, byte(len(name))}, name...)
+		msg = append(append(msg, byte(len(pass))), pass...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		var status [2]byte
+		if _, err := io.ReadFull(conn, status[:]); err != nil {
+			return err
+		}
+		if status[1] != 0 {
+			return errors.New("upstream SOCKS5 proxy rejected the credentials")
+		}
+	default:
+		return errors.New("upstream SOCKS5 proxy accepts none of our authentication methods")
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port in %q", addr)
+	}
+	if len(host) > 255 {
+		return fmt.Errorf("host name too long for SOCKS5: %q", host)
+	}
+	req := []byte{socksVersion, socksCmdConnect, 0}
+	req = appendSOCKSAddr(req, host)
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != socksReplySucceeded {
+		return fmt.Errorf("upstream SOCKS5 proxy refused CONNECT: %s", socksReplyText(reply[1]))
+	}
+	// The bound address is of no use to a tunnel.
+	_, err = readSOCKSAddr(conn, reply[3])
+	return err
+}
+
+var errSOCKSAddrType = errors.New("unsupported SOCKS5 address type")
+
+// readSOCKSAddr reads the address of type atyp and port following it in a
+// request, reply or UDP header, returning them as host:port.
+func readSOCKSAddr(r io.Reader, atyp byte) (string, error) {
+	var host string
+	switch atyp {
+	case socksAddrIPv4, socksAddrIPv6:
+		b := make([]byte, 4)
+		if atyp == socksAddrIPv6 {
+			b = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		ip, _ := netip.AddrFromSlice(b)
+		host = ip.String()
+	case socksAddrDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		b := make([]byte, n[0])
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		host = string(b)
+	default:
+		return "", errSOCKSAddrType
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// appendSOCKSAddr appends host as a SOCKS5 address, without the port: an
+// IP literal as itself, anything else as a domain name.
+func appendSOCKSAddr(b []byte, host string) []byte {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip.Is4() || ip.Is4In6() {
+			return append(append(b, socksAddrIPv4), ip.Unmap().AsSlice()...)
+		}
+		return append(append(b, socksAddrIPv6), ip.AsSlice()...)
+	}
+	return append(append(b, socksAddrDomain, byte(len(host))), host...)
+}
+
+// socksReplyText describes a SOCKS5 reply code.
+func socksReplyText(code byte) string {
+	texts := []string{
+		1: "general failure",
+		2: "not allowed by ruleset",
+		3: "network unreachable",
+		4: "host unreachable",
+		5: "connection refused",
+		6: "TTL expired",
+		7: "command not supported",
+		8: "address type not supported",
+	}
+	if int(code) < len(texts) && texts[code] != "" {
+		return texts[code]
+	}
+	return "reply " + strconv.Itoa(int(code))
+}
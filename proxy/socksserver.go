@@ -0,0 +1,501 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// socksHandshakeTimeout bounds how long a SOCKS client may take to
+// authenticate and send its request.
+const socksHandshakeTimeout = 30 * time.Second
+
+// socksServer accepts SOCKS5 clients on -socks-addr and serves them with
+// the listener's proxy, so its ACL, authentication, filters and logging
+// apply to them just as to HTTP clients.
+type socksServer struct {
+	addr       string
+	reusePort  bool
+	proxyProto []netip.Prefix
+	connLimit  *connLimiter
+	handler    atomic.Pointer[proxy]
+
+	mu      sync.Mutex
+	ln      net.Listener
+	closing bool
+	conns   map[net.Conn]struct{}
+	active  sync.WaitGroup
+}
+
+func newSOCKSServer(addr string, p *proxy) *socksServer {
+	s := &socksServer{addr: addr, conns: make(map[net.Conn]struct{})}
+	s.handler.Store(p)
+	return s
+}
+
+// listenAndServe accepts clients until shutdown, when it returns
+// net.ErrClosed, calling bound once it is listening.
+func (s *socksServer) listenAndServe(bound func()) error {
+	ln, err := listen(s.addr, s.reusePort)
+	if err != nil {
+		return err
+	}
+	if s.proxyProto != nil {
+		ln = &proxyProtoListener{Listener: ln, trusted: s.proxyProto}
+	}
+	ln = s.connLimit.listener(ln, false)
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		ln.Close()
+		return net.ErrClosed
+	}
+	s.ln = ln
+	s.mu.Unlock()
+	bound()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if fdExhausted(err) {
+				logFDExhausted(slog.Default(), err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			s.mu.Lock()
+			closing := s.closing
+			s.mu.Unlock()
+			if closing {
+				return net.ErrClosed
+			}
+			return err
+		}
+		if !s.track(conn, true) {
+			conn.Close()
+			return net.ErrClosed
+		}
+		go func() {
+			defer s.track(conn, false)
+			defer conn.Close()
+			s.handler.Load().serveSOCKS(conn)
+		}()
+	}
+}
+
+// track adds or removes a client connection, refusing new ones once
+// shutdown has begun.
+func (s *socksServer) track(conn net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, conn)
+		s.active.Done()
+		return true
+	}
+	if s.closing {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.active.Add(1)
+	return true
+}
+
+// shutdown stops accepting clients and waits for connected ones to finish
+// until ctx is done, then closes them.
+func (s *socksServer) shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// serveSOCKS serves one SOCKS5 client connection.
+func (p *proxy) serveSOCKS(conn net.Conn) {
+	log := p.log().With("remote", conn.RemoteAddr().String())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	user, err := p.socksAuthenticate(conn)
+	if user != "" {
+		log = log.With("user", user)
+	}
+	if err != nil {
+		log.Warn("SOCKS client failed proxy authentication", "error", err)
+		return
+	}
+
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		log.Debug("reading SOCKS request", "error", err)
+		return
+	}
+	addr, err := readSOCKSAddr(conn, head[3])
+	if err != nil || head[0] != socksVersion {
+		log.Warn("bad SOCKS request", "error", err)
+		writeSOCKSReply(conn, socksReplyAddrUnsupported, nil)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	req := socksRequest(ctx, conn, addr)
+	switch head[1] {
+	case socksCmdConnect:
+		log = log.With("method", "SOCKS CONNECT", "URL", addr)
+		log.Info("Incoming Request")
+		defer p.stats.begin()()
+		p.socksConnect(conn, req, user, log)
+	case socksCmdAssociate:
+		log = log.With("method", "SOCKS UDP ASSOCIATE", "URL", addr)
+		log.Info("Incoming Request")
+		defer p.stats.begin()()
+		p.socksAssociate(conn, req, log)
+	default:
+		log.Warn("unsupported SOCKS command", "command", head[1])
+		writeSOCKSReply(conn, socksReplyCmdUnsupported, nil)
+	}
+}
+
+// socksRequest describes a SOCKS request as the CONNECT request it amounts
+// to, so it goes through the same filters and audit log as HTTP ones.
+func socksRequest(ctx context.Context, conn net.Conn, addr string) *http.Request {
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: addr},
+		Host:       addr,
+		RemoteAddr: conn.RemoteAddr().String(),
+		Header:     make(http.Header),
+	}
+	return req.WithContext(ctx)
+}
+
+// socksAuthenticate negotiates the authentication method: username and
+// password against -auth-file when it is set, none otherwise.
+func (p *proxy) socksAuthenticate(conn net.Conn) (user string, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return "", err
+	}
+	if head[0] != socksVersion {
+		return "", fmt.Errorf("not a SOCKS5 client (version %d)", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	want := byte(socksAuthNone)
+	if p.auth != nil {
+		want = socksAuthPassword
+	}
+	if !bytes.Contains(methods, []byte{want}) {
+		conn.Write([]byte{socksVersion, socksAuthRejected})
+		return "", errors.New("client offered no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, want}); err != nil {
+		return "", err
+	}
+	if want == socksAuthNone {
+		return "", nil
+	}
+
+	// RFC 1929: VER ULEN UNAME PLEN PASSWD
+	var b [1]byte
+	readField := func() (string, error) {
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return "", err
+		}
+		field := make([]byte, b[0])
+		_, err := io.ReadFull(conn, field)
+		return string(field), err
+	}
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return "", err
+	}
+	user, err = readField()
+	if err != nil {
+		return "", err
+	}
+	pass, err := readField()
+	if err != nil {
+		return user, err
+	}
+	if !p.auth.users.check(user, pass) {
+		conn.Write([]byte{1, 1})
+		return user, errors.New("wrong username or password")
+	}
+	_, err = conn.Write([]byte{1, 0})
+	return user, err
+}
+
+// writeSOCKSReply sends a reply with the given code and bound address.
+func writeSOCKSReply(conn net.Conn, code byte, bound net.Addr) error {
+	ap := netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+	switch a := bound.(type) {
+	case *net.TCPAddr:
+		ap = a.AddrPort()
+	case *net.UDPAddr:
+		ap = a.AddrPort()
+	}
+	b := appendSOCKSAddr([]byte{socksVersion, code, 0}, ap.Addr().Unmap().String())
+	b = binary.BigEndian.AppendUint16(b, ap.Port())
+	_, err := conn.Write(b)
+	return err
+}
+
+// socksPermitted applies the destination filters to req, as for an HTTP
+// CONNECT, and returns the reply code to refuse it with, if any.
+func (p *proxy) socksPermitted(req *http.Request, log *slog.Logger) (byte, bool) {
+	if rule, ok := p.blocklist.match(targetHost(req)); ok {
+		logBlocked(log, req, blockReasonDenyList, rule)
+		return socksReplyNotAllowed, false
+	}
+	if rule, ok := p.checkACL(req, req.Host); !ok {
+		logBlocked(log, req, blockReasonACL, rule)
+		return socksReplyNotAllowed, false
+	}
+	if rule, blocked := p.routeBlocks(req.Host); blocked {
+		logBlocked(log, req, blockReasonRoute, rule)
+		return socksReplyNotAllowed, false
+	}
+	if country := p.geo.country(req.RemoteAddr); !p.geo.permits(country) {
+		logBlocked(log, req, blockReasonGeo, "country "+country)
+		return socksReplyNotAllowed, false
+	}
+	if p.quota != nil {
+		client, _ := remoteHost(req.RemoteAddr)
+		if wait, over := p.quota.exceeded(client); over {
+			log.Warn("client over byte quota", "client", client, "reset", wait)
+			return socksReplyNotAllowed, false
+		}
+	}
+	if p.globalRate != nil {
+		wait, ok := p.globalRate.reserve(p.globalRateWait)
+		if !ok {
+			log.Warn("over -global-rate, refusing request", "retry", wait)
+			return socksReplyFailure, false
+		}
+		time.Sleep(wait)
+	}
+	return 0, true
+}
+
+// socksReplyFor returns the SOCKS reply code for a failed dial.
+func socksReplyFor(err error) byte {
+	switch dialErrorKind(err) {
+	case "refused":
+		return socksReplyRefused
+	case "dns", "timeout":
+		return socksReplyHostUnreach
+	}
+	return socksReplyFailure
+}
+
+// socksConnect serves a CONNECT command: a TCP tunnel like an HTTP
+// CONNECT's, upstream proxies included.
+func (p *proxy) socksConnect(conn net.Conn, req *http.Request, user string, log *slog.Logger) {
+	if code, ok := p.socksPermitted(req, log); !ok {
+		writeSOCKSReply(conn, code, nil)
+		return
+	}
+	req = p.acl.pin(req, req.Host)
+	if rule, wait, over := p.overRateLimit(req, user); over {
+		log.Warn("client over -rate-limit", "rule", rule, "retry", wait)
+		writeSOCKSReply(conn, socksReplyNotAllowed, nil)
+		return
+	}
+	req = p.shapeBandwidth(req, user)
+	if _, port, _ := net.SplitHostPort(req.Host); !p.connectPorts.allows(port) {
+		logBlocked(log, req, blockReasonPort, "-connect-ports")
+		writeSOCKSReply(conn, socksReplyNotAllowed, nil)
+		return
+	}
+	if !p.acquireTunnel() {
+		log.Warn("too many tunnels, refusing SOCKS CONNECT", "max", p.maxTunnels)
+		writeSOCKSReply(conn, socksReplyFailure, nil)
+		return
+	}
+	defer p.releaseTunnel()
+
+	if host, _, _ := net.SplitHostPort(req.Host); p.mitm.intercepts(host) {
+		if err := writeSOCKSReply(conn, socksReplySucceeded, conn.LocalAddr()); err == nil {
+			p.serveIntercepted(conn, req, req.Host, user, log)
+		}
+		return
+	}
+
+	sock, err := p.dialTunnel(req.Context(), req.Host, log)
+	if err != nil {
+		if fdExhausted(err) {
+			logFDExhausted(log, err)
+		}
+		writeSOCKSReply(conn, socksReplyFor(err), nil)
+		return
+	}
+	defer sock.Close()
+	if err := writeSOCKSReply(conn, socksReplySucceeded, sock.LocalAddr()); err != nil {
+		return
+	}
+	p.relay(conn, sock, req, log)
+}
+
+// socksAssociate serves a UDP ASSOCIATE command. Datagrams are relayed
+// from a UDP socket opened for the client, for as long as its TCP
+// connection stays open. Only datagrams from the client's IP are relayed
+// out, and only replies from destinations it has sent to are relayed
+// back. Each new destination goes through the filters; fragmented
+// datagrams are dropped. UDP can't go through upstream proxies, so it is
+// refused when any are set.
+func (p *proxy) socksAssociate(conn net.Conn, req *http.Request, log *slog.Logger) {
+	if p.routesUpstream() {
+		log.Warn("refusing SOCKS UDP ASSOCIATE, UDP can't be sent through -upstream")
+		writeSOCKSReply(conn, socksReplyCmdUnsupported, nil)
+		return
+	}
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		log.Warn("refusing SOCKS UDP ASSOCIATE from a Unix socket client")
+		writeSOCKSReply(conn, socksReplyCmdUnsupported, nil)
+		return
+	}
+	if !p.acquireTunnel() {
+		log.Warn("too many tunnels, refusing SOCKS UDP ASSOCIATE", "max", p.maxTunnels)
+		writeSOCKSReply(conn, socksReplyFailure, nil)
+		return
+	}
+	defer p.releaseTunnel()
+
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		log.Error("opening SOCKS UDP relay", "error", err)
+		writeSOCKSReply(conn, socksReplyFailure, nil)
+		return
+	}
+	defer pc.Close()
+	if err := writeSOCKSReply(conn, socksReplySucceeded, pc.LocalAddr()); err != nil {
+		return
+	}
+	p.stats.tunnel()
+
+	// The association ends with the control connection.
+	go func() {
+		io.Copy(io.Discard, conn)
+		pc.Close()
+	}()
+
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr().Unmap()
+	client, _ := remoteHost(req.RemoteAddr)
+	var clientAddr netip.AddrPort
+	// Clients may say which port they will send from, or leave it 0.
+	if _, port, _ := net.SplitHostPort(req.Host); port != "0" {
+		n, _ := strconv.ParseUint(port, 10, 16)
+		clientAddr = netip.AddrPortFrom(clientIP, uint16(n))
+	}
+	// targets holds the verdict for each destination seen so far: its
+	// resolved address, or an invalid one if it is refused.
+	targets := make(map[string]netip.AddrPort)
+	sent := make(map[netip.AddrPort]bool)
+	count := func(n int) {
+		p.stats.addBytes(int64(n))
+		if p.quota != nil {
+			p.quota.add(client, int64(n))
+		}
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := pc.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+
+		if from.Addr() == clientIP && (!clientAddr.IsValid() || clientAddr == from) {
+			clientAddr = from
+			r := bytes.NewReader(buf[:n])
+			var head [4]byte
+			if _, err := io.ReadFull(r, head[:]); err != nil || head[2] != 0 {
+				continue // short, or a fragment
+			}
+			dest, err := readSOCKSAddr(r, head[3])
+			if err != nil {
+				continue
+			}
+			target, seen := targets[dest]
+			if !seen {
+				target = p.socksUDPTarget(socksRequest(req.Context(), conn, dest), log)
+				targets[dest] = target
+			}
+			if !target.IsValid() {
+				continue
+			}
+			payload := buf[n-r.Len() : n]
+			if _, err := pc.WriteToUDPAddrPort(payload, target); err == nil {
+				sent[target] = true
+				count(len(payload))
+				p.metrics.addBytes(int64(len(payload)), 0)
+			}
+			continue
+		}
+
+		if !sent[from] || !clientAddr.IsValid() {
+			continue
+		}
+		b := appendSOCKSAddr([]byte{0, 0, 0}, from.Addr().String())
+		b = binary.BigEndian.AppendUint16(b, from.Port())
+		if _, err := pc.WriteToUDPAddrPort(append(b, buf[:n]...), clientAddr); err == nil {
+			count(n)
+			p.metrics.addBytes(0, int64(n))
+		}
+	}
+}
+
+// socksUDPTarget filters and resolves a UDP destination, returning an
+// invalid address if it is refused or doesn't resolve.
+func (p *proxy) socksUDPTarget(req *http.Request, log *slog.Logger) netip.AddrPort {
+	if _, ok := p.socksPermitted(req, log); !ok {
+		return netip.AddrPort{}
+	}
+	host, port, _ := net.SplitHostPort(req.Host)
+	ips, err := p.lookup().LookupNetIP(req.Context(), "ip", host)
+	if err != nil || len(ips) == 0 {
+		log.Warn("resolving SOCKS UDP destination", "host", host, "error", err)
+		return netip.AddrPort{}
+	}
+	n, _ := strconv.ParseUint(port, 10, 16)
+	if rule, ok := p.acl.checkAddr(host, int(n), ips[0]); !ok {
+		logBlocked(log, req, blockReasonACL, rule)
+		return netip.AddrPort{}
+	}
+	return netip.AddrPortFrom(ips[0].Unmap(), uint16(n))
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSOCKSListener serves SOCKS5 clients with the proxy args configure
+// and returns its address.
+func newSOCKSListener(t *testing.T, args ...string) string {
+	t.Helper()
+	s := newSOCKSServer("127.0.0.1:0", newTestProxy(t, args...).l.handler)
+	bound := make(chan string, 1)
+	go s.listenAndServe(func() { bound <- s.ln.Addr().String() })
+	t.Cleanup(func() { s.shutdown(context.Background()) })
+	select {
+	case addr := <-bound:
+		return addr
+	case <-time.After(5 * time.Second):
+		t.Fatal("SOCKS listener didn't start")
+		return ""
+	}
+}
+
+// dialSOCKS connects to the SOCKS5 server at addr.
+func dialSOCKS(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func TestSOCKSConnect(t *testing.T) {
+	echo := newEchoServer(t)
+	addr := newSOCKSListener(t)
+	conn := dialSOCKS(t, addr)
+	if err := socksConnect(conn, echo, nil); err != nil {
+		t.Fatalf("SOCKS CONNECT: %v", err)
+	}
+	if !echoes(conn, bufio.NewReader(conn), "ping") {
+		t.Error("SOCKS tunnel didn't carry data")
+	}
+
+	if err := socksConnect(dialSOCKS(t, addr), closedAddr(t), nil); err == nil || !strings.Contains(err.Error(), socksReplyText(socksReplyRefused)) {
+		t.Errorf("CONNECT to a closed port got %v, want connection refused", err)
+	}
+}
+
+func TestSOCKSAuth(t *testing.T) {
+	echo := newEchoServer(t)
+	addr := newSOCKSListener(t, "-auth-file", writeUserFile(t, "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="))
+	for _, tt := range []struct {
+		user *url.Userinfo
+		ok   bool
+	}{
+		{url.UserPassword("alice", "secret"), true},
+		{url.UserPassword("alice", "wrong"), false},
+		{nil, false},
+	} {
+		conn := dialSOCKS(t, addr)
+		err := socksConnect(conn, echo, tt.user)
+		if (err == nil) != tt.ok {
+			t.Errorf("CONNECT as %v got %v, want ok %v", tt.user, err, tt.ok)
+		}
+		if err == nil && !echoes(conn, bufio.NewReader(conn), "ping") {
+			t.Errorf("tunnel as %v didn't carry data", tt.user)
+		}
+	}
+}
+
+func TestSOCKSFilters(t *testing.T) {
+	echo := newEchoServer(t)
+	_, port, _ := net.SplitHostPort(echo)
+	for _, args := range [][]string{
+		{"-acl-deny", "127.0.0.1"},
+		{"-connect-ports", "443"},
+	} {
+		err := socksConnect(dialSOCKS(t, newSOCKSListener(t, args...)), echo, nil)
+		if err == nil || !strings.Contains(err.Error(), socksReplyText(socksReplyNotAllowed)) {
+			t.Errorf("%q: CONNECT to %s got %v, want not allowed", args, echo, err)
+		}
+	}
+	if err := socksConnect(dialSOCKS(t, newSOCKSListener(t, "-connect-ports", port)), echo, nil); err != nil {
+		t.Errorf("CONNECT to a listed port got %v", err)
+	}
+}
+
+// associateSOCKS sends a UDP ASSOCIATE over conn and returns the relay
+// address the server replies with, or the reply code if it refuses.
+func associateSOCKS(t *testing.T, conn net.Conn) (*net.UDPAddr, error) {
+	t.Helper()
+	if _, err := conn.Write([]byte{socksVersion, 1, socksAuthNone}); err != nil {
+		return nil, err
+	}
+	var choice [2]byte
+	if _, err := io.ReadFull(conn, choice[:]); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksCmdAssociate, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return nil, err
+	}
+	relay, err := readSOCKSAddr(conn, reply[3])
+	if err != nil {
+		return nil, err
+	}
+	if reply[1] != socksReplySucceeded {
+		return nil, errors.New(socksReplyText(reply[1]))
+	}
+	return net.ResolveUDPAddr("udp", relay)
+}
+
+func TestSOCKSAssociate(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	relay, err := associateSOCKS(t, dialSOCKS(t, newSOCKSListener(t)))
+	if err != nil {
+		t.Fatalf("UDP ASSOCIATE: %v", err)
+	}
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// RFC 1928 UDP header: RSV RSV FRAG ATYP DST.ADDR DST.PORT
+	target := echo.LocalAddr().(*net.UDPAddr)
+	head := appendSOCKSAddr([]byte{0, 0, 0}, "127.0.0.1")
+	head = binary.BigEndian.AppendUint16(head, uint16(target.Port))
+	if _, err := client.WriteToUDP(append(head, "ping"...), relay); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("no reply relayed: %v", err)
+	}
+	if !bytes.Equal(buf[:n], append(head, "ping"...)) {
+		t.Errorf("relayed reply %q, want %q", buf[:n], append(head, "ping"...))
+	}
+
+	upstream := newSOCKSListener(t, "-upstream", "http://"+closedAddr(t))
+	if _, err := associateSOCKS(t, dialSOCKS(t, upstream)); err == nil || err.Error() != socksReplyText(socksReplyCmdUnsupported) {
+		t.Errorf("UDP ASSOCIATE with -upstream got %v, want command not supported", err)
+	}
+}
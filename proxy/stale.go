@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// staleEntry is a copy of a successful backend response kept around so it
+// can be served if the backend later becomes unreachable.
+type staleEntry struct {
+	status int
+	header http.Header
+	body   []byte
+	stored time.Time
+}
+
+// staleCache holds the last good response for each URL. It is only
+// consulted when the backend fails, so entries never expire; the oldest
+// entry is evicted once maxEntries is reached.
+type staleCache struct {
+	mu         sync.Mutex
+	entries    map[string]*staleEntry
+	order      []string
+	maxEntries int
+	maxBody    int
+}
+
+func newStaleCache(maxEntries, maxBody int) *staleCache {
+	return &staleCache{
+		entries:    make(map[string]*staleEntry),
+		maxEntries: maxEntries,
+		maxBody:    maxBody,
+	}
+}
+
+func (c *staleCache) get(key string) *staleEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries[key]
+}
+
+func (c *staleCache) put(key string, e *staleEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		if c.maxEntries > 0 && len(c.order) >= c.maxEntries {
+			delete(c.entries, c.order[0])
+			c.order = c.order[1:]
+		}
+		c.order = append(c.order, key)
+	}
+	c.entries[key] = e
+}
+
+// flush drops every entry and returns how many there were.
+func (c *staleCache) flush() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.entries)
+	c.entries = make(map[string]*staleEntry)
+	c.order = nil
+	return n
+}
+
+// serve writes a stale entry to the client, marking it with the RFC 7234
+// "Response is Stale" warning and, if statusHeader is set, a STALE cache
+// status.
+func (e *staleEntry) serve(wr http.ResponseWriter, statusHeader string) {
+	copyHeader(wr.Header(), e.header)
+	wr.Header().Add("Warning", `110 - "Response is Stale"`)
+	setCacheStatus(wr.Header(), statusHeader, cacheStale)
+	wr.WriteHeader(e.status)
+	wr.Write(e.body)
+}
+
+// Values of the cache status header (-cache-status-header).
+const (
+	cacheHit    = "HIT"
+	cacheMiss   = "MISS"
+	cacheStale  = "STALE"
+	cacheBypass = "BYPASS"
+)
+
+// setCacheStatus records how the proxy's cache handled a request in the
+// header called name. An empty name disables the header.
+func setCacheStatus(header http.Header, name, status string) {
+	if name != "" {
+		header.Set(name, status)
+	}
+}
+
+// staleKey returns the cache key for req, or "" if the request is not
+// eligible for stale serving. Like the coalescer's, it includes
+// Accept-Encoding, so a compressed body only goes to clients that asked
+// for one.
+func staleKey(req *http.Request) string {
+	if req.Method != http.MethodGet {
+		return ""
+	}
+	return cacheKey(req) + "\x00" + strings.Join(req.Header.Values("Accept-Encoding"), ",")
+}
+
+// staleStorable reports whether resp, the answer to req, may be kept for
+// -serve-stale. An entry goes to the next client asking for the URL,
+// whoever that is, so it takes a response a shared cache may store that
+// varies on nothing but Accept-Encoding.
+func staleStorable(req *http.Request, resp *http.Response) bool {
+	return resp.StatusCode == http.StatusOK && sharedStorable(req, resp) && variesOnlyOnEncoding(resp.Header)
+}
+
+// cappedBuffer collects up to max bytes; anything past that marks it as
+// overflowed and is discarded.
+type cappedBuffer struct {
+	bytes.Buffer
+	max      int
+	overflow bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if b.overflow {
+		return len(p), nil
+	}
+	if b.Len()+len(p) > b.max {
+		b.overflow = true
+		b.Reset()
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServeStaleWhenBackendDown(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("X-From", "backend")
+		fmt.Fprint(wr, "good "+req.URL.Path)
+	})
+	p := newTestProxy(t, "-backend", b.URL, "-serve-stale")
+
+	if rec := serve(p, "GET", "http://front.test/a"); rec.Header().Get("X-Cache") != cacheMiss {
+		t.Errorf("first response X-Cache = %q, want %s", rec.Header().Get("X-Cache"), cacheMiss)
+	}
+	b.Close()
+
+	rec := serve(p, "GET", "http://front.test/a")
+	if rec.Code != http.StatusOK || rec.Body.String() != "good /a" {
+		t.Errorf("backend down: got %d %q, want the stale copy", rec.Code, rec.Body)
+	}
+	if rec.Header().Get("X-Cache") != cacheStale || rec.Header().Get("X-From") != "backend" {
+		t.Errorf("stale headers = %v", rec.Header())
+	}
+	if w := rec.Header().Get("Warning"); !strings.HasPrefix(w, "110 ") {
+		t.Errorf("Warning = %q, want 110", w)
+	}
+
+	if rec := serve(p, "GET", "http://front.test/never-fetched"); rec.Code != http.StatusBadGateway {
+		t.Errorf("uncached URL with the backend down got %d, want 502", rec.Code)
+	}
+}
+
+func TestServeStaleOnGatewayErrors(t *testing.T) {
+	status := http.StatusOK
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		wr.WriteHeader(status)
+		fmt.Fprintf(wr, "status %d", status)
+	})
+	p := newTestProxy(t, "-backend", b.URL, "-serve-stale")
+	serve(p, "GET", "http://front.test/")
+
+	for _, tt := range []struct {
+		status int
+		want   string
+	}{
+		{http.StatusBadGateway, "status 200"},
+		{http.StatusGatewayTimeout, "status 200"},
+		{http.StatusInternalServerError, "status 500"},
+		{http.StatusNotFound, "status 404"},
+	} {
+		status = tt.status
+		if rec := serve(p, "GET", "http://front.test/"); rec.Body.String() != tt.want {
+			t.Errorf("backend %d: got %q, want %q", tt.status, rec.Body, tt.want)
+		}
+	}
+}
+
+func TestServeStaleKeepsOnlyGoodGETs(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			http.NotFound(wr, req)
+			return
+		}
+		fmt.Fprint(wr, strings.Repeat("x", 100))
+	})
+	p := newTestProxy(t, "-backend", b.URL, "-serve-stale", "-stale-max-body", "50")
+	serve(p, "GET", "http://front.test/big")
+	serve(p, "GET", "http://front.test/missing")
+	serve(p, "POST", "http://front.test/post")
+	if n := len(p.l.handler.stale.entries); n != 0 {
+		t.Errorf("%d entries kept, want none", n)
+	}
+}
+
+func TestServeStaleKeepsOnlySharedResponses(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/private":
+			wr.Header().Set("Cache-Control", "private")
+		case "/cookie":
+			wr.Header().Set("Set-Cookie", "session=ann")
+		case "/vary":
+			wr.Header().Set("Vary", "Cookie")
+		case "/public":
+			wr.Header().Set("Cache-Control", "public")
+		}
+		fmt.Fprint(wr, "for "+req.Header.Get("Authorization"))
+	})
+	p := newTestProxy(t, "-backend", b.URL, "-serve-stale")
+	for _, path := range []string{"/private", "/cookie", "/vary", "/authorized", "/public"} {
+		serve(p, "GET", "http://front.test"+path, "Authorization: Basic YW5uOnB3")
+	}
+	serve(p, "GET", "http://front.test/encoded", "Accept-Encoding: gzip")
+	b.Close()
+
+	for _, path := range []string{"/private", "/cookie", "/vary", "/authorized", "/encoded"} {
+		if rec := serve(p, "GET", "http://front.test"+path); rec.Code != http.StatusBadGateway {
+			t.Errorf("%s with the backend down got %d %q, want 502", path, rec.Code, rec.Body)
+		}
+	}
+	if rec := serve(p, "GET", "http://front.test/public"); rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != cacheStale {
+		t.Errorf("public response to an authorized request got %d with X-Cache %q, want it served stale", rec.Code, rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestStaleCacheEvictsOldest(t *testing.T) {
+	c := newStaleCache(2, 100)
+	for _, key := range []string{"a", "b", "a", "c"} {
+		c.put(key, &staleEntry{body: []byte(key)})
+	}
+	if c.get("a") != nil {
+		t.Error("a, the oldest, wasn't evicted")
+	}
+	if c.get("b") == nil || c.get("c") == nil {
+		t.Error("newer entries evicted")
+	}
+	if n := c.flush(); n != 2 || c.get("b") != nil {
+		t.Errorf("flush dropped %d, want 2", n)
+	}
+}
+
+func TestCappedBuffer(t *testing.T) {
+	b := &cappedBuffer{max: 5}
+	fmt.Fprint(b, "abc")
+	fmt.Fprint(b, "de")
+	if b.overflow || b.String() != "abcde" {
+		t.Errorf("at the cap: %q overflow %v", b.String(), b.overflow)
+	}
+	fmt.Fprint(b, "f")
+	if !b.overflow || b.Len() != 0 {
+		t.Errorf("past the cap: %q overflow %v", b.String(), b.overflow)
+	}
+}
+
+func TestCacheStatusHeader(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("Cache-Control", "max-age=60")
+	})
+	p := newTestProxy(t, "-backend", b.URL, "-cache-size", "1000000", "-serve-stale", "-cache-status-header", "X-Proxy-Cache")
+	for _, tt := range []struct {
+		method, path string
+		header       []string
+		want         string
+	}{
+		{"GET", "/a", nil, cacheMiss},
+		{"GET", "/a", nil, cacheHit},
+		{"POST", "/a", nil, cacheBypass},
+		{"GET", "/b", []string{"Cache-Control: only-if-cached"}, cacheMiss},
+		{"GET", "/a", []string{"Cache-Control: no-store"}, cacheMiss},
+	} {
+		rec := serve(p, tt.method, "http://front.test"+tt.path, tt.header...)
+		if got := rec.Header().Get("X-Proxy-Cache"); got != tt.want {
+			t.Errorf("%s %s %q: cache status %q, want %s", tt.method, tt.path, tt.header, got, tt.want)
+		}
+		if rec.Header().Get("X-Cache") != "" {
+			t.Error("default X-Cache header set as well")
+		}
+	}
+
+	off := newTestProxy(t, "-backend", b.URL, "-cache-size", "1000000", "-cache-status-header", "")
+	if rec := serve(off, "GET", "http://front.test/a"); rec.Header().Get("X-Cache") != "" {
+		t.Error("empty -cache-status-header still set X-Cache")
+	}
+
+	b.Close()
+	if got := serve(p, "GET", "http://front.test/a", "Cache-Control: no-cache").Header().Get("X-Proxy-Cache"); got != cacheStale {
+		t.Errorf("backend down: cache status %q, want %s", got, cacheStale)
+	}
+}
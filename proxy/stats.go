@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// serverStats counts traffic over the life of the process, for the summary
+// logged at shutdown. It is shared by every listener.
+type serverStats struct {
+	start    time.Time
+	requests atomic.Int64
+	tunnels  atomic.Int64
+	bytes    atomic.Int64
+	active   atomic.Int64
+	peak     atomic.Int64
+}
+
+func newServerStats() *serverStats {
+	return &serverStats{start: time.Now()}
+}
+
+// begin records the start of a request and returns the function that
+// records its end.
+func (s *serverStats) begin() func() {
+	if s == nil {
+		return func() {}
+	}
+	s.requests.Add(1)
+	n := s.active.Add(1)
+	for {
+		peak := s.peak.Load()
+		if n <= peak || s.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	return func() { s.active.Add(-1) }
+}
+
+// addBytes counts n bytes transferred in either direction.
+func (s *serverStats) addBytes(n int64) {
+	if s != nil {
+		s.bytes.Add(n)
+	}
+}
+
+// tunnel counts an established CONNECT tunnel.
+func (s *serverStats) tunnel() {
+	if s != nil {
+		s.tunnels.Add(1)
+	}
+}
+
+// log writes the summary line.
+func (s *serverStats) log() {
+	if s == nil {
+		return
+	}
+	slog.Info("Summary",
+		"requests", s.requests.Load(),
+		"bytes", s.bytes.Load(),
+		"tunnels", s.tunnels.Load(),
+		"peak_concurrency", s.peak.Load(),
+		"uptime", time.Since(s.start).Round(time.Second),
+	)
+}
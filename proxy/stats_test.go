@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServerStats(t *testing.T) {
+	release := make(chan struct{})
+	b := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			<-release
+		}
+		wr.Write(make([]byte, 100))
+	}))
+	defer b.Close()
+	p := newTestProxy(t, "-backend", b.URL)
+	stats := p.l.handler.stats
+
+	serveBody(p, "POST", "http://front.test/", strings.NewReader("0123456789"))
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(p, "GET", "http://front.test/slow")
+		}()
+	}
+	waitFor(t, func() bool { return stats.active.Load() == 3 })
+	close(release)
+	wg.Wait()
+
+	fwd := newTestProxy(t)
+	fwd.l.handler.stats = stats
+	tunnels := httptest.NewServer(fwd)
+	defer tunnels.Close()
+	conn, br, _ := connect(t, tunnels.Listener.Addr().String(), newEchoServer(t))
+	echoes(conn, br, "ping")
+	conn.Close()
+	waitFor(t, func() bool { return stats.bytes.Load() == 4*100+10+8 })
+
+	if got := [3]int64{stats.requests.Load(), stats.tunnels.Load(), stats.peak.Load()}; got != [3]int64{5, 1, 3} {
+		t.Errorf("requests, tunnels, peak = %v, want [5 1 3]", got)
+	}
+
+	logger, logs := newTestLogger()
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logger)
+	stats.start = time.Now().Add(-time.Minute)
+	stats.log()
+	for _, want := range []string{"requests=5", "bytes=418", "tunnels=1", "peak_concurrency=3", "uptime=1m0s"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("summary lacks %s: %s", want, logs)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package proxy
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// newSyslogHandler reports that syslog isn't available here.
+func newSyslogHandler(target string) (slog.Handler, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,94 @@
+//go:build !windows && !plan9
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// newSyslogHandler returns a slog handler sending records to syslog.
+// target is "local" for the local daemon, or a URL such as
+// udp://logs:514, tcp://logs:601 or unix:///dev/log.
+func newSyslogHandler(target string) (slog.Handler, error) {
+	var network, addr string
+	if target != "local" {
+		u, err := url.Parse(target)
+		if err != nil || u.Scheme == "" {
+			return nil, fmt.Errorf("invalid -syslog target %q", target)
+		}
+		network, addr = u.Scheme, u.Host
+		if network == "unix" || network == "unixgram" {
+			addr = u.Path
+		}
+	}
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "minprox")
+	if err != nil {
+		return nil, err
+	}
+	out := &syslogWriter{w: w}
+	return &syslogHandler{
+		Handler: slog.NewTextHandler(out, &slog.HandlerOptions{
+			Level: logLevel,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				// syslog stamps and grades each message itself.
+				if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+					return slog.Attr{}
+				}
+				return a
+			},
+		}),
+		out: out,
+	}, nil
+}
+
+// syslogWriter sends each line written to it at the severity of the
+// record being handled.
+type syslogWriter struct {
+	mu    sync.Mutex
+	w     *syslog.Writer
+	level slog.Level
+}
+
+func (s *syslogWriter) Write(b []byte) (int, error) {
+	msg := strings.TrimSuffix(string(b), "\n")
+	var err error
+	switch {
+	case s.level >= slog.LevelError:
+		err = s.w.Err(msg)
+	case s.level >= slog.LevelWarn:
+		err = s.w.Warning(msg)
+	case s.level >= slog.LevelInfo:
+		err = s.w.Info(msg)
+	default:
+		err = s.w.Debug(msg)
+	}
+	return len(b), err
+}
+
+// syslogHandler formats records with a text handler and tells the shared
+// writer their level.
+type syslogHandler struct {
+	slog.Handler
+	out *syslogWriter
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+	h.out.level = r.Level
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{Handler: h.Handler.WithAttrs(attrs), out: h.out}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{Handler: h.Handler.WithGroup(name), out: h.out}
+}
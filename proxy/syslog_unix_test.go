@@ -0,0 +1,50 @@
+//go:build !windows && !plan9
+
+package proxy
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogHandler(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	h, err := newSyslogHandler("udp://" + pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := slog.New(h).With("listener", "main")
+	log.Error("dial failed", "error", "refused")
+	log.Warn("slow backend")
+	log.Info("Incoming Request")
+
+	// The priority is facility daemon (3) times 8 plus the severity.
+	for _, want := range []string{"<27>", "<28>", "<30>"} {
+		buf := make([]byte, 2048)
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := string(buf[:n])
+		if !strings.HasPrefix(msg, want) || !strings.Contains(msg, "minprox") || !strings.Contains(msg, "listener=main") {
+			t.Errorf("got %q, want priority %s from minprox", msg, want)
+		}
+		if strings.Contains(msg, "level=") || strings.Contains(msg, "time=") {
+			t.Errorf("%q repeats the time or level syslog records itself", msg)
+		}
+	}
+
+	for _, target := range []string{"logs:514", "%zz"} {
+		if _, err := newSyslogHandler(target); err == nil {
+			t.Errorf("-syslog %q accepted", target)
+		}
+	}
+}
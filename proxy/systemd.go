@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// systemdSockets are the listening sockets systemd passed in for socket
+// activation (LISTEN_FDS), taken by "systemd:" addresses. "systemd:NAME"
+// takes the one with FileDescriptorName=NAME, and a bare "systemd:" the
+// next not yet taken, so if a unit passes several, name them.
+var systemdSockets struct {
+	once  sync.Once
+	mu    sync.Mutex
+	files []*os.File
+	names []string
+	err   error
+}
+
+// listenFDsStart is the first file descriptor systemd passes.
+const listenFDsStart = 3
+
+// systemdListener returns the inherited socket for a "systemd:" address,
+// name being what follows the colon.
+func systemdListener(name string) (net.Listener, error) {
+	s := &systemdSockets
+	s.once.Do(func() {
+		defer func() {
+			// Not for any processes started from here.
+			os.Unsetenv("LISTEN_PID")
+			os.Unsetenv("LISTEN_FDS")
+			os.Unsetenv("LISTEN_FDNAMES")
+		}()
+		if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid != os.Getpid() {
+			s.err = fmt.Errorf("no sockets passed by systemd (LISTEN_PID is not this process)")
+			return
+		}
+		n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || n < 1 {
+			s.err = fmt.Errorf("no sockets passed by systemd (LISTEN_FDS %q)", os.Getenv("LISTEN_FDS"))
+			return
+		}
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i := range n {
+			fd := uintptr(listenFDsStart + i)
+			s.files = append(s.files, os.NewFile(fd, "systemd:"+strconv.Itoa(int(fd))))
+			if i < len(names) {
+				s.names = append(s.names, names[i])
+			} else {
+				s.names = append(s.names, "")
+			}
+		}
+	})
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, f := range s.files {
+		if f == nil || (name != "" && s.names[i] != name) {
+			continue
+		}
+		s.files[i] = nil
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("systemd socket %d: %w", listenFDsStart+i, err)
+		}
+		return ln, nil
+	}
+	if name != "" {
+		return nil, fmt.Errorf("no systemd socket named %q (LISTEN_FDNAMES %q)", name, strings.Join(s.names, ":"))
+	}
+	return nil, fmt.Errorf("all %d systemd sockets are taken", len(s.files))
+}
+
+// sdNotify sends state to systemd's NOTIFY_SOCKET, for units of
+// Type=notify. It does nothing when not run by systemd. An abstract socket,
+// "@NAME", is dialled as such by package net.
+func sdNotify(state ...string) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("notifying systemd", "error", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(strings.Join(state, "\n"))); err != nil {
+		slog.Warn("notifying systemd", "error", err)
+	}
+}
+
+// sdWatchdog pings systemd's watchdog at half its WatchdogSec= interval
+// until ctx is done, if the unit has one.
+func sdWatchdog(ctx context.Context) {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	slog.Debug("Pinging systemd watchdog", "interval", interval)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			sdNotify("WATCHDOG=1")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// systemdHooks tell a Type=notify unit's systemd when the command is ready
+// and stopping, and ping its watchdog in between.
+func systemdHooks() serveHooks {
+	return serveHooks{
+		ready: func(ctx context.Context) {
+			sdNotify("READY=1")
+			sdWatchdog(ctx)
+		},
+		stopping: func() { sdNotify("STOPPING=1") },
+	}
+}
@@ -0,0 +1,174 @@
+//go:build !windows && !plan9
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSystemdSocketActivation passes two listening sockets to the test
+// binary run again, as systemd would, for it to take with systemdListener
+// and answer a connection on each with the name it took the socket by.
+func TestSystemdSocketActivation(t *testing.T) {
+	if os.Getenv("MINPROX_TEST_SYSTEMD") != "" {
+		systemdChild(t)
+		return
+	}
+	var files []*os.File
+	var addrs []string
+	for range 2 {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		f, err := ln.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+		addrs = append(addrs, ln.Addr().String())
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSystemdSocketActivation$")
+	cmd.Env = append(os.Environ(), "MINPROX_TEST_SYSTEMD=1", "LISTEN_FDS=2", "LISTEN_FDNAMES=first:second")
+	cmd.ExtraFiles = files
+	out := new(strings.Builder)
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// In the order the child takes them: second by name, then the first.
+	for _, i := range []int{1, 0} {
+		want := []string{"", "second"}[i]
+		conn, err := net.DialTimeout("tcp", addrs[i], 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		got, _ := io.ReadAll(conn)
+		conn.Close()
+		if string(got) != "taken as systemd:"+want {
+			t.Errorf("socket %d answered %q, want it taken as systemd:%s", i+3, got, want)
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("child failed: %v\n%s", err, out)
+	}
+}
+
+// systemdChild is the process systemd started: it takes the named socket
+// and then the next free one, and answers a connection on each.
+func systemdChild(t *testing.T) {
+	// Only the process itself knows its PID to set.
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	for _, name := range []string{"second", ""} {
+		ln, err := systemdListener(name)
+		if err != nil {
+			t.Fatalf("systemd:%s: %v", name, err)
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(conn, "taken as systemd:"+name)
+		conn.Close()
+		ln.Close()
+	}
+	if _, err := systemdListener(""); err == nil {
+		t.Error("a third socket taken from two")
+	}
+	if _, err := systemdListener("other"); err == nil || !strings.Contains(err.Error(), "first:second") {
+		t.Errorf("systemd:other got %v, want the names there are", err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("LISTEN_FDS left for child processes")
+	}
+}
+
+// notifySocket listens where sdNotify sends, returning what it receives.
+func notifySocket(t *testing.T) <-chan string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	got := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			got <- string(buf[:n])
+		}
+	}()
+	return got
+}
+
+// nextNotify returns the next message sent to the notify socket.
+func nextNotify(t *testing.T, got <-chan string) string {
+	t.Helper()
+	select {
+	case msg := <-got:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing sent to NOTIFY_SOCKET")
+		return ""
+	}
+}
+
+func TestSDNotify(t *testing.T) {
+	got := notifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "20000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	hooks := systemdHooks()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		hooks.ready(ctx)
+		close(done)
+	}()
+	if msg := nextNotify(t, got); msg != "READY=1" {
+		t.Errorf("got %q, want READY=1 first", msg)
+	}
+	if msg := nextNotify(t, got); msg != "WATCHDOG=1" {
+		t.Errorf("got %q, want watchdog pings once ready", msg)
+	}
+	cancel()
+	<-done
+	hooks.stopping()
+	for msg := nextNotify(t, got); msg != "STOPPING=1"; msg = nextNotify(t, got) {
+		if msg != "WATCHDOG=1" {
+			t.Fatalf("got %q, want STOPPING=1", msg)
+		}
+	}
+
+	// Another process's watchdog isn't pinged.
+	t.Setenv("WATCHDOG_PID", "1")
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	sdWatchdog(ctx)
+	select {
+	case msg := <-got:
+		t.Errorf("got %q for another process's watchdog", msg)
+	default:
+	}
+
+	// Outside systemd there is nowhere to send to.
+	t.Setenv("NOTIFY_SOCKET", "")
+	sdNotify("READY=1")
+}
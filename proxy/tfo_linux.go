@@ -0,0 +1,24 @@
+//go:build linux
+
+package proxy
+
+import "syscall"
+
+// tcpFastOpenConnect is TCP_FASTOPEN_CONNECT from linux/tcp.h (Linux 4.11+),
+// which the syscall package doesn't define.
+const tcpFastOpenConnect = 30
+
+// tcpFastOpenControl returns a dialer Control func enabling TCP Fast Open
+// on outbound connections.
+func tcpFastOpenControl() (func(network, address string, c syscall.RawConn) error, bool) {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}, true
+}
@@ -0,0 +1,35 @@
+//go:build linux
+
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+)
+
+func TestTCPFastOpen(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	p := newTestProxy(t, "-backend", b.URL, "-tcp-fastopen")
+	if rec := serve(p, "GET", "http://front.test/"); rec.Code != http.StatusOK {
+		t.Fatalf("got %d through a fast open dialer", rec.Code)
+	}
+
+	conn, err := p.l.handler.dialer.Dial("tcp", b.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	raw.Control(func(fd uintptr) {
+		v, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect)
+	})
+	if err != nil || v != 1 {
+		t.Errorf("TCP_FASTOPEN_CONNECT = %d, %v; want 1", v, err)
+	}
+}
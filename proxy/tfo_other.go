@@ -0,0 +1,10 @@
+//go:build !linux
+
+package proxy
+
+import "syscall"
+
+// tcpFastOpenControl reports that TCP Fast Open isn't supported here.
+func tcpFastOpenControl() (func(network, address string, c syscall.RawConn) error, bool) {
+	return nil, false
+}
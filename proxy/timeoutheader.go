@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// timeoutHeader lets trusted callers set their own upstream timeout.
+const timeoutHeader = "X-Proxy-Timeout"
+
+// timeoutOverride honours X-Proxy-Timeout from clients in trusted, capped
+// at max. A nil *timeoutOverride leaves the header alone.
+type timeoutOverride struct {
+	max     time.Duration
+	trusted []netip.Prefix
+}
+
+// parsePrefixes parses CIDR prefixes, accepting bare IPs as single hosts.
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not an IP or CIDR prefix", s)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP or CIDR prefix", s)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// timeout returns the upstream timeout req asked for, clamped to max, and
+// removes the header so it never reaches the backend. ok is false if there
+// is none or the client is not trusted; a value that is not a positive Go
+// duration is an error.
+func (t *timeoutOverride) timeout(req *http.Request) (d time.Duration, ok bool, err error) {
+	if t == nil {
+		return 0, false, nil
+	}
+	value := req.Header.Get(timeoutHeader)
+	req.Header.Del(timeoutHeader)
+	if value == "" || !t.trustedClient(req.RemoteAddr) {
+		return 0, false, nil
+	}
+	d, err = time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, false, fmt.Errorf("%s %q is not a positive duration", timeoutHeader, value)
+	}
+	return min(d, t.max), true, nil
+}
+
+func (t *timeoutOverride) trustedClient(remoteAddr string) bool {
+	host, _ := remoteHost(remoteAddr)
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, p := range t.trusted {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
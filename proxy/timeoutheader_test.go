@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTimeoutHeader(t *testing.T) {
+	var sawHeader atomic.Bool
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(timeoutHeader) != "" {
+			sawHeader.Store(true)
+		}
+		select {
+		case <-time.After(300 * time.Millisecond):
+		case <-req.Context().Done():
+		}
+	})
+	p := newTestProxy(t, "-backend", b.URL, "-timeout-header-max", "100ms", "-timeout-header-from", "192.0.2.0/24, 2001:db8::1")
+	for _, tt := range []struct {
+		name, client, timeout string
+		status                int
+	}{
+		{"within max", "192.0.2.7:4000", "50ms", http.StatusGatewayTimeout},
+		{"clamped to max", "192.0.2.7:4000", "1m", http.StatusGatewayTimeout},
+		{"trusted IPv6", "[2001:db8::1]:4000", "50ms", http.StatusGatewayTimeout},
+		{"untrusted", "198.51.100.1:4000", "50ms", http.StatusOK},
+		{"not a duration", "192.0.2.7:4000", "soon", http.StatusOK},
+		{"negative", "192.0.2.7:4000", "-1s", http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "http://front.test/", nil)
+		req.RemoteAddr = tt.client
+		req.Header.Set(timeoutHeader, tt.timeout)
+		rec := httptest.NewRecorder()
+		start := time.Now()
+		p.ServeHTTP(rec, req)
+		elapsed := time.Since(start)
+		if rec.Code != tt.status {
+			t.Errorf("%s: got %d, want %d", tt.name, rec.Code, tt.status)
+		}
+		if tt.status == http.StatusGatewayTimeout && elapsed > 250*time.Millisecond {
+			t.Errorf("%s: timed out after %v, want by the 100ms max", tt.name, elapsed)
+		}
+	}
+	if sawHeader.Load() {
+		t.Errorf("%s reached the backend", timeoutHeader)
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	got, err := parsePrefixes([]string{"192.0.2.7", "10.1.2.3/8", "::ffff:192.0.2.8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Prefix{
+		netip.MustParsePrefix("192.0.2.7/32"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.0.2.8/32"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}
+	for i := range want {
+		if i >= len(got) || got[i] != want[i] {
+			t.Fatalf("parsePrefixes = %v, want %v", got, want)
+		}
+	}
+	for _, bad := range []string{"example.com", "10.0.0.0/33"} {
+		if _, err := parsePrefixes([]string{bad}); err == nil {
+			t.Errorf("parsePrefixes accepted %q", bad)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// certFile is the -tls-cert and -tls-key pair the proxy listener serves.
+// It is re-read on SIGHUP so renewed certificates are picked up without a
+// restart; connections already open keep the certificate they started
+// with.
+type certFile struct {
+	path, keyPath string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func loadCertFile(certPath, keyPath string) (*certFile, error) {
+	c := &certFile{path: certPath, keyPath: keyPath}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload re-reads the pair. On error the previous certificate is kept.
+func (c *certFile) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.path, c.keyPath)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *certFile) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// serverTLSConfig returns the TLS config for serving the proxy itself
+// over TLS with cert. alpn lists the protocols offered to clients, and
+// clientCA, if set, is a PEM bundle client certificates must chain to;
+// clients without one are refused during the handshake.
+func serverTLSConfig(cert *certFile, alpn []string, clientCA string) (*tls.Config, error) {
+	for _, proto := range alpn {
+		if proto != "h2" && proto != "http/1.1" {
+			return nil, fmt.Errorf("-tls-alpn protocol %q is not h2 or http/1.1", proto)
+		}
+	}
+	if len(alpn) == 0 {
+		return nil, fmt.Errorf("-tls-alpn is empty")
+	}
+	cfg := &tls.Config{
+		GetCertificate: cert.getCertificate,
+		NextProtos:     alpn,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no PEM certificates", clientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestPKI writes a CA to ca.pem in a new directory, and with it a
+// server certificate for 127.0.0.1 (server.pem, server.key) and a client
+// certificate (client.pem, client.key). It returns the directory and the
+// CA pool.
+func writeTestPKI(t *testing.T) (string, *x509.CertPool) {
+	t.Helper()
+	dir := t.TempDir()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	write := func(name, typ string, der []byte) {
+		if err := os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("ca.pem", "CERTIFICATE", caDER)
+
+	for i, name := range []string{"server", "client"} {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		}
+		if name == "client" {
+			tmpl.ExtKeyUsage, tmpl.IPAddresses = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, nil
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, _ := x509.MarshalPKCS8PrivateKey(key)
+		write(name+".pem", "CERTIFICATE", der)
+		write(name+".key", "PRIVATE KEY", keyDER)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return dir, pool
+}
+
+// newTLSProxy serves the listener args configure over TLS with the
+// server certificate in dir, returning its address.
+func newTLSProxy(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	args = append([]string{"-tls-cert", filepath.Join(dir, "server.pem"), "-tls-key", filepath.Join(dir, "server.key"), "-connect-ports", "*"}, args...)
+	l, err := newListener("minprox", args)
+	if err != nil {
+		t.Fatalf("newListener(%q): %v", args, err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go l.server.ServeTLS(ln, "", "")
+	t.Cleanup(func() { l.server.Close() })
+	return ln.Addr().String()
+}
+
+func TestTLSListener(t *testing.T) {
+	dir, pool := writeTestPKI(t)
+	b := echoBackend(t, "backend")
+	proxyURL := &url.URL{Scheme: "https", Host: newTLSProxy(t, dir)}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get(b.URL + "/x")
+	if err != nil {
+		t.Fatalf("GET through the https:// proxy: %v", err)
+	}
+	defer resp.Body.Close()
+	if body := readBody(t, resp.Body); resp.StatusCode != http.StatusOK || body != "backend "+b.Listener.Addr().String()+" /x" {
+		t.Errorf("got %s %q", resp.Status, body)
+	}
+
+	if _, err := tls.Dial("tcp", proxyURL.Host, &tls.Config{}); err == nil {
+		t.Error("handshake succeeded without trusting the proxy's CA")
+	}
+}
+
+func TestTLSListenerALPN(t *testing.T) {
+	dir, pool := writeTestPKI(t)
+	for _, tt := range []struct {
+		alpn string
+		want string
+	}{
+		{"", "h2"},
+		{"http/1.1", "http/1.1"},
+		{"h2", "h2"},
+	} {
+		var args []string
+		if tt.alpn != "" {
+			args = []string{"-tls-alpn", tt.alpn}
+		}
+		conn, err := tls.Dial("tcp", newTLSProxy(t, dir, args...), &tls.Config{RootCAs: pool, NextProtos: []string{"h2", "http/1.1"}})
+		if err != nil {
+			t.Fatalf("-tls-alpn %q: %v", tt.alpn, err)
+		}
+		if got := conn.ConnectionState().NegotiatedProtocol; got != tt.want {
+			t.Errorf("-tls-alpn %q negotiated %q, want %q", tt.alpn, got, tt.want)
+		}
+		conn.Close()
+	}
+}
+
+// TestTLSListenerHTTP2Connect tunnels over an HTTP/2 CONNECT stream,
+// which can't be hijacked.
+func TestTLSListenerHTTP2Connect(t *testing.T) {
+	dir, pool := writeTestPKI(t)
+	echo := newEchoServer(t)
+	tr := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}, ForceAttemptHTTP2: true}
+	defer tr.CloseIdleConnections()
+	pr, pw := io.Pipe()
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Scheme: "https", Host: newTLSProxy(t, dir)}, Host: echo, Header: http.Header{}, Body: pr}
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("HTTP/2 CONNECT: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT got %s %s, want HTTP/2 200", resp.Proto, resp.Status)
+	}
+	fmt.Fprint(pw, "ping")
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(resp.Body, got); err != nil || string(got) != "ping" {
+		t.Errorf("tunnel read %q, %v; want ping", got, err)
+	}
+	pw.Close()
+}
+
+func TestTLSClientCA(t *testing.T) {
+	dir, pool := writeTestPKI(t)
+	addr := newTLSProxy(t, dir, "-tls-client-ca", filepath.Join(dir, "ca.pem"))
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		certs []tls.Certificate
+		ok    bool
+	}{
+		{[]tls.Certificate{cert}, true},
+		{nil, false},
+	} {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, Certificates: tt.certs, NextProtos: []string{"http/1.1"}})
+		if err == nil {
+			// TLS 1.3 clients learn of a refused certificate on first read.
+			fmt.Fprint(conn, "GET http://front.test/ HTTP/1.1\r\nHost: front.test\r\n\r\n")
+			_, err = conn.Read(make([]byte, 1))
+			conn.Close()
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("with %d client certificates got %v, want ok %v", len(tt.certs), err, tt.ok)
+		}
+	}
+}
+
+func TestTLSFlags(t *testing.T) {
+	dir, _ := writeTestPKI(t)
+	cert, key := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	for _, args := range [][]string{
+		{"-tls-cert", cert},
+		{"-tls-key", key},
+		{"-tls-client-ca", filepath.Join(dir, "ca.pem")},
+		{"-tls-cert", cert, "-tls-key", key, "-tls-alpn", "h3"},
+		{"-tls-cert", cert, "-tls-key", key, "-tls-alpn", ""},
+		{"-tls-cert", cert, "-tls-key", key, "-tls-client-ca", key},
+		{"-tls-cert", key, "-tls-key", cert},
+	} {
+		if _, err := newListener("minprox", args); err == nil {
+			t.Errorf("%q accepted", args)
+		}
+	}
+}
+
+func TestCertFileReload(t *testing.T) {
+	dir, _ := writeTestPKI(t)
+	other, _ := writeTestPKI(t)
+	cert, key := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	c, err := loadCertFile(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := c.getCertificate(nil)
+
+	os.WriteFile(cert, []byte("not PEM"), 0o600)
+	if err := c.reload(); err == nil {
+		t.Error("reloading a broken certificate succeeded")
+	}
+	if got, _ := c.getCertificate(nil); got != first {
+		t.Error("a failed reload dropped the certificate")
+	}
+
+	for _, name := range []string{"server.pem", "server.key"} {
+		b, _ := os.ReadFile(filepath.Join(other, name))
+		os.WriteFile(filepath.Join(dir, name), b, 0o600)
+	}
+	if err := c.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.getCertificate(nil); got == first {
+		t.Error("reload kept the old certificate")
+	}
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// TLS verification modes for -tls-verify.
+const (
+	tlsVerifyStrict = "strict"
+	tlsVerifySkip   = "skip"
+	tlsVerifyCA     = "ca:"
+)
+
+// tlsVerifyTransport sends https requests for hosts with their own
+// -tls-verify rule through a transport cloned from base with that rule's
+// TLS settings. Everything else goes through base, which verifies against
+// the system roots. The per-host transports are cloned on first use, so
+// they pick up any changes made to base while the proxy is configured.
+type tlsVerifyTransport struct {
+	base  *http.Transport
+	rules map[string]*tls.Config // by domain, covering subdomains
+
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+}
+
+// parseTLSVerify parses -tls-verify values of the form
+// host=strict|skip|ca:/path/to/ca.pem.
+func parseTLSVerify(values []string) (map[string]*tls.Config, error) {
+	rules := make(map[string]*tls.Config)
+	for _, v := range values {
+		host, mode, ok := strings.Cut(v, "=")
+		host = normalizeHost(host)
+		if !ok || host == "" {
+			return nil, fmt.Errorf("-tls-verify %q is not host=mode", v)
+		}
+		cfg := &tls.Config{}
+		switch {
+		case mode == tlsVerifyStrict:
+		case mode == tlsVerifySkip:
+			cfg.InsecureSkipVerify = true
+		case strings.HasPrefix(mode, tlsVerifyCA):
+			pem, err := os.ReadFile(strings.TrimPrefix(mode, tlsVerifyCA))
+			if err != nil {
+				return nil, fmt.Errorf("-tls-verify %q: %w", v, err)
+			}
+			cfg.RootCAs = x509.NewCertPool()
+			if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("-tls-verify %q: no certificates found", v)
+			}
+		default:
+			return nil, fmt.Errorf("-tls-verify %q: unknown mode %q", v, mode)
+		}
+		rules[host] = cfg
+	}
+	return rules, nil
+}
+
+func newTLSVerifyTransport(base *http.Transport, rules map[string]*tls.Config) *tlsVerifyTransport {
+	return &tlsVerifyTransport{base: base, rules: rules, transports: make(map[string]*http.Transport)}
+}
+
+// rule returns the domain whose rule covers host, or "".
+func (t *tlsVerifyTransport) rule(host string) string {
+	host = normalizeHost(host)
+	for host != "" {
+		if t.rules[host] != nil {
+			return host
+		}
+		_, host, _ = strings.Cut(host, ".")
+	}
+	return ""
+}
+
+func (t *tlsVerifyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		return t.base.RoundTrip(req)
+	}
+	domain := t.rule(req.URL.Hostname())
+	if domain == "" {
+		return t.base.RoundTrip(req)
+	}
+
+	t.mu.Lock()
+	tr := t.transports[domain]
+	if tr == nil {
+		tr = t.base.Clone()
+		cfg := t.rules[domain].Clone()
+		if base := t.base.TLSClientConfig; base != nil {
+			cfg.NextProtos = base.NextProtos
+			cfg.ClientSessionCache = base.ClientSessionCache
+		}
+		tr.TLSClientConfig = cfg
+		t.transports[domain] = tr
+	}
+	t.mu.Unlock()
+	return tr.RoundTrip(req)
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// resumingBackend is a TLS backend counting the requests that came over a
+// resumed session.
+func resumingBackend(tb testing.TB) (*httptest.Server, *atomic.Int64) {
+	resumed := new(atomic.Int64)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if req.TLS.DidResume {
+			resumed.Add(1)
+		}
+	}))
+	tb.Cleanup(srv.Close)
+	return srv, resumed
+}
+
+// backendCA writes srv's certificate to a file for -tls-verify ca:.
+func backendCA(tb testing.TB, srv *httptest.Server) string {
+	path := filepath.Join(tb.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(path, cert, 0o644); err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
+
+func TestTLSVerifyRules(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {}))
+	defer srv.Close()
+	ca := backendCA(t, srv)
+	for _, tt := range []struct {
+		rule   string
+		status int
+	}{
+		{"", http.StatusBadGateway},
+		{"127.0.0.1=strict", http.StatusBadGateway},
+		{"127.0.0.1=skip", http.StatusOK},
+		{"127.0.0.1=ca:" + ca, http.StatusOK},
+		{"192.0.2.1=skip", http.StatusBadGateway},
+	} {
+		args := []string{"-backend", srv.URL}
+		if tt.rule != "" {
+			args = append(args, "-tls-verify", tt.rule)
+		}
+		if rec := serve(newTestProxy(t, args...), "GET", "http://front.test/"); rec.Code != tt.status {
+			t.Errorf("-tls-verify %q: got %d, want %d", tt.rule, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestParseTLSVerify(t *testing.T) {
+	ca := writeTempFile(t, "ca.pem", "")
+	for _, v := range []string{"example.com", "=skip", "example.com=lax", "example.com=ca:/nonexistent", "example.com=ca:" + ca} {
+		if _, err := parseTLSVerify([]string{v}); err == nil {
+			t.Errorf("parseTLSVerify(%q) accepted", v)
+		}
+	}
+
+	rules, err := parseTLSVerify([]string{"Example.COM=skip", "dev.example.com=strict"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := newTLSVerifyTransport(&http.Transport{}, rules)
+	for host, want := range map[string]string{
+		"example.com":         "example.com",
+		"www.example.com":     "example.com",
+		"api.dev.example.com": "dev.example.com",
+		"example.org":         "",
+		"badexample.com":      "",
+	} {
+		if got := tr.rule(host); got != want {
+			t.Errorf("rule(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestTLSSessionCache(t *testing.T) {
+	p := newTestProxy(t, "-backend", "https://back.test")
+	cfg := p.l.handler.transport.(*http.Transport).TLSClientConfig
+	if cfg == nil || cfg.ClientSessionCache == nil {
+		t.Fatal("no client session cache configured by default")
+	}
+
+	p = newTestProxy(t, "-backend", "https://back.test", "-tls-session-cache", "0")
+	if cfg := p.l.handler.transport.(*http.Transport).TLSClientConfig; cfg != nil && cfg.ClientSessionCache != nil {
+		t.Error("session cache configured with -tls-session-cache 0")
+	}
+}
+
+func TestTLSSessionResumed(t *testing.T) {
+	srv, resumed := resumingBackend(t)
+	// The -tls-verify transport shares the base transport's cache.
+	p := newTestProxy(t, "-backend", srv.URL, "-disable-keepalives", "-tls-verify", "127.0.0.1=ca:"+backendCA(t, srv))
+	for range 3 {
+		if rec := serve(p, "GET", "http://front.test/"); rec.Code != http.StatusOK {
+			t.Fatalf("got %d", rec.Code)
+		}
+	}
+	if resumed.Load() != 2 {
+		t.Errorf("%d of 3 connections resumed, want 2", resumed.Load())
+	}
+}
+
+// BenchmarkBackendTLSHandshake fetches over a new backend connection each
+// time, with and without sessions to resume.
+func BenchmarkBackendTLSHandshake(b *testing.B) {
+	for _, bb := range []struct {
+		name, cache string
+	}{
+		{"full", "0"},
+		{"resumed", "256"},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			srv, _ := resumingBackend(b)
+			p, err := New(WithFlags("-backend", srv.URL, "-disable-keepalives", "-tls-session-cache", bb.cache, "-tls-verify", "127.0.0.1=ca:"+backendCA(b, srv)))
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			for b.Loop() {
+				if rec := serve(p, "GET", "http://front.test/"); rec.Code != http.StatusOK {
+					b.Fatalf("got %d", rec.Code)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// parseTOMLConfig reads the TOML form of a -config file:
+//
+//	[[listeners]]
+//	addr = ":8081"
+//	mode = "reverse"
+//
+//	[listeners.options]
+//	route = ["/api=http://api:8000"]
+//	timeout = "30s"
+//
+// Only what the config needs is supported: [[listeners]] and
+// [listeners.options] tables, basic and literal strings, integers, floats,
+// booleans and single-line arrays of them.
+func parseTOMLConfig(r io.Reader) (*config, error) {
+	var cfg config
+	var options map[string]any // the table keys go to, nil in a listener's own table
+	inListener := false
+
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fail := func(format string, args ...any) error {
+			return fmt.Errorf("line %d: %s", n, fmt.Sprintf(format, args...))
+		}
+
+		if strings.HasPrefix(line, "[") {
+			header, _, _ := strings.Cut(line, "#")
+			switch strings.Join(strings.Fields(header), "") {
+			case "[[listeners]]":
+				cfg.Listeners = append(cfg.Listeners, listenerSpec{})
+				inListener, options = true, nil
+			case "[listeners.options]":
+				if !inListener {
+					return nil, fail("[listeners.options] before any [[listeners]]")
+				}
+				spec := &cfg.Listeners[len(cfg.Listeners)-1]
+				if spec.Options != nil {
+					return nil, fail("duplicate [listeners.options]")
+				}
+				spec.Options = make(map[string]any)
+				options = spec.Options
+			default:
+				return nil, fail("unsupported table %s", strings.TrimSpace(header))
+			}
+			continue
+		}
+
+		key, rest, err := parseTOMLKey(line)
+		if err != nil {
+			return nil, fail("%v", err)
+		}
+		rest, ok := strings.CutPrefix(strings.TrimLeft(rest, " \t"), "=")
+		if !ok {
+			return nil, fail("want key = value")
+		}
+		value, rest, err := parseTOMLValue(strings.TrimLeft(rest, " \t"))
+		if err != nil {
+			return nil, fail("%s: %v", key, err)
+		}
+		if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+			return nil, fail("%s: unexpected %q after value", key, rest)
+		}
+
+		switch {
+		case options != nil:
+			if _, dup := options[key]; dup {
+				return nil, fail("duplicate option %q", key)
+			}
+			options[key] = value
+		case !inListener:
+			return nil, fail("%q outside [[listeners]]", key)
+		default:
+			spec := &cfg.Listeners[len(cfg.Listeners)-1]
+			s, ok := value.(string)
+			if !ok {
+				return nil, fail("%s must be a string", key)
+			}
+			switch key {
+			case "addr":
+				spec.Addr = s
+			case "mode":
+				spec.Mode = s
+			default:
+				return nil, fail("unknown listener key %q", key)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// parseTOMLKey returns the bare or quoted key at the start of s and what
+// follows it.
+func parseTOMLKey(s string) (key, rest string, err error) {
+	if strings.HasPrefix(s, `"`) || strings.HasPrefix(s, "'") {
+		v, rest, err := parseTOMLValue(s)
+		if err != nil {
+			return "", "", err
+		}
+		return v.(string), rest, nil
+	}
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_')
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	if i == 0 {
+		return "", "", fmt.Errorf("want key = value")
+	}
+	return s[:i], s[i:], nil
+}
+
+// parseTOMLValue parses the value at the start of s, returning it and
+// what follows it. Numbers become json.Number, as they are from JSON
+// config files.
+func parseTOMLValue(s string) (any, string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				v, err := strconv.Unquote(s[:i+1])
+				return v, s[i+1:], err
+			}
+		}
+		return nil, "", fmt.Errorf("unterminated string")
+	case strings.HasPrefix(s, "'"):
+		v, rest, ok := strings.Cut(s[1:], "'")
+		if !ok {
+			return nil, "", fmt.Errorf("unterminated string")
+		}
+		return v, rest, nil
+	case strings.HasPrefix(s, "["):
+		values := []any{}
+		s = s[1:]
+		for {
+			s = strings.TrimLeft(s, " \t")
+			if rest, ok := strings.CutPrefix(s, "]"); ok {
+				return values, rest, nil
+			}
+			v, rest, err := parseTOMLValue(s)
+			if err != nil {
+				return nil, "", err
+			}
+			values = append(values, v)
+			s = strings.TrimLeft(rest, " \t")
+			if rest, ok := strings.CutPrefix(s, ","); ok {
+				s = rest
+			} else if !strings.HasPrefix(s, "]") {
+				return nil, "", fmt.Errorf("unterminated array")
+			}
+		}
+	}
+
+	end := strings.IndexAny(s, " \t,]#")
+	if end < 0 {
+		end = len(s)
+	}
+	token := s[:end]
+	switch token {
+	case "true":
+		return true, s[end:], nil
+	case "false":
+		return false, s[end:], nil
+	}
+	num := strings.ReplaceAll(token, "_", "")
+	if _, err := strconv.ParseFloat(num, 64); err != nil || token == "" {
+		return nil, "", fmt.Errorf("unsupported value %q", token)
+	}
+	return json.Number(num), s[end:], nil
+}
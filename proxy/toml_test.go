@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOMLConfig(t *testing.T) {
+	cfg, err := parseTOMLConfig(strings.NewReader(`
+# Two listeners.
+[[listeners]]
+addr = ":8080"
+
+[[ listeners ]] # spaces are fine
+addr = ':8081'
+"mode" = "reverse"
+
+[listeners.options]
+route = ["/api=http://api:8000", '/static=http://cdn:80',]
+timeout = "30s"  # trailing comment
+max-conns = 1_000
+ratio = 0.5
+preserve-host = true
+escaped = "a\tb \"c\""
+empty = []
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &config{Listeners: []listenerSpec{
+		{Addr: ":8080"},
+		{Addr: ":8081", Mode: "reverse", Options: map[string]any{
+			"route":         []any{"/api=http://api:8000", "/static=http://cdn:80"},
+			"timeout":       "30s",
+			"max-conns":     json.Number("1000"),
+			"ratio":         json.Number("0.5"),
+			"preserve-host": true,
+			"escaped":       "a\tb \"c\"",
+			"empty":         []any{},
+		}},
+	}}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got %#v\nwant %#v", cfg, want)
+	}
+}
+
+func TestParseTOMLConfigErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name, toml, want string
+	}{
+		{"key outside", `addr = ":80"`, `line 1: "addr" outside [[listeners]]`},
+		{"options first", "[listeners.options]", "line 1: [listeners.options] before any [[listeners]]"},
+		{"other table", "[server]", "line 1: unsupported table [server]"},
+		{"unknown key", "[[listeners]]\nport = \"80\"", `line 2: unknown listener key "port"`},
+		{"addr not string", "[[listeners]]\naddr = 80", "line 2: addr must be a string"},
+		{"no equals", "[[listeners]]\naddr", "line 2: want key = value"},
+		{"no key", "[[listeners]]\n= 1", "line 2: want key = value"},
+		{"duplicate option", "[[listeners]]\n[listeners.options]\na = 1\na = 2", `line 4: duplicate option "a"`},
+		{"duplicate options table", "[[listeners]]\n[listeners.options]\n[listeners.options]", "line 3: duplicate [listeners.options]"},
+		{"unterminated string", "[[listeners]]\naddr = \":80", "line 2: addr: unterminated string"},
+		{"unterminated array", "[[listeners]]\n[listeners.options]\na = [1 2]", "line 3: a: unterminated array"},
+		{"bare word", "[[listeners]]\n[listeners.options]\na = yes", `line 3: a: unsupported value "yes"`},
+		{"junk after value", "[[listeners]]\naddr = \":80\" x", `line 2: addr: unexpected "x" after value`},
+	} {
+		_, err := parseTOMLConfig(strings.NewReader(tt.toml))
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+// TestLoadConfigFormats checks a TOML file and its JSON twin give the
+// same listeners and flags.
+func TestLoadConfigFormats(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"c.toml": `
+[[listeners]]
+addr = ":8081"
+mode = "reverse"
+[listeners.options]
+route = ["/a=http://a:1", "/b=http://b:2"]
+retries = 2
+preserve-host = true
+`,
+		"c.json": `{"listeners": [{"addr": ":8081", "mode": "reverse", "options": {
+			"route": ["/a=http://a:1", "/b=http://b:2"], "retries": 2, "preserve-host": true}}]}`,
+	}
+	var got [][]string
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := loadConfig(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		args, err := cfg.Listeners[0].args()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got = append(got, args)
+	}
+	want := []string{"-addr=", "-addr=:8081", "-preserve-host=true", "-retries=2", "-route=/a=http://a:1", "-route=/b=http://b:2"}
+	for _, args := range got {
+		if !reflect.DeepEqual(args, want) {
+			t.Errorf("args = %q, want %q", args, want)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tracer records one span per proxied request and exports them in batches
+// to an OTLP/HTTP collector using the JSON encoding. Incoming W3C trace
+// context is continued and the proxy's span is propagated to the backend.
+type tracer struct {
+	endpoint string
+	service  string
+	client   *http.Client
+	spans    chan *span
+	done     chan struct{}
+}
+
+type span struct {
+	t        *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	flags    string
+	name     string
+	start    time.Time
+	end      time.Time
+	status   int
+	attrs    map[string]any
+}
+
+// newTracer starts a tracer exporting to endpoint. An endpoint without a
+// path gets the standard /v1/traces.
+func newTracer(endpoint *url.URL, service string) *tracer {
+	if endpoint.Path == "" || endpoint.Path == "/" {
+		endpoint.Path = "/v1/traces"
+	}
+	t := &tracer{
+		endpoint: endpoint.String(),
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		spans:    make(chan *span, 2048),
+		done:     make(chan struct{}),
+	}
+	go t.export()
+	return t
+}
+
+// start begins a span for req, continuing any trace in its traceparent
+// header, and rewrites traceparent so the backend sees the proxy's span as
+// its parent. tracestate is passed through untouched. start is a no-op on
+// a nil tracer.
+func (t *tracer) start(req *http.Request) *span {
+	if t == nil {
+		return nil
+	}
+	s := &span{
+		t:     t,
+		flags: "01",
+		name:  req.Method,
+		start: time.Now(),
+		attrs: map[string]any{
+			"http.request.method": req.Method,
+			"server.address":      req.URL.Hostname(),
+			"url.full":            req.URL.String(),
+			"client.address":      req.RemoteAddr,
+		},
+	}
+	if traceID, parentID, flags, ok := parseTraceparent(req.Header.Get("Traceparent")); ok {
+		s.traceID, s.parentID, s.flags = traceID, parentID, flags
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	req.Header.Set("Traceparent", "00-"+hex.EncodeToString(s.traceID[:])+"-"+hex.EncodeToString(s.spanID[:])+"-"+s.flags)
+	return s
+}
+
+// finish ends the span with the response status and queues it for
+// export. Spans are dropped rather than blocking if the queue is full.
+func (s *span) finish(status int) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.status = status
+	if status != 0 {
+		s.attrs["http.response.status_code"] = status
+	}
+	select {
+	case s.t.spans <- s:
+	default:
+	}
+}
+
+// parseTraceparent parses a version 00 W3C traceparent header.
+func parseTraceparent(h string) (traceID [16]byte, parentID [8]byte, flags string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return
+	}
+	if _, err := hex.DecodeString(parts[3]); err != nil {
+		return
+	}
+	return traceID, parentID, parts[3], true
+}
+
+// export batches finished spans and posts them to the collector.
+func (t *tracer) export() {
+	var batch []*span
+	tick := time.NewTicker(5 * time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < 512 {
+				continue
+			}
+		case <-tick.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-t.done:
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+			}
+			if len(batch) > 0 {
+				t.post(batch)
+			}
+			return
+		}
+		t.post(batch)
+		batch = batch[:0]
+	}
+}
+
+// stop sends the spans queued so far and ends the export. Spans finished
+// later are dropped. stop is a no-op on a nil tracer.
+func (t *tracer) stop() {
+	if t != nil {
+		close(t.done)
+	}
+}
+
+func (t *tracer) post(batch []*span) {
+	spans := make([]map[string]any, 0, len(batch))
+	for _, s := range batch {
+		status := map[string]any{}
+		if s.status >= 500 {
+			status["code"] = 2 // STATUS_CODE_ERROR
+		}
+		var attrs []map[string]any
+		for k, v := range s.attrs {
+			attrs = append(attrs, otlpAttr(k, v))
+		}
+		js := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              2, // SPAN_KIND_SERVER
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        attrs,
+			"status":            status,
+		}
+		if s.parentID != [8]byte{} {
+			js["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		spans = append(spans, js)
+	}
+
+	body, _ := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []any{otlpAttr("service.name", t.service)},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "minprox"},
+				"spans": spans,
+			}},
+		}},
+	})
+
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("exporting traces failed", "endpoint", t.endpoint, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		slog.Warn("exporting traces failed", "endpoint", t.endpoint, "status", resp.Status)
+	}
+}
+
+func otlpAttr(key string, v any) map[string]any {
+	var value map[string]any
+	switch v := v.(type) {
+	case int:
+		value = map[string]any{"intValue": strconv.Itoa(v)}
+	default:
+		value = map[string]any{"stringValue": v}
+	}
+	return map[string]any{"key": key, "value": value}
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTracePropagated(t *testing.T) {
+	collector := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	p := newTestProxy(t, "-backend", b.URL, "-otlp-endpoint", collector.URL)
+
+	const incoming = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	serve(p, "GET", "http://front.test/", "Traceparent: "+incoming, "Tracestate: vendor=1")
+	got := b.last.Header.Get("Traceparent")
+	traceID, spanID, flags, ok := parseTraceparent(got)
+	if !ok {
+		t.Fatalf("backend got traceparent %q", got)
+	}
+	if !strings.HasPrefix(got, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || flags != "01" {
+		t.Errorf("backend traceparent %q doesn't continue the trace", got)
+	}
+	if got == incoming || spanID == [8]byte{} || traceID == [16]byte{} {
+		t.Errorf("backend traceparent %q names the client's span as parent", got)
+	}
+	if b.last.Header.Get("Tracestate") != "vendor=1" {
+		t.Error("tracestate not passed through")
+	}
+
+	// Without one a new trace starts.
+	serve(p, "GET", "http://front.test/")
+	if _, _, _, ok := parseTraceparent(b.last.Header.Get("Traceparent")); !ok {
+		t.Errorf("no traceparent started: %q", b.last.Header.Get("Traceparent"))
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	for h, ok := range map[string]bool{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01": true,
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01": false,
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01": false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01": false,
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01": false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7":    false,
+		"": false,
+	} {
+		if _, _, _, got := parseTraceparent(h); got != ok {
+			t.Errorf("parseTraceparent(%q) ok = %v, want %v", h, got, ok)
+		}
+	}
+}
+
+func TestTracerExport(t *testing.T) {
+	var body map[string]any
+	collector := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		json.Unmarshal(b, &body)
+	})
+	tr := &tracer{endpoint: collector.URL + "/v1/traces", service: "test", client: http.DefaultClient, spans: make(chan *span, 1)}
+	req := httptest.NewRequest("GET", "http://x.test/a", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	s := tr.start(req)
+	s.finish(http.StatusBadGateway)
+	tr.post([]*span{<-tr.spans})
+
+	if collector.last.URL.Path != "/v1/traces" || collector.last.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("posted to %s as %s", collector.last.URL, collector.last.Header.Get("Content-Type"))
+	}
+	rs := body["resourceSpans"].([]any)[0].(map[string]any)
+	exported := rs["scopeSpans"].([]any)[0].(map[string]any)["spans"].([]any)[0].(map[string]any)
+	if exported["traceId"] != "4bf92f3577b34da6a3ce929d0e0e4736" || exported["parentSpanId"] != "00f067aa0ba902b7" {
+		t.Errorf("exported span ids: %v", exported)
+	}
+	if code := exported["status"].(map[string]any)["code"]; code != float64(2) {
+		t.Errorf("502 span status code = %v, want 2 (error)", code)
+	}
+	service := rs["resource"].(map[string]any)["attributes"].([]any)[0].(map[string]any)
+	if service["value"].(map[string]any)["stringValue"] != "test" {
+		t.Errorf("service attribute = %v", service)
+	}
+}
+
+func TestTracerStopSendsQueuedSpans(t *testing.T) {
+	posted := make(chan int, 1)
+	collector := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		var body map[string]any
+		json.NewDecoder(req.Body).Decode(&body)
+		rs := body["resourceSpans"].([]any)[0].(map[string]any)
+		posted <- len(rs["scopeSpans"].([]any)[0].(map[string]any)["spans"].([]any))
+	})
+	u, _ := url.Parse(collector.URL)
+	tr := newTracer(u, "test")
+	tr.start(httptest.NewRequest("GET", "http://x.test/a", nil)).finish(http.StatusOK)
+	tr.start(httptest.NewRequest("GET", "http://x.test/b", nil)).finish(http.StatusOK)
+	tr.stop()
+
+	select {
+	case n := <-posted:
+		if n != 2 {
+			t.Errorf("stop posted %d spans, want 2", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stop didn't send the queued spans before the export interval")
+	}
+}
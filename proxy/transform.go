@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// transformer rewrites response bodies of selected content types, either
+// through an external command (body on stdin, new body on stdout) or a Go
+// text/template. Bodies over maxBody and encoded bodies are passed through
+// untouched, so large downloads and streams are never held back.
+type transformer struct {
+	command []string
+	tmpl    *template.Template
+	timeout time.Duration
+	types   []string
+	maxBody int64
+}
+
+// transformData is what a -transform template is executed with.
+type transformData struct {
+	Body        string
+	URL         string
+	ContentType string
+	Status      int
+}
+
+var transformFuncs = template.FuncMap{
+	"replace": strings.ReplaceAll,
+}
+
+// newTransformer parses -transform: "template:FILE" for a Go template,
+// else a command line split on spaces.
+func newTransformer(spec string, types []string, maxBody int64, timeout time.Duration) (*transformer, error) {
+	t := &transformer{types: types, maxBody: maxBody, timeout: timeout}
+	if path, ok := strings.CutPrefix(spec, "template:"); ok {
+		text, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		t.tmpl, err = template.New(path).Funcs(transformFuncs).Parse(string(text))
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+	t.command = strings.Fields(spec)
+	if len(t.command) == 0 {
+		return nil, fmt.Errorf("-transform is empty")
+	}
+	return t, nil
+}
+
+// applies reports whether resp is one the transformer rewrites.
+func (t *transformer) applies(resp *http.Response) bool {
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" && !strings.EqualFold(ce, "identity") {
+		return false
+	}
+	if resp.ContentLength > t.maxBody {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	for _, prefix := range t.types {
+		if strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// transform replaces resp's body with its transformed version. A body
+// turning out larger than maxBody is left as it is, read back from where
+// it was cut off.
+func (t *transformer) transform(ctx context.Context, resp *http.Response, target string) error {
+	if !t.applies(resp) {
+		return nil
+	}
+	orig := resp.Body
+	body, err := io.ReadAll(io.LimitReader(orig, t.maxBody+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > t.maxBody {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), orig), orig}
+		return nil
+	}
+	orig.Close()
+
+	var out []byte
+	if t.tmpl != nil {
+		var buf bytes.Buffer
+		err = t.tmpl.Execute(&buf, transformData{
+			Body:        string(body),
+			URL:         target,
+			ContentType: resp.Header.Get("Content-Type"),
+			Status:      resp.StatusCode,
+		})
+		out = buf.Bytes()
+	} else {
+		ctx, cancel := context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, t.command[0], t.command[1:]...)
+		cmd.Env = append(os.Environ(),
+			"TRANSFORM_URL="+target,
+			"TRANSFORM_CONTENT_TYPE="+resp.Header.Get("Content-Type"),
+			"TRANSFORM_STATUS="+strconv.Itoa(resp.StatusCode),
+		)
+		cmd.Stdin = bytes.NewReader(body)
+		out, err = cmd.Output()
+	}
+	if err != nil {
+		resp.Body = http.NoBody
+		return fmt.Errorf("transforming response: %w", err)
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(out))
+	resp.ContentLength = int64(len(out))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	return nil
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// pagesBackend serves an HTML page at /page, JSON at /data and an HTML
+// page of 1000 bytes at /big.
+func pagesBackend(t *testing.T) *countingBackend {
+	return newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/page":
+			wr.Header().Set("Content-Type", "text/html; charset=utf-8")
+			io.WriteString(wr, "<html><body>hello</body></html>")
+		case "/data":
+			wr.Header().Set("Content-Type", "application/json")
+			io.WriteString(wr, `{"body":"</body>"}`)
+		case "/big":
+			wr.Header().Set("Content-Type", "text/html")
+			io.WriteString(wr, "<body>"+strings.Repeat("x", 987)+"</body>")
+		}
+	})
+}
+
+func TestTransformTemplate(t *testing.T) {
+	b := pagesBackend(t)
+	tmpl := writeTempFile(t, "banner.tmpl", `{{replace .Body "</body>" "<div>banner</div></body>"}}`)
+	p := newTestProxy(t, "-backend", b.URL, "-transform", "template:"+tmpl, "-transform-max-body", "100")
+
+	rec := serve(p, "GET", "http://front.test/page")
+	want := "<html><body>hello<div>banner</div></body></html>"
+	if rec.Body.String() != want || rec.Header().Get("Content-Length") != strconv.Itoa(len(want)) {
+		t.Errorf("HTML page: got %q with Content-Length %s, want %q", rec.Body, rec.Header().Get("Content-Length"), want)
+	}
+	if rec := serve(p, "GET", "http://front.test/data"); rec.Body.String() != `{"body":"</body>"}` {
+		t.Errorf("JSON rewritten to %q, want it untouched", rec.Body)
+	}
+	if rec := serve(p, "GET", "http://front.test/big"); rec.Body.Len() != 1000 || strings.Contains(rec.Body.String(), "banner") {
+		t.Errorf("body over -transform-max-body: %d bytes, banner %v; want the 1000 untouched", rec.Body.Len(), strings.Contains(rec.Body.String(), "banner"))
+	}
+}
+
+func TestTransformCommand(t *testing.T) {
+	if _, err := exec.LookPath("tr"); err != nil {
+		t.Skip("no tr command")
+	}
+	b := pagesBackend(t)
+	p := newTestProxy(t, "-backend", b.URL, "-transform", "tr a-z A-Z")
+	if rec := serve(p, "GET", "http://front.test/page"); rec.Body.String() != "<HTML><BODY>HELLO</BODY></HTML>" {
+		t.Errorf("command transform gave %q", rec.Body)
+	}
+
+	p = newTestProxy(t, "-backend", b.URL, "-transform", "false")
+	if rec := serve(p, "GET", "http://front.test/page"); rec.Code != http.StatusBadGateway {
+		t.Errorf("failing command: got %d, want 502", rec.Code)
+	}
+	if rec := serve(p, "GET", "http://front.test/data"); rec.Code != http.StatusOK {
+		t.Errorf("failing command on an untransformed type: got %d, want 200", rec.Code)
+	}
+}
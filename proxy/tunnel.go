@@ -0,0 +1,410 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// serveConnect handles a CONNECT request by hijacking the client connection
+// and splicing it to a TCP connection to the requested host.
+func (p *proxy) serveConnect(wr http.ResponseWriter, req *http.Request, user string, log *slog.Logger) {
+	addr, err := connectTarget(req, p.connectDefaultPort)
+	if err != nil {
+		log.Warn("bad CONNECT target", "error", err)
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	clientConn, err := hijackTunnel(wr, req)
+	if err != nil {
+		log.Error("taking over CONNECT connection", "error", err)
+		http.Error(wr, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	entry := accessEntryFrom(req)
+	if _, port, _ := net.SplitHostPort(addr); !p.connectPorts.allows(port) {
+		logBlocked(log, req, blockReasonPort, "-connect-ports")
+		entry.setStatus(http.StatusForbidden)
+		refuseTunnel(clientConn, "403 Forbidden", "CONNECT to port "+port+" is not allowed by this proxy.", nil)
+		return
+	}
+
+	// Counted from before the dial so a burst of slow dials can't
+	// overshoot the cap.
+	if !p.acquireTunnel() {
+		log.Warn("too many tunnels, refusing CONNECT", "max", p.maxTunnels)
+		entry.setStatus(http.StatusServiceUnavailable)
+		refuseTunnel(clientConn, "503 Service Unavailable", "Too many open tunnels, try again later.",
+			http.Header{"Retry-After": {p.retryAfter(0)}})
+		return
+	}
+	defer p.releaseTunnel()
+
+	if host, _, _ := net.SplitHostPort(addr); p.mitm.intercepts(host) {
+		entry.setStatus(http.StatusOK)
+		writeRawResponse(clientConn, "200 Connection Established", nil)
+		p.serveIntercepted(clientConn, req, addr, user, log)
+		return
+	}
+
+	sock, err := p.dialTunnel(req.Context(), addr, log)
+
+	if err != nil && fdExhausted(err) {
+		logFDExhausted(log, err)
+		entry.setStatus(http.StatusServiceUnavailable)
+		writeRawResponse(clientConn, "503 Service Unavailable", http.Header{"Retry-After": {p.retryAfter(0)}})
+		clientConn.Close()
+		return
+	}
+	if err != nil {
+		entry.setStatus(http.StatusBadGateway)
+		writeRawResponse(clientConn, "502 Bad Gateway", nil)
+		clientConn.Close()
+		return
+	}
+
+	entry.setStatus(http.StatusOK)
+	writeRawResponse(clientConn, "200 Connection Established", nil)
+	p.relay(clientConn, sock, req, log)
+}
+
+// relay splices an established tunnel's client and target connections
+// until both sides are done. It applies the tunnel socket options, byte
+// accounting and timeouts, and checks the TLS server name the client
+// sends first against the blocklist.
+//
+// When one side finishes sending, the other is half-closed so the end of
+// stream passes through, and has -tunnel-linger to finish in turn. An
+// error in either direction tears the tunnel down at once. Both
+// connections are closed by the time relay returns.
+func (p *proxy) relay(clientConn, sock net.Conn, req *http.Request, log *slog.Logger) {
+	stream, _ := clientConn.(*streamConn)
+	rawClient, target := clientConn, sock
+	for _, conn := range []net.Conn{clientConn, sock} {
+		if err := p.tunnelSockOpts.apply(conn); err != nil {
+			log.Debug("setting tunnel socket options", "error", err)
+		}
+	}
+
+	p.stats.tunnel()
+	defer p.metrics.tunnel()()
+	defer p.tunnels.add(rawClient, req)()
+	start := time.Now()
+	var up, down atomic.Int64
+	clientConn = &directedConn{Conn: clientConn, read: &up, written: &down}
+	clientConn = p.metrics.meter(clientConn)
+	clientConn = shaperFor(req).conn(clientConn)
+
+	if p.stats != nil {
+		clientConn = &meteredConn{Conn: clientConn, count: p.stats.addBytes}
+	}
+
+	if p.quota != nil {
+		client, _ := remoteHost(req.RemoteAddr)
+		clientConn = &meteredConn{Conn: clientConn, count: func(n int64) { p.quota.add(client, n) }}
+	}
+
+	closeBoth := func() {
+		clientConn.Close()
+		sock.Close()
+	}
+	defer func() {
+		closeBoth()
+		if entry := accessEntryFrom(req); entry != nil {
+			entry.up.Add(up.Load())
+			entry.down.Add(down.Load())
+		}
+		log.Info("Tunnel closed", "duration", time.Since(start).Round(time.Millisecond), "bytes_up", up.Load(), "bytes_down", down.Load())
+	}()
+
+	if p.tunnelIdleTimeout > 0 {
+		idle := newIdleTimer(p.tunnelIdleTimeout, func() {
+			log.Info("closing idle tunnel", "timeout", p.tunnelIdleTimeout)
+			closeBoth()
+		})
+		defer idle.Stop()
+		clientConn = idle.wrap(clientConn)
+		sock = idle.wrap(sock)
+	}
+	if p.tunnelMaxDuration > 0 {
+		limit := time.AfterFunc(p.tunnelMaxDuration, func() {
+			log.Info("closing tunnel at -tunnel-max-duration", "limit", p.tunnelMaxDuration)
+			closeBoth()
+		})
+		defer limit.Stop()
+	}
+
+	toClient := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(clientConn, sock)
+		if err == nil {
+			// The target is done; pass its end of stream on and give the
+			// client a while to finish.
+			if stream != nil {
+				stream.Close()
+			} else {
+				closeWrite(rawClient)
+			}
+			p.linger(rawClient)
+		} else {
+			closeBoth()
+		}
+		toClient <- err
+	}()
+
+	if req.Method == http.MethodConnect && (p.logSNI || p.blocklist != nil) {
+		// Peek while the backend side is already relaying, so protocols
+		// where the server speaks first aren't held up.
+		sni, hello := peekClientHello(clientConn)
+		if sni != "" && p.logSNI {
+			log.Info("tunnel TLS server name", "sni", sni)
+		}
+		// The target may be a bare IP, but the ClientHello still names
+		// the real domain.
+		if rule, ok := p.blocklist.match(sni); ok {
+			logBlocked(log, req, blockReasonSNI, rule)
+			// The 200 is already sent, so refuse in TLS terms instead.
+			clientConn.Write(tlsAccessDenied)
+			closeBoth()
+			<-toClient
+			return
+		}
+		if _, err := sock.Write(hello); err != nil {
+			closeBoth()
+			<-toClient
+			return
+		}
+	}
+
+	if _, err := io.Copy(sock, clientConn); err != nil {
+		closeBoth()
+		<-toClient
+		return
+	}
+	// The client is done; the target may still have more to send. A
+	// stream can't be written once the handler returns, so this waits
+	// for the target either way.
+	closeWrite(target)
+	p.linger(target)
+	<-toClient
+}
+
+// closeWrite half-closes conn, or closes it if it can't be half-closed.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// linger gives conn, the remaining sender of a half-closed tunnel,
+// -tunnel-linger to finish.
+func (p *proxy) linger(conn net.Conn) {
+	if p.tunnelLinger > 0 {
+		conn.SetReadDeadline(time.Now().Add(p.tunnelLinger))
+	}
+}
+
+// portSet is a -connect-ports list of ports and LOW-HIGH ranges. A nil
+// portSet allows any port.
+type portSet [][2]uint64
+
+func parsePortSet(list []string) (portSet, error) {
+	if len(list) == 0 {
+		return nil, errors.New("no ports given; * allows any")
+	}
+	var set portSet
+	for _, entry := range list {
+		loText, hiText, isRange := strings.Cut(entry, "-")
+		lo, err := strconv.ParseUint(loText, 10, 16)
+		hi := lo
+		if err == nil && isRange {
+			hi, err = strconv.ParseUint(hiText, 10, 16)
+		}
+		if err != nil || hi < lo {
+			return nil, fmt.Errorf("bad port or range %q", entry)
+		}
+		set = append(set, [2]uint64{lo, hi})
+	}
+	return set, nil
+}
+
+// allows reports whether port is in the set.
+func (s portSet) allows(port string) bool {
+	if s == nil {
+		return true
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return false
+	}
+	for _, r := range s {
+		if r[0] <= n && n <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// acquireTunnel counts a tunnel against -max-tunnels, returning false if
+// there is no room for it. The caller must call releaseTunnel when done.
+func (p *proxy) acquireTunnel() bool {
+	if p.maxTunnels <= 0 {
+		return true
+	}
+	if n := p.activeTunnels.Add(1); n > int64(p.maxTunnels) {
+		p.activeTunnels.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (p *proxy) releaseTunnel() {
+	if p.maxTunnels > 0 {
+		p.activeTunnels.Add(-1)
+	}
+}
+
+// masqueProtocol returns the protocol of a request asking for a UDP or IP
+// tunnel (MASQUE, RFC 9298 and RFC 9484), or of any other extended CONNECT,
+// or "" for everything else. Extended CONNECT carries the protocol in the
+// HTTP/2 and HTTP/3 :protocol pseudo-header; over HTTP/1.1 connect-udp is a
+// GET with an Upgrade token instead.
+func masqueProtocol(req *http.Request) string {
+	if req.Method == http.MethodConnect {
+		if proto := req.Header.Get(":protocol"); proto != "" {
+			return proto
+		}
+	}
+	for _, v := range req.Header.Values("Upgrade") {
+		for _, token := range strings.Split(v, ",") {
+			token = strings.ToLower(strings.TrimSpace(token))
+			if token == "connect-udp" || token == "connect-ip" {
+				return token
+			}
+		}
+	}
+	return ""
+}
+
+// defaultConnectPort is dialled for port-less CONNECT targets unless
+// -connect-default-port says otherwise. CONNECT is almost always used to
+// tunnel TLS, so this is the HTTPS port rather than 80.
+const defaultConnectPort = "443"
+
+// connectTarget returns the host:port a CONNECT request asks for. The
+// authority-form target is taken from req.Host, falling back to req.URL.Host
+// for clients that only populate the latter, and defaultPort is filled in
+// when it has no port.
+func connectTarget(req *http.Request, defaultPort string) (string, error) {
+	authority := req.Host
+	if authority == "" {
+		authority = req.URL.Host
+	}
+	if authority == "" {
+		return "", fmt.Errorf("missing CONNECT target")
+	}
+
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		// No port; strip the brackets from a bare IPv6 literal.
+		host, port = strings.TrimSuffix(strings.TrimPrefix(authority, "["), "]"), defaultPort
+	}
+	if host == "" || port == "" {
+		return "", fmt.Errorf("invalid CONNECT target %q", authority)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// writeRawResponse writes a bodiless response to a hijacked connection.
+// net/http adds a Date header to everything it writes itself; this does the
+// same for responses that bypass it.
+func writeRawResponse(w io.Writer, status string, header http.Header) error {
+	if header == nil {
+		header = make(http.Header)
+	}
+	setDate(header)
+	if stream, ok := w.(*streamConn); ok {
+		return stream.writeResponse(status, header)
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/1.1 %s\r\n", status)
+	header.Write(&buf)
+	buf.WriteString("\r\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// refuseTunnel answers a CONNECT on its hijacked connection with a
+// complete error response explaining why, then closes the connection.
+// Clients see the reason instead of a reset or a failed TLS handshake.
+// header, which may be nil, adds to the response headers.
+func refuseTunnel(conn net.Conn, status, msg string, header http.Header) {
+	msg += "\n"
+	header = header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Content-Length", fmt.Sprint(len(msg)))
+	header.Set("Connection", "close")
+	writeRawResponse(conn, status, header)
+	io.WriteString(conn, msg)
+	conn.Close()
+}
+
+// setDate sets the Date header to now unless it is already present.
+func setDate(header http.Header) {
+	if _, ok := header["Date"]; !ok {
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+}
+
+// idleTimer fires once nothing has been read from or written to any of its
+// wrapped connections for the configured duration.
+type idleTimer struct {
+	*time.Timer
+	d time.Duration
+}
+
+func newIdleTimer(d time.Duration, onIdle func()) *idleTimer {
+	return &idleTimer{Timer: time.AfterFunc(d, onIdle), d: d}
+}
+
+func (t *idleTimer) wrap(c net.Conn) net.Conn {
+	return &idleConn{Conn: c, timer: t}
+}
+
+// idleConn resets its shared idleTimer on every successful read or write,
+// so traffic in either direction keeps the tunnel alive.
+type idleConn struct {
+	net.Conn
+	timer *idleTimer
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.timer.Reset(c.timer.d)
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.timer.Reset(c.timer.d)
+	}
+	return n, err
+}
@@ -0,0 +1,431 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newProxyServer serves the proxy args configure on a local address. Like
+// the listener's own server it leaves OPTIONS * to the proxy.
+func newProxyServer(t *testing.T, args ...string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(newTestProxy(t, args...))
+	srv.Config.DisableGeneralOptionsHandler = true
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newEchoServer returns the address of a TCP server echoing what each
+// connection sends.
+func newEchoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// connect sends a CONNECT for target through the proxy at proxyAddr and
+// returns the connection, a reader positioned after the response header,
+// and the response.
+func connect(t *testing.T, proxyAddr, target string, header ...string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+	for _, h := range header {
+		req += h + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("reading CONNECT response: %v", err)
+	}
+	return conn, br, resp
+}
+
+// echoes reports whether msg sent down the tunnel comes back.
+func echoes(conn net.Conn, br *bufio.Reader, msg string) bool {
+	if _, err := io.WriteString(conn, msg); err != nil {
+		return false
+	}
+	got := make([]byte, len(msg))
+	_, err := io.ReadFull(br, got)
+	return err == nil && string(got) == msg
+}
+
+// closedWithin reports whether the peer closes conn within d.
+func closedWithin(br *bufio.Reader, conn net.Conn, d time.Duration) bool {
+	conn.SetReadDeadline(time.Now().Add(d))
+	_, err := br.ReadByte()
+	return err == io.EOF
+}
+
+func TestTunnel(t *testing.T) {
+	echo := newEchoServer(t)
+	srv := newProxyServer(t)
+	conn, br, resp := connect(t, srv.Listener.Addr().String(), echo)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Date") == "" {
+		t.Fatalf("CONNECT got %s %v", resp.Status, resp.Header)
+	}
+	if !echoes(conn, br, "ping") {
+		t.Error("tunnel didn't carry data")
+	}
+}
+
+func TestNoConnect(t *testing.T) {
+	srv := newProxyServer(t, "-no-connect")
+	_, _, resp := connect(t, srv.Listener.Addr().String(), newEchoServer(t))
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("CONNECT with -no-connect got %s, want 405", resp.Status)
+	}
+	if allow := resp.Header.Get("Allow"); allow == "" || strings.Contains(allow, "CONNECT") {
+		t.Errorf("Allow = %q, want the methods bar CONNECT", allow)
+	}
+}
+
+func TestTunnelIdleTimeout(t *testing.T) {
+	echo := newEchoServer(t)
+	srv := newProxyServer(t, "-tunnel-idle-timeout", "200ms")
+	conn, br, _ := connect(t, srv.Listener.Addr().String(), echo)
+
+	// Traffic every 100ms keeps the tunnel open past the timeout.
+	for range 4 {
+		time.Sleep(100 * time.Millisecond)
+		if !echoes(conn, br, "x") {
+			t.Fatal("busy tunnel closed")
+		}
+	}
+	if !closedWithin(br, conn, time.Second) {
+		t.Error("idle tunnel left open")
+	}
+}
+
+func TestIdleTimerResetByWrites(t *testing.T) {
+	fired := make(chan struct{})
+	timer := newIdleTimer(100*time.Millisecond, func() { close(fired) })
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := timer.wrap(client)
+	go io.Copy(io.Discard, server)
+
+	// Only writes, no reads.
+	for range 4 {
+		time.Sleep(50 * time.Millisecond)
+		conn.Write([]byte("x"))
+	}
+	select {
+	case <-fired:
+		t.Fatal("timer fired while the connection was writing")
+	default:
+	}
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Error("timer didn't fire once idle")
+	}
+}
+
+func TestConnectTarget(t *testing.T) {
+	for _, tt := range []struct {
+		host, urlHost, want string
+	}{
+		{"example.com:8443", "", "example.com:8443"},
+		{"", "example.com:8443", "example.com:8443"},
+		{"example.com:8443", "other.test:1", "example.com:8443"},
+		{"example.com", "", "example.com:443"},
+		{"[2001:db8::1]:8443", "", "[2001:db8::1]:8443"},
+		{"[2001:db8::1]", "", "[2001:db8::1]:443"},
+		{"", "", ""},
+		{":8443", "", ""},
+	} {
+		req := &http.Request{Method: http.MethodConnect, Host: tt.host, URL: &url.URL{Host: tt.urlHost}}
+		got, err := connectTarget(req, "443")
+		if got != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("connectTarget(Host %q, URL.Host %q) = %q, %v; want %q", tt.host, tt.urlHost, got, err, tt.want)
+		}
+	}
+}
+
+func TestConnectDefaultPort(t *testing.T) {
+	if defaultConnectPort != "443" {
+		t.Errorf("default CONNECT port is %s, want 443", defaultConnectPort)
+	}
+	echo := newEchoServer(t)
+	host, port, _ := net.SplitHostPort(echo)
+	srv := newProxyServer(t, "-connect-default-port", port)
+	conn, br, resp := connect(t, srv.Listener.Addr().String(), host)
+	if resp.StatusCode != http.StatusOK || !echoes(conn, br, "ping") {
+		t.Errorf("port-less CONNECT %s got %s, want a tunnel to port %s", host, resp.Status, port)
+	}
+}
+
+func TestMASQUENotImplemented(t *testing.T) {
+	srv := newProxyServer(t)
+	resp := rawRequest(t, srv.Listener.Addr().String(), "GET /.well-known/masque/udp/192.0.2.1/443/ HTTP/1.1\r\nHost: proxy.test\r\n"+
+		"Connection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n")
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("HTTP/1.1 connect-udp upgrade got %s, want 501", resp.Status)
+	}
+
+	for _, tt := range []struct {
+		method string
+		header http.Header
+		want   string
+	}{
+		{"CONNECT", http.Header{":protocol": {"connect-udp"}}, "connect-udp"},
+		{"CONNECT", http.Header{":protocol": {"websocket"}}, "websocket"},
+		{"GET", http.Header{"Upgrade": {"h2c, Connect-IP"}}, "connect-ip"},
+		{"GET", http.Header{"Upgrade": {"websocket"}}, ""},
+		{"CONNECT", http.Header{}, ""},
+	} {
+		req := &http.Request{Method: tt.method, Header: tt.header}
+		if got := masqueProtocol(req); got != tt.want {
+			t.Errorf("masqueProtocol(%s %v) = %q, want %q", tt.method, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestRawResponsesDated(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+
+	srv := newProxyServer(t, "-connect-retries", "0")
+	for _, target := range []string{newEchoServer(t), closed} {
+		_, _, resp := connect(t, srv.Listener.Addr().String(), target)
+		if d, err := http.ParseTime(resp.Header.Get("Date")); err != nil || time.Since(d) > time.Minute {
+			t.Errorf("CONNECT %s answered %s with Date %q", target, resp.Status, resp.Header.Get("Date"))
+		}
+	}
+
+	var buf bytes.Buffer
+	writeRawResponse(&buf, "200 OK", http.Header{"Date": {"Sun, 06 Nov 1994 08:49:37 GMT"}})
+	if got := strings.Count(buf.String(), "Date: "); got != 1 || !strings.Contains(buf.String(), "Date: Sun, 06 Nov 1994 08:49:37 GMT") {
+		t.Errorf("a given Date wasn't kept:\n%s", buf.String())
+	}
+}
+
+func TestConnectPortRefused(t *testing.T) {
+	echo := newEchoServer(t)
+	srv := newProxyServer(t, "-connect-ports", "443, 8443")
+	conn, br, resp := connect(t, srv.Listener.Addr().String(), echo)
+	body, err := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusForbidden || err != nil || !strings.Contains(string(body), "not allowed") {
+		t.Errorf("CONNECT to an unlisted port got %s %q (err %v), want 403 saying why", resp.Status, body, err)
+	}
+	if !resp.Close || resp.ContentLength != int64(len(body)) {
+		t.Errorf("refusal Close %v, Content-Length %d for %d bytes", resp.Close, resp.ContentLength, len(body))
+	}
+	if !closedWithin(br, conn, time.Second) {
+		t.Error("connection left open after the refusal")
+	}
+
+	_, port, _ := net.SplitHostPort(echo)
+	srv = newProxyServer(t, "-connect-ports", "443,"+port)
+	if conn, br, resp := connect(t, srv.Listener.Addr().String(), echo); resp.StatusCode != http.StatusOK || !echoes(conn, br, "ping") {
+		t.Errorf("CONNECT to a listed port got %s", resp.Status)
+	}
+
+	// Without -connect-ports, only 80 and 443 may be reached.
+	p, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv = httptest.NewServer(p)
+	defer srv.Close()
+	if _, _, resp := connect(t, srv.Listener.Addr().String(), echo); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("CONNECT to port %s by default got %s, want 403", port, resp.Status)
+	}
+	if set := p.l.handler.connectPorts; !set.allows("443") || !set.allows("80") || set.allows("8443") {
+		t.Errorf("default -connect-ports = %v, want 80 and 443", set)
+	}
+}
+
+func TestMaxTunnels(t *testing.T) {
+	echo := newEchoServer(t)
+	p := newTestProxy(t, "-max-tunnels", "1")
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	conn, br, resp := connect(t, addr, echo)
+	if resp.StatusCode != http.StatusOK || !echoes(conn, br, "first") {
+		t.Fatalf("first CONNECT got %s", resp.Status)
+	}
+	if _, _, resp := connect(t, addr, echo); resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("CONNECT over -max-tunnels got %s with Retry-After %q, want 503 with one", resp.Status, resp.Header.Get("Retry-After"))
+	}
+
+	// Closing the tunnel frees its place.
+	conn.Close()
+	waitFor(t, func() bool { return p.l.handler.activeTunnels.Load() == 0 })
+	if conn, br, resp := connect(t, addr, echo); resp.StatusCode != http.StatusOK || !echoes(conn, br, "again") {
+		t.Errorf("CONNECT after the first closed got %s", resp.Status)
+	}
+}
+
+// halfCloseServer returns the address of a TCP server that, if
+// speakFirst, sends "bye" and half-closes before reading; then it reads
+// to EOF and reports what it read on the channel and, hearing first,
+// answers with how many bytes that was.
+func halfCloseServer(t *testing.T, speakFirst bool) (string, chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	read := make(chan string, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if speakFirst {
+			io.WriteString(c, "bye")
+			c.(*net.TCPConn).CloseWrite()
+		}
+		b, _ := io.ReadAll(c)
+		read <- string(b)
+		if !speakFirst {
+			fmt.Fprintf(c, "read %d", len(b))
+		}
+	}()
+	return ln.Addr().String(), read
+}
+
+func TestTunnelHalfClose(t *testing.T) {
+	srv := newProxyServer(t)
+	addr := srv.Listener.Addr().String()
+
+	// The client finishes first and still gets the answer.
+	target, read := halfCloseServer(t, false)
+	conn, br, _ := connect(t, addr, target)
+	io.WriteString(conn, "hello")
+	conn.(*net.TCPConn).CloseWrite()
+	if got := readBody(t, br); got != "read 5" {
+		t.Errorf("after the client's half-close got %q, want read 5", got)
+	}
+	if got := <-read; got != "hello" {
+		t.Errorf("target read %q", got)
+	}
+
+	// The target finishes first and still hears the client out.
+	target, read = halfCloseServer(t, true)
+	conn, br, _ = connect(t, addr, target)
+	if got := readBody(t, br); got != "bye" {
+		t.Errorf("after the target's half-close got %q, want bye", got)
+	}
+	io.WriteString(conn, "late")
+	conn.(*net.TCPConn).CloseWrite()
+	select {
+	case got := <-read:
+		if got != "late" {
+			t.Errorf("target read %q after its half-close, want late", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the client's end of stream never reached the target")
+	}
+}
+
+func TestTunnelLinger(t *testing.T) {
+	for _, tt := range []struct {
+		linger string
+		closed bool
+	}{
+		{"200ms", true},
+		{"0", false},
+	} {
+		p := newTestProxy(t, "-tunnel-linger", tt.linger)
+		srv := httptest.NewServer(p)
+		target, _ := halfCloseServer(t, true)
+		_, br, _ := connect(t, srv.Listener.Addr().String(), target)
+		if got := readBody(t, br); got != "bye" {
+			t.Errorf("-tunnel-linger %s: got %q", tt.linger, got)
+		}
+		// The client never finishes its side.
+		time.Sleep(time.Second)
+		if closed := p.l.handler.tunnels.count() == 0; closed != tt.closed {
+			t.Errorf("-tunnel-linger %s: tunnel closed %v a second after the target finished, want %v", tt.linger, closed, tt.closed)
+		}
+		srv.CloseClientConnections()
+		srv.Close()
+	}
+}
+
+func TestTunnelMaxDuration(t *testing.T) {
+	srv := newProxyServer(t, "-tunnel-max-duration", "300ms", "-tunnel-idle-timeout", "1m")
+	conn, br, _ := connect(t, srv.Listener.Addr().String(), newEchoServer(t))
+	start := time.Now()
+	for time.Since(start) < 5*time.Second {
+		if !echoes(conn, br, "x") {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("busy tunnel closed after %v, want -tunnel-max-duration's 300ms", elapsed)
+	}
+}
+
+func TestParsePortSet(t *testing.T) {
+	set, err := parsePortSet([]string{"443", "8000-8999"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for port, want := range map[string]bool{"443": true, "8000": true, "8999": true, "8443": true, "80": false, "9000": false, "x": false, "": false} {
+		if got := set.allows(port); got != want {
+			t.Errorf("allows(%q) = %v, want %v", port, got, want)
+		}
+	}
+	if !portSet(nil).allows("1") {
+		t.Error("no -connect-ports refuses a port")
+	}
+	for _, bad := range []string{"https", "9-1", "70000", "1-", "-5"} {
+		if _, err := parsePortSet([]string{bad}); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+	if _, err := parsePortSet(nil); err == nil {
+		t.Error("empty list accepted")
+	}
+	if p := newTestProxy(t, "-connect-ports", "*"); p.l.handler.connectPorts != nil {
+		t.Errorf("-connect-ports * = %v, want any port", p.l.handler.connectPorts)
+	}
+}
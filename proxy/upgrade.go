@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// upgradeProtocol returns the protocol an HTTP/1 client asks to switch
+// to, such as "websocket", or "" if req is not an Upgrade request. h2c is
+// left out: it is a hop-by-hop switch between the client and the proxy.
+func upgradeProtocol(req *http.Request) string {
+	if req.ProtoMajor != 1 || !hasToken(req.Header.Values("Connection"), "upgrade") {
+		return ""
+	}
+	proto := req.Header.Get("Upgrade")
+	if strings.EqualFold(proto, "h2c") {
+		return ""
+	}
+	return proto
+}
+
+// hasToken reports whether the comma-separated values list token, in any
+// case.
+func hasToken(values []string, token string) bool {
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveUpgrade completes a protocol switch the backend agreed to: it
+// passes the 101 on to the client and then relays the two connections as
+// a tunnel, so WebSockets and the like work through the proxy, and wss://
+// as well inside intercepted tunnels.
+func (p *proxy) serveUpgrade(wr http.ResponseWriter, req *http.Request, resp *http.Response, log *slog.Logger) {
+	backend, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		http.Error(wr, "Bad Gateway", http.StatusBadGateway)
+		log.Error("backend switched protocols without a connection to relay")
+		return
+	}
+	proto := resp.Header.Get("Upgrade")
+	if !strings.EqualFold(proto, req.Header.Get("Upgrade")) {
+		backend.Close()
+		http.Error(wr, "Bad Gateway", http.StatusBadGateway)
+		log.Error("backend switched to a protocol the client did not ask for", "upgrade", proto)
+		return
+	}
+
+	clientConn, brw, err := http.NewResponseController(wr).Hijack()
+	if err != nil {
+		backend.Close()
+		http.Error(wr, "Upgrade not supported", http.StatusInternalServerError)
+		log.Error("hijacking connection for upgrade", "error", err)
+		return
+	}
+	if brw.Reader.Buffered() > 0 {
+		// The client may have spoken first in the new protocol.
+		clientConn = &bufferedConn{Conn: clientConn, r: brw.Reader}
+	}
+
+	delHopHeaders(resp.Header)
+	p.filterResponseHeader(resp.Header)
+	addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor, p.via)
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", proto)
+	if err := writeRawResponse(clientConn, "101 Switching Protocols", resp.Header); err != nil {
+		clientConn.Close()
+		backend.Close()
+		return
+	}
+	accessEntryFrom(req).setStatus(http.StatusSwitchingProtocols)
+	log.Info("Response", "status", resp.Status, "upgrade", proto)
+
+	p.relay(clientConn, upgradeConn{ReadWriteCloser: backend, conn: clientConn}, req, log)
+}
+
+// upgradeConn is the backend side of a switched connection, which the
+// client hands over as a bare io.ReadWriteCloser. It has no deadlines,
+// so the idle and maximum tunnel timeouts, which close it, are what
+// bound it; the addresses are the client connection's.
+type upgradeConn struct {
+	io.ReadWriteCloser
+	conn net.Conn
+}
+
+func (c upgradeConn) LocalAddr() net.Addr              { return c.conn.LocalAddr() }
+func (c upgradeConn) RemoteAddr() net.Addr             { return c.conn.RemoteAddr() }
+func (c upgradeConn) SetDeadline(time.Time) error      { return nil }
+func (c upgradeConn) SetReadDeadline(time.Time) error  { return nil }
+func (c upgradeConn) SetWriteDeadline(time.Time) error { return nil }
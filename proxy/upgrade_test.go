@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// upgradeBackend switches to protocol "echo" for clients that ask for it
+// and then echoes what they send; with ?answer=NAME it switches to NAME
+// instead, and with ?refuse it answers normally.
+func upgradeBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Has("refuse") || !hasToken(req.Header.Values("Connection"), "upgrade") {
+			io.WriteString(wr, "not switching")
+			return
+		}
+		proto := req.Header.Get("Upgrade")
+		if answer := req.URL.Query().Get("answer"); answer != "" {
+			proto = answer
+		}
+		conn, brw, err := http.NewResponseController(wr).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: "+proto+"\r\n\r\n")
+		io.Copy(conn, brw)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// upgrade sends a request for url asking to switch to proto over a new
+// connection to the proxy at addr, followed by early bytes in the new
+// protocol, and returns the connection and response.
+func upgrade(t *testing.T, addr, url, proto, early string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	host := strings.TrimPrefix(url, "http://")
+	host, _, _ = strings.Cut(host, "/")
+	io.WriteString(conn, "GET "+url+" HTTP/1.1\r\nHost: "+host+"\r\nConnection: keep-alive, Upgrade\r\nUpgrade: "+proto+"\r\n\r\n"+early)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("reading the upgrade response: %v", err)
+	}
+	return conn, br, resp
+}
+
+func TestUpgrade(t *testing.T) {
+	b := upgradeBackend(t)
+	srv := newProxyServer(t)
+	addr := srv.Listener.Addr().String()
+
+	conn, br, resp := upgrade(t, addr, b.URL+"/ws", "echo", "early ")
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "echo" || !hasToken(resp.Header.Values("Connection"), "upgrade") {
+		t.Fatalf("upgrade got %s %v, want 101 to echo", resp.Status, resp.Header)
+	}
+	// Bytes the client sent right after its request come back first.
+	got := make([]byte, len("early "))
+	if _, err := io.ReadFull(br, got); err != nil || string(got) != "early " {
+		t.Errorf("early bytes came back as %q, %v", got, err)
+	}
+	if !echoes(conn, br, "ping") {
+		t.Error("upgraded connection didn't carry data")
+	}
+
+	_, _, resp = upgrade(t, addr, b.URL+"/ws?refuse", "echo", "")
+	if body := readBody(t, resp.Body); resp.StatusCode != http.StatusOK || body != "not switching" {
+		t.Errorf("refused upgrade got %s %q, want the backend's 200", resp.Status, body)
+	}
+
+	_, _, resp = upgrade(t, addr, b.URL+"/ws?answer=other", "echo", "")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("switch to an unasked-for protocol got %s, want 502", resp.Status)
+	}
+}
+
+func TestUpgradeProtocol(t *testing.T) {
+	for _, tt := range []struct {
+		proto      int
+		connection string
+		upgrade    string
+		want       string
+	}{
+		{1, "Upgrade", "websocket", "websocket"},
+		{1, "keep-alive, upgrade", "WebSocket", "WebSocket"},
+		{1, "keep-alive", "websocket", ""},
+		{1, "Upgrade", "h2c", ""},
+		{2, "Upgrade", "websocket", ""},
+	} {
+		req := &http.Request{ProtoMajor: tt.proto, Header: http.Header{"Connection": {tt.connection}, "Upgrade": {tt.upgrade}}}
+		if got := upgradeProtocol(req); got != tt.want {
+			t.Errorf("HTTP/%d Connection %q Upgrade %q: got %q, want %q", tt.proto, tt.connection, tt.upgrade, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyAuthorization returns the Basic Proxy-Authorization value for the
+// credentials in u, or "" if it has none.
+func proxyAuthorization(u *url.URL) string {
+	if u.User == nil {
+		return ""
+	}
+	pass, _ := u.User.Password()
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+pass))
+}
+
+// upstreamRoute sends destinations matching rule through upstream,
+// directly if upstream is nil, or nowhere if block is set: they are
+// refused, for plain requests, CONNECT and SOCKS5 alike. Routes are set
+// with -upstream-route and -route-file and take precedence over -upstream.
+type upstreamRoute struct {
+	rule     aclRule
+	upstream *url.URL
+	block    bool
+}
+
+// parseUpstreamRoute parses PATTERN=URL, where PATTERN is written as in an
+// ACL rule and URL may be "direct" or "block". CIDR patterns only match
+// address literals; host names are not resolved to pick a route.
+func parseUpstreamRoute(s string) (upstreamRoute, error) {
+	pattern, target, ok := strings.Cut(s, "=")
+	if !ok {
+		return upstreamRoute{}, fmt.Errorf("invalid -upstream-route %q: want PATTERN=URL, PATTERN=direct or PATTERN=block", s)
+	}
+	rule, err := parseACLRule(pattern)
+	if err != nil {
+		return upstreamRoute{}, fmt.Errorf("invalid -upstream-route %q: %w", s, err)
+	}
+	route := upstreamRoute{rule: rule}
+	switch target {
+	case "direct":
+	case "block":
+		route.block = true
+	default:
+		if route.upstream, err = parseUpstreamURL("upstream-route", target); err != nil {
+			return upstreamRoute{}, err
+		}
+	}
+	return route, nil
+}
+
+// loadRouteFile reads -route-file: one "PATTERN TARGET" route per line,
+// TARGET being a parent proxy URL, direct or block, as for -upstream-route.
+// # starts a comment.
+func loadRouteFile(path string) ([]upstreamRoute, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var routes []upstreamRoute
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want PATTERN URL, PATTERN direct or PATTERN block", path, n)
+		}
+		route, err := parseUpstreamRoute(fields[0] + "=" + fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		routes = append(routes, route)
+	}
+	return routes, sc.Err()
+}
+
+// parseUpstreamURL parses a parent proxy URL, which may be an HTTP or a
+// SOCKS5 proxy.
+func parseUpstreamURL(name, value string) (*url.URL, error) {
+	u, err := parseFlagURL(name, value)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && !isSOCKS(u) {
+		return nil, fmt.Errorf("invalid -%s URL %q: must be http:// or socks5://host:port", name, value)
+	}
+	return u, nil
+}
+
+// routeFor returns the first route matching addr (host:port), if any.
+func (p *proxy) routeFor(addr string) *upstreamRoute {
+	host, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+	host = normalizeHost(host)
+	ip, _ := netip.ParseAddr(host)
+	for i, r := range p.upstreamRoutes {
+		if r.rule.permitPort(port) && r.rule.matchHost(host, ip.Unmap()) {
+			return &p.upstreamRoutes[i]
+		}
+	}
+	return nil
+}
+
+// upstreamFor returns the parent proxy to reach addr (host:port) through,
+// or nil to dial it directly.
+func (p *proxy) upstreamFor(addr string) *url.URL {
+	if r := p.routeFor(addr); r != nil {
+		return r.upstream
+	}
+	return p.upstreamURL()
+}
+
+// routeBlocks reports whether addr is routed to block, and by which route.
+func (p *proxy) routeBlocks(addr string) (rule string, blocked bool) {
+	if r := p.routeFor(addr); r != nil && r.block {
+		return "route " + r.rule.text + "=block", true
+	}
+	return "", false
+}
+
+// routesUpstream reports whether anything may go through a parent proxy.
+func (p *proxy) routesUpstream() bool {
+	if p.upstream != nil {
+		return true
+	}
+	for _, r := range p.upstreamRoutes {
+		if r.upstream != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// dialTunnel connects to addr for a CONNECT tunnel, either directly or
+// through its upstream proxy: with a CONNECT of our own to an HTTP proxy,
+// or a SOCKS5 connect request. The client's Proxy-Authorization is never
+// passed on; only the upstream credentials are sent.
+func (p *proxy) dialTunnel(ctx context.Context, addr string, log *slog.Logger) (net.Conn, error) {
+	upstream := p.upstreamFor(addr)
+	if upstream == nil {
+		return p.dialRetry(ctx, "tcp", addr, p.connectRetries, p.connectRetryBackoff, log)
+	}
+	tried := make(map[string]bool)
+	for {
+		tried[hostPort(upstream)] = true
+		conn, err := p.dialVia(ctx, upstream, addr, log)
+		if err == nil || ctx.Err() != nil {
+			return conn, err
+		}
+		// A parent proxy that couldn't be reached is now marked down, so
+		// -upstream may have another to offer.
+		next := p.upstreamFor(addr)
+		if next == nil || tried[hostPort(next)] {
+			return nil, err
+		}
+		log.Warn("parent proxy failed, failing over", "upstream", upstream.Host, "next", next.Host, "error", err)
+		upstream = next
+	}
+}
+
+// dialVia connects to addr through the parent proxy upstream.
+func (p *proxy) dialVia(ctx context.Context, upstream *url.URL, addr string, log *slog.Logger) (net.Conn, error) {
+	conn, err := p.dialRetry(ctx, "tcp", hostPort(upstream), p.connectRetries, p.connectRetryBackoff, log)
+	if err != nil {
+		return nil, err
+	}
+
+	// The handshake is part of connecting to addr: a parent that accepts
+	// the connection and then says nothing is given up on after
+	// -dial-timeout too.
+	if deadline, ok := p.handshakeDeadline(ctx); ok {
+		conn.SetDeadline(deadline)
+	}
+	if isSOCKS(upstream) {
+		if err := socksConnect(conn, addr, upstream.User); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+
+	connectReq := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	addVia(connectReq.Header, 1, 1, p.via)
+	if auth := proxyAuthorization(upstream); auth != "" {
+		connectReq.Header.Set("Proxy-Authorization", auth)
+	}
+	if err := connectReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, connectReq)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy refused CONNECT: %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// handshakeDeadline returns when a handshake with a parent proxy begun
+// now must be done by: ctx's deadline or the dialer's timeout from now,
+// whichever comes first.
+func (p *proxy) handshakeDeadline(ctx context.Context) (time.Time, bool) {
+	deadline, ok := ctx.Deadline()
+	if p.dialer != nil && p.dialer.Timeout > 0 {
+		if d := time.Now().Add(p.dialer.Timeout); !ok || d.Before(deadline) {
+			deadline, ok = d, true
+		}
+	}
+	return deadline, ok
+}
+
+// upstreamDownTime is how long a parent proxy that couldn't be reached is
+// passed over in favour of the next -upstream.
+const upstreamDownTime = 30 * time.Second
+
+// upstreamFailover is a list of -upstream parent proxies, used in order of
+// preference: one whose address refuses a dial is down for
+// upstreamDownTime and the next takes its traffic. If all are down, the
+// first is tried anyway. A nil *upstreamFailover has one parent, which is
+// never passed over.
+type upstreamFailover struct {
+	urls []*url.URL
+
+	mu   sync.Mutex
+	down map[string]time.Time // by host:port, until when
+}
+
+func newUpstreamFailover(urls []*url.URL) *upstreamFailover {
+	return &upstreamFailover{urls: urls, down: make(map[string]time.Time)}
+}
+
+// pick returns the first parent proxy that isn't down.
+func (f *upstreamFailover) pick() *url.URL {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	for _, u := range f.urls {
+		if until, ok := f.down[hostPort(u)]; !ok || now.After(until) {
+			return u
+		}
+	}
+	return f.urls[0]
+}
+
+// observe records the outcome of a dial to addr, if it is one of the
+// parent proxies.
+func (f *upstreamFailover) observe(addr string, err error) {
+	if f == nil || !slices.ContainsFunc(f.urls, func(u *url.URL) bool { return hostPort(u) == addr }) {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		delete(f.down, addr)
+		return
+	}
+	if _, ok := f.down[addr]; !ok {
+		slog.Warn("parent proxy unreachable, passing it over", "upstream", addr, "for", upstreamDownTime, "error", err)
+	}
+	f.down[addr] = time.Now().Add(upstreamDownTime)
+}
+
+// available reports whether some parent proxy isn't down.
+func (f *upstreamFailover) available() bool {
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	for _, u := range f.urls {
+		if until, ok := f.down[hostPort(u)]; !ok || now.After(until) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostPort returns u's host:port, filling in the scheme's default port.
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	switch {
+	case u.Scheme == "https":
+		return net.JoinHostPort(u.Hostname(), "443")
+	case isSOCKS(u):
+		return net.JoinHostPort(u.Hostname(), "1080")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// bufferedConn is a net.Conn whose first reads come from a bufio.Reader
+// that may already hold bytes read off the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// defaultVia returns the default Via pseudonym. It includes the hostname
+// so chained minprox instances don't mistake each other for a loop.
+func defaultVia() string {
+	if h, err := os.Hostname(); err == nil && h != "" {
+		return "minprox-" + h
+	}
+	return "minprox"
+}
+
+// addVia appends this proxy to the Via header (RFC 7230 section 5.7.1)
+// for a message received over HTTP major.minor.
+func addVia(header http.Header, major, minor int, pseudonym string) {
+	if pseudonym == "" {
+		return
+	}
+	proto := fmt.Sprintf("%d.%d", major, minor)
+	if major >= 2 {
+		proto = fmt.Sprint(major)
+	}
+	header.Add("Via", proto+" "+pseudonym)
+}
+
+// viaContains reports whether pseudonym already appears as a received-by
+// entry in the Via chain, meaning the message has looped back to us.
+func viaContains(header http.Header, pseudonym string) bool {
+	if pseudonym == "" {
+		return false
+	}
+	for _, v := range header.Values("Via") {
+		for _, hop := range strings.Split(v, ",") {
+			fields := strings.Fields(hop)
+			if len(fields) >= 2 && strings.EqualFold(fields[1], pseudonym) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestViaLoopDetected(t *testing.T) {
+	b := newCountingBackend(t, func(wr http.ResponseWriter, req *http.Request) {})
+	p := newTestProxy(t, "-backend", b.URL, "-via", "edge-1")
+	if rec := serve(p, "GET", "http://front.test/", "Via: 1.1 cdn, 1.1 EDGE-1 (minprox)"); rec.Code != http.StatusLoopDetected || b.hits != 0 {
+		t.Errorf("looped request got %d and %d backend hits, want 508 and none", rec.Code, b.hits)
+	}
+
+	rec := serve(p, "GET", "http://front.test/", "Via: 1.1 edge-2")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("request via another proxy got %d", rec.Code)
+	}
+	if got := b.last.Header.Values("Via"); len(got) != 2 || got[1] != "1.1 edge-1" {
+		t.Errorf("backend Via = %q, want edge-1 appended", got)
+	}
+	if got := rec.Header().Get("Via"); got != "1.1 edge-1" {
+		t.Errorf("response Via = %q", got)
+	}
+
+	p = newTestProxy(t, "-backend", b.URL, "-via", "")
+	if rec := serve(p, "GET", "http://front.test/", "Via: 1.1 edge-1"); rec.Code != http.StatusOK || len(b.last.Header.Values("Via")) != 1 {
+		t.Errorf("-via \"\": got %d, backend Via %q; want no detection and nothing added", rec.Code, b.last.Header.Values("Via"))
+	}
+}
+
+func TestViaContains(t *testing.T) {
+	h := http.Header{"Via": {"1.0 fred, 1.1 p.example.net", "2 minprox-a"}}
+	for pseudonym, want := range map[string]bool{
+		"fred":          true,
+		"p.example.net": true,
+		"minprox-a":     true,
+		"minprox":       false,
+		"1.1":           false,
+		"":              false,
+	} {
+		if got := viaContains(h, pseudonym); got != want {
+			t.Errorf("viaContains(%q) = %v, want %v", pseudonym, got, want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// warmer keeps connections to the configured backends open in the shared
+// transport's idle pool, so the first real requests skip the dial and TLS
+// handshake. It does so by sending batches of concurrent HEAD requests,
+// each of which leaves its connection idle in the pool afterwards.
+type warmer struct {
+	transport http.RoundTripper
+	targets   []*url.URL
+	conns     int
+	interval  time.Duration
+
+	// done is closed to stop run when a -config reload retires the
+	// proxy the warmer belongs to.
+	done chan struct{}
+}
+
+// newWarmer returns a warmer for the proxy's backends, or nil if there are
+// none. In upstream mode the backends are reached through the parent proxy,
+// so it is those connections that are kept warm.
+func (p *proxy) newWarmer(conns int, interval time.Duration) *warmer {
+	var targets []*url.URL
+	seen := make(map[string]bool)
+	add := func(u *url.URL) {
+		if u == nil {
+			return
+		}
+		key := u.Scheme + "://" + hostPort(u)
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		targets = append(targets, u)
+	}
+	add(p.backend)
+	if p.pool != nil {
+		for _, b := range p.pool.backends {
+			add(b)
+		}
+	}
+	for _, r := range p.routes {
+		add(r.backend)
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	return &warmer{transport: p.transport, targets: targets, conns: conns, interval: interval, done: make(chan struct{})}
+}
+
+// run warms the pool now and then every interval until ctx is done or
+// stop is called.
+func (w *warmer) run(ctx context.Context) {
+	for {
+		w.warm(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.done:
+			return
+		case <-time.After(w.interval):
+		}
+	}
+}
+
+// stop ends run early. It must be called at most once.
+func (w *warmer) stop() {
+	if w != nil {
+		close(w.done)
+	}
+}
+
+// warm opens up to w.conns connections to each target at once. Idle
+// connections already in the pool are reused rather than duplicated.
+func (w *warmer) warm(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, target := range w.targets {
+		for range w.conns {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req, err := http.NewRequestWithContext(ctx, http.MethodHead, target.String(), nil)
+				if err != nil {
+					return
+				}
+				resp, err := w.transport.RoundTrip(req)
+				if err != nil {
+					slog.Debug("warmup request failed", "backend", target.Host, "error", err)
+					return
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}()
+		}
+	}
+	wg.Wait()
+}
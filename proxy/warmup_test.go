@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWarmup(t *testing.T) {
+	b, conns := connCountingBackend(t)
+	p := newTestProxy(t, "-backend", b.URL, "-warmup-conns", "3")
+	w := p.l.handler.warmer
+	if w == nil {
+		t.Fatal("no warmer for -backend")
+	}
+	w.warm(context.Background())
+	if n := conns.Load(); n != 3 {
+		t.Fatalf("%d connections open before any request, want 3", n)
+	}
+
+	serve(p, "GET", "http://front.test/")
+	w.warm(context.Background())
+	if n := conns.Load(); n != 3 {
+		t.Errorf("%d connections after a request and another warmup, want the 3 warm ones reused", n)
+	}
+}
+
+func TestWarmupTargets(t *testing.T) {
+	p := newTestProxy(t, "-backend", "http://a.test", "-route", "/x=http://a.test:80/x", "-route", "/y=http://b.test", "-warmup-conns", "1")
+	if w := p.l.handler.warmer; w == nil || len(w.targets) != 2 {
+		t.Errorf("warmer %+v, want a.test and b.test as targets once each", w)
+	}
+	if fwd := newTestProxy(t, "-warmup-conns", "1"); fwd.l.handler.warmer != nil {
+		t.Error("forward proxy has a warmer")
+	}
+}